@@ -0,0 +1,180 @@
+// The dlq command inspects the dead-letter topic of the transactions consumer and replays its messages.
+//
+//	go run ./cmd/dlq list [-limit 100]
+//	go run ./cmd/dlq replay -partition 0 -offset 12 [-count 1]
+//
+// Replayed messages are put back on their original topic, with a dlq-replayed-from header.
+// The dead-letter topic is never modified, so replaying the same message twice publishes it twice.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"payment-gateway/internal/kafka/dlq"
+	kafkaProducer "payment-gateway/internal/kafka/producer"
+
+	kafkaGo "github.com/segmentio/kafka-go"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	kafkaURL := os.Getenv("KAFKA_BROKER_URL")
+	if kafkaURL == "" {
+		kafkaURL = "kafka:9092"
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	var err error
+	switch os.Args[1] {
+	case "list":
+		flags := flag.NewFlagSet("list", flag.ExitOnError)
+		limit := flags.Int("limit", 100, "maximum number of messages to list per partition")
+		flags.Parse(os.Args[2:])
+
+		err = list(ctx, kafkaURL, *limit)
+	case "replay":
+		flags := flag.NewFlagSet("replay", flag.ExitOnError)
+		partition := flags.Int("partition", -1, "partition of the dead-letter topic to replay from")
+		offset := flags.Int64("offset", -1, "offset of the first message to replay")
+		count := flags.Int("count", 1, "number of consecutive messages to replay")
+		flags.Parse(os.Args[2:])
+
+		if *partition < 0 || *offset < 0 || *count < 1 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		err = replay(ctx, kafkaURL, *partition, *offset, *count)
+	default:
+		usage()
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage:\n  %[1]s list [-limit n]\n  %[1]s replay -partition p -offset o [-count n]\n", os.Args[0])
+	os.Exit(2)
+}
+
+// list prints the messages of every partition of the dead-letter topic, oldest first
+func list(ctx context.Context, kafkaURL string, limit int) error {
+	conn, err := kafkaGo.DialContext(ctx, "tcp", kafkaURL)
+	if err != nil {
+		return fmt.Errorf("failed to connect to kafka: %v", err)
+	}
+	partitions, err := conn.ReadPartitions(dlq.Topic)
+	conn.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read partitions of %s: %v", dlq.Topic, err)
+	}
+
+	for _, partition := range partitions {
+		first, last, err := readOffsets(ctx, kafkaURL, partition.ID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("partition %d: %d messages\n", partition.ID, last-first)
+		if last-first > int64(limit) {
+			last = first + int64(limit)
+		}
+
+		err = readRange(ctx, kafkaURL, partition.ID, first, int(last-first), func(msg kafkaGo.Message) error {
+			info := dlq.ParseInfo(msg)
+			fmt.Printf("  offset=%d key=%s failed_at=%s origin=%s/%d/%d error=%q\n    value=%s\n",
+				msg.Offset, msg.Key, info.FailedAt.Format(time.RFC3339), info.OriginalTopic, info.OriginalPartition, info.OriginalOffset, info.Error, msg.Value)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replay publishes count messages of a partition of the dead-letter topic, starting at offset, back to their original topic
+func replay(ctx context.Context, kafkaURL string, partition int, offset int64, count int) error {
+	first, last, err := readOffsets(ctx, kafkaURL, partition)
+	if err != nil {
+		return err
+	}
+	if offset < first || offset >= last {
+		return fmt.Errorf("offset %d is not in partition %d of %s, which has offsets %d to %d", offset, partition, dlq.Topic, first, last-1)
+	}
+	if offset+int64(count) > last {
+		count = int(last - offset)
+	}
+
+	producer := kafkaProducer.NewKafkaProducer()
+	defer producer.Close()
+
+	return readRange(ctx, kafkaURL, partition, offset, count, func(msg kafkaGo.Message) error {
+		replayed := dlq.ReplayMessage(msg)
+		if replayed.Topic == "" {
+			return fmt.Errorf("message at offset %d has no original topic", msg.Offset)
+		}
+		if err := producer.PublishMessages(ctx, replayed); err != nil {
+			return fmt.Errorf("failed to replay message at offset %d: %v", msg.Offset, err)
+		}
+		fmt.Printf("replayed offset %d (key %s) to %s\n", msg.Offset, msg.Key, replayed.Topic)
+		return nil
+	})
+}
+
+// readOffsets returns the first offset and the offset after the last message of a partition of the dead-letter topic
+func readOffsets(ctx context.Context, kafkaURL string, partition int) (int64, int64, error) {
+	conn, err := kafkaGo.DialLeader(ctx, "tcp", kafkaURL, dlq.Topic, partition)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to connect to partition %d of %s: %v", partition, dlq.Topic, err)
+	}
+	defer conn.Close()
+
+	first, last, err := conn.ReadOffsets()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read offsets of partition %d of %s: %v", partition, dlq.Topic, err)
+	}
+	return first, last, nil
+}
+
+// readRange calls fn on count messages of a partition of the dead-letter topic starting at offset, without a consumer group
+func readRange(ctx context.Context, kafkaURL string, partition int, offset int64, count int, fn func(kafkaGo.Message) error) error {
+	if count <= 0 {
+		return nil
+	}
+
+	reader := kafkaGo.NewReader(kafkaGo.ReaderConfig{
+		Brokers:   []string{kafkaURL},
+		Topic:     dlq.Topic,
+		Partition: partition,
+		MaxWait:   time.Second,
+	})
+	defer reader.Close()
+
+	if err := reader.SetOffset(offset); err != nil {
+		return fmt.Errorf("failed to seek partition %d of %s to %d: %v", partition, dlq.Topic, offset, err)
+	}
+
+	for i := 0; i < count; i++ {
+		msg, err := reader.ReadMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to read partition %d of %s: %v", partition, dlq.Topic, err)
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+// The ledgercheck command verifies the invariants of the ledger, every journal has at least two entries which sum to zero.
+//
+//	go run ./cmd/ledgercheck
+//
+// It connects to the database with the same DB_* variables as the service, prints the journals which break
+// the invariants, and exits with status 1 if there is any.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"payment-gateway/db"
+	"payment-gateway/internal/repository"
+)
+
+func main() {
+	dbURL := "postgres://" + os.Getenv("DB_USER") + ":" + os.Getenv("DB_PASSWORD") + "@" + os.Getenv("DB_HOST") + ":" + os.Getenv("DB_PORT") + "/" + os.Getenv("DB_NAME") + "?sslmode=disable"
+	db.InitializeDB(dbURL)
+	defer db.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	imbalances, err := repository.NewLedgerRepository(db.GetDB()).UnbalancedJournals(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, imbalance := range imbalances {
+		fmt.Printf("journal %d (%s of transaction %d): %d entries summing to %s %s\n",
+			imbalance.JournalID, imbalance.Kind, imbalance.TransactionID, imbalance.Entries, imbalance.Sum, imbalance.Currency)
+	}
+	if len(imbalances) > 0 {
+		fmt.Printf("%d unbalanced journals\n", len(imbalances))
+		os.Exit(1)
+	}
+	fmt.Println("every journal is balanced")
+}
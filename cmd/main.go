@@ -8,16 +8,43 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
 	"payment-gateway/db"
 	"payment-gateway/internal/api"
+	"payment-gateway/internal/connectors"
 	kafkaConsumer "payment-gateway/internal/kafka/consumer"
 	kafkaProducer "payment-gateway/internal/kafka/producer"
+	"payment-gateway/internal/middleware"
 	"payment-gateway/internal/repository"
 	"payment-gateway/internal/services"
 )
 
+// serverShutdownTimeout is how long in-flight HTTP requests get to finish on shutdown
+const serverShutdownTimeout = 10 * time.Second
+
+// @securityDefinitions.apikey  MerchantAPIKey
+// @in                          header
+// @name                        Authorization
+// @description                 API key of the merchant making the request, as `Bearer <key>`
+
+// @securityDefinitions.apikey  UserToken
+// @in                          header
+// @name                        X-User-Token
+// @description                 JWT of the user making the request, with or without a `Bearer ` scheme
+
+// @securityDefinitions.apikey  AdminAPIKey
+// @in                          header
+// @name                        Authorization
+// @description                 Admin key of the operators, ADMIN_API_KEY, as `Bearer <key>`
 func main() {
+	// Create the authenticator of users first, so a misconfiguration fails before anything starts,
+	// tokens are signed with JWT_SECRET (HS256) or a key of JWT_JWKS_FILE (RS256)
+	authenticator, err := middleware.NewJWTAuthenticator(os.Getenv("JWT_SECRET"), os.Getenv("JWT_JWKS_FILE"), os.Getenv("JWT_ISSUER"), os.Getenv("JWT_AUDIENCE"))
+	if err != nil {
+		log.Fatalf("Failed to set up JWT authentication: %v", err)
+	}
+
 	// Create a wait group to wait for background tasks to finish
 	wg := &sync.WaitGroup{}
 
@@ -47,13 +74,54 @@ func main() {
 	// Set up repositories
 	txnRepo := repository.NewTransactionRepository(db.GetDB())
 	gatewayRepo := repository.NewGatewayRepository(db.GetDB())
-
-	// Initialize Kafka consumer
+	idempotencyRepo := repository.NewIdempotencyRepository(db.GetDB())
+	outboxRepo := repository.NewOutboxRepository(db.GetDB())
+	recoveryRepo := repository.NewRecoveryRepository(db.GetDB())
+	webhookSignatureRepo := repository.NewWebhookSignatureRepository(db.GetDB())
+	ledgerRepo := repository.NewLedgerRepository(db.GetDB())
+	merchantRepo := repository.NewMerchantRepository(db.GetDB())
+
+	// Initialize Kafka consumer, CONSUMER_CONCURRENCY workers process CONSUMER_BATCH_SIZE batches in parallel,
+	// a batch is processed once full, or CONSUMER_MAX_LINGER after its first message
 	batchSize := os.Getenv("CONSUMER_BATCH_SIZE")
-	consumer := kafkaConsumer.NewKafkaConsumer(batchSize)
+	consumer := kafkaConsumer.NewKafkaConsumer(batchSize, os.Getenv("CONSUMER_CONCURRENCY"), os.Getenv("CONSUMER_MAX_LINGER"))
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Printf("Error closing Kafka consumer: %v", err)
+		}
+	}()
+
+	// Circuit breakers of the gateways, shared by routing and the admin routes
+	gatewayHealth := services.NewGatewayHealth()
+
+	// Register gateway connectors, without a real gateway integration,
+	// every gateway is sent to the simulator when GATEWAY_SIMULATOR_URL is set
+	connectorRegistry := connectors.NewRegistry()
+	if simulatorURL := os.Getenv("GATEWAY_SIMULATOR_URL"); simulatorURL != "" {
+		webhookBaseURL := os.Getenv("WEBHOOK_BASE_URL")
+		if webhookBaseURL == "" {
+			webhookBaseURL = "http://localhost:8080/api/v1/webhooks"
+		}
+
+		connectorRegistry.SetFallback(func(gatewayName string) connectors.GatewayConnector {
+			return connectors.NewSimulatorConnector(simulatorURL, webhookBaseURL, gatewayName)
+		})
+	}
 
 	// Create the transaction service
-	txnService := services.NewTransactionService(txnRepo, gatewayRepo, producer, consumer)
+	txnService := services.NewTransactionService(txnRepo, gatewayRepo, services.NewGatewayRouter(gatewayHealth), gatewayHealth, connectorRegistry, consumer, producer)
+
+	// Create the idempotency service, keys expire after IDEMPOTENCY_KEY_TTL
+	idempotencyService := services.NewIdempotencyService(idempotencyRepo, os.Getenv("IDEMPOTENCY_KEY_TTL"))
+
+	// Create the webhook verifier, signatures older than WEBHOOK_SIGNATURE_TOLERANCE are rejected
+	webhookVerifier := services.NewWebhookVerifier(gatewayRepo, webhookSignatureRepo, os.Getenv("WEBHOOK_SIGNATURE_TOLERANCE"))
+
+	// Create the balance service, balances are read from the ledger
+	balanceService := services.NewBalanceService(ledgerRepo)
+
+	// Create the merchant service, which authenticates the API keys of merchants
+	merchantService := services.NewMerchantService(merchantRepo)
 
 	// Start consuming Kafka messages in a goroutine
 
@@ -63,8 +131,29 @@ func main() {
 		wg.Done()
 	}()
 
+	// Relay status changes from the outbox to kafka, every OUTBOX_POLL_INTERVAL, OUTBOX_BATCH_SIZE events at a time,
+	// giving up on an event after OUTBOX_MAX_ATTEMPTS
+	outboxRelay := services.NewOutboxRelay(outboxRepo, producer, os.Getenv("OUTBOX_POLL_INTERVAL"), os.Getenv("OUTBOX_BATCH_SIZE"), os.Getenv("OUTBOX_MAX_ATTEMPTS"))
+
+	wg.Add(1)
+	go func() {
+		outboxRelay.Run(ctx)
+		wg.Done()
+	}()
+
+	// Re-drive transactions stuck in INIT or KAFKA_PUBLISH_FAILED for longer than RECOVERY_STUCK_AFTER,
+	// every RECOVERY_INTERVAL, until RECOVERY_MAX_ATTEMPTS moves them to MANUAL_REVIEW
+	recoveryWorker := services.NewRecoveryWorker(recoveryRepo, txnRepo, gatewayRepo, connectorRegistry, gatewayHealth,
+		os.Getenv("RECOVERY_INTERVAL"), os.Getenv("RECOVERY_STUCK_AFTER"), os.Getenv("RECOVERY_MAX_ATTEMPTS"))
+
+	wg.Add(1)
+	go func() {
+		recoveryWorker.Run(ctx)
+		wg.Done()
+	}()
+
 	// Set up the HTTP server and routes
-	router := api.SetupRouter(db.GetDB(), txnRepo, gatewayRepo, txnService)
+	router := api.SetupRouter(db.GetDB(), txnRepo, gatewayRepo, txnService, idempotencyService, webhookVerifier, gatewayHealth, balanceService, merchantService, authenticator, os.Getenv("ADMIN_API_KEY"))
 
 	// Start the HTTP server on port 8080
 	server := &http.Server{Addr: ":8080", Handler: router}
@@ -77,11 +166,13 @@ func main() {
 
 	ListenForClosingSignals(cancelFunc)
 
-	// Wait for the Kafka consumer and HTTP server to finish
+	// Wait for the Kafka consumer to drain its in-flight batches, and the workers to finish
 	wg.Wait()
 
-	// Gracefully shut down the HTTP server
-	if err := server.Shutdown(ctx); err != nil && err != http.ErrServerClosed {
+	// Gracefully shut down the HTTP server, ctx is already cancelled so in-flight requests get their own deadline
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil && err != http.ErrServerClosed {
 		log.Printf("HTTP server shutdown failed: %v", err)
 	} else {
 		log.Println("HTTP server gracefully shut down.")
@@ -0,0 +1,86 @@
+// The merchant command creates merchants and rotates their API keys.
+//
+//	go run ./cmd/merchant create -name acme
+//	go run ./cmd/merchant rotate -merchant 1 [-overlap 24h]
+//
+// It connects to the database with the same DB_* variables as the service. Keys are printed once, only their hash is stored.
+// After a rotation, the other keys of the merchant keep working for the overlap, so clients can move to the new key,
+// an overlap of 0 revokes them right away. The default merchant, which owns everything from before merchants, starts without a key.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"payment-gateway/db"
+	"payment-gateway/internal/repository"
+	"payment-gateway/internal/services"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var run func(ctx context.Context, merchantService services.MerchantService) error
+	switch os.Args[1] {
+	case "create":
+		flags := flag.NewFlagSet("create", flag.ExitOnError)
+		name := flags.String("name", "", "unique name of the merchant")
+		flags.Parse(os.Args[2:])
+
+		if *name == "" {
+			flags.Usage()
+			os.Exit(2)
+		}
+		run = func(ctx context.Context, merchantService services.MerchantService) error {
+			merchant, apiKey, err := merchantService.CreateMerchant(ctx, *name)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("merchant %d (%s)\napi key: %s\n", merchant.ID, merchant.Name, apiKey)
+			return nil
+		}
+	case "rotate":
+		flags := flag.NewFlagSet("rotate", flag.ExitOnError)
+		merchantID := flags.Int("merchant", 0, "ID of the merchant whose key is rotated")
+		overlap := flags.Duration("overlap", services.DefaultAPIKeyOverlap, "how long the previous keys keep working")
+		flags.Parse(os.Args[2:])
+
+		if *merchantID <= 0 || *overlap < 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		run = func(ctx context.Context, merchantService services.MerchantService) error {
+			apiKey, err := merchantService.RotateAPIKey(ctx, *merchantID, *overlap)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("api key: %s\nprevious keys expire in %s\n", apiKey, *overlap)
+			return nil
+		}
+	default:
+		usage()
+	}
+
+	dbURL := "postgres://" + os.Getenv("DB_USER") + ":" + os.Getenv("DB_PASSWORD") + "@" + os.Getenv("DB_HOST") + ":" + os.Getenv("DB_PORT") + "/" + os.Getenv("DB_NAME") + "?sslmode=disable"
+	db.InitializeDB(dbURL)
+	defer db.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if err := run(ctx, services.NewMerchantService(repository.NewMerchantRepository(db.GetDB()))); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage:\n  %[1]s create -name name\n  %[1]s rotate -merchant id [-overlap 24h]\n", os.Args[0])
+	os.Exit(2)
+}
@@ -0,0 +1,188 @@
+// The simulator stands in for a real payment gateway when running locally.
+//
+// It accepts payments, payouts and refunds, and after SIMULATOR_WEBHOOK_DELAY calls the callback url
+// sent along with the transaction, with SUCCESS or, for SIMULATOR_FAILURE_RATE of transactions, FAILED.
+// Webhooks are signed with SIMULATOR_WEBHOOK_SECRET, which must match the webhook_secret of the gateways
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"payment-gateway/internal/connectors"
+	"payment-gateway/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+type simulator struct {
+	mu           sync.Mutex
+	transactions map[int]*connectors.SimulatorTransaction
+	delay        time.Duration
+	failureRate  float64
+	secret       string
+	client       *http.Client
+}
+
+func main() {
+	delay, err := time.ParseDuration(os.Getenv("SIMULATOR_WEBHOOK_DELAY"))
+	if err != nil {
+		delay = 2 * time.Second
+	}
+	failureRate, err := strconv.ParseFloat(os.Getenv("SIMULATOR_FAILURE_RATE"), 64)
+	if err != nil {
+		failureRate = 0.1
+	}
+	port := os.Getenv("SIMULATOR_PORT")
+	if port == "" {
+		port = "8090"
+	}
+
+	s := &simulator{
+		transactions: map[int]*connectors.SimulatorTransaction{},
+		delay:        delay,
+		failureRate:  failureRate,
+		secret:       os.Getenv("SIMULATOR_WEBHOOK_SECRET"),
+		client:       &http.Client{Timeout: 5 * time.Second},
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/payments", s.initiate).Methods("POST")
+	router.HandleFunc("/payouts", s.initiate).Methods("POST")
+	router.HandleFunc("/refunds", s.initiate).Methods("POST")
+	router.HandleFunc("/transactions/{id}", s.status).Methods("GET")
+
+	server := &http.Server{Addr: ":" + port, Handler: router}
+	go func() {
+		log.Printf("Starting gateway simulator on port %s, webhook delay: %s, failure rate: %.2f", port, delay, failureRate)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Simulator failed: %v", err)
+		}
+	}()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	<-sigChan
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Simulator shutdown failed: %v", err)
+	}
+}
+
+// initiate accepts a transaction, the same txn_id is only accepted once, like a real gateway would
+func (s *simulator) initiate(w http.ResponseWriter, r *http.Request) {
+	req := connectors.SimulatorRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TxnID == 0 {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	txn, exists := s.transactions[req.TxnID]
+	if !exists {
+		txn = &connectors.SimulatorTransaction{
+			TxnID:     req.TxnID,
+			Reference: fmt.Sprintf("sim_%d_%d", req.TxnID, time.Now().UnixNano()),
+			Status:    models.PENDING,
+			UpdatedAt: time.Now().UTC(),
+		}
+		s.transactions[req.TxnID] = txn
+	}
+	response := *txn
+	s.mu.Unlock()
+
+	if !exists {
+		log.Printf("Accepted %s %d of %s %s", req.Type, req.TxnID, req.Amount, req.Currency)
+		go s.settle(req)
+	}
+
+	writeJSON(w, http.StatusAccepted, response)
+}
+
+func (s *simulator) status(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	txn, ok := s.transactions[id]
+	var response connectors.SimulatorTransaction
+	if ok {
+		response = *txn
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// settle decides the outcome of a transaction after the delay, and calls the webhook until it's acknowledged
+func (s *simulator) settle(req connectors.SimulatorRequest) {
+	time.Sleep(s.delay)
+
+	status := models.SUCCESS
+	if rand.Float64() < s.failureRate {
+		status = models.FAILED
+	}
+
+	s.mu.Lock()
+	txn := s.transactions[req.TxnID]
+	txn.Status = status
+	txn.UpdatedAt = time.Now().UTC()
+	webhook := models.TransactionWebhookResponse{TxnID: txn.TxnID, Status: txn.Status, UpdatedAt: txn.UpdatedAt}
+	s.mu.Unlock()
+
+	body, _ := json.Marshal(webhook)
+	for attempt := 1; attempt <= 5; attempt++ {
+		resp, err := s.deliver(req.CallbackURL, body)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < http.StatusMultipleChoices {
+				log.Printf("Delivered %s webhook for %d", status, req.TxnID)
+				return
+			}
+			err = fmt.Errorf("webhook responded with %d", resp.StatusCode)
+		}
+
+		log.Printf("Failed to deliver webhook for %d, attempt: %d, err: %v", req.TxnID, attempt, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// deliver posts a webhook, signed at the time of sending so retries aren't rejected as stale
+func (s *simulator) deliver(callbackURL string, body []byte) (*http.Response, error) {
+	httpReq, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", string(models.JSON))
+	httpReq.Header.Set(connectors.WebhookSignatureHeader, connectors.SignWebhook(s.secret, time.Now(), body))
+
+	return s.client.Do(httpReq)
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, data interface{}) {
+	w.Header().Set("Content-Type", string(models.JSON))
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+// The token command issues HS256 tokens signed with JWT_SECRET, to call the API locally.
+//
+//	go run ./cmd/token -user 1 [-ttl 1h]
+//
+// Tokens carry JWT_ISSUER and JWT_AUDIENCE when they are set, like the service expects them,
+// and are sent in the X-User-Token header, next to the merchant's API key.
+// It is meant for local testing only, tokens are issued by an identity provider in production.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"payment-gateway/internal/middleware"
+)
+
+func main() {
+	userID := flag.Int("user", 0, "ID of the user the token is issued to")
+	ttl := flag.Duration("ttl", time.Hour, "how long the token is valid for")
+	flag.Parse()
+
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		log.Fatal("JWT_SECRET is required")
+	}
+	if *userID <= 0 {
+		log.Fatal("-user must be a positive user ID")
+	}
+
+	now := time.Now()
+	claims := middleware.JWTClaims{
+		Subject:   strconv.Itoa(*userID),
+		Issuer:    os.Getenv("JWT_ISSUER"),
+		ExpiresAt: now.Add(*ttl).Unix(),
+		IssuedAt:  now.Unix(),
+	}
+	if audience := os.Getenv("JWT_AUDIENCE"); audience != "" {
+		claims.Audience = []string{audience}
+	}
+
+	token, err := middleware.SignHS256(claims, secret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(token)
+}
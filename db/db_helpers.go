@@ -83,10 +83,10 @@ func GetUsers(db *sql.DB) ([]User, error) {
 }
 
 func CreateCountry(db *sql.DB, country models.Country) error {
-	query := `INSERT INTO countries (name, code, created_at, updated_at) 
-			  VALUES ($1, $2, $3, $4) RETURNING id`
+	query := `INSERT INTO countries (name, code, currency, created_at, updated_at) 
+			  VALUES ($1, $2, $3, $4, $5) RETURNING id`
 
-	err := db.QueryRow(query, country.Name, country.Code, time.Now(), time.Now()).Scan(&country.ID)
+	err := db.QueryRow(query, country.Name, country.Code, country.Currency, time.Now(), time.Now()).Scan(&country.ID)
 	if err != nil {
 		return fmt.Errorf("failed to insert country: %v", err)
 	}
@@ -94,7 +94,7 @@ func CreateCountry(db *sql.DB, country models.Country) error {
 }
 
 func GetCountries(db *sql.DB) ([]models.Country, error) {
-	rows, err := db.Query(`SELECT id, name, code, created_at, updated_at FROM countries`)
+	rows, err := db.Query(`SELECT id, name, code, currency, created_at, updated_at FROM countries`)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch countries: %v", err)
 	}
@@ -103,7 +103,7 @@ func GetCountries(db *sql.DB) ([]models.Country, error) {
 	var countries []models.Country
 	for rows.Next() {
 		var country models.Country
-		if err := rows.Scan(&country.ID, &country.Name, &country.Code, &country.CreatedAt, &country.UpdatedAt); err != nil {
+		if err := rows.Scan(&country.ID, &country.Name, &country.Code, &country.Currency, &country.CreatedAt, &country.UpdatedAt); err != nil {
 			return nil, fmt.Errorf("failed to scan country: %v", err)
 		}
 		countries = append(countries, country)
@@ -71,3 +71,331 @@ BEGIN
         );
     END IF;
 END $$;
+
+
+DO $$ 
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'idempotency_keys') THEN
+        CREATE TABLE idempotency_keys (
+            key VARCHAR(255) PRIMARY KEY,
+            request_hash CHAR(64) NOT NULL,
+            status_code INT NOT NULL,
+            response JSONB NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            expires_at TIMESTAMP NOT NULL
+        );
+    END IF;
+END $$;
+
+
+DO $$ 
+BEGIN
+    -- DECIMAL(10, 2) truncates amounts at or above 100 million and can't hold 3 decimal currencies like KWD
+    ALTER TABLE public.transactions ALTER COLUMN amount TYPE NUMERIC(22, 3);
+END $$;
+
+
+DO $$ 
+BEGIN
+    ALTER TABLE public.transactions ADD COLUMN IF NOT EXISTS currency CHAR(3) NULL;
+
+    -- Transactions made before the column existed were always in the currency of their country
+    UPDATE public.transactions t SET currency = c.currency
+    FROM public.countries c
+    WHERE t.currency IS NULL AND c.id = t.country_id;
+
+    ALTER TABLE public.transactions ALTER COLUMN currency SET NOT NULL;
+END $$;
+
+
+DO $$ 
+BEGIN
+    -- Routing rules of a gateway for a country, lower priority is preferred and
+    -- gateways sharing a priority split its traffic by weight (percentage)
+    ALTER TABLE public.gateway_countries ADD COLUMN IF NOT EXISTS priority INT NOT NULL DEFAULT 100;
+    ALTER TABLE public.gateway_countries ADD COLUMN IF NOT EXISTS weight INT NOT NULL DEFAULT 100;
+    ALTER TABLE public.gateway_countries ADD COLUMN IF NOT EXISTS min_amount NUMERIC(22, 3) NULL;
+    ALTER TABLE public.gateway_countries ADD COLUMN IF NOT EXISTS max_amount NUMERIC(22, 3) NULL;
+    ALTER TABLE public.gateway_countries ADD COLUMN IF NOT EXISTS enabled BOOLEAN NOT NULL DEFAULT TRUE;
+
+    -- Existing gateways keep sharing traffic, new ones get none until a weight is assigned
+    ALTER TABLE public.gateway_countries ALTER COLUMN weight SET DEFAULT 0;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.table_constraints WHERE constraint_name = 'gateway_countries_weight_check') THEN
+        ALTER TABLE public.gateway_countries ADD CONSTRAINT gateway_countries_weight_check CHECK (weight BETWEEN 0 AND 100);
+    END IF;
+
+    ALTER TABLE public.transactions ADD COLUMN IF NOT EXISTS routing_decision JSONB NULL;
+END $$;
+
+
+DO $$ 
+BEGIN
+    -- Secret shared with the gateway to sign its webhooks, webhooks of gateways without one are rejected
+    ALTER TABLE public.gateways ADD COLUMN IF NOT EXISTS webhook_secret VARCHAR(255) NULL;
+
+    -- Signatures of accepted webhooks, only kept for as long as their timestamp is within tolerance
+    CREATE TABLE IF NOT EXISTS public.webhook_signatures (
+        gateway_id INT NOT NULL REFERENCES public.gateways(id),
+        signature VARCHAR(128) NOT NULL,
+        received_at TIMESTAMP NOT NULL,
+        PRIMARY KEY (gateway_id, signature)
+    );
+
+    CREATE INDEX IF NOT EXISTS webhook_signatures_received_at_idx ON public.webhook_signatures (received_at);
+END $$;
+
+
+DO $$ 
+BEGIN
+    -- Kafka messages written in the same transaction as the change they describe, published by the outbox relay
+    CREATE TABLE IF NOT EXISTS public.outbox (
+        id BIGSERIAL PRIMARY KEY,
+        aggregate_id INT NOT NULL,
+        key VARCHAR(255) NOT NULL,
+        payload BYTEA NOT NULL,
+        created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        published_at TIMESTAMP NULL,
+        attempts INT NOT NULL DEFAULT 0,
+        last_error TEXT NULL,
+        next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+    );
+
+    -- The relay only reads unpublished events, in order
+    CREATE INDEX IF NOT EXISTS outbox_unpublished_idx ON public.outbox (id) WHERE published_at IS NULL;
+    CREATE INDEX IF NOT EXISTS outbox_published_at_idx ON public.outbox (published_at) WHERE published_at IS NOT NULL;
+END $$;
+
+
+DO $$ 
+BEGIN
+    -- Every attempt of the recovery worker on a stuck transaction
+    CREATE TABLE IF NOT EXISTS public.recovery_attempts (
+        id BIGSERIAL PRIMARY KEY,
+        transaction_id INT NOT NULL REFERENCES public.transactions(id),
+        status VARCHAR(50) NOT NULL,
+        outcome VARCHAR(20) NOT NULL,
+        error TEXT NULL,
+        attempted_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+    );
+
+    CREATE INDEX IF NOT EXISTS recovery_attempts_transaction_id_idx ON public.recovery_attempts (transaction_id, attempted_at);
+
+    -- The recovery worker only looks for stuck transactions
+    CREATE INDEX IF NOT EXISTS transactions_stuck_idx ON public.transactions (created_at) WHERE status IN ('INIT', 'KAFKA_PUBLISH_FAILED');
+END $$;
+
+
+DO $$ 
+BEGIN
+    -- Events applied by the consumer, recorded in the same db transaction as their update, so redelivered events are skipped
+    CREATE TABLE IF NOT EXISTS public.processed_events (
+        event_id VARCHAR(36) PRIMARY KEY,
+        transaction_id INT NOT NULL,
+        processed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+    );
+END $$;
+
+
+DO $$ 
+BEGIN
+    -- The gateway's timestamp of the last status change applied to the transaction, older status changes are ignored
+    ALTER TABLE public.transactions ADD COLUMN IF NOT EXISTS gateway_updated_at TIMESTAMP NULL;
+END $$;
+
+
+DO $$ 
+BEGIN
+    -- Incremented by every update, updates compare-and-swap on the version they read
+    ALTER TABLE public.transactions ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+END $$;
+
+
+DO $$ 
+BEGIN
+    -- Status history of transactions, one row per status change, written in the same db transaction as the change
+    CREATE TABLE IF NOT EXISTS public.transaction_events (
+        id BIGSERIAL PRIMARY KEY,
+        transaction_id INT NOT NULL REFERENCES public.transactions(id),
+        -- NULL for the event creating the transaction
+        from_status VARCHAR(50) NULL,
+        to_status VARCHAR(50) NOT NULL,
+        -- api, webhook, consumer or recovery
+        source VARCHAR(20) NOT NULL,
+        -- Event ID of the message published or consumed for the change, or the gateway's reference
+        payload_ref VARCHAR(255) NULL,
+        created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+    );
+
+    CREATE INDEX IF NOT EXISTS transaction_events_transaction_id_idx ON public.transaction_events (transaction_id, id);
+
+    -- The history is append only
+    CREATE OR REPLACE FUNCTION public.transaction_events_append_only() RETURNS trigger AS $fn$
+    BEGIN
+        RAISE EXCEPTION 'transaction_events is append only';
+    END $fn$ LANGUAGE plpgsql;
+
+    IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'transaction_events_append_only') THEN
+        CREATE TRIGGER transaction_events_append_only BEFORE UPDATE OR DELETE ON public.transaction_events
+            FOR EACH ROW EXECUTE FUNCTION public.transaction_events_append_only();
+    END IF;
+END $$;
+
+
+DO $$ 
+BEGIN
+    -- Transaction search is sorted by descending ID, and paginated by ID, so filters are indexed along with the ID
+    CREATE INDEX IF NOT EXISTS transactions_user_id_idx ON public.transactions (user_id, id);
+    CREATE INDEX IF NOT EXISTS transactions_gateway_id_idx ON public.transactions (gateway_id, id);
+    CREATE INDEX IF NOT EXISTS transactions_created_at_idx ON public.transactions (created_at);
+END $$;
+
+
+DO $$ 
+BEGIN
+    -- Refunds reference the deposit they refund, the refunds of a deposit are summed under a lock of the deposit
+    ALTER TABLE public.transactions ADD COLUMN IF NOT EXISTS parent_id INT NULL REFERENCES public.transactions(id);
+    CREATE INDEX IF NOT EXISTS transactions_parent_id_idx ON public.transactions (parent_id) WHERE parent_id IS NOT NULL;
+END $$;
+
+
+DO $$ 
+BEGIN
+    -- Fee charged by a gateway on every transaction it settles, in basis points of the amount
+    ALTER TABLE public.gateways ADD COLUMN IF NOT EXISTS fee_bps INT NOT NULL DEFAULT 0;
+
+    -- Double-entry ledger, accounts are opened per type, owner and currency as journals are posted
+    CREATE TABLE IF NOT EXISTS public.ledger_accounts (
+        id BIGSERIAL PRIMARY KEY,
+        -- USER_WALLET, USER_HOLD, GATEWAY_CLEARING, FEES or SUSPENSE
+        type VARCHAR(50) NOT NULL,
+        -- User or gateway owning the account, 0 for accounts without owner
+        owner_id INT NOT NULL DEFAULT 0,
+        currency CHAR(3) NOT NULL,
+        created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE (type, owner_id, currency)
+    );
+
+    -- A transaction has at most one journal of each kind
+    CREATE TABLE IF NOT EXISTS public.ledger_journals (
+        id BIGSERIAL PRIMARY KEY,
+        transaction_id INT NOT NULL REFERENCES public.transactions(id),
+        -- hold, settlement or reversal
+        kind VARCHAR(20) NOT NULL,
+        currency CHAR(3) NOT NULL,
+        created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE (transaction_id, kind)
+    );
+
+    -- Debits are positive amounts and credits negative ones, so the entries of a journal sum to zero
+    CREATE TABLE IF NOT EXISTS public.ledger_entries (
+        id BIGSERIAL PRIMARY KEY,
+        journal_id BIGINT NOT NULL REFERENCES public.ledger_journals(id),
+        account_id BIGINT NOT NULL REFERENCES public.ledger_accounts(id),
+        amount NUMERIC(22, 3) NOT NULL
+    );
+
+    CREATE INDEX IF NOT EXISTS ledger_entries_journal_id_idx ON public.ledger_entries (journal_id);
+    CREATE INDEX IF NOT EXISTS ledger_entries_account_id_idx ON public.ledger_entries (account_id);
+
+    -- Journals and their entries are never modified once posted
+    CREATE OR REPLACE FUNCTION public.ledger_immutable() RETURNS trigger AS $fn$
+    BEGIN
+        RAISE EXCEPTION '% is immutable', TG_TABLE_NAME;
+    END $fn$ LANGUAGE plpgsql;
+
+    IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'ledger_journals_immutable') THEN
+        CREATE TRIGGER ledger_journals_immutable BEFORE UPDATE OR DELETE ON public.ledger_journals
+            FOR EACH ROW EXECUTE FUNCTION public.ledger_immutable();
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'ledger_entries_immutable') THEN
+        CREATE TRIGGER ledger_entries_immutable BEFORE UPDATE OR DELETE ON public.ledger_entries
+            FOR EACH ROW EXECUTE FUNCTION public.ledger_immutable();
+    END IF;
+
+    -- A journal must balance by the time the db transaction posting it commits
+    CREATE OR REPLACE FUNCTION public.ledger_journal_balanced() RETURNS trigger AS $fn$
+    BEGIN
+        IF (SELECT SUM(amount) FROM public.ledger_entries WHERE journal_id = NEW.journal_id) <> 0 THEN
+            RAISE EXCEPTION 'journal % is not balanced', NEW.journal_id;
+        END IF;
+        RETURN NULL;
+    END $fn$ LANGUAGE plpgsql;
+
+    IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'ledger_entries_balanced') THEN
+        CREATE CONSTRAINT TRIGGER ledger_entries_balanced AFTER INSERT ON public.ledger_entries
+            DEFERRABLE INITIALLY DEFERRED FOR EACH ROW EXECUTE FUNCTION public.ledger_journal_balanced();
+    END IF;
+END $$;
+
+
+DO $$ 
+BEGIN
+    -- Merchants integrating with the gateway, the data of a merchant is never visible to another
+    CREATE TABLE IF NOT EXISTS public.merchants (
+        id SERIAL PRIMARY KEY,
+        name VARCHAR(255) NOT NULL UNIQUE,
+        created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+    );
+
+    -- Everything created before merchants existed belongs to the default merchant
+    INSERT INTO public.merchants (id, name) VALUES (1, 'default') ON CONFLICT (id) DO NOTHING;
+    PERFORM setval(pg_get_serial_sequence('public.merchants', 'id'), (SELECT MAX(id) FROM public.merchants));
+
+    -- Only the prefix and the SHA-256 of API keys are stored, rotated keys are accepted until they expire
+    CREATE TABLE IF NOT EXISTS public.merchant_api_keys (
+        id SERIAL PRIMARY KEY,
+        merchant_id INT NOT NULL REFERENCES public.merchants(id),
+        prefix VARCHAR(32) NOT NULL UNIQUE,
+        key_hash CHAR(64) NOT NULL,
+        created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        -- NULL until the key is rotated
+        expires_at TIMESTAMP NULL
+    );
+
+    CREATE INDEX IF NOT EXISTS merchant_api_keys_merchant_id_idx ON public.merchant_api_keys (merchant_id);
+
+    ALTER TABLE public.transactions ADD COLUMN IF NOT EXISTS merchant_id INT NOT NULL DEFAULT 1 REFERENCES public.merchants(id);
+    ALTER TABLE public.transactions ALTER COLUMN merchant_id DROP DEFAULT;
+    ALTER TABLE public.gateways ADD COLUMN IF NOT EXISTS merchant_id INT NOT NULL DEFAULT 1 REFERENCES public.merchants(id);
+    ALTER TABLE public.gateways ALTER COLUMN merchant_id DROP DEFAULT;
+
+    -- Gateway names are unique per merchant
+    ALTER TABLE public.gateways DROP CONSTRAINT IF EXISTS gateways_name_key;
+    IF NOT EXISTS (SELECT 1 FROM information_schema.table_constraints WHERE constraint_name = 'gateways_merchant_id_name_key') THEN
+        ALTER TABLE public.gateways ADD CONSTRAINT gateways_merchant_id_name_key UNIQUE (merchant_id, name);
+    END IF;
+
+    -- Every query on transactions is scoped by merchant, so the merchant leads their indexes
+    DROP INDEX IF EXISTS public.transactions_user_id_idx;
+    DROP INDEX IF EXISTS public.transactions_gateway_id_idx;
+    CREATE INDEX IF NOT EXISTS transactions_merchant_id_idx ON public.transactions (merchant_id, id);
+    CREATE INDEX IF NOT EXISTS transactions_merchant_id_user_id_idx ON public.transactions (merchant_id, user_id, id);
+    CREATE INDEX IF NOT EXISTS transactions_merchant_id_gateway_id_idx ON public.transactions (merchant_id, gateway_id, id);
+
+    -- Ledger accounts are opened per merchant, a user's wallet at one merchant isn't their wallet at another
+    ALTER TABLE public.ledger_accounts ADD COLUMN IF NOT EXISTS merchant_id INT NOT NULL DEFAULT 1 REFERENCES public.merchants(id);
+    ALTER TABLE public.ledger_accounts ALTER COLUMN merchant_id DROP DEFAULT;
+    ALTER TABLE public.ledger_accounts DROP CONSTRAINT IF EXISTS ledger_accounts_type_owner_id_currency_key;
+    IF NOT EXISTS (SELECT 1 FROM information_schema.table_constraints WHERE constraint_name = 'ledger_accounts_merchant_id_type_owner_id_currency_key') THEN
+        ALTER TABLE public.ledger_accounts ADD CONSTRAINT ledger_accounts_merchant_id_type_owner_id_currency_key UNIQUE (merchant_id, type, owner_id, currency);
+    END IF;
+END $$;
+
+
+DO $$ 
+BEGIN
+    -- The transaction a request created, so a retry of a request which failed after creating it resumes that transaction
+    ALTER TABLE public.idempotency_keys ADD COLUMN IF NOT EXISTS transaction_id INT NULL REFERENCES public.transactions(id);
+END $$;
+
+
+DO $$ 
+BEGIN
+    -- Set once an event used up its attempts, it isn't published anymore, and holds back the later events of its transaction
+    ALTER TABLE public.outbox ADD COLUMN IF NOT EXISTS failed_at TIMESTAMP NULL;
+
+    -- The relay skips transactions whose oldest unpublished event is waiting, by looking up the unpublished events of a transaction
+    CREATE INDEX IF NOT EXISTS outbox_unpublished_aggregate_idx ON public.outbox (aggregate_id, id) WHERE published_at IS NULL;
+END $$;
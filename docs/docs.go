@@ -15,9 +15,41 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/api/v1/admin/gateways/breakers": {
+            "get": {
+                "description": "Returns the state and counts of the circuit breaker of every gateway which received traffic since the server started.",
+                "produces": [
+                    "application/json",
+                    "text/xml"
+                ],
+                "tags": [
+                    "Admin"
+                ],
+                "summary": "List gateway circuit breakers",
+                "responses": {
+                    "200": {
+                        "description": "Circuit breaker states",
+                        "schema": {
+                            "$ref": "#/definitions/models.SuccessAPIResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing or invalid admin key",
+                        "schema": {
+                            "$ref": "#/definitions/models.UnauthorizedAPIResponse"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "AdminAPIKey": []
+                    }
+                ]
+            }
+        },
         "/api/v1/payments/{operation}": {
             "post": {
-                "description": "Initializes a transaction in a pending state for either deposit or withdrawal.",
+                "description": "Initializes a transaction in a pending state for either deposit or withdrawal.\nRequests sent with an ` + "`" + `Idempotency-Key` + "`" + ` header are processed once, replays return the original response.\nWithdrawals larger than the available balance of the user are rejected.\nThe transaction is made for the user of the request's token, a ` + "`" + `user_id` + "`" + ` in the body must be that user,\nat the merchant of the API key, through the merchant's gateways.",
                 "consumes": [
                     "application/json",
                     "text/xml"
@@ -42,6 +74,12 @@ const docTemplate = `{
                         "in": "path",
                         "required": true
                     },
+                    {
+                        "type": "string",
+                        "description": "Unique key making retries of this request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    },
                     {
                         "description": "Transaction request payload",
                         "name": "request",
@@ -60,23 +98,427 @@ const docTemplate = `{
                         }
                     },
                     "400": {
-                        "description": "Invalid request body or operation",
+                        "description": "Invalid request body or operation, or insufficient funds for a withdrawal",
                         "schema": {
                             "$ref": "#/definitions/models.BadRequestAPIResponse"
                         }
                     },
+                    "401": {
+                        "description": "Missing or invalid API key or token",
+                        "schema": {
+                            "$ref": "#/definitions/models.UnauthorizedAPIResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Idempotency key reused with a different request",
+                        "schema": {
+                            "$ref": "#/definitions/models.ConflictAPIResponse"
+                        }
+                    },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
                             "$ref": "#/definitions/models.InternalErrorAPIResponse"
                         }
+                    },
+                    "502": {
+                        "description": "Transaction couldn't be sent to the gateway, a retry with the same idempotency key sends it again",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIResponse"
+                        }
                     }
-                }
+                },
+                "security": [
+                    {
+                        "MerchantAPIKey": [],
+                        "UserToken": []
+                    }
+                ]
             }
         },
-        "/api/v1/webhooks": {
+        "/api/v1/transactions": {
+            "get": {
+                "description": "Returns the transactions matching every filter given, newest (highest ID) first, a page at a time.\nThe next page is fetched with the ` + "`" + `next_cursor` + "`" + ` of the previous one, it is empty on the last page.\nOnly the transactions of the merchant of the API key are searched.",
+                "produces": [
+                    "application/json",
+                    "text/xml"
+                ],
+                "tags": [
+                    "Transactions"
+                ],
+                "summary": "Search transactions",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "User of the transactions",
+                        "name": "user_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "array",
+                        "description": "Statuses of the transactions, repeated or comma separated",
+                        "name": "status",
+                        "in": "query",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "multi"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Transaction type",
+                        "name": "type",
+                        "in": "query",
+                        "enum": [
+                            "DEPOSIT",
+                            "WITHDRAWAL",
+                            "REFUND"
+                        ]
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Gateway of the transactions",
+                        "name": "gateway_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Country of the transactions",
+                        "name": "country_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Transactions created at or after, RFC 3339",
+                        "name": "created_from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Transactions created before, RFC 3339",
+                        "name": "created_to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Page size, 50 by default, at most 200",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "next_cursor of the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "A page of transactions, along with the next_cursor",
+                        "schema": {
+                            "$ref": "#/definitions/models.SuccessAPIResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid filter or cursor",
+                        "schema": {
+                            "$ref": "#/definitions/models.BadRequestAPIResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing or invalid API key",
+                        "schema": {
+                            "$ref": "#/definitions/models.UnauthorizedAPIResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.InternalErrorAPIResponse"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "MerchantAPIKey": []
+                    }
+                ]
+            }
+        },
+        "/api/v1/transactions/{id}": {
+            "get": {
+                "description": "Returns a transaction of the user making the request, transactions of other users or merchants are not found.",
+                "produces": [
+                    "application/json",
+                    "text/xml"
+                ],
+                "tags": [
+                    "Transactions"
+                ],
+                "summary": "Get a transaction",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Transaction ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "The transaction",
+                        "schema": {
+                            "$ref": "#/definitions/models.SuccessAPIResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid transaction ID",
+                        "schema": {
+                            "$ref": "#/definitions/models.BadRequestAPIResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing or invalid API key or token",
+                        "schema": {
+                            "$ref": "#/definitions/models.UnauthorizedAPIResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Transaction not found",
+                        "schema": {
+                            "$ref": "#/definitions/models.NotFoundAPIResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.InternalErrorAPIResponse"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "MerchantAPIKey": [],
+                        "UserToken": []
+                    }
+                ]
+            }
+        },
+        "/api/v1/transactions/{id}/events": {
+            "get": {
+                "description": "Returns every status change of a transaction of the user making the request, oldest first, with the source\nwhich caused it (api, webhook, consumer or recovery) and a reference to the payload behind it.",
+                "produces": [
+                    "application/json",
+                    "text/xml"
+                ],
+                "tags": [
+                    "Transactions"
+                ],
+                "summary": "Get the status history of a transaction",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Transaction ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Status history of the transaction",
+                        "schema": {
+                            "$ref": "#/definitions/models.SuccessAPIResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid transaction ID",
+                        "schema": {
+                            "$ref": "#/definitions/models.BadRequestAPIResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing or invalid API key or token",
+                        "schema": {
+                            "$ref": "#/definitions/models.UnauthorizedAPIResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Transaction not found",
+                        "schema": {
+                            "$ref": "#/definitions/models.NotFoundAPIResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.InternalErrorAPIResponse"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "MerchantAPIKey": [],
+                        "UserToken": []
+                    }
+                ]
+            }
+        },
+        "/api/v1/transactions/{id}/refunds": {
+            "post": {
+                "description": "Creates a REFUND transaction linked to a successful deposit, sent through the deposit's gateway.\nA deposit may be refunded several times, up to its amount, an empty amount refunds all that is left.\nThe deposit is marked PARTIALLY_REFUNDED or REFUNDED as its refunds succeed.\nLike payments, requests sent with an ` + "`" + `Idempotency-Key` + "`" + ` header are processed once, replays return the original response.",
+                "consumes": [
+                    "application/json",
+                    "text/xml"
+                ],
+                "produces": [
+                    "application/json",
+                    "text/xml"
+                ],
+                "tags": [
+                    "Transactions"
+                ],
+                "summary": "Refund a transaction",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "ID of the deposit to refund",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Unique key making retries of this request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    },
+                    {
+                        "description": "Refund request payload",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/models.RefundRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Refund processing initialized",
+                        "schema": {
+                            "$ref": "#/definitions/models.SuccessAPIResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request body or amount",
+                        "schema": {
+                            "$ref": "#/definitions/models.BadRequestAPIResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing or invalid API key or token",
+                        "schema": {
+                            "$ref": "#/definitions/models.UnauthorizedAPIResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Transaction not found",
+                        "schema": {
+                            "$ref": "#/definitions/models.NotFoundAPIResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Transaction can't be refunded, or not for that much, or the user's available balance doesn't cover the refund, or idempotency key reused with a different request",
+                        "schema": {
+                            "$ref": "#/definitions/models.ConflictAPIResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.InternalErrorAPIResponse"
+                        }
+                    },
+                    "502": {
+                        "description": "Refund was created but couldn't be sent to the gateway, it is sent again in the background, or by a retry with the same idempotency key",
+                        "schema": {
+                            "$ref": "#/definitions/models.APIResponse"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "MerchantAPIKey": [],
+                        "UserToken": []
+                    }
+                ]
+            }
+        },
+        "/api/v1/users/{id}/balances": {
+            "get": {
+                "description": "Returns the available and held balance of the user in every currency the user has funds in.\nFunds of withdrawals in progress are held, withdrawals not yet accepted by a gateway are taken out of the available balance.\nUsers can only read their own balances, balances of other users are not found.\nBalances are kept per merchant, only the funds the user has at the merchant of the API key are returned.",
+                "produces": [
+                    "application/json",
+                    "text/xml"
+                ],
+                "tags": [
+                    "Balances"
+                ],
+                "summary": "Get the balances of a user",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "User ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Balances of the user, per currency",
+                        "schema": {
+                            "$ref": "#/definitions/models.SuccessAPIResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid user ID",
+                        "schema": {
+                            "$ref": "#/definitions/models.BadRequestAPIResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Missing or invalid API key or token",
+                        "schema": {
+                            "$ref": "#/definitions/models.UnauthorizedAPIResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "User not found",
+                        "schema": {
+                            "$ref": "#/definitions/models.NotFoundAPIResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.InternalErrorAPIResponse"
+                        }
+                    }
+                },
+                "security": [
+                    {
+                        "MerchantAPIKey": [],
+                        "UserToken": []
+                    }
+                ]
+            }
+        },
+        "/api/v1/webhooks/{merchant}/{gateway}": {
             "post": {
-                "description": "Processes webhook responses to update the status of transactions based on the gateway's response.",
+                "description": "Processes webhook responses to update the status of transactions based on the gateway's response.\nThe body is decoded by the connector of the gateway named in the path, among the gateways of the merchant in the path.\nWebhooks sent to ` + "`" + `/api/v1/webhooks/{gateway}` + "`" + `, without a merchant, are of the gateways of the default merchant.\nWebhooks must be signed with the gateway's webhook secret, unsigned, stale or replayed webhooks are rejected.",
                 "consumes": [
                     "application/json",
                     "text/xml"
@@ -90,6 +532,27 @@ const docTemplate = `{
                 ],
                 "summary": "Process webhook updates",
                 "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "ID of the merchant the gateway belongs to",
+                        "name": "merchant",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Name of the gateway sending the webhook",
+                        "name": "gateway",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Signature of the body: t=<unix timestamp>,v1=<hex hmac-sha256 of timestamp.body>",
+                        "name": "X-Webhook-Signature",
+                        "in": "header",
+                        "required": true
+                    },
                     {
                         "description": "Webhook response payload",
                         "name": "request",
@@ -108,13 +571,25 @@ const docTemplate = `{
                         }
                     },
                     "400": {
-                        "description": "Invalid request body",
+                        "description": "Invalid request body, or transaction not found among the gateway's transactions",
                         "schema": {
                             "$ref": "#/definitions/models.APIResponse"
                         }
                     },
+                    "401": {
+                        "description": "Invalid webhook signature",
+                        "schema": {
+                            "$ref": "#/definitions/models.UnauthorizedAPIResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Transaction can't move to the webhook's status, or kept being modified concurrently",
+                        "schema": {
+                            "$ref": "#/definitions/models.ConflictAPIResponse"
+                        }
+                    },
                     "500": {
-                        "description": "Internal server error",
+                        "description": "Webhook couldn't be processed, it should be redelivered",
                         "schema": {
                             "$ref": "#/definitions/models.APIResponse"
                         }
@@ -140,10 +615,25 @@ const docTemplate = `{
             "type": "object",
             "properties": {
                 "message": {
-                    "type": "string"
+                    "type": "string",
+                    "example": "Invalid request body"
                 },
                 "statusCode": {
-                    "type": "integer"
+                    "type": "integer",
+                    "example": 400
+                }
+            }
+        },
+        "models.ConflictAPIResponse": {
+            "type": "object",
+            "properties": {
+                "message": {
+                    "type": "string",
+                    "example": "Idempotency key was already used with a different request"
+                },
+                "statusCode": {
+                    "type": "integer",
+                    "example": 409
                 }
             }
         },
@@ -155,7 +645,30 @@ const docTemplate = `{
                     "example": "Internal Error"
                 },
                 "statusCode": {
-                    "type": "integer"
+                    "type": "integer",
+                    "example": 500
+                }
+            }
+        },
+        "models.NotFoundAPIResponse": {
+            "type": "object",
+            "properties": {
+                "message": {
+                    "type": "string",
+                    "example": "Transaction not found"
+                },
+                "statusCode": {
+                    "type": "integer",
+                    "example": 404
+                }
+            }
+        },
+        "models.RefundRequest": {
+            "type": "object",
+            "properties": {
+                "amount": {
+                    "description": "Amount is a decimal in major units, like in TransactionRequest, all that is left to refund is refunded when it is empty",
+                    "type": "number"
                 }
             }
         },
@@ -164,10 +677,12 @@ const docTemplate = `{
             "properties": {
                 "data": {},
                 "message": {
-                    "type": "string"
+                    "type": "string",
+                    "example": "WITHDRAWAL processing initialized"
                 },
                 "statusCode": {
-                    "type": "integer"
+                    "type": "integer",
+                    "example": 200
                 }
             }
         },
@@ -192,6 +707,7 @@ const docTemplate = `{
                     ]
                 },
                 "user_id": {
+                    "description": "UserID is the user of the request's token, it is optional in the body, and must be that user when given",
                     "type": "integer"
                 }
             }
@@ -203,25 +719,33 @@ const docTemplate = `{
                 "KAFKA_PUBLISH_FAILED",
                 "PENDING",
                 "SUCCESS",
-                "FAILED"
+                "FAILED",
+                "MANUAL_REVIEW",
+                "PARTIALLY_REFUNDED",
+                "REFUNDED"
             ],
             "x-enum-varnames": [
                 "INIT",
                 "KAFKA_PUBLISH_FAILED",
                 "PENDING",
                 "SUCCESS",
-                "FAILED"
+                "FAILED",
+                "MANUAL_REVIEW",
+                "PARTIALLY_REFUNDED",
+                "REFUNDED"
             ]
         },
         "models.TransactionType": {
             "type": "string",
             "enum": [
                 "DEPOSIT",
-                "WITHDRAWAL"
+                "WITHDRAWAL",
+                "REFUND"
             ],
             "x-enum-varnames": [
                 "DEPOSIT",
-                "WITHDRAWAL"
+                "WITHDRAWAL",
+                "REFUND"
             ]
         },
         "models.TransactionWebhookResponse": {
@@ -237,6 +761,39 @@ const docTemplate = `{
                     "type": "string"
                 }
             }
+        },
+        "models.UnauthorizedAPIResponse": {
+            "type": "object",
+            "properties": {
+                "message": {
+                    "type": "string",
+                    "example": "Invalid webhook signature"
+                },
+                "statusCode": {
+                    "type": "integer",
+                    "example": 401
+                }
+            }
+        }
+    },
+    "securityDefinitions": {
+        "MerchantAPIKey": {
+            "description": "API key of the merchant making the request, as ` + "`" + `Bearer <key>` + "`" + `",
+            "type": "apiKey",
+            "name": "Authorization",
+            "in": "header"
+        },
+        "UserToken": {
+            "description": "JWT of the user making the request, with or without a ` + "`" + `Bearer ` + "`" + ` scheme",
+            "type": "apiKey",
+            "name": "X-User-Token",
+            "in": "header"
+        },
+        "AdminAPIKey": {
+            "description": "Admin key of the operators, ADMIN_API_KEY, as ` + "`" + `Bearer <key>` + "`" + `",
+            "type": "apiKey",
+            "name": "Authorization",
+            "in": "header"
         }
     }
 }`
@@ -0,0 +1,29 @@
+package api
+
+import (
+	"net/http"
+	"payment-gateway/internal/services"
+)
+
+type AdminHandler struct {
+	gatewayHealth services.GatewayHealth
+}
+
+func NewAdminHandler(gatewayHealth services.GatewayHealth) *AdminHandler {
+	return &AdminHandler{gatewayHealth: gatewayHealth}
+}
+
+// GatewayBreakers returns the circuit breaker state of every gateway.
+//
+// @Summary      List gateway circuit breakers
+// @Description  Returns the state and counts of the circuit breaker of every gateway which received traffic since the server started.
+// @Tags         Admin
+// @Produce      json
+// @Produce      xml
+// @Security     AdminAPIKey
+// @Success      200          {object}  models.SuccessAPIResponse            "Circuit breaker states"
+// @Failure      401          {object}  models.UnauthorizedAPIResponse       "Missing or invalid admin key"
+// @Router       /api/v1/admin/gateways/breakers [get]
+func (a *AdminHandler) GatewayBreakers(w http.ResponseWriter, r *http.Request) {
+	services.NewAPIResponse(services.GetDataFormat(r)).NewStatusOKResponse(w, "", a.gatewayHealth.States())
+}
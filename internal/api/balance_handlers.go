@@ -0,0 +1,70 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"payment-gateway/internal/middleware"
+	"payment-gateway/internal/services"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type BalanceHandler struct {
+	balanceService services.BalanceService
+}
+
+func NewBalanceHandler(balanceService services.BalanceService) *BalanceHandler {
+	return &BalanceHandler{balanceService: balanceService}
+}
+
+// GetUserBalances returns the balances of the user making the request.
+//
+// @Summary      Get the balances of a user
+// @Description  Returns the available and held balance of the user in every currency the user has funds in.
+// @Description  Funds of withdrawals in progress are held, withdrawals not yet accepted by a gateway are taken out of the available balance.
+// @Description  Users can only read their own balances, balances of other users are not found.
+// @Description  Balances are kept per merchant, only the funds the user has at the merchant of the API key are returned.
+// @Tags         Balances
+// @Produce      json
+// @Produce      xml
+// @Param        id         path      int                              true  "User ID"
+// @Security     MerchantAPIKey && UserToken
+// @Success      200        {object}  models.SuccessAPIResponse              "Balances of the user, per currency"
+// @Failure      400        {object}  models.BadRequestAPIResponse           "Invalid user ID"
+// @Failure      401        {object}  models.UnauthorizedAPIResponse         "Missing or invalid API key or token"
+// @Failure      404        {object}  models.NotFoundAPIResponse             "User not found"
+// @Failure      500        {object}  models.InternalErrorAPIResponse        "Internal server error"
+// @Router       /api/v1/users/{id}/balances [get]
+func (b *BalanceHandler) GetUserBalances(w http.ResponseWriter, r *http.Request) {
+	apiResponse := services.NewAPIResponse(services.GetDataFormat(r))
+
+	merchantID, ok := requestMerchant(w, r, apiResponse)
+	if !ok {
+		return
+	}
+	requestingUserID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		apiResponse.NewUnauthorizedErrorResponse(w, "Missing token")
+		return
+	}
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		apiResponse.NewBadRequestErrorResponse(w, "Invalid user ID")
+		return
+	}
+	if userID != requestingUserID {
+		apiResponse.NewNotFoundErrorResponse(w, "User not found")
+		return
+	}
+
+	balances, err := b.balanceService.GetUserBalances(r.Context(), merchantID, userID)
+	if err != nil {
+		log.Printf("Error fetching balances of user %d, error: %+v", userID, err)
+		apiResponse.NewInternalServerErrorResponse(w, "", nil)
+		return
+	}
+
+	apiResponse.NewStatusOKResponse(w, "", balances)
+}
@@ -2,41 +2,84 @@ package api
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"payment-gateway/internal/connectors"
+	"payment-gateway/internal/middleware"
 	"payment-gateway/internal/models"
+	"payment-gateway/internal/repository"
 	"payment-gateway/internal/services"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
 type TransactionHandler struct {
-	txService services.TransactionService
+	txService          services.TransactionService
+	idempotencyService services.IdempotencyService
+	webhookVerifier    services.WebhookVerifier
 }
 
-func NewTransactionHandler(service services.TransactionService) *TransactionHandler {
-	return &TransactionHandler{txService: service}
+func NewTransactionHandler(service services.TransactionService, idempotencyService services.IdempotencyService, webhookVerifier services.WebhookVerifier) *TransactionHandler {
+	return &TransactionHandler{txService: service, idempotencyService: idempotencyService, webhookVerifier: webhookVerifier}
 }
 
 // PaymentHandler processes deposit or withdrawal transactions.
 //
 // @Summary      Create a deposit or withdrawal transaction
 // @Description  Initializes a transaction in a pending state for either deposit or withdrawal.
+// @Description  Requests sent with an `Idempotency-Key` header are processed once, replays return the original response.
+// @Description  Withdrawals larger than the available balance of the user are rejected.
+// @Description  The transaction is made for the user of the request's token, a `user_id` in the body must be that user,
+// @Description  at the merchant of the API key, through the merchant's gateways.
 // @Tags         Payments
 // @Accept       json
 // @Accept       xml
 // @Produce      json
 // @Produce      xml
-// @Param        operation    path      string                        true  "Transaction type: 'DEPOSIT' or 'WITHDRAWAL'"  Enums(DEPOSIT, WITHDRAWAL)
-// @Param        request      body      models.TransactionRequest     true   "Transaction request payload"
-// @Success      200          {object}  models.SuccessAPIResponse            "Transaction processing initialized successfully"
-// @Failure      400          {object}  models.BadRequestAPIResponse         "Invalid request body or operation"
-// @Failure      500          {object}  models.InternalErrorAPIResponse      "Internal server error"
+// @Param        operation        path      string                        true   "Transaction type: 'DEPOSIT' or 'WITHDRAWAL'"  Enums(DEPOSIT, WITHDRAWAL)
+// @Param        Idempotency-Key  header    string                        false  "Unique key making retries of this request safe"
+// @Param        request          body      models.TransactionRequest     true   "Transaction request payload"
+// @Security     MerchantAPIKey && UserToken
+// @Success      200              {object}  models.SuccessAPIResponse            "Transaction processing initialized successfully"
+// @Failure      400              {object}  models.BadRequestAPIResponse         "Invalid request body or operation, or insufficient funds for a withdrawal"
+// @Failure      401              {object}  models.UnauthorizedAPIResponse       "Missing or invalid API key or token"
+// @Failure      409              {object}  models.ConflictAPIResponse           "Idempotency key reused with a different request"
+// @Failure      500              {object}  models.InternalErrorAPIResponse      "Internal server error"
+// @Failure      502              {object}  models.APIResponse                   "Transaction couldn't be sent to the gateway, a retry with the same idempotency key sends it again"
 // @Router       /api/v1/payments/{operation} [post]
 func (t *TransactionHandler) PaymentHandler(w http.ResponseWriter, r *http.Request) {
 	req := models.TransactionRequest{}
 
+	merchantID, ok := requestMerchant(w, r, services.NewAPIResponse(services.GetDataFormat(r)))
+	if !ok {
+		return
+	}
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		services.NewAPIResponse(services.GetDataFormat(r)).NewUnauthorizedErrorResponse(w, "Missing token")
+		return
+	}
+
+	// Hash the request before decoding, as decoding consumes the body
+	idempotencyKey := r.Header.Get(services.IdempotencyKeyHeader)
+	requestHash := ""
+	if idempotencyKey != "" {
+		hash, err := services.HashRequest(r)
+		if err != nil {
+			log.Printf("Error hashing req body during %s, error: %+v", r.URL.Path, err)
+			services.NewAPIResponse(services.GetDataFormat(r)).NewBadRequestErrorResponse(w, "Invalid request body")
+			return
+		}
+		requestHash = hash
+	}
+
 	// Decode request
 	if err := services.DecodeRequest(r, &req); err != nil {
 		log.Printf("Error decoding req body during deposit, error: %+v", err)
@@ -44,6 +87,14 @@ func (t *TransactionHandler) PaymentHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// The user comes from the token, a body naming another user is most likely a client bug
+	if req.UserID != 0 && req.UserID != userID {
+		services.NewAPIResponse(req.DataFormat).NewBadRequestErrorResponse(w, "user_id doesn't match the authenticated user")
+		return
+	}
+	req.UserID = userID
+	req.MerchantID = merchantID
+
 	// Process the path to know if it's deposit/withdrawal
 	vars := mux.Vars(r)
 	txnType, err := services.ParseTransactionType(vars["operation"])
@@ -58,51 +109,505 @@ func (t *TransactionHandler) PaymentHandler(w http.ResponseWriter, r *http.Reque
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	transaction, err := t.txService.StartTransactionProcessing(ctx, &req)
+	apiResponse := services.NewAPIResponse(req.DataFormat)
+
+	if idempotencyKey == "" {
+		resp, _ := t.processPayment(ctx, &req, 0)
+		apiResponse.SendResponse(w, resp)
+		return
+	}
+
+	// Keys are scoped to the merchant and user, so a user can't replay the response of another user's request
+	scopedKey := strconv.Itoa(merchantID) + ":" + strconv.Itoa(userID) + ":" + idempotencyKey
+	resp, replayed, err := t.idempotencyService.Execute(ctx, scopedKey, requestHash, &models.Transaction{}, func(resumeID int) (*models.APIResponse, int) {
+		return t.processPayment(ctx, &req, resumeID)
+	})
+	if errors.Is(err, services.ErrIdempotencyKeyReused) {
+		apiResponse.NewConflictErrorResponse(w, "Idempotency key was already used with a different request")
+		return
+	}
 	if err != nil {
-		log.Printf("Error while starting %s processing, req: %+v, error: %+v", txnType.String(), req, err)
-		services.NewAPIResponse(req.DataFormat).NewBadRequestErrorResponse(w, "Invalid request body")
+		log.Printf("Error while processing %s with idempotency key %s, error: %+v", txnType.String(), idempotencyKey, err)
+		apiResponse.NewInternalServerErrorResponse(w, "", nil)
 		return
 	}
 
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	apiResponse.SendResponse(w, resp)
+}
+
+// processPayment starts the transaction, or resumes the transaction resumeID an earlier attempt of the request created,
+// and builds the response without writing it. The ID of the transaction is returned along with it, 0 if none was created
+func (t *TransactionHandler) processPayment(ctx context.Context, req *models.TransactionRequest, resumeID int) (*models.APIResponse, int) {
+	apiResponse := services.NewAPIResponse(req.DataFormat)
+
+	var transaction *models.Transaction
+	var err error
+	if resumeID != 0 {
+		transaction, err = t.txService.ResumeTransaction(ctx, req.MerchantID, req.UserID, resumeID)
+	} else {
+		transaction, err = t.txService.StartTransactionProcessing(ctx, req)
+	}
+	txnID := 0
+	if transaction != nil {
+		txnID = transaction.ID
+	}
+
+	// Only rejections of the request are 4xx, anything else may succeed on a retry, so it must not be replayed
+	if errors.Is(err, models.ErrInvalidAmount) {
+		return apiResponse.BuildResponse(http.StatusBadRequest, "Amount must be positive", nil), txnID
+	}
+	if errors.Is(err, models.ErrCurrencyMismatch) || errors.Is(err, models.ErrCountryNotFound) {
+		log.Printf("Rejected %s for unsupported currency, req: %+v, error: %+v", req.Type.String(), *req, err)
+		return apiResponse.BuildResponse(http.StatusBadRequest, "Currency "+req.Currency+" is not supported for the country", nil), txnID
+	}
+	if errors.Is(err, models.ErrInsufficientFunds) {
+		log.Printf("Rejected %s for insufficient funds, req: %+v, error: %+v", req.Type.String(), *req, err)
+		return apiResponse.BuildResponse(http.StatusBadRequest, "Insufficient funds", nil), txnID
+	}
+	if errors.Is(err, models.ErrNoEligibleGateway) {
+		log.Printf("Rejected %s as no gateway accepts it, req: %+v, error: %+v", req.Type.String(), *req, err)
+		return apiResponse.BuildResponse(http.StatusBadRequest, "No gateway is available for the amount", nil), txnID
+	}
+	if errors.Is(err, models.ErrGatewayDispatch) {
+		log.Printf("Error sending %s to its gateway, req: %+v, error: %+v", req.Type.String(), *req, err)
+		return apiResponse.BuildResponse(http.StatusBadGateway, "Gateway is unavailable, please retry", nil), txnID
+	}
+	if err != nil {
+		log.Printf("Error while starting %s processing, req: %+v, error: %+v", req.Type.String(), *req, err)
+		return apiResponse.BuildResponse(http.StatusInternalServerError, "Internal Server Error", nil), txnID
+	}
+
 	// Respond with success
-	services.NewAPIResponse(req.DataFormat).NewStatusOKResponse(w, txnType.String()+" processing initialized", transaction)
+	return apiResponse.BuildResponse(http.StatusOK, req.Type.String()+" processing initialized", transaction), txnID
 }
 
 // HandleWebhook processes incoming webhook updates from the gateway.
 //
 // @Summary      Process webhook updates
 // @Description  Processes webhook responses to update the status of transactions based on the gateway's response.
+// @Description  The body is decoded by the connector of the gateway named in the path, among the gateways of the merchant in the path.
+// @Description  Webhooks sent to `/api/v1/webhooks/{gateway}`, without a merchant, are of the gateways of the default merchant.
+// @Description  Webhooks must be signed with the gateway's webhook secret, unsigned, stale or replayed webhooks are rejected.
 // @Tags         Webhooks
 // @Accept       json
 // @Accept       xml
 // @Produce      json
 // @Produce      xml
-// @Param        request      body      models.TransactionWebhookResponse  true   "Webhook response payload"
-// @Success      200          {object}  models.APIResponse               "Webhook processing completed successfully"
-// @Failure      400          {object}  models.APIResponse               "Invalid request body"
-// @Failure      500          {object}  models.APIResponse               "Internal server error"
-// @Router       /api/v1/webhooks [post]
+// @Param        merchant             path      int                                true  "ID of the merchant the gateway belongs to"
+// @Param        gateway              path      string                             true  "Name of the gateway sending the webhook"
+// @Param        X-Webhook-Signature  header    string                             true  "Signature of the body: t=<unix timestamp>,v1=<hex hmac-sha256 of timestamp.body>"
+// @Param        request              body      models.TransactionWebhookResponse  true  "Webhook response payload"
+// @Success      200                  {object}  models.APIResponse                       "Webhook processing completed successfully"
+// @Failure      400                  {object}  models.APIResponse                       "Invalid request body, or transaction not found among the gateway's transactions"
+// @Failure      401                  {object}  models.UnauthorizedAPIResponse           "Invalid webhook signature"
+// @Failure      409                  {object}  models.ConflictAPIResponse               "Transaction can't move to the webhook's status, or kept being modified concurrently"
+// @Failure      500                  {object}  models.APIResponse                       "Webhook couldn't be processed, it should be redelivered"
+// @Router       /api/v1/webhooks/{merchant}/{gateway} [post]
 func (t *TransactionHandler) HandleWebhook(w http.ResponseWriter, r *http.Request) {
-	req := models.TransactionWebhookResponse{
-		DataFormat: services.GetDataFormat(r),
+	dataFormat := services.GetDataFormat(r)
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading webhook body, error: %+v", err)
+		services.NewAPIResponse(dataFormat).NewBadRequestErrorResponse(w, "Invalid request body")
+		return
+	}
+
+	// Webhooks configured before merchants existed don't name one, their gateways belong to the default merchant
+	merchantID := models.DEFAULT_MERCHANT_ID
+	if merchant, ok := mux.Vars(r)["merchant"]; ok {
+		if merchantID, err = strconv.Atoi(merchant); err != nil {
+			services.NewAPIResponse(dataFormat).NewBadRequestErrorResponse(w, "Invalid merchant ID")
+			return
+		}
+	}
+
+	// Verify the signature against the raw body, before anything in the body is trusted
+	gateway, err := t.webhookVerifier.Verify(r.Context(), merchantID, mux.Vars(r)["gateway"], r.Header.Get(connectors.WebhookSignatureHeader), body)
+	if errors.Is(err, services.ErrInvalidWebhookSignature) {
+		log.Printf("Rejected webhook, error: %+v", err)
+		services.NewAPIResponse(dataFormat).NewUnauthorizedErrorResponse(w, "Invalid webhook signature")
+		return
+	}
+	if err != nil {
+		log.Printf("Error verifying webhook signature, error: %+v", err)
+		services.NewAPIResponse(dataFormat).NewInternalServerErrorResponse(w, "", nil)
+		return
 	}
 
 	// Decode request
-	if err := services.DecodeRequest(r, &req); err != nil {
-		log.Printf("Error decoding req body during deposit, error: %+v", err)
-		services.NewAPIResponse(req.DataFormat).NewBadRequestErrorResponse(w, "Invalid request body")
+	req, err := t.txService.ParseWebhook(r.Context(), gateway, body, r.Header.Get("Content-Type"))
+	if err != nil {
+		log.Printf("Error decoding webhook body, error: %+v", err)
+		services.NewAPIResponse(dataFormat).NewBadRequestErrorResponse(w, "Invalid request body")
 		return
 	}
 
-	_, err := t.txService.StartWebhookProcessing(context.Background(), &req)
+	_, err = t.txService.StartWebhookProcessing(context.Background(), req)
+	if err != nil {
+		// Nothing was applied, the gateway's redelivery of the webhook must not be rejected as a replay
+		if releaseErr := t.webhookVerifier.Release(context.Background(), gateway, r.Header.Get(connectors.WebhookSignatureHeader), body); releaseErr != nil {
+			log.Printf("Error releasing signature of failed webhook, error: %+v", releaseErr)
+		}
+	}
 	// In my previous experience, gateway providers mostly care about status code of webhooks
 	// to know if they should retry the webhook or not, so ignored the response and only used error
+	if errors.Is(err, models.ErrInvalidTransition) || errors.Is(err, models.ErrConcurrentModification) {
+		log.Printf("Rejected webhook status, error: %+v", err)
+		services.NewAPIResponse(req.DataFormat).NewConflictErrorResponse(w, err.Error())
+		return
+	}
+	if errors.Is(err, models.ErrTransactionNotFound) || errors.Is(err, models.ErrGatewayMismatch) {
+		log.Printf("Rejected webhook, error: %+v", err)
+		services.NewAPIResponse(req.DataFormat).NewBadRequestErrorResponse(w, err.Error())
+		return
+	}
 	if err != nil {
+		// Not the gateway's fault, e.g. the db is down, a 5xx makes the gateway redeliver the webhook
 		log.Printf("Error Starting webhook processing, error: %+v", err)
-		services.NewAPIResponse(req.DataFormat).NewBadRequestErrorResponse(w, "")
+		services.NewAPIResponse(req.DataFormat).NewInternalServerErrorResponse(w, "", nil)
 		return
 	}
 
 	services.NewAPIResponse(req.DataFormat).NewStatusOKResponse(w, "", nil)
 }
+
+// SearchTransactions returns a page of the transactions matching the filters in the query.
+//
+// @Summary      Search transactions
+// @Description  Returns the transactions matching every filter given, newest (highest ID) first, a page at a time.
+// @Description  The next page is fetched with the `next_cursor` of the previous one, it is empty on the last page.
+// @Description  Only the transactions of the merchant of the API key are searched.
+// @Tags         Transactions
+// @Produce      json
+// @Produce      xml
+// @Param        user_id       query     int                              false  "User of the transactions"
+// @Param        status        query     []string                         false  "Statuses of the transactions, repeated or comma separated"  collectionFormat(multi)
+// @Param        type          query     string                           false  "Transaction type"  Enums(DEPOSIT, WITHDRAWAL, REFUND)
+// @Param        gateway_id    query     int                              false  "Gateway of the transactions"
+// @Param        country_id    query     int                              false  "Country of the transactions"
+// @Param        created_from  query     string                           false  "Transactions created at or after, RFC 3339"
+// @Param        created_to    query     string                           false  "Transactions created before, RFC 3339"
+// @Param        limit         query     int                              false  "Page size, 50 by default, at most 200"
+// @Param        cursor        query     string                           false  "next_cursor of the previous page"
+// @Security     MerchantAPIKey
+// @Success      200           {object}  models.SuccessAPIResponse              "A page of transactions, along with the next_cursor"
+// @Failure      400           {object}  models.BadRequestAPIResponse           "Invalid filter or cursor"
+// @Failure      401           {object}  models.UnauthorizedAPIResponse         "Missing or invalid API key"
+// @Failure      500           {object}  models.InternalErrorAPIResponse        "Internal server error"
+// @Router       /api/v1/transactions [get]
+func (t *TransactionHandler) SearchTransactions(w http.ResponseWriter, r *http.Request) {
+	apiResponse := services.NewAPIResponse(services.GetDataFormat(r))
+
+	merchantID, ok := requestMerchant(w, r, apiResponse)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	filter, err := parseTransactionFilter(query)
+	if err != nil {
+		apiResponse.NewBadRequestErrorResponse(w, "Invalid filter: "+err.Error())
+		return
+	}
+	filter.MerchantID = merchantID
+
+	page, err := t.txService.SearchTransactions(r.Context(), filter, query.Get("cursor"))
+	if errors.Is(err, models.ErrInvalidCursor) {
+		apiResponse.NewBadRequestErrorResponse(w, "Invalid cursor")
+		return
+	}
+	if err != nil {
+		log.Printf("Error searching transactions, filter: %+v, error: %+v", filter, err)
+		apiResponse.NewInternalServerErrorResponse(w, "", nil)
+		return
+	}
+
+	apiResponse.NewStatusOKResponse(w, "", page)
+}
+
+// parseTransactionFilter reads the search filters of a query, the returned error names the invalid filter
+func parseTransactionFilter(query url.Values) (repository.TransactionFilter, error) {
+	filter := repository.TransactionFilter{}
+
+	ids := map[string]*int{"user_id": &filter.UserID, "gateway_id": &filter.GatewayID, "country_id": &filter.CountryID, "limit": &filter.Limit}
+	for name, id := range ids {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return filter, fmt.Errorf("%s must be a positive integer", name)
+		}
+		*id = parsed
+	}
+
+	if value := query.Get("type"); value != "" {
+		// Refunds are searchable, though they can't be created through the payments route
+		txnType, err := services.ParseTransactionType(value)
+		if strings.EqualFold(value, string(models.REFUND)) {
+			txnType, err = models.REFUND, nil
+		}
+		if err != nil {
+			return filter, errors.New("type must be DEPOSIT, WITHDRAWAL or REFUND")
+		}
+		filter.Type = txnType
+	}
+
+	for _, values := range query["status"] {
+		for _, value := range strings.Split(values, ",") {
+			status := models.TransactionStatus(strings.ToUpper(strings.TrimSpace(value)))
+			if !status.IsValid() {
+				return filter, fmt.Errorf("unknown status %s", value)
+			}
+			filter.Statuses = append(filter.Statuses, status)
+		}
+	}
+
+	times := map[string]*time.Time{"created_from": &filter.CreatedFrom, "created_to": &filter.CreatedTo}
+	for name, at := range times {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, fmt.Errorf("%s must be an RFC 3339 time", name)
+		}
+		*at = parsed
+	}
+
+	return filter, nil
+}
+
+// GetTransaction returns a transaction of the user making the request.
+//
+// @Summary      Get a transaction
+// @Description  Returns a transaction of the user making the request, transactions of other users or merchants are not found.
+// @Tags         Transactions
+// @Produce      json
+// @Produce      xml
+// @Param        id         path      int                              true  "Transaction ID"
+// @Security     MerchantAPIKey && UserToken
+// @Success      200        {object}  models.SuccessAPIResponse              "The transaction"
+// @Failure      400        {object}  models.BadRequestAPIResponse           "Invalid transaction ID"
+// @Failure      401        {object}  models.UnauthorizedAPIResponse         "Missing or invalid API key or token"
+// @Failure      404        {object}  models.NotFoundAPIResponse             "Transaction not found"
+// @Failure      500        {object}  models.InternalErrorAPIResponse        "Internal server error"
+// @Router       /api/v1/transactions/{id} [get]
+func (t *TransactionHandler) GetTransaction(w http.ResponseWriter, r *http.Request) {
+	apiResponse := services.NewAPIResponse(services.GetDataFormat(r))
+
+	merchantID, userID, txnID, ok := requestedTransaction(w, r, apiResponse)
+	if !ok {
+		return
+	}
+
+	transaction, err := t.txService.GetTransaction(r.Context(), merchantID, userID, txnID)
+	if errors.Is(err, models.ErrTransactionNotFound) {
+		apiResponse.NewNotFoundErrorResponse(w, "Transaction not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching transaction %d, error: %+v", txnID, err)
+		apiResponse.NewInternalServerErrorResponse(w, "", nil)
+		return
+	}
+
+	apiResponse.NewStatusOKResponse(w, "", transaction)
+}
+
+// GetTransactionEvents returns the status history of a transaction.
+//
+// @Summary      Get the status history of a transaction
+// @Description  Returns every status change of a transaction of the user making the request, oldest first, with the source
+// @Description  which caused it (api, webhook, consumer or recovery) and a reference to the payload behind it.
+// @Tags         Transactions
+// @Produce      json
+// @Produce      xml
+// @Param        id         path      int                              true  "Transaction ID"
+// @Security     MerchantAPIKey && UserToken
+// @Success      200        {object}  models.SuccessAPIResponse              "Status history of the transaction"
+// @Failure      400        {object}  models.BadRequestAPIResponse           "Invalid transaction ID"
+// @Failure      401        {object}  models.UnauthorizedAPIResponse         "Missing or invalid API key or token"
+// @Failure      404        {object}  models.NotFoundAPIResponse             "Transaction not found"
+// @Failure      500        {object}  models.InternalErrorAPIResponse        "Internal server error"
+// @Router       /api/v1/transactions/{id}/events [get]
+func (t *TransactionHandler) GetTransactionEvents(w http.ResponseWriter, r *http.Request) {
+	apiResponse := services.NewAPIResponse(services.GetDataFormat(r))
+
+	merchantID, userID, txnID, ok := requestedTransaction(w, r, apiResponse)
+	if !ok {
+		return
+	}
+
+	events, err := t.txService.GetTransactionEvents(r.Context(), merchantID, userID, txnID)
+	if errors.Is(err, models.ErrTransactionNotFound) {
+		apiResponse.NewNotFoundErrorResponse(w, "Transaction not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching events of transaction %d, error: %+v", txnID, err)
+		apiResponse.NewInternalServerErrorResponse(w, "", nil)
+		return
+	}
+
+	apiResponse.NewStatusOKResponse(w, "", events)
+}
+
+// RefundTransaction refunds part or all of a deposit of the user making the request.
+//
+// @Summary      Refund a transaction
+// @Description  Creates a REFUND transaction linked to a successful deposit, sent through the deposit's gateway.
+// @Description  A deposit may be refunded several times, up to its amount, an empty amount refunds all that is left.
+// @Description  The deposit is marked PARTIALLY_REFUNDED or REFUNDED as its refunds succeed.
+// @Description  Like payments, requests sent with an `Idempotency-Key` header are processed once, replays return the original response.
+// @Tags         Transactions
+// @Accept       json
+// @Accept       xml
+// @Produce      json
+// @Produce      xml
+// @Param        id               path      int                              true   "ID of the deposit to refund"
+// @Param        Idempotency-Key  header    string                           false  "Unique key making retries of this request safe"
+// @Security     MerchantAPIKey && UserToken
+// @Param        request          body      models.RefundRequest             true   "Refund request payload"
+// @Success      200              {object}  models.SuccessAPIResponse              "Refund processing initialized"
+// @Failure      400              {object}  models.BadRequestAPIResponse           "Invalid request body or amount"
+// @Failure      401              {object}  models.UnauthorizedAPIResponse         "Missing or invalid API key or token"
+// @Failure      404              {object}  models.NotFoundAPIResponse             "Transaction not found"
+// @Failure      409              {object}  models.ConflictAPIResponse             "Transaction can't be refunded, or not for that much, or the user's available balance doesn't cover the refund, or idempotency key reused with a different request"
+// @Failure      500              {object}  models.InternalErrorAPIResponse        "Internal server error"
+// @Failure      502              {object}  models.APIResponse                     "Refund was created but couldn't be sent to the gateway, it is sent again in the background, or by a retry with the same idempotency key"
+// @Router       /api/v1/transactions/{id}/refunds [post]
+func (t *TransactionHandler) RefundTransaction(w http.ResponseWriter, r *http.Request) {
+	// Hash the request before decoding, as decoding consumes the body
+	idempotencyKey := r.Header.Get(services.IdempotencyKeyHeader)
+	requestHash := ""
+	if idempotencyKey != "" {
+		hash, err := services.HashRequest(r)
+		if err != nil {
+			log.Printf("Error hashing req body during %s, error: %+v", r.URL.Path, err)
+			services.NewAPIResponse(services.GetDataFormat(r)).NewBadRequestErrorResponse(w, "Invalid request body")
+			return
+		}
+		requestHash = hash
+	}
+
+	req := models.RefundRequest{}
+	if err := services.DecodeRequest(r, &req); err != nil {
+		log.Printf("Error decoding req body during refund, error: %+v", err)
+		services.NewAPIResponse(services.GetDataFormat(r)).NewBadRequestErrorResponse(w, "Invalid request body")
+		return
+	}
+	apiResponse := services.NewAPIResponse(req.DataFormat)
+
+	merchantID, userID, txnID, ok := requestedTransaction(w, r, apiResponse)
+	if !ok {
+		return
+	}
+
+	if idempotencyKey == "" {
+		resp, _ := t.processRefund(r.Context(), merchantID, userID, txnID, &req, 0)
+		apiResponse.SendResponse(w, resp)
+		return
+	}
+
+	// Keys are scoped like the ones of payments, the path is part of the hash, so a key can't be reused for another deposit
+	scopedKey := strconv.Itoa(merchantID) + ":" + strconv.Itoa(userID) + ":" + idempotencyKey
+	resp, replayed, err := t.idempotencyService.Execute(r.Context(), scopedKey, requestHash, &models.Transaction{}, func(resumeID int) (*models.APIResponse, int) {
+		return t.processRefund(r.Context(), merchantID, userID, txnID, &req, resumeID)
+	})
+	if errors.Is(err, services.ErrIdempotencyKeyReused) {
+		apiResponse.NewConflictErrorResponse(w, "Idempotency key was already used with a different request")
+		return
+	}
+	if err != nil {
+		log.Printf("Error while refunding transaction %d with idempotency key %s, error: %+v", txnID, idempotencyKey, err)
+		apiResponse.NewInternalServerErrorResponse(w, "", nil)
+		return
+	}
+
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	apiResponse.SendResponse(w, resp)
+}
+
+// processRefund refunds the deposit txnID, or resumes the refund resumeID an earlier attempt of the request created,
+// and builds the response without writing it. The ID of the refund is returned along with it, 0 if none was created
+func (t *TransactionHandler) processRefund(ctx context.Context, merchantID, userID, txnID int, req *models.RefundRequest, resumeID int) (*models.APIResponse, int) {
+	apiResponse := services.NewAPIResponse(req.DataFormat)
+
+	var refund *models.Transaction
+	var err error
+	if resumeID != 0 {
+		refund, err = t.txService.ResumeTransaction(ctx, merchantID, userID, resumeID)
+	} else {
+		refund, err = t.txService.RefundTransaction(ctx, merchantID, userID, txnID, req)
+	}
+	refundID := 0
+	if refund != nil {
+		refundID = refund.ID
+	}
+
+	switch {
+	case errors.Is(err, models.ErrTransactionNotFound):
+		return apiResponse.BuildResponse(http.StatusNotFound, "Transaction not found", nil), refundID
+	case errors.Is(err, models.ErrInvalidAmount):
+		return apiResponse.BuildResponse(http.StatusBadRequest, "Invalid refund amount", nil), refundID
+	case errors.Is(err, models.ErrNotRefundable):
+		log.Printf("Rejected refund of transaction %d, error: %+v", txnID, err)
+		return apiResponse.BuildResponse(http.StatusConflict, "Only successful deposits can be refunded", nil), refundID
+	case errors.Is(err, models.ErrRefundExceedsAmount):
+		log.Printf("Rejected refund of transaction %d, error: %+v", txnID, err)
+		return apiResponse.BuildResponse(http.StatusConflict, "Refund exceeds the amount left to refund", nil), refundID
+	case errors.Is(err, models.ErrInsufficientFunds):
+		log.Printf("Rejected refund of transaction %d, error: %+v", txnID, err)
+		return apiResponse.BuildResponse(http.StatusConflict, "Insufficient funds to refund", nil), refundID
+	case errors.Is(err, models.ErrGatewayDispatch):
+		// The refund exists, a retry without the idempotency key would create another one
+		log.Printf("Error sending refund of transaction %d to its gateway, error: %+v", txnID, err)
+		return apiResponse.BuildResponse(http.StatusBadGateway, "Gateway is unavailable, the refund will be sent again", refund), refundID
+	case err != nil:
+		log.Printf("Error refunding transaction %d, req: %+v, error: %+v", txnID, *req, err)
+		return apiResponse.BuildResponse(http.StatusInternalServerError, "Internal Server Error", nil), refundID
+	default:
+		return apiResponse.BuildResponse(http.StatusOK, string(models.REFUND)+" processing initialized", refund), refundID
+	}
+}
+
+// requestedTransaction returns the merchant and user making the request and the transaction in the path,
+// if any is missing, the error response is written and ok is false
+func requestedTransaction(w http.ResponseWriter, r *http.Request, apiResponse *services.APIResponseSvcImpl) (merchantID, userID, txnID int, ok bool) {
+	merchantID, ok = requestMerchant(w, r, apiResponse)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	userID, ok = middleware.UserIDFromContext(r.Context())
+	if !ok {
+		apiResponse.NewUnauthorizedErrorResponse(w, "Missing token")
+		return 0, 0, 0, false
+	}
+
+	txnID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		apiResponse.NewBadRequestErrorResponse(w, "Invalid transaction ID")
+		return 0, 0, 0, false
+	}
+	return merchantID, userID, txnID, true
+}
+
+// requestMerchant returns the merchant making the request, if there is none, the error response is written and ok is false.
+// Routes of merchants are wrapped by middleware.MerchantMiddleware, so it is only missing from a misconfigured route
+func requestMerchant(w http.ResponseWriter, r *http.Request, apiResponse *services.APIResponseSvcImpl) (int, bool) {
+	merchantID, ok := middleware.MerchantIDFromContext(r.Context())
+	if !ok {
+		apiResponse.NewUnauthorizedErrorResponse(w, "Missing API key")
+		return 0, false
+	}
+	return merchantID, true
+}
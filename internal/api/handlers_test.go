@@ -0,0 +1,286 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"payment-gateway/internal/connectors"
+	"payment-gateway/internal/middleware"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/repository"
+	"payment-gateway/internal/services"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// stubTransactionService fails StartTransactionProcessing, ResumeTransaction and StartWebhookProcessing with the next of errs,
+// and succeeds once they run out. Like the service, a transaction failing at the gateway was created, and is returned with the error
+type stubTransactionService struct {
+	services.TransactionService
+	errs    []error
+	calls   int
+	created []*models.Transaction
+	resumed []int
+}
+
+func (s *stubTransactionService) nextErr() error {
+	if len(s.errs) == 0 {
+		return nil
+	}
+	err := s.errs[0]
+	s.errs = s.errs[1:]
+	return err
+}
+
+func (s *stubTransactionService) ParseWebhook(ctx context.Context, gateway *models.Gateway, body []byte, contentType string) (*models.TransactionWebhookResponse, error) {
+	return &models.TransactionWebhookResponse{TxnID: 1, GatewayID: gateway.ID, MerchantID: gateway.MerchantID, Status: models.SUCCESS, DataFormat: models.JSON}, nil
+}
+
+func (s *stubTransactionService) StartWebhookProcessing(ctx context.Context, request *models.TransactionWebhookResponse) (*models.Transaction, error) {
+	return s.StartTransactionProcessing(ctx, nil)
+}
+
+func (s *stubTransactionService) StartTransactionProcessing(ctx context.Context, request *models.TransactionRequest) (*models.Transaction, error) {
+	return s.create()
+}
+
+func (s *stubTransactionService) RefundTransaction(ctx context.Context, merchantID, userID, txnID int, request *models.RefundRequest) (*models.Transaction, error) {
+	return s.create()
+}
+
+func (s *stubTransactionService) create() (*models.Transaction, error) {
+	s.calls++
+	err := s.nextErr()
+	if err != nil && !errors.Is(err, models.ErrGatewayDispatch) {
+		return nil, err
+	}
+
+	txn := &models.Transaction{ID: len(s.created) + 1, Amount: models.NewMoney(1050, "USD"), Currency: "USD", Status: models.INIT}
+	s.created = append(s.created, txn)
+	if err != nil {
+		return txn, err
+	}
+	txn.Status = models.PENDING
+	return txn, nil
+}
+
+func (s *stubTransactionService) ResumeTransaction(ctx context.Context, merchantID, userID, txnID int) (*models.Transaction, error) {
+	s.resumed = append(s.resumed, txnID)
+	txn := s.created[txnID-1]
+	if err := s.nextErr(); err != nil {
+		return txn, err
+	}
+	txn.Status = models.PENDING
+	return txn, nil
+}
+
+// memoryIdempotencyRepository keeps records in a map, without expiry
+type memoryIdempotencyRepository struct {
+	records map[string]*models.IdempotencyRecord
+}
+
+func (m *memoryIdempotencyRepository) WithLock(ctx context.Context, key string, fn func(existing *models.IdempotencyRecord) (*models.IdempotencyRecord, error)) error {
+	record, err := fn(m.records[key])
+	if err == nil && record != nil {
+		m.records[key] = record
+	}
+	return err
+}
+
+// stubGatewayRepository only knows the gateway "stripe" of merchant 2
+type stubGatewayRepository struct {
+	repository.GatewayRepository
+}
+
+func (s *stubGatewayRepository) GetGatewayByName(merchantID int, name string) (*models.Gateway, error) {
+	if merchantID != 2 || name != "stripe" {
+		return nil, models.ErrGatewayNotFound
+	}
+	return &models.Gateway{ID: 1, MerchantID: 2, Name: "stripe", WebhookSecret: "whsec"}, nil
+}
+
+// memorySignatureRepository remembers signatures in a set
+type memorySignatureRepository struct {
+	signatures map[string]bool
+}
+
+func (m *memorySignatureRepository) MarkUsed(ctx context.Context, gatewayID int, signature string, receivedAt time.Time) (bool, error) {
+	if m.signatures[signature] {
+		return false, nil
+	}
+	m.signatures[signature] = true
+	return true, nil
+}
+
+func (m *memorySignatureRepository) Release(ctx context.Context, gatewayID int, signature string) error {
+	delete(m.signatures, signature)
+	return nil
+}
+
+func (m *memorySignatureRepository) DeleteBefore(ctx context.Context, before time.Time) (int64, error) {
+	return 0, nil
+}
+
+func sendPayment(handler *TransactionHandler, idempotencyKey string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/v1/payments/deposit", strings.NewReader(`{"amount": 10.5, "currency": "USD", "country_id": 1}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(services.IdempotencyKeyHeader, idempotencyKey)
+	r = mux.SetURLVars(r, map[string]string{"operation": "deposit"})
+	r = r.WithContext(middleware.WithUserID(middleware.WithMerchantID(r.Context(), 2), 3))
+
+	w := httptest.NewRecorder()
+	handler.PaymentHandler(w, r)
+	return w
+}
+
+func TestPaymentHandler_RetriesFailuresWithSameKey(t *testing.T) {
+	txService := &stubTransactionService{errs: []error{errors.New("failed to create transaction, err: connection refused")}}
+	idempotency := services.NewIdempotencyService(&memoryIdempotencyRepository{records: map[string]*models.IdempotencyRecord{}}, "")
+	handler := NewTransactionHandler(txService, idempotency, nil)
+
+	w := sendPayment(handler, "key-1")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	// No transaction was created and the failure wasn't stored, so the retry is processed again rather than replayed
+	w = sendPayment(handler, "key-1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, 2, txService.calls)
+	assert.Len(t, txService.created, 1)
+}
+
+func TestPaymentHandler_ResumesTransactionFailedAtGateway(t *testing.T) {
+	dispatchErr := fmt.Errorf("%w: failed to send deposit 1 to gateway stripe, err: %w", models.ErrGatewayDispatch, errors.New("circuit breaker is open"))
+	txService := &stubTransactionService{errs: []error{dispatchErr, dispatchErr}}
+	idempotency := services.NewIdempotencyService(&memoryIdempotencyRepository{records: map[string]*models.IdempotencyRecord{}}, "")
+	handler := NewTransactionHandler(txService, idempotency, nil)
+
+	w := sendPayment(handler, "key-1")
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+
+	// The transaction was created before the gateway failed, retries send that transaction again rather than creating another one
+	w = sendPayment(handler, "key-1")
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	w = sendPayment(handler, "key-1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+
+	assert.Equal(t, 1, txService.calls)
+	assert.Len(t, txService.created, 1)
+	assert.Equal(t, []int{1, 1}, txService.resumed)
+
+	// Once sent, the response is replayed
+	w = sendPayment(handler, "key-1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	assert.Len(t, txService.resumed, 2)
+}
+
+func TestPaymentHandler_StoresRejections(t *testing.T) {
+	txService := &stubTransactionService{errs: []error{fmt.Errorf("%w: withdrawal of 10.5 USD", models.ErrInsufficientFunds)}}
+	idempotency := services.NewIdempotencyService(&memoryIdempotencyRepository{records: map[string]*models.IdempotencyRecord{}}, "")
+	handler := NewTransactionHandler(txService, idempotency, nil)
+
+	w := sendPayment(handler, "key-1")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// A rejection of the request is final, it is replayed
+	w = sendPayment(handler, "key-1")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, 1, txService.calls)
+}
+
+func TestHandleWebhook_AcceptsRedeliveryOfFailedWebhook(t *testing.T) {
+	txService := &stubTransactionService{errs: []error{&models.ConcurrentModificationError{TxnID: 1, Version: 2, Current: 3}}}
+	verifier := services.NewWebhookVerifier(&stubGatewayRepository{}, &memorySignatureRepository{signatures: map[string]bool{}}, "")
+	handler := NewTransactionHandler(txService, nil, verifier)
+
+	body := []byte(`{"txn_id": 1, "status": "SUCCESS"}`)
+	signature := connectors.SignWebhook("whsec", time.Now(), body)
+	send := func() int {
+		r := httptest.NewRequest("POST", "/api/v1/webhooks/2/stripe", bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(connectors.WebhookSignatureHeader, signature)
+		r = mux.SetURLVars(r, map[string]string{"merchant": "2", "gateway": "stripe"})
+		w := httptest.NewRecorder()
+		handler.HandleWebhook(w, r)
+		return w.Code
+	}
+
+	// Processing fails, so the gateway redelivers the same signed webhook, which is applied
+	assert.Equal(t, http.StatusConflict, send())
+	assert.Equal(t, http.StatusOK, send())
+	assert.Equal(t, 2, txService.calls)
+
+	// Once applied, the same webhook is a replay
+	assert.Equal(t, http.StatusUnauthorized, send())
+	assert.Equal(t, 2, txService.calls)
+}
+
+func TestRefundTransaction_ResumesRefundFailedAtGateway(t *testing.T) {
+	dispatchErr := fmt.Errorf("%w: failed to send refund 1 to gateway stripe, err: %w", models.ErrGatewayDispatch, errors.New("circuit breaker is open"))
+	txService := &stubTransactionService{errs: []error{dispatchErr}}
+	idempotency := services.NewIdempotencyService(&memoryIdempotencyRepository{records: map[string]*models.IdempotencyRecord{}}, "")
+	handler := NewTransactionHandler(txService, idempotency, nil)
+
+	send := func(idempotencyKey, amount string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/v1/transactions/7/refunds", strings.NewReader(`{"amount": "`+amount+`"}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(services.IdempotencyKeyHeader, idempotencyKey)
+		r = mux.SetURLVars(r, map[string]string{"id": "7"})
+		r = r.WithContext(middleware.WithUserID(middleware.WithMerchantID(r.Context(), 2), 3))
+		w := httptest.NewRecorder()
+		handler.RefundTransaction(w, r)
+		return w
+	}
+
+	w := send("key-1", "5")
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+
+	// The refund was created before the gateway failed, the retry sends it again rather than creating another refund
+	w = send("key-1", "5")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, txService.created, 1)
+	assert.Equal(t, []int{1}, txService.resumed)
+
+	w = send("key-1", "5")
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	w = send("key-1", "6")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Len(t, txService.created, 1)
+}
+
+func TestHandleWebhook_StatusCodes(t *testing.T) {
+	body := []byte(`{"txn_id": 1, "status": "SUCCESS"}`)
+	for name, c := range map[string]struct {
+		err      error
+		expected int
+	}{
+		"not found":          {models.ErrTransactionNotFound, http.StatusBadRequest},
+		"other gateway":      {fmt.Errorf("%w: webhook from gateway 1 for transaction 1 which belongs to gateway 2", models.ErrGatewayMismatch), http.StatusBadRequest},
+		"invalid transition": {&models.InvalidTransitionError{TxnID: 1, From: models.FAILED, To: models.SUCCESS}, http.StatusConflict},
+		// Gateways only redeliver webhooks answered with a 5xx
+		"db down": {errors.New("failed to update transaction status: connection refused"), http.StatusInternalServerError},
+	} {
+		txService := &stubTransactionService{errs: []error{c.err}}
+		verifier := services.NewWebhookVerifier(&stubGatewayRepository{}, &memorySignatureRepository{signatures: map[string]bool{}}, "")
+		handler := NewTransactionHandler(txService, nil, verifier)
+
+		r := httptest.NewRequest("POST", "/api/v1/webhooks/2/stripe", bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(connectors.WebhookSignatureHeader, connectors.SignWebhook("whsec", time.Now(), body))
+		r = mux.SetURLVars(r, map[string]string{"merchant": "2", "gateway": "stripe"})
+		w := httptest.NewRecorder()
+		handler.HandleWebhook(w, r)
+
+		assert.Equal(t, c.expected, w.Code, name)
+	}
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"database/sql"
+	"expvar"
 	"net/http"
 	"payment-gateway/internal/middleware"
 	"payment-gateway/internal/repository"
@@ -19,31 +20,77 @@ func SetupRouter(
 	txnRepo repository.TransactionRepository,
 	gatewayRepo repository.GatewayRepository,
 	txnService services.TransactionService,
+	idempotencyService services.IdempotencyService,
+	webhookVerifier services.WebhookVerifier,
+	gatewayHealth services.GatewayHealth,
+	balanceService services.BalanceService,
+	merchantService services.MerchantService,
+	authenticator *middleware.JWTAuthenticator,
+	adminAPIKey string,
 ) *mux.Router {
 	router := mux.NewRouter()
 	router.Use(middleware.LoggingMiddleware)
 
 	// repos which may or may not be shared across routes or route groups
 
+	// Routes of merchants are authenticated with the merchant's API key, and those of users with the user's token as well
+	merchantAuth := middleware.MerchantMiddleware(merchantService)
+
 	// v1 routes
 	v1 := router.PathPrefix("/api/v1").Subrouter()
 	{
-		// Txn Routes like deposit, withdrawal
+		// Txn Routes like deposit, withdrawal, for the user of the request's token, at the merchant of the API key
 		{
 			// Dependencies for txn routes
-			txnHandler := NewTransactionHandler(txnService)
+			txnHandler := NewTransactionHandler(txnService, idempotencyService, webhookVerifier)
 
 			// Payment Route Group
 			paymentRoutes := v1.PathPrefix("/payments/{operation}")
-			paymentRoutes.Handler(http.HandlerFunc(txnHandler.PaymentHandler)).Methods("POST")
+			paymentRoutes.Handler(merchantAuth(authenticator.Middleware(http.HandlerFunc(txnHandler.PaymentHandler)))).Methods("POST")
+		}
+
+		// Transaction reads and refunds, which are scoped to the user making the request,
+		// and searches, which are scoped to the merchant
+		{
+			txnHandler := NewTransactionHandler(txnService, idempotencyService, webhookVerifier)
+
+			v1.Handle("/transactions", merchantAuth(http.HandlerFunc(txnHandler.SearchTransactions))).Methods("GET")
+
+			transactionRoutes := v1.PathPrefix("/transactions/{id}").Subrouter()
+			transactionRoutes.Use(merchantAuth, authenticator.Middleware)
+			transactionRoutes.Handle("", http.HandlerFunc(txnHandler.GetTransaction)).Methods("GET")
+			transactionRoutes.Handle("/events", http.HandlerFunc(txnHandler.GetTransactionEvents)).Methods("GET")
+			transactionRoutes.Handle("/refunds", http.HandlerFunc(txnHandler.RefundTransaction)).Methods("POST")
+		}
+
+		// Balances, users can only read their own
+		{
+			balanceHandler := NewBalanceHandler(balanceService)
+
+			userRoutes := v1.PathPrefix("/users/{id}").Subrouter()
+			userRoutes.Use(merchantAuth, authenticator.Middleware)
+			userRoutes.Handle("/balances", http.HandlerFunc(balanceHandler.GetUserBalances)).Methods("GET")
+		}
+
+		// Webhooks, authenticated by their signature, the gateway is one of the merchant in the path.
+		// Webhooks without a merchant are of the gateways of the default merchant
+		{
+			txnHandler := NewTransactionHandler(txnService, idempotencyService, webhookVerifier)
+
+			v1.Handle("/webhooks/{merchant:[0-9]+}/{gateway}", http.HandlerFunc(txnHandler.HandleWebhook)).Methods("POST")
+			v1.Handle("/webhooks/{gateway}", http.HandlerFunc(txnHandler.HandleWebhook)).Methods("POST")
 		}
 
-		// Webhooks
+		// Admin, the breakers are of the gateways of every merchant, and expvar also exposes the command line
+		// and memory stats of the process, so only the admin key may read them
 		{
-			txnHandler := NewTransactionHandler(txnService)
+			adminHandler := NewAdminHandler(gatewayHealth)
 
-			webhookRoutes := v1.PathPrefix("/webhooks")
-			webhookRoutes.Handler(http.HandlerFunc(txnHandler.HandleWebhook)).Methods("POST")
+			adminRoutes := v1.PathPrefix("/admin").Subrouter()
+			adminRoutes.Use(middleware.AdminMiddleware(adminAPIKey))
+			adminRoutes.Handle("/gateways/breakers", http.HandlerFunc(adminHandler.GatewayBreakers)).Methods("GET")
+			// expvar metrics, e.g. stale_status_updates
+			adminRoutes.Handle("/metrics", expvar.Handler()).Methods("GET")
 		}
 
 		// Swagger
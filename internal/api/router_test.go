@@ -0,0 +1,29 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"payment-gateway/internal/services"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetupRouter_AdminRoutesNeedAdminKey(t *testing.T) {
+	router := SetupRouter(nil, nil, nil, nil, nil, nil, services.NewGatewayHealth(), nil, nil, nil, "admin-key")
+
+	for _, path := range []string{"/api/v1/admin/metrics", "/api/v1/admin/gateways/breakers"} {
+		for header, expected := range map[string]int{
+			"":                 http.StatusUnauthorized,
+			"Bearer mk_valid":  http.StatusUnauthorized,
+			"Bearer admin-key": http.StatusOK,
+		} {
+			r := httptest.NewRequest("GET", path, nil)
+			r.Header.Set("Authorization", header)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, expected, w.Code, "%s with %q", path, header)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package connectors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"payment-gateway/internal/models"
+	"strings"
+	"sync"
+)
+
+// ErrConnectorNotFound is returned when no connector is registered for a gateway
+var ErrConnectorNotFound = errors.New("gateway connector not found")
+
+// GatewayConnector sends transactions to a payment gateway and understands the webhooks it sends back
+type GatewayConnector interface {
+	// InitiatePayment asks the gateway to collect a deposit
+	InitiatePayment(ctx context.Context, txn *models.Transaction) (*models.GatewayResponse, error)
+	// InitiatePayout asks the gateway to pay out a withdrawal
+	InitiatePayout(ctx context.Context, txn *models.Transaction) (*models.GatewayResponse, error)
+	// InitiateRefund asks the gateway to refund part or all of the deposit `txn.ParentID`
+	InitiateRefund(ctx context.Context, txn *models.Transaction) (*models.GatewayResponse, error)
+	// QueryStatus fetches the status of a transaction previously sent to the gateway
+	QueryStatus(ctx context.Context, txn *models.Transaction) (*models.GatewayResponse, error)
+	// ParseWebhook decodes a webhook body sent by the gateway
+	ParseWebhook(body []byte, contentType string) (*models.TransactionWebhookResponse, error)
+}
+
+// Registry holds connectors by `models.Gateway.Name`
+type Registry struct {
+	mu         sync.RWMutex
+	connectors map[string]GatewayConnector
+	fallback   func(gatewayName string) GatewayConnector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{connectors: map[string]GatewayConnector{}}
+}
+
+// Register sets the connector of a gateway, names are case insensitive
+func (r *Registry) Register(gatewayName string, connector GatewayConnector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.connectors[strings.ToLower(gatewayName)] = connector
+}
+
+// SetFallback sets a factory used for gateways without a registered connector,
+// e.g. to send every gateway's traffic to the simulator when running locally
+func (r *Registry) SetFallback(fallback func(gatewayName string) GatewayConnector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.fallback = fallback
+}
+
+// Get returns the connector of a gateway
+func (r *Registry) Get(gatewayName string) (GatewayConnector, error) {
+	name := strings.ToLower(gatewayName)
+
+	r.mu.RLock()
+	connector, ok := r.connectors[name]
+	fallback := r.fallback
+	r.mu.RUnlock()
+
+	if ok {
+		return connector, nil
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("%w for %s", ErrConnectorNotFound, gatewayName)
+	}
+
+	// Keep the connector built by the fallback, so every gateway has a single connector
+	connector = fallback(gatewayName)
+	r.Register(gatewayName, connector)
+	return connector, nil
+}
@@ -0,0 +1,101 @@
+package connectors
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"payment-gateway/internal/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	simulator := NewSimulatorConnector("http://simulator", "http://app/webhooks", "stripe")
+	registry.Register("Stripe", simulator)
+
+	connector, err := registry.Get("stripe")
+	assert.NoError(t, err)
+	assert.Same(t, simulator, connector)
+
+	_, err = registry.Get("paypal")
+	assert.True(t, errors.Is(err, ErrConnectorNotFound))
+
+	registry.SetFallback(func(gatewayName string) GatewayConnector {
+		return NewSimulatorConnector("http://simulator", "http://app/webhooks", gatewayName)
+	})
+	connector, err = registry.Get("paypal")
+	assert.NoError(t, err)
+	again, _ := registry.Get("paypal")
+	assert.Same(t, connector, again)
+}
+
+func TestSimulatorConnector(t *testing.T) {
+	updatedAt := time.Date(2024, 12, 18, 11, 58, 52, 0, time.UTC)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/payouts":
+			req := SimulatorRequest{}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			assert.Equal(t, SimulatorRequest{TxnID: 7, Type: "WITHDRAWAL", Amount: "1.005", Currency: "KWD", CallbackURL: "http://app/webhooks/2/sim%20pay"}, req)
+
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(SimulatorTransaction{TxnID: 7, Reference: "sim_7", Status: models.PENDING, UpdatedAt: updatedAt})
+		case r.Method == http.MethodPost && r.URL.Path == "/refunds":
+			req := SimulatorRequest{}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			assert.Equal(t, 3, *req.ParentTxnID)
+			assert.Equal(t, "REFUND", req.Type)
+
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(SimulatorTransaction{TxnID: 8, Reference: "sim_8", Status: models.PENDING, UpdatedAt: updatedAt})
+		case r.Method == http.MethodGet && r.URL.Path == "/transactions/7":
+			json.NewEncoder(w).Encode(SimulatorTransaction{TxnID: 7, Reference: "sim_7", Status: models.SUCCESS, UpdatedAt: updatedAt})
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	connector := NewSimulatorConnector(server.URL, "http://app/webhooks", "sim pay")
+	txn := &models.Transaction{ID: 7, MerchantID: 2, Type: "WITHDRAWAL", Amount: models.NewMoney(1005, "KWD"), Currency: "KWD"}
+
+	resp, err := connector.InitiatePayout(context.Background(), txn)
+	assert.NoError(t, err)
+	assert.Equal(t, &models.GatewayResponse{Reference: "sim_7", Status: models.PENDING, UpdatedAt: updatedAt}, resp)
+
+	resp, err = connector.QueryStatus(context.Background(), txn)
+	assert.NoError(t, err)
+	assert.Equal(t, models.SUCCESS, resp.Status)
+
+	_, err = connector.InitiatePayment(context.Background(), txn)
+	assert.Error(t, err)
+
+	parentID := 3
+	resp, err = connector.InitiateRefund(context.Background(), &models.Transaction{ID: 8, Type: "REFUND", Amount: models.NewMoney(500, "KWD"), Currency: "KWD", ParentID: &parentID})
+	assert.NoError(t, err)
+	assert.Equal(t, "sim_8", resp.Reference)
+}
+
+func TestSimulatorConnector_ParseWebhook(t *testing.T) {
+	connector := NewSimulatorConnector("http://simulator", "http://app/webhooks", "sim")
+
+	webhook, err := connector.ParseWebhook([]byte(`{"txn_id": 35, "status": "SUCCESS", "updated_at": "2024-12-18T11:58:52.283721968Z"}`), "application/json")
+	assert.NoError(t, err)
+	assert.Equal(t, 35, webhook.TxnID)
+	assert.Equal(t, models.SUCCESS, webhook.Status)
+	assert.Equal(t, models.JSON, webhook.DataFormat)
+
+	webhook, err = connector.ParseWebhook([]byte(`<webhook><txn_id>35</txn_id><status>FAILED</status></webhook>`), "application/xml")
+	assert.NoError(t, err)
+	assert.Equal(t, models.FAILED, webhook.Status)
+	assert.Equal(t, models.XML, webhook.DataFormat)
+
+	_, err = connector.ParseWebhook([]byte(`{`), "application/json")
+	assert.Error(t, err)
+}
@@ -0,0 +1,74 @@
+package connectors
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebhookSignatureHeader carries the signature of a webhook, formatted as `t=<unix seconds>,v1=<hex hmac>`.
+//
+//	The HMAC-SHA256 is computed with the gateway's webhook secret over `<t>.<raw body>`,
+//	several v1 entries may be sent while a secret is being rotated
+const WebhookSignatureHeader = "X-Webhook-Signature"
+
+var errMalformedSignature = errors.New("malformed webhook signature header")
+
+// SignWebhook returns the signature header value of a webhook body sent at timestamp
+func SignWebhook(secret string, timestamp time.Time, body []byte) string {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + ts + ",v1=" + computeSignature(secret, ts, body)
+}
+
+// ParseWebhookSignature splits a signature header into its timestamp and signatures
+func ParseWebhookSignature(header string) (time.Time, []string, error) {
+	var timestamp time.Time
+	var signatures []string
+
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return time.Time{}, nil, errMalformedSignature
+		}
+
+		switch key {
+		case "t":
+			unix, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return time.Time{}, nil, fmt.Errorf("%w: invalid timestamp %q", errMalformedSignature, value)
+			}
+			timestamp = time.Unix(unix, 0)
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+
+	if timestamp.IsZero() || len(signatures) == 0 {
+		return time.Time{}, nil, errMalformedSignature
+	}
+	return timestamp, signatures, nil
+}
+
+// VerifyWebhookSignature returns the signature out of signatures which matches the body, in constant time
+func VerifyWebhookSignature(secret string, timestamp time.Time, signatures []string, body []byte) (string, bool) {
+	expected := computeSignature(secret, strconv.FormatInt(timestamp.Unix(), 10), body)
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			return signature, true
+		}
+	}
+	return "", false
+}
+
+func computeSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,43 @@
+package connectors
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	body := []byte(`{"txn_id":1,"status":"SUCCESS"}`)
+	signedAt := time.Unix(1700000000, 0)
+
+	header := SignWebhook("secret", signedAt, body)
+
+	timestamp, signatures, err := ParseWebhookSignature(header)
+	assert.NoError(t, err)
+	assert.True(t, timestamp.Equal(signedAt))
+	assert.Len(t, signatures, 1)
+
+	signature, ok := VerifyWebhookSignature("secret", timestamp, signatures, body)
+	assert.True(t, ok)
+	assert.Equal(t, signatures[0], signature)
+
+	// Wrong secret, tampered body and tampered timestamp all fail
+	_, ok = VerifyWebhookSignature("other", timestamp, signatures, body)
+	assert.False(t, ok)
+	_, ok = VerifyWebhookSignature("secret", timestamp, signatures, []byte(`{"txn_id":1,"status":"FAILED"}`))
+	assert.False(t, ok)
+	_, ok = VerifyWebhookSignature("secret", timestamp.Add(time.Second), signatures, body)
+	assert.False(t, ok)
+
+	// Any of several signatures may match, e.g. while the secret is rotated
+	_, ok = VerifyWebhookSignature("secret", timestamp, []string{"deadbeef", signatures[0]}, body)
+	assert.True(t, ok)
+}
+
+func TestParseWebhookSignature_Malformed(t *testing.T) {
+	for _, header := range []string{"", "t=1", "v1=abc", "t=abc,v1=abc", "garbage"} {
+		_, _, err := ParseWebhookSignature(header)
+		assert.Error(t, err, header)
+	}
+}
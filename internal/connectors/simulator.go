@@ -0,0 +1,143 @@
+package connectors
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"payment-gateway/internal/models"
+	"time"
+)
+
+// SimulatorRequest is sent to the simulator to initiate a payment, a payout or a refund
+type SimulatorRequest struct {
+	TxnID       int    `json:"txn_id"`
+	Type        string `json:"type"`
+	Amount      string `json:"amount"`
+	Currency    string `json:"currency"`
+	CallbackURL string `json:"callback_url"`
+	// ParentTxnID is the deposit being refunded
+	ParentTxnID *int `json:"parent_txn_id,omitempty"`
+}
+
+// SimulatorTransaction is the simulator's view of a transaction, returned by all of its endpoints
+type SimulatorTransaction struct {
+	TxnID     int                      `json:"txn_id"`
+	Reference string                   `json:"reference"`
+	Status    models.TransactionStatus `json:"status"`
+	UpdatedAt time.Time                `json:"updated_at"`
+}
+
+// SimulatorConnector talks to the gateway simulator in `cmd/simulator`,
+// which accepts transactions and later calls the webhook back with their outcome
+type SimulatorConnector struct {
+	baseURL        string
+	webhookBaseURL string
+	gatewayName    string
+	client         *http.Client
+}
+
+// NewSimulatorConnector creates a connector for the simulator at baseURL, standing in for the gateways named gatewayName.
+// The simulator will send webhooks to the route of the transaction's merchant and gateway under webhookBaseURL
+func NewSimulatorConnector(baseURL, webhookBaseURL, gatewayName string) *SimulatorConnector {
+	return &SimulatorConnector{
+		baseURL:        baseURL,
+		webhookBaseURL: webhookBaseURL,
+		gatewayName:    gatewayName,
+		client:         &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (s *SimulatorConnector) InitiatePayment(ctx context.Context, txn *models.Transaction) (*models.GatewayResponse, error) {
+	return s.initiate(ctx, "/payments", txn)
+}
+
+func (s *SimulatorConnector) InitiatePayout(ctx context.Context, txn *models.Transaction) (*models.GatewayResponse, error) {
+	return s.initiate(ctx, "/payouts", txn)
+}
+
+func (s *SimulatorConnector) InitiateRefund(ctx context.Context, txn *models.Transaction) (*models.GatewayResponse, error) {
+	return s.initiate(ctx, "/refunds", txn)
+}
+
+func (s *SimulatorConnector) QueryStatus(ctx context.Context, txn *models.Transaction) (*models.GatewayResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/transactions/%d", s.baseURL, txn.ID), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build simulator request: %v", err)
+	}
+	return s.do(req)
+}
+
+func (s *SimulatorConnector) ParseWebhook(body []byte, contentType string) (*models.TransactionWebhookResponse, error) {
+	webhook := &models.TransactionWebhookResponse{DataFormat: models.JSON}
+
+	var err error
+	switch models.DataFormat(contentType) {
+	case models.XML:
+		webhook.DataFormat = models.XML
+		err = xml.Unmarshal(body, webhook)
+	default:
+		err = json.Unmarshal(body, webhook)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode simulator webhook: %v", err)
+	}
+	return webhook, nil
+}
+
+func (s *SimulatorConnector) initiate(ctx context.Context, path string, txn *models.Transaction) (*models.GatewayResponse, error) {
+	body, err := json.Marshal(SimulatorRequest{
+		TxnID:       txn.ID,
+		Type:        txn.Type,
+		Amount:      txn.Amount.String(),
+		Currency:    txn.Currency,
+		CallbackURL: s.callbackURL(txn),
+		ParentTxnID: txn.ParentID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode simulator request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build simulator request: %v", err)
+	}
+	req.Header.Set("Content-Type", string(models.JSON))
+	return s.do(req)
+}
+
+// callbackURL is the webhook route of txn, gateways of different merchants may share a name, so the merchant is part of it
+func (s *SimulatorConnector) callbackURL(txn *models.Transaction) string {
+	return fmt.Sprintf("%s/%d/%s", s.webhookBaseURL, txn.MerchantID, url.PathEscape(s.gatewayName))
+}
+
+func (s *SimulatorConnector) do(req *http.Request) (*models.GatewayResponse, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call simulator: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read simulator response: %v", err)
+	}
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return nil, fmt.Errorf("simulator responded with %d: %s", resp.StatusCode, string(body))
+	}
+
+	simulated := SimulatorTransaction{}
+	if err := json.Unmarshal(body, &simulated); err != nil {
+		return nil, fmt.Errorf("failed to decode simulator response: %v", err)
+	}
+
+	return &models.GatewayResponse{
+		Reference: simulated.Reference,
+		Status:    simulated.Status,
+		UpdatedAt: simulated.UpdatedAt,
+	}, nil
+}
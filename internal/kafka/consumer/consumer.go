@@ -14,18 +14,29 @@ type KafkaConsumer interface {
 	ReadMessage(ctx context.Context) (kafkaGo.Message, error)
 	CommitMessages(ctx context.Context, msgs ...kafkaGo.Message) error
 	GetBatchSize() int
+	// GetConcurrency is the number of workers processing messages in parallel
+	GetConcurrency() int
+	// GetMaxLinger is how long a batch waits for more messages before it is processed anyway
+	GetMaxLinger() time.Duration
 	Close() error
 }
 
 type KafkaConsumerImpl struct {
-	reader    *kafkaGo.Reader
-	batchSize int
+	reader      *kafkaGo.Reader
+	batchSize   int
+	concurrency int
+	maxLinger   time.Duration
 }
 
+// defaultMaxLinger is the max linger of a batch when CONSUMER_MAX_LINGER isn't set
+const defaultMaxLinger = time.Second
+
 // Initialize the Kafka consumer
 //
 //	If batchSize is not provided or not a valid number, it will default to 1
-func NewKafkaConsumer(batchSize string) *KafkaConsumerImpl {
+//	If concurrency is not provided or not a valid number, it will default to 1
+//	If maxLinger is not provided or not a valid positive duration, it will default to 1s
+func NewKafkaConsumer(batchSize string, concurrency string, maxLinger string) *KafkaConsumerImpl {
 	kafkaURL := os.Getenv("KAFKA_BROKER_URL")
 	if kafkaURL == "" {
 		kafkaURL = "kafka:9092"
@@ -45,18 +56,36 @@ func NewKafkaConsumer(batchSize string) *KafkaConsumerImpl {
 	if err != nil {
 		batchSizeInt = 1
 	}
-	return &KafkaConsumerImpl{reader: reader, batchSize: batchSizeInt}
+	concurrencyInt, err := strconv.Atoi(concurrency)
+	if err != nil || concurrencyInt < 1 {
+		concurrencyInt = 1
+	}
+	maxLingerDuration, err := time.ParseDuration(maxLinger)
+	if err != nil || maxLingerDuration <= 0 {
+		maxLingerDuration = defaultMaxLinger
+	}
+	return &KafkaConsumerImpl{reader: reader, batchSize: batchSizeInt, concurrency: concurrencyInt, maxLinger: maxLingerDuration}
 }
 
-// Consume listens for messages on the Kafka topic
+// ReadMessage blocks until the next message on the Kafka topic is read, or ctx is done.
+//
+//	The message isn't committed, offsets are only committed through CommitMessages once processed
 func (kc *KafkaConsumerImpl) ReadMessage(ctx context.Context) (kafkaGo.Message, error) {
-	return kc.reader.ReadMessage(ctx)
+	return kc.reader.FetchMessage(ctx)
 }
 
 func (kc *KafkaConsumerImpl) GetBatchSize() int {
 	return kc.batchSize
 }
 
+func (kc *KafkaConsumerImpl) GetConcurrency() int {
+	return kc.concurrency
+}
+
+func (kc *KafkaConsumerImpl) GetMaxLinger() time.Duration {
+	return kc.maxLinger
+}
+
 // CommitMessage commits the message on the particular topic
 func (kc *KafkaConsumerImpl) CommitMessages(ctx context.Context, msgs ...kafkaGo.Message) error {
 	return kc.reader.CommitMessages(ctx, msgs...)
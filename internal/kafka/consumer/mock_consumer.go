@@ -2,6 +2,7 @@ package consumer
 
 import (
 	"context"
+	"time"
 
 	kafkaGo "github.com/segmentio/kafka-go"
 	"github.com/stretchr/testify/mock"
@@ -30,16 +31,38 @@ func (m *MockKafkaReader) Close() error {
 // MockKafkaConsumerImpl is a mock implementation of KafkaConsumerImpl
 type MockKafkaConsumerImpl struct {
 	MockKafkaReader
-	batchSize int
+	batchSize   int
+	concurrency int
+	maxLinger   time.Duration
 }
 
 func NewMockKafkaConsumer(batchSize int) *MockKafkaConsumerImpl {
 	return &MockKafkaConsumerImpl{
 		MockKafkaReader: MockKafkaReader{},
 		batchSize:       batchSize,
+		concurrency:     1,
+		maxLinger:       defaultMaxLinger,
 	}
 }
 
 func (kc *MockKafkaConsumerImpl) GetBatchSize() int {
 	return kc.batchSize
 }
+
+func (kc *MockKafkaConsumerImpl) GetConcurrency() int {
+	return kc.concurrency
+}
+
+// SetConcurrency sets the value returned by GetConcurrency
+func (kc *MockKafkaConsumerImpl) SetConcurrency(concurrency int) {
+	kc.concurrency = concurrency
+}
+
+func (kc *MockKafkaConsumerImpl) GetMaxLinger() time.Duration {
+	return kc.maxLinger
+}
+
+// SetMaxLinger sets the value returned by GetMaxLinger
+func (kc *MockKafkaConsumerImpl) SetMaxLinger(maxLinger time.Duration) {
+	kc.maxLinger = maxLinger
+}
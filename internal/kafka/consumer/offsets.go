@@ -0,0 +1,94 @@
+package consumer
+
+import (
+	"sync"
+
+	kafkaGo "github.com/segmentio/kafka-go"
+)
+
+type topicPartition struct {
+	topic     string
+	partition int
+}
+
+// partitionOffsets are the messages read from a partition which weren't committed yet, in read order
+type partitionOffsets struct {
+	pending []int64
+	done    map[int64]kafkaGo.Message
+}
+
+// OffsetTracker tracks messages processed out of order, so only offsets whose messages,
+// and every message read before them on the same partition, were processed get committed
+type OffsetTracker struct {
+	mu         sync.Mutex
+	partitions map[topicPartition]*partitionOffsets
+}
+
+func NewOffsetTracker() *OffsetTracker {
+	return &OffsetTracker{partitions: map[topicPartition]*partitionOffsets{}}
+}
+
+// Track records a message as read, it must be called in the order messages are read
+func (o *OffsetTracker) Track(msg kafkaGo.Message) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	key := topicPartition{topic: msg.Topic, partition: msg.Partition}
+	offsets, ok := o.partitions[key]
+	if !ok {
+		offsets = &partitionOffsets{done: map[int64]kafkaGo.Message{}}
+		o.partitions[key] = offsets
+	}
+	offsets.pending = append(offsets.pending, msg.Offset)
+}
+
+// Done records messages as processed
+func (o *OffsetTracker) Done(msgs ...kafkaGo.Message) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, msg := range msgs {
+		if offsets, ok := o.partitions[topicPartition{topic: msg.Topic, partition: msg.Partition}]; ok {
+			offsets.done[msg.Offset] = msg
+		}
+	}
+}
+
+// Committable returns, per partition, the last message of the processed prefix of the read messages,
+// and stops tracking that prefix. Committing the returned messages never skips an unprocessed message.
+func (o *OffsetTracker) Committable() []kafkaGo.Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var committable []kafkaGo.Message
+	for _, offsets := range o.partitions {
+		var last *kafkaGo.Message
+		i := 0
+		for ; i < len(offsets.pending); i++ {
+			msg, ok := offsets.done[offsets.pending[i]]
+			if !ok {
+				break
+			}
+			delete(offsets.done, offsets.pending[i])
+			last = &msg
+		}
+		offsets.pending = offsets.pending[i:]
+
+		if last != nil {
+			committable = append(committable, *last)
+		}
+	}
+	return committable
+}
+
+// Pending returns the number of messages read but not committable yet
+func (o *OffsetTracker) Pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	pending := 0
+	for _, offsets := range o.partitions {
+		pending += len(offsets.pending)
+	}
+	return pending
+}
@@ -0,0 +1,48 @@
+package consumer
+
+import (
+	"sort"
+	"testing"
+
+	kafkaGo "github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func message(partition int, offset int64) kafkaGo.Message {
+	return kafkaGo.Message{Topic: "transactions", Partition: partition, Offset: offset}
+}
+
+func TestOffsetTracker_CommitsOnlyContiguousOffsets(t *testing.T) {
+	tracker := NewOffsetTracker()
+	for offset := int64(10); offset < 15; offset++ {
+		tracker.Track(message(0, offset))
+	}
+	tracker.Track(message(1, 3))
+	tracker.Track(message(1, 4))
+
+	// 10 is still in flight, so nothing of partition 0 can be committed
+	tracker.Done(message(0, 11), message(0, 12), message(1, 3))
+	assert.Equal(t, []kafkaGo.Message{message(1, 3)}, tracker.Committable())
+	assert.Equal(t, 6, tracker.Pending())
+
+	tracker.Done(message(0, 10))
+	assert.Equal(t, []kafkaGo.Message{message(0, 12)}, tracker.Committable())
+
+	// Nothing new was processed
+	assert.Empty(t, tracker.Committable())
+
+	tracker.Done(message(0, 14), message(0, 13), message(1, 4))
+	committable := tracker.Committable()
+	sort.Slice(committable, func(i, j int) bool { return committable[i].Partition < committable[j].Partition })
+	assert.Equal(t, []kafkaGo.Message{message(0, 14), message(1, 4)}, committable)
+	assert.Equal(t, 0, tracker.Pending())
+}
+
+func TestOffsetTracker_IgnoresUntrackedMessages(t *testing.T) {
+	tracker := NewOffsetTracker()
+	tracker.Track(message(0, 1))
+
+	tracker.Done(message(2, 1))
+	assert.Empty(t, tracker.Committable())
+	assert.Equal(t, 1, tracker.Pending())
+}
@@ -0,0 +1,98 @@
+package dlq
+
+import (
+	"strconv"
+	"time"
+
+	kafkaGo "github.com/segmentio/kafka-go"
+)
+
+// Topic receives the messages of the transactions topic which couldn't be processed
+const Topic = "transactions.dlq"
+
+// Headers added to a message when it is sent to the dead-letter topic
+const (
+	HeaderError             = "dlq-error"
+	HeaderOriginalTopic     = "dlq-original-topic"
+	HeaderOriginalPartition = "dlq-original-partition"
+	HeaderOriginalOffset    = "dlq-original-offset"
+	HeaderFailedAt          = "dlq-failed-at"
+	// HeaderReplayedFrom is added to a message put back on its original topic, as `<partition>/<offset>` in the dead-letter topic
+	HeaderReplayedFrom = "dlq-replayed-from"
+)
+
+// Info is what the headers of a dead-lettered message say about why it got there
+type Info struct {
+	Error             string
+	OriginalTopic     string
+	OriginalPartition int
+	OriginalOffset    int64
+	FailedAt          time.Time
+}
+
+// NewMessage wraps a message which failed processing for the dead-letter topic, keeping its key, value and headers
+func NewMessage(original kafkaGo.Message, cause error, failedAt time.Time) kafkaGo.Message {
+	headers := make([]kafkaGo.Header, 0, len(original.Headers)+5)
+	headers = append(headers, original.Headers...)
+	headers = append(headers,
+		kafkaGo.Header{Key: HeaderError, Value: []byte(cause.Error())},
+		kafkaGo.Header{Key: HeaderOriginalTopic, Value: []byte(original.Topic)},
+		kafkaGo.Header{Key: HeaderOriginalPartition, Value: []byte(strconv.Itoa(original.Partition))},
+		kafkaGo.Header{Key: HeaderOriginalOffset, Value: []byte(strconv.FormatInt(original.Offset, 10))},
+		kafkaGo.Header{Key: HeaderFailedAt, Value: []byte(failedAt.UTC().Format(time.RFC3339Nano))},
+	)
+
+	return kafkaGo.Message{
+		Topic:   Topic,
+		Key:     original.Key,
+		Value:   original.Value,
+		Headers: headers,
+	}
+}
+
+// ParseInfo reads the dead-letter headers of msg, missing or invalid headers are left empty
+func ParseInfo(msg kafkaGo.Message) Info {
+	info := Info{}
+	for _, header := range msg.Headers {
+		value := string(header.Value)
+		switch header.Key {
+		case HeaderError:
+			info.Error = value
+		case HeaderOriginalTopic:
+			info.OriginalTopic = value
+		case HeaderOriginalPartition:
+			info.OriginalPartition, _ = strconv.Atoi(value)
+		case HeaderOriginalOffset:
+			info.OriginalOffset, _ = strconv.ParseInt(value, 10, 64)
+		case HeaderFailedAt:
+			info.FailedAt, _ = time.Parse(time.RFC3339Nano, value)
+		}
+	}
+	return info
+}
+
+// ReplayMessage turns a dead-lettered message back into a message for its original topic,
+// the dead-letter headers are replaced by HeaderReplayedFrom
+func ReplayMessage(msg kafkaGo.Message) kafkaGo.Message {
+	info := ParseInfo(msg)
+
+	headers := []kafkaGo.Header{}
+	for _, header := range msg.Headers {
+		switch header.Key {
+		case HeaderError, HeaderOriginalTopic, HeaderOriginalPartition, HeaderOriginalOffset, HeaderFailedAt, HeaderReplayedFrom:
+			continue
+		}
+		headers = append(headers, header)
+	}
+	headers = append(headers, kafkaGo.Header{
+		Key:   HeaderReplayedFrom,
+		Value: []byte(strconv.Itoa(msg.Partition) + "/" + strconv.FormatInt(msg.Offset, 10)),
+	})
+
+	return kafkaGo.Message{
+		Topic:   info.OriginalTopic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	}
+}
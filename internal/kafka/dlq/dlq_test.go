@@ -0,0 +1,48 @@
+package dlq
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	kafkaGo "github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMessageAndReplay(t *testing.T) {
+	failedAt := time.Date(2024, 12, 18, 11, 58, 52, 0, time.UTC)
+	original := kafkaGo.Message{
+		Topic:     "transactions",
+		Partition: 2,
+		Offset:    41,
+		Key:       []byte("7"),
+		Value:     []byte("not json"),
+		Headers:   []kafkaGo.Header{{Key: "trace-id", Value: []byte("abc")}},
+	}
+
+	dead := NewMessage(original, errors.New("invalid character"), failedAt)
+
+	assert.Equal(t, Topic, dead.Topic)
+	assert.Equal(t, original.Key, dead.Key)
+	assert.Equal(t, original.Value, dead.Value)
+	assert.Equal(t, Info{
+		Error:             "invalid character",
+		OriginalTopic:     "transactions",
+		OriginalPartition: 2,
+		OriginalOffset:    41,
+		FailedAt:          failedAt,
+	}, ParseInfo(dead))
+
+	// As read back from the dead-letter topic
+	dead.Partition = 0
+	dead.Offset = 5
+	replayed := ReplayMessage(dead)
+
+	assert.Equal(t, "transactions", replayed.Topic)
+	assert.Equal(t, original.Key, replayed.Key)
+	assert.Equal(t, original.Value, replayed.Value)
+	assert.Equal(t, []kafkaGo.Header{
+		{Key: "trace-id", Value: []byte("abc")},
+		{Key: HeaderReplayedFrom, Value: []byte("0/5")},
+	}, replayed.Headers)
+}
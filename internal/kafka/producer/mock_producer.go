@@ -39,6 +39,12 @@ func (kc *MockKafkaProducerImpl) Publish(ctx context.Context, transactionID stri
 	return args.Error(0)
 }
 
+func (kc *MockKafkaProducerImpl) PublishMessages(ctx context.Context, msgs ...kafka.Message) error {
+	kc.WriteMessages(ctx, msgs...)
+	args := kc.Called(ctx, msgs)
+	return args.Error(0)
+}
+
 func (kc *MockKafkaProducerImpl) Close() error {
 	args := kc.Called()
 	return args.Error(0)
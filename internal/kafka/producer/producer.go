@@ -12,6 +12,8 @@ import (
 
 type KafkaProducer interface {
 	Publish(ctx context.Context, transactionID string, message []byte) error
+	// PublishMessages publishes messages as they are, each to its own topic
+	PublishMessages(ctx context.Context, msgs ...kafka.Message) error
 	Close() error
 }
 
@@ -26,9 +28,10 @@ func NewKafkaProducer() *KafkaProducerImpl {
 		kafkaURL = "kafka:9092"
 	}
 
+	// Messages are keyed by transaction ID, hashing keeps a transaction's messages on one partition, in order
 	writer := &kafka.Writer{
 		Addr:                   kafka.TCP(kafkaURL),
-		Balancer:               &kafka.LeastBytes{},
+		Balancer:               &kafka.Hash{},
 		AllowAutoTopicCreation: true,
 		BatchTimeout:           10 * time.Millisecond,
 	}
@@ -66,6 +69,21 @@ func (kc *KafkaProducerImpl) Publish(ctx context.Context, transactionID string,
 	return nil
 }
 
+// publishes messages which already carry their topic, key and headers
+func (kc *KafkaProducerImpl) PublishMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if kc.writer == nil {
+		log.Println("Kafka writer is nil, cannot publish to Kafka.")
+		return errors.New("kafka writer is not initialized")
+	}
+
+	err := kc.writer.WriteMessages(ctx, msgs...)
+	if err != nil {
+		log.Printf("Error publishing %d messages to Kafka: %v", len(msgs), err)
+		return err
+	}
+	return nil
+}
+
 // returns the appropriate Kafka topic
 func getTopic() string {
 	// Ideally we can have the topic name ingested from config
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/segmentio/kafka-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -27,6 +28,22 @@ func TestPublish(t *testing.T) {
 	mockProducer.AssertExpectations(t)
 }
 
+// Test PublishMessages successfully publishes messages
+func TestPublishMessages(t *testing.T) {
+	mockProducer := NewMockKafkaProducer()
+
+	ctx := context.Background()
+	msgs := []kafka.Message{{Topic: "transactions.dlq", Key: []byte("1"), Value: []byte("test message")}}
+
+	mockProducer.On("PublishMessages", ctx, msgs).Return(nil)
+	mockProducer.On("WriteMessages", mock.Anything, mock.Anything).Return(nil)
+
+	err := mockProducer.PublishMessages(ctx, msgs...)
+
+	assert.NoError(t, err)
+	mockProducer.AssertExpectations(t)
+}
+
 // Test Close method successfully closes the producer
 func TestClose(t *testing.T) {
 	mockProducer := NewMockKafkaProducer()
@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"payment-gateway/internal/services"
+	"strings"
+)
+
+// AdminMiddleware only lets requests sending the admin key, as `Authorization: Bearer <admin key>`, through.
+// Admin routes see the data of every merchant, so they are disabled when no admin key is configured
+func AdminMiddleware(adminKey string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apiResponse := services.NewAPIResponse(services.GetDataFormat(r))
+
+			scheme, key, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+			key = strings.TrimSpace(key)
+			if !strings.EqualFold(scheme, "Bearer") || key == "" {
+				apiResponse.NewUnauthorizedErrorResponse(w, "Missing admin key")
+				return
+			}
+
+			if adminKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) != 1 {
+				log.Printf("Rejected admin key of %s %s", r.Method, r.URL.Path)
+				apiResponse.NewUnauthorizedErrorResponse(w, "Invalid admin key")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler := AdminMiddleware("admin-key")(ok)
+	for header, expected := range map[string]int{
+		"Bearer admin-key":   http.StatusOK,
+		"bearer  admin-key ": http.StatusOK,
+		"":                   http.StatusUnauthorized,
+		"admin-key":          http.StatusUnauthorized,
+		"Bearer admin-keyx":  http.StatusUnauthorized,
+		"Bearer mk_valid":    http.StatusUnauthorized,
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", header)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		assert.Equal(t, expected, w.Code, header)
+	}
+
+	// Without an admin key, admin routes are disabled
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer admin-key")
+	w := httptest.NewRecorder()
+	AdminMiddleware("")(ok).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
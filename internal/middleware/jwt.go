@@ -0,0 +1,285 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"payment-gateway/internal/services"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned for tokens which are malformed, not signed by a configured key, expired,
+// or not meant for this service
+var ErrInvalidToken = errors.New("invalid token")
+
+// jwtLeeway absorbs the clock skew between the token issuer and this service
+const jwtLeeway = 30 * time.Second
+
+// UserTokenHeader carries the token of the user making the request, the Authorization header carries the merchant's API key
+const UserTokenHeader = "X-User-Token"
+
+// JWTClaims are the claims of a token read by this service, the subject is the ID of the user
+type JWTClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss,omitempty"`
+	Audience  audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+}
+
+// audience is the aud claim, which is either a single string or an array of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+type JWTAuthenticator struct {
+	// secret verifies HS256 tokens, they are rejected when it is empty
+	secret []byte
+	// keys verify RS256 tokens, by key ID
+	keys     map[string]*rsa.PublicKey
+	issuer   string
+	audience string
+	now      func() time.Time
+}
+
+// NewJWTAuthenticator creates the authenticator of the users making requests, from the token of their UserTokenHeader.
+//
+//	HS256 tokens are verified with secret, and RS256 tokens with the RSA keys of the JWKS file at jwksFile,
+//	at least one of them is required. The algorithm is taken from the key verifying a token, never trusted from the token alone.
+//	When issuer or audience are not empty, tokens must carry them in their iss or aud claims.
+func NewJWTAuthenticator(secret, jwksFile, issuer, audience string) (*JWTAuthenticator, error) {
+	if secret == "" && jwksFile == "" {
+		return nil, errors.New("a JWT secret or JWKS file is required")
+	}
+
+	authenticator := &JWTAuthenticator{secret: []byte(secret), keys: map[string]*rsa.PublicKey{}, issuer: issuer, audience: audience, now: time.Now}
+	if jwksFile != "" {
+		data, err := os.ReadFile(jwksFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWKS file: %v", err)
+		}
+		if authenticator.keys, err = parseJWKS(data); err != nil {
+			return nil, fmt.Errorf("invalid JWKS file %s: %v", jwksFile, err)
+		}
+	}
+	return authenticator, nil
+}
+
+// parseJWKS reads the RSA signing keys of a JWK set, other keys are skipped
+func parseJWKS(data []byte) (map[string]*rsa.PublicKey, error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Alg string `json:"alg"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") || (jwk.Alg != "" && jwk.Alg != "RS256") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus of key %q: %v", jwk.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent of key %q: %v", jwk.Kid, err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid exponent of key %q", jwk.Kid)
+		}
+		if _, ok := keys[jwk.Kid]; ok {
+			return nil, fmt.Errorf("duplicate key %q", jwk.Kid)
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no RS256 signing key")
+	}
+	return keys, nil
+}
+
+// Middleware puts the user of the request's token, sent in UserTokenHeader with or without a Bearer scheme, in the request context.
+// Requests without a token are passed on without a user, handlers needing a user reject them,
+// while requests with a token which isn't valid are rejected right away
+func (j *JWTAuthenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimSpace(r.Header.Get(UserTokenHeader))
+		if token == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if scheme, bearer, ok := strings.Cut(token, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			token = strings.TrimSpace(bearer)
+		}
+
+		userID, err := j.Authenticate(token)
+		if err != nil {
+			log.Printf("Rejected token of %s %s, error: %+v", r.Method, r.URL.Path, err)
+			services.NewAPIResponse(services.GetDataFormat(r)).NewUnauthorizedErrorResponse(w, "Invalid token")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithUserID(r.Context(), userID)))
+	})
+}
+
+// Authenticate verifies token and returns the user it was issued to, errors match ErrInvalidToken
+func (j *JWTAuthenticator) Authenticate(token string) (int, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("%w: %d segments", ErrInvalidToken, len(parts))
+	}
+
+	header := jwtHeader{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return 0, fmt.Errorf("%w: header: %v", ErrInvalidToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, fmt.Errorf("%w: signature: %v", ErrInvalidToken, err)
+	}
+	if err := j.verify(header, parts[0]+"."+parts[1], signature); err != nil {
+		return 0, err
+	}
+
+	claims := JWTClaims{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return 0, fmt.Errorf("%w: claims: %v", ErrInvalidToken, err)
+	}
+	return j.validate(&claims)
+}
+
+// verify checks the signature of signed, the header and claims segments, with the key matching the header's algorithm
+func (j *JWTAuthenticator) verify(header jwtHeader, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+
+	switch header.Alg {
+	case "HS256":
+		if len(j.secret) == 0 {
+			return fmt.Errorf("%w: HS256 tokens are not accepted", ErrInvalidToken)
+		}
+		mac := hmac.New(sha256.New, j.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("%w: signature mismatch", ErrInvalidToken)
+		}
+		return nil
+	case "RS256":
+		key, ok := j.keys[header.Kid]
+		if !ok && header.Kid == "" && len(j.keys) == 1 {
+			// A token without key ID is verified with the only key there is
+			for _, only := range j.keys {
+				key, ok = only, true
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%w: unknown key %q", ErrInvalidToken, header.Kid)
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return fmt.Errorf("%w: signature mismatch", ErrInvalidToken)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: algorithm %q is not accepted", ErrInvalidToken, header.Alg)
+	}
+}
+
+// validate checks the claims of a verified token, and returns its subject as a user ID
+func (j *JWTAuthenticator) validate(claims *JWTClaims) (int, error) {
+	now := j.now()
+	if claims.ExpiresAt == 0 {
+		return 0, fmt.Errorf("%w: no expiry", ErrInvalidToken)
+	}
+	if now.Add(-jwtLeeway).After(time.Unix(claims.ExpiresAt, 0)) {
+		return 0, fmt.Errorf("%w: expired at %d", ErrInvalidToken, claims.ExpiresAt)
+	}
+	if claims.NotBefore != 0 && now.Add(jwtLeeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return 0, fmt.Errorf("%w: not valid before %d", ErrInvalidToken, claims.NotBefore)
+	}
+	if j.issuer != "" && claims.Issuer != j.issuer {
+		return 0, fmt.Errorf("%w: issued by %q", ErrInvalidToken, claims.Issuer)
+	}
+	if j.audience != "" && !claims.Audience.contains(j.audience) {
+		return 0, fmt.Errorf("%w: audience %q", ErrInvalidToken, claims.Audience)
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil || userID <= 0 {
+		return 0, fmt.Errorf("%w: subject %q is not a user ID", ErrInvalidToken, claims.Subject)
+	}
+	return userID, nil
+}
+
+func (a audience) contains(value string) bool {
+	for _, aud := range a {
+		if aud == value {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// SignHS256 returns a token carrying claims, signed with secret, e.g. for local testing
+func SignHS256(claims JWTClaims, secret string) (string, error) {
+	header, err := json.Marshal(jwtHeader{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
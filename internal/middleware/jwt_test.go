@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims JWTClaims) string {
+	header, _ := json.Marshal(jwtHeader{Alg: "RS256", Kid: kid, Typ: "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	assert.NoError(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeJWKS(t *testing.T, kid string, key *rsa.PublicKey) string {
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA", "kid": kid, "use": "sig", "alg": "RS256",
+		"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(path, jwks, 0o600))
+	return path
+}
+
+func TestJWTAuthenticator_HS256(t *testing.T) {
+	authenticator, err := NewJWTAuthenticator("secret", "", "issuer", "payments")
+	assert.NoError(t, err)
+	now := time.Now()
+	valid := JWTClaims{Subject: "3", Issuer: "issuer", Audience: []string{"other", "payments"}, ExpiresAt: now.Add(time.Minute).Unix()}
+
+	token, _ := SignHS256(valid, "secret")
+	userID, err := authenticator.Authenticate(token)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, userID)
+
+	// Expiry is checked with some leeway
+	expired := valid
+	expired.ExpiresAt = now.Add(-10 * time.Second).Unix()
+	token, _ = SignHS256(expired, "secret")
+	_, err = authenticator.Authenticate(token)
+	assert.NoError(t, err)
+
+	for name, claims := range map[string]JWTClaims{
+		"expired":       {Subject: "3", Issuer: "issuer", Audience: []string{"payments"}, ExpiresAt: now.Add(-time.Minute).Unix()},
+		"no expiry":     {Subject: "3", Issuer: "issuer", Audience: []string{"payments"}},
+		"not yet valid": {Subject: "3", Issuer: "issuer", Audience: []string{"payments"}, ExpiresAt: now.Add(time.Hour).Unix(), NotBefore: now.Add(time.Minute).Unix()},
+		"other issuer":  {Subject: "3", Issuer: "other", Audience: []string{"payments"}, ExpiresAt: now.Add(time.Minute).Unix()},
+		"other aud":     {Subject: "3", Issuer: "issuer", Audience: []string{"other"}, ExpiresAt: now.Add(time.Minute).Unix()},
+		"not a user":    {Subject: "admin", Issuer: "issuer", Audience: []string{"payments"}, ExpiresAt: now.Add(time.Minute).Unix()},
+	} {
+		token, _ := SignHS256(claims, "secret")
+		_, err := authenticator.Authenticate(token)
+		assert.ErrorIs(t, err, ErrInvalidToken, name)
+	}
+
+	// Signed with another secret, or tampered with
+	token, _ = SignHS256(valid, "other secret")
+	_, err = authenticator.Authenticate(token)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	token, _ = SignHS256(valid, "secret")
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(JWTClaims{Subject: "4", Issuer: "issuer", Audience: []string{"payments"}, ExpiresAt: valid.ExpiresAt})
+	_, err = authenticator.Authenticate(parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2])
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	// Unsigned tokens are never accepted
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	_, err = authenticator.Authenticate(none + "." + parts[1] + ".")
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestJWTAuthenticator_RS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	authenticator, err := NewJWTAuthenticator("", writeJWKS(t, "k1", &key.PublicKey), "", "")
+	assert.NoError(t, err)
+	claims := JWTClaims{Subject: "7", ExpiresAt: time.Now().Add(time.Minute).Unix()}
+
+	userID, err := authenticator.Authenticate(signRS256(t, key, "k1", claims))
+	assert.NoError(t, err)
+	assert.Equal(t, 7, userID)
+
+	// The only key verifies tokens without key ID
+	userID, err = authenticator.Authenticate(signRS256(t, key, "", claims))
+	assert.NoError(t, err)
+	assert.Equal(t, 7, userID)
+
+	_, err = authenticator.Authenticate(signRS256(t, other, "k1", claims))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = authenticator.Authenticate(signRS256(t, key, "k2", claims))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	// Without a secret, HS256 tokens are rejected, even when signed with something public
+	token, _ := SignHS256(claims, "")
+	_, err = authenticator.Authenticate(token)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	_, err = NewJWTAuthenticator("", "", "", "")
+	assert.Error(t, err)
+}
+
+func TestJWTAuthenticator_Middleware(t *testing.T) {
+	authenticator, err := NewJWTAuthenticator("secret", "", "", "")
+	assert.NoError(t, err)
+	handler := authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := UserIDFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Write([]byte(strconv.Itoa(userID)))
+	}))
+	token, _ := SignHS256(JWTClaims{Subject: "3", ExpiresAt: time.Now().Add(time.Minute).Unix()}, "secret")
+
+	for header, expected := range map[string]int{token: http.StatusOK, "Bearer " + token: http.StatusOK, "": http.StatusNoContent, "nope": http.StatusUnauthorized} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(UserTokenHeader, header)
+		// The Authorization header carries the merchant's API key, it is never read as a user token
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		assert.Equal(t, expected, w.Code, header)
+		if expected == http.StatusOK {
+			assert.Equal(t, "3", w.Body.String())
+		}
+	}
+}
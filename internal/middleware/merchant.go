@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/services"
+	"strings"
+)
+
+type merchantIDKey struct{}
+
+// WithMerchantID returns a copy of ctx carrying the merchant making the request
+func WithMerchantID(ctx context.Context, merchantID int) context.Context {
+	return context.WithValue(ctx, merchantIDKey{}, merchantID)
+}
+
+// MerchantIDFromContext returns the merchant making the request, if ctx carries one.
+// The merchant is put in the context by MerchantMiddleware, from the API key of the request
+func MerchantIDFromContext(ctx context.Context) (int, bool) {
+	merchantID, ok := ctx.Value(merchantIDKey{}).(int)
+	return merchantID, ok
+}
+
+// MerchantMiddleware puts the merchant of the request's API key, sent as `Authorization: Bearer <api key>`, in the request context.
+// Every route it wraps belongs to a merchant, so requests without a valid key are rejected right away
+func MerchantMiddleware(merchantService services.MerchantService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apiResponse := services.NewAPIResponse(services.GetDataFormat(r))
+
+			scheme, apiKey, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+			apiKey = strings.TrimSpace(apiKey)
+			if !strings.EqualFold(scheme, "Bearer") || apiKey == "" {
+				apiResponse.NewUnauthorizedErrorResponse(w, "Missing API key")
+				return
+			}
+
+			merchantID, err := merchantService.Authenticate(r.Context(), apiKey)
+			if errors.Is(err, models.ErrInvalidAPIKey) {
+				log.Printf("Rejected API key of %s %s, error: %+v", r.Method, r.URL.Path, err)
+				apiResponse.NewUnauthorizedErrorResponse(w, "Invalid API key")
+				return
+			}
+			if err != nil {
+				log.Printf("Error authenticating API key of %s %s, error: %+v", r.Method, r.URL.Path, err)
+				apiResponse.NewInternalServerErrorResponse(w, "", nil)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithMerchantID(r.Context(), merchantID)))
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/services"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stubMerchantService knows a single key, of merchant 2, and fails on "mk_down"
+type stubMerchantService struct {
+	services.MerchantService
+}
+
+func (s *stubMerchantService) Authenticate(ctx context.Context, apiKey string) (int, error) {
+	switch apiKey {
+	case "mk_valid":
+		return 2, nil
+	case "mk_down":
+		return 0, errors.New("connection refused")
+	default:
+		return 0, models.ErrInvalidAPIKey
+	}
+}
+
+func TestMerchantMiddleware(t *testing.T) {
+	handler := MerchantMiddleware(&stubMerchantService{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		merchantID, _ := MerchantIDFromContext(r.Context())
+		w.Write([]byte(strconv.Itoa(merchantID)))
+	}))
+
+	for header, expected := range map[string]int{
+		"Bearer mk_valid":   http.StatusOK,
+		"bearer  mk_valid ": http.StatusOK,
+		"":                  http.StatusUnauthorized,
+		"mk_valid":          http.StatusUnauthorized,
+		"Basic mk_valid":    http.StatusUnauthorized,
+		"Bearer mk_nope":    http.StatusUnauthorized,
+		"Bearer mk_down":    http.StatusInternalServerError,
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", header)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		assert.Equal(t, expected, w.Code, header)
+		if expected == http.StatusOK {
+			assert.Equal(t, "2", w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package middleware
+
+import (
+	"context"
+)
+
+type userIDKey struct{}
+
+// WithUserID returns a copy of ctx carrying the user making the request
+func WithUserID(ctx context.Context, userID int) context.Context {
+	return context.WithValue(ctx, userIDKey{}, userID)
+}
+
+// UserIDFromContext returns the user making the request, if ctx carries one.
+// The user is put in the context by JWTAuthenticator.Middleware, from the subject of the request's token
+func UserIDFromContext(ctx context.Context) (int, bool) {
+	userID, ok := ctx.Value(userIDKey{}).(int)
+	return userID, ok
+}
@@ -10,20 +10,38 @@ type APIResponse struct {
 
 // a standard response structure for the APIs
 type SuccessAPIResponse struct {
-	StatusCode int         `example:200`
-	Message    string      `example: "WITHDRAWAL processing initialized"`
-	Data       interface{} `example: {}`
+	StatusCode int         `example:"200"`
+	Message    string      `example:"WITHDRAWAL processing initialized"`
+	Data       interface{} `example:"{}"`
 }
 
 // a standard response structure for the APIs
 type BadRequestAPIResponse struct {
-	StatusCode int    `example:400`
-	Message    string `example: "Invalid request body"`
+	StatusCode int    `example:"400"`
+	Message    string `example:"Invalid request body"`
+}
+
+// a standard response structure for the APIs
+type UnauthorizedAPIResponse struct {
+	StatusCode int    `example:"401"`
+	Message    string `example:"Invalid webhook signature"`
+}
+
+// a standard response structure for the APIs
+type NotFoundAPIResponse struct {
+	StatusCode int    `example:"404"`
+	Message    string `example:"Transaction not found"`
+}
+
+// a standard response structure for the APIs
+type ConflictAPIResponse struct {
+	StatusCode int    `example:"409"`
+	Message    string `example:"Idempotency key was already used with a different request"`
 }
 
 // a standard response structure for the APIs
 type InternalErrorAPIResponse struct {
-	StatusCode int    `example:500`
+	StatusCode int    `example:"500"`
 	Message    string `example:"Internal Error"`
 }
 
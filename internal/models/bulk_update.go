@@ -0,0 +1,59 @@
+package models
+
+import "time"
+
+type BulkUpdateOutcome string
+
+// APPLIED means the transaction moved to the requested status
+const APPLIED BulkUpdateOutcome = "APPLIED"
+
+// UNCHANGED means the transaction already was in the requested status, e.g. a message delivered again
+const UNCHANGED BulkUpdateOutcome = "UNCHANGED"
+
+// REJECTED means the transaction's status can't move to the requested status
+const REJECTED BulkUpdateOutcome = "REJECTED"
+
+// DUPLICATE means the event the update came with was already processed, so it was skipped
+const DUPLICATE BulkUpdateOutcome = "DUPLICATE"
+
+// STALE means the gateway already made a later status change to the transaction, so it was skipped
+const STALE BulkUpdateOutcome = "STALE"
+
+// CONFLICT means the transaction isn't at the requested version anymore
+const CONFLICT BulkUpdateOutcome = "CONFLICT"
+
+// NOT_FOUND means there is no transaction with the ID
+const NOT_FOUND BulkUpdateOutcome = "NOT_FOUND"
+
+// BulkUpdateResult is the outcome of one row of a bulk status update
+type BulkUpdateResult struct {
+	TxnID int
+	// Status is the requested status
+	Status TransactionStatus
+	// Current is the status of the transaction once the update ran, empty if it wasn't found
+	Current TransactionStatus
+	// UpdatedAt is when the gateway made the requested status change
+	UpdatedAt time.Time
+	// GatewayUpdatedAt is when the gateway made the last status change applied to the transaction, only set for STALE
+	GatewayUpdatedAt time.Time
+	// Version is the version the update was requested for
+	Version int
+	// CurrentVersion is the version of the transaction in db, only set for CONFLICT
+	CurrentVersion int
+	Outcome        BulkUpdateOutcome
+}
+
+// Err returns the reason the row wasn't applied, nil if it was applied, unchanged or a duplicate
+func (r BulkUpdateResult) Err() error {
+	switch r.Outcome {
+	case REJECTED:
+		return &InvalidTransitionError{TxnID: r.TxnID, From: r.Current, To: r.Status}
+	case CONFLICT:
+		return &ConcurrentModificationError{TxnID: r.TxnID, Version: r.Version, Current: r.CurrentVersion}
+	case STALE:
+		return &StaleUpdateError{TxnID: r.TxnID, UpdatedAt: r.UpdatedAt, GatewayUpdatedAt: r.GatewayUpdatedAt}
+	case NOT_FOUND:
+		return ErrTransactionNotFound
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package models
+
+import "errors"
+
+var (
+	// ErrCountryNotFound is returned when a transaction is made for a country that doesn't exist
+	ErrCountryNotFound = errors.New("country not found")
+	// ErrCurrencyMismatch is returned when a transaction's currency isn't the currency of its country
+	ErrCurrencyMismatch = errors.New("currency is not supported for the country")
+	// ErrGatewayNotFound is returned when a gateway doesn't exist
+	ErrGatewayNotFound = errors.New("gateway not found")
+	// ErrTransactionNotFound is returned when a transaction doesn't exist
+	ErrTransactionNotFound = errors.New("transaction not found")
+	// ErrGatewayMismatch is returned when a gateway reports on a transaction of another gateway
+	ErrGatewayMismatch = errors.New("transaction belongs to another gateway")
+	// ErrInvalidCursor is returned when a pagination cursor wasn't returned by a previous page
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrInvalidAmount is returned when an amount isn't a positive amount of its currency
+	ErrInvalidAmount = errors.New("invalid amount")
+	// ErrNotRefundable is returned when refunding a transaction which isn't a successful deposit
+	ErrNotRefundable = errors.New("transaction can't be refunded")
+	// ErrRefundExceedsAmount is returned when a refund is larger than what is left to refund of its transaction
+	ErrRefundExceedsAmount = errors.New("refund exceeds the amount left to refund")
+	// ErrInsufficientFunds is returned when a withdrawal or a refund is larger than the available balance of its user
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	// ErrNoEligibleGateway is returned when no gateway's routing rule accepts a transaction
+	ErrNoEligibleGateway = errors.New("no eligible gateway")
+	// ErrGatewayDispatch is returned when a transaction couldn't be sent to its gateway, it can be retried
+	ErrGatewayDispatch = errors.New("transaction couldn't be sent to its gateway")
+)
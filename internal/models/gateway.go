@@ -6,13 +6,28 @@ type Gateway struct {
 	ID                  int
 	Name                string
 	DataFormatSupported string
-	CreatedAt           time.Time
-	UpdatedAt           time.Time
+	// MerchantID is the merchant the gateway account belongs to, names are unique per merchant
+	MerchantID int
+	// WebhookSecret signs the webhooks of the gateway, it is only populated when fetching a single gateway
+	WebhookSecret string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	// Routing is only populated when gateways are fetched for a country
+	Routing *RoutingRule
 }
 type Country struct {
 	ID        int
 	Name      string
 	Code      string
+	Currency  string
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
+
+// GatewayResponse is what a gateway answered to a request about a transaction
+type GatewayResponse struct {
+	// Reference is the gateway's own ID for the transaction
+	Reference string
+	Status    TransactionStatus
+	UpdatedAt time.Time
+}
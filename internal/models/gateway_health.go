@@ -0,0 +1,11 @@
+package models
+
+// GatewayBreakerState is a snapshot of the circuit breaker of a gateway
+type GatewayBreakerState struct {
+	GatewayID           int    `json:"gateway_id" xml:"gateway_id"`
+	Name                string `json:"name" xml:"name"`
+	State               string `json:"state" xml:"state"`
+	Requests            uint32 `json:"requests" xml:"requests"`
+	TotalFailures       uint32 `json:"total_failures" xml:"total_failures"`
+	ConsecutiveFailures uint32 `json:"consecutive_failures" xml:"consecutive_failures"`
+}
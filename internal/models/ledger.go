@@ -0,0 +1,172 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrUnbalancedJournal is returned when the entries of a journal don't sum to zero
+var ErrUnbalancedJournal = errors.New("journal is not balanced")
+
+// LedgerAccountType is the kind of a ledger account, accounts are opened per merchant, type, owner and currency
+type LedgerAccountType string
+
+// USER_WALLET holds what is owed to a user, its owner is the user
+const USER_WALLET LedgerAccountType = "USER_WALLET"
+
+// USER_HOLD holds the funds of a user's withdrawals sent to a gateway, until they succeed or fail, its owner is the user
+const USER_HOLD LedgerAccountType = "USER_HOLD"
+
+// GATEWAY_CLEARING holds what a gateway owes, or is owed, for the transactions it processed, its owner is the gateway
+const GATEWAY_CLEARING LedgerAccountType = "GATEWAY_CLEARING"
+
+// FEES holds the fees charged by gateways, it has no owner
+const FEES LedgerAccountType = "FEES"
+
+// SUSPENSE holds funds which can't be attributed to a user yet, it has no owner
+const SUSPENSE LedgerAccountType = "SUSPENSE"
+
+// JournalKind is why a journal was posted, a transaction has at most one journal of each kind
+type JournalKind string
+
+// HOLD moves the funds of a withdrawal sent to a gateway from the user's wallet to the user's held funds
+const HOLD JournalKind = "hold"
+
+// SETTLEMENT moves the funds of a transaction which succeeded
+const SETTLEMENT JournalKind = "settlement"
+
+// REVERSAL cancels the journals of a transaction which failed
+const REVERSAL JournalKind = "reversal"
+
+// LedgerEntry is one line of a journal, debits are positive amounts and credits negative ones
+type LedgerEntry struct {
+	AccountType LedgerAccountType `json:"account_type" xml:"account_type"`
+	// OwnerID is the user or gateway owning the account, 0 for accounts without owner
+	OwnerID int   `json:"owner_id" xml:"owner_id"`
+	Amount  Money `json:"amount" xml:"amount"`
+}
+
+// Journal is a set of entries posted together for a transaction, journals are balanced and never modified once posted
+type Journal struct {
+	ID            int64         `json:"id" xml:"id"`
+	TransactionID int           `json:"transaction_id" xml:"transaction_id"`
+	Kind          JournalKind   `json:"kind" xml:"kind"`
+	Currency      string        `json:"currency" xml:"currency"`
+	Entries       []LedgerEntry `json:"entries" xml:"entries>entry"`
+	CreatedAt     time.Time     `json:"created_at" xml:"created_at"`
+	// MerchantID is the merchant of the transaction, whose accounts the entries are posted to
+	MerchantID int `json:"-" xml:"-"`
+}
+
+// Validate returns an error matching ErrUnbalancedJournal unless the journal has at least two entries,
+// all in the journal's currency, summing to zero
+func (j *Journal) Validate() error {
+	if len(j.Entries) < 2 {
+		return fmt.Errorf("%w: journal of transaction %d has %d entries", ErrUnbalancedJournal, j.TransactionID, len(j.Entries))
+	}
+
+	var sum int64
+	for _, entry := range j.Entries {
+		if entry.Amount.Currency != j.Currency {
+			return fmt.Errorf("%w: %s entry in %s journal of transaction %d", ErrUnbalancedJournal, entry.Amount.Currency, j.Currency, j.TransactionID)
+		}
+		sum += entry.Amount.MinorUnits
+	}
+	if sum != 0 {
+		return fmt.Errorf("%w: journal of transaction %d sums to %s %s", ErrUnbalancedJournal, j.TransactionID, NewMoney(sum, j.Currency), j.Currency)
+	}
+	return nil
+}
+
+// HoldJournal is the journal holding the funds of a withdrawal or a refund once the gateway accepted it
+func HoldJournal(txn *Transaction) *Journal {
+	return &Journal{TransactionID: txn.ID, MerchantID: txn.MerchantID, Kind: HOLD, Currency: txn.Currency, Entries: []LedgerEntry{
+		{AccountType: USER_WALLET, OwnerID: txn.UserID, Amount: NewMoney(txn.Amount.MinorUnits, txn.Currency)},
+		{AccountType: USER_HOLD, OwnerID: txn.UserID, Amount: NewMoney(-txn.Amount.MinorUnits, txn.Currency)},
+	}}
+}
+
+// SettlementJournal is the journal moving the funds of txn once it succeeded, the gateway charges feeBps basis points of the amount.
+//
+//	A deposit is owed by the gateway and credited to the user, less the fee.
+//	A withdrawal or a refund is debited from the user, and owed to the gateway along with the fee.
+//	A withdrawal or a refund whose funds are held is captured from the held funds instead of the wallet.
+//	Funds of a transaction without user go to SUSPENSE instead of a wallet.
+func SettlementJournal(txn *Transaction, feeBps int, held bool) (*Journal, error) {
+	amount := txn.Amount.MinorUnits
+	fee := (amount*int64(feeBps) + 5_000) / 10_000
+
+	userAccount, userID := USER_WALLET, txn.UserID
+	if userID == 0 {
+		userAccount = SUSPENSE
+	}
+	if held {
+		userAccount = USER_HOLD
+	}
+
+	var user, clearing int64
+	switch TransactionType(txn.Type) {
+	case DEPOSIT:
+		user, clearing = -amount, amount-fee
+	case WITHDRAWAL, REFUND:
+		user, clearing = amount, -amount-fee
+	default:
+		return nil, fmt.Errorf("no settlement for transaction %d of type %s", txn.ID, txn.Type)
+	}
+
+	journal := &Journal{TransactionID: txn.ID, MerchantID: txn.MerchantID, Kind: SETTLEMENT, Currency: txn.Currency}
+	journal.Entries = append(journal.Entries,
+		LedgerEntry{AccountType: userAccount, OwnerID: userID, Amount: NewMoney(user, txn.Currency)},
+		LedgerEntry{AccountType: GATEWAY_CLEARING, OwnerID: txn.GatewayID, Amount: NewMoney(clearing, txn.Currency)},
+	)
+	if fee != 0 {
+		journal.Entries = append(journal.Entries, LedgerEntry{AccountType: FEES, Amount: NewMoney(fee, txn.Currency)})
+	}
+	return journal, journal.Validate()
+}
+
+// ReversalJournal is the journal cancelling the entries of journals, which were posted for txn before it failed,
+// it is nil when nothing was posted
+func ReversalJournal(txn *Transaction, journals []Journal) *Journal {
+	reversal := &Journal{TransactionID: txn.ID, MerchantID: txn.MerchantID, Kind: REVERSAL, Currency: txn.Currency}
+	for _, journal := range journals {
+		for _, entry := range journal.Entries {
+			entry.Amount.MinorUnits = -entry.Amount.MinorUnits
+			reversal.Entries = append(reversal.Entries, entry)
+		}
+	}
+	if len(reversal.Entries) == 0 {
+		return nil
+	}
+	return reversal
+}
+
+// JournalImbalance is a journal which failed the ledger's invariants
+type JournalImbalance struct {
+	JournalID     int64
+	TransactionID int
+	Kind          JournalKind
+	Currency      string
+	// Sum of the entries, which should be zero
+	Sum Money
+	// Entries is the number of entries, which should be at least two
+	Entries int
+}
+
+// HasJournal reports whether journals has one of kind
+func HasJournal(journals []Journal, kind JournalKind) bool {
+	for _, journal := range journals {
+		if journal.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Balance is what a user has in a currency, funds of withdrawals in progress aren't available
+type Balance struct {
+	Currency  string `json:"currency" xml:"currency"`
+	Available Money  `json:"available" xml:"available"`
+	Held      Money  `json:"held" xml:"held"`
+}
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSettlementJournal(t *testing.T) {
+	deposit := &Transaction{ID: 1, Type: string(DEPOSIT), Amount: NewMoney(10000, "USD"), Currency: "USD", UserID: 3, GatewayID: 2}
+
+	journal, err := SettlementJournal(deposit, 150, false)
+	assert.NoError(t, err)
+	assert.Equal(t, SETTLEMENT, journal.Kind)
+	assert.Equal(t, []LedgerEntry{
+		{AccountType: USER_WALLET, OwnerID: 3, Amount: NewMoney(-10000, "USD")},
+		{AccountType: GATEWAY_CLEARING, OwnerID: 2, Amount: NewMoney(9850, "USD")},
+		{AccountType: FEES, Amount: NewMoney(150, "USD")},
+	}, journal.Entries)
+
+	// The fee is rounded to the minor unit, and left out when it is zero
+	withdrawal := &Transaction{ID: 2, Type: string(WITHDRAWAL), Amount: NewMoney(1005, "KWD"), Currency: "KWD", UserID: 3, GatewayID: 2}
+	journal, err = SettlementJournal(withdrawal, 0, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []LedgerEntry{
+		{AccountType: USER_WALLET, OwnerID: 3, Amount: NewMoney(1005, "KWD")},
+		{AccountType: GATEWAY_CLEARING, OwnerID: 2, Amount: NewMoney(-1005, "KWD")},
+	}, journal.Entries)
+
+	journal, err = SettlementJournal(withdrawal, 50, false)
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(5, "KWD"), journal.Entries[2].Amount)
+	assert.NoError(t, journal.Validate())
+
+	// Funds without user are held in suspense
+	deposit.UserID = 0
+	journal, err = SettlementJournal(deposit, 0, false)
+	assert.NoError(t, err)
+	assert.Equal(t, LedgerEntry{AccountType: SUSPENSE, Amount: NewMoney(-10000, "USD")}, journal.Entries[0])
+
+	_, err = SettlementJournal(&Transaction{ID: 3, Type: "CHARGEBACK", Currency: "USD"}, 0, false)
+	assert.Error(t, err)
+}
+
+func TestReversalJournal(t *testing.T) {
+	txn := &Transaction{ID: 1, Currency: "USD"}
+	assert.Nil(t, ReversalJournal(txn, nil))
+
+	posted := Journal{TransactionID: 1, Kind: SETTLEMENT, Currency: "USD", Entries: []LedgerEntry{
+		{AccountType: USER_WALLET, OwnerID: 3, Amount: NewMoney(-100, "USD")},
+		{AccountType: GATEWAY_CLEARING, OwnerID: 2, Amount: NewMoney(100, "USD")},
+	}}
+	reversal := ReversalJournal(txn, []Journal{posted})
+
+	assert.Equal(t, REVERSAL, reversal.Kind)
+	assert.Equal(t, NewMoney(100, "USD"), reversal.Entries[0].Amount)
+	assert.Equal(t, NewMoney(-100, "USD"), reversal.Entries[1].Amount)
+	assert.NoError(t, reversal.Validate())
+	// The posted journal is left as is
+	assert.Equal(t, NewMoney(-100, "USD"), posted.Entries[0].Amount)
+}
+
+func TestJournalValidate(t *testing.T) {
+	journal := &Journal{TransactionID: 1, Currency: "USD", Entries: []LedgerEntry{{AccountType: USER_WALLET, Amount: NewMoney(0, "USD")}}}
+	assert.ErrorIs(t, journal.Validate(), ErrUnbalancedJournal)
+
+	journal.Entries = append(journal.Entries, LedgerEntry{AccountType: FEES, Amount: NewMoney(1, "USD")})
+	assert.ErrorIs(t, journal.Validate(), ErrUnbalancedJournal)
+
+	journal.Entries[0].Amount = NewMoney(-1, "EUR")
+	assert.ErrorIs(t, journal.Validate(), ErrUnbalancedJournal)
+
+	journal.Entries[0].Amount = NewMoney(-1, "USD")
+	assert.NoError(t, journal.Validate())
+}
+
+func TestHoldJournal(t *testing.T) {
+	withdrawal := &Transaction{ID: 1, Type: string(WITHDRAWAL), Amount: NewMoney(10000, "USD"), Currency: "USD", UserID: 3, GatewayID: 2}
+
+	hold := HoldJournal(withdrawal)
+	assert.Equal(t, HOLD, hold.Kind)
+	assert.Equal(t, []LedgerEntry{
+		{AccountType: USER_WALLET, OwnerID: 3, Amount: NewMoney(10000, "USD")},
+		{AccountType: USER_HOLD, OwnerID: 3, Amount: NewMoney(-10000, "USD")},
+	}, hold.Entries)
+	assert.NoError(t, hold.Validate())
+
+	// The settlement captures the held funds, leaving the hold account at zero
+	journal, err := SettlementJournal(withdrawal, 100, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []LedgerEntry{
+		{AccountType: USER_HOLD, OwnerID: 3, Amount: NewMoney(10000, "USD")},
+		{AccountType: GATEWAY_CLEARING, OwnerID: 2, Amount: NewMoney(-10100, "USD")},
+		{AccountType: FEES, Amount: NewMoney(100, "USD")},
+	}, journal.Entries)
+	assert.True(t, HasJournal([]Journal{*hold}, HOLD))
+	assert.False(t, HasJournal([]Journal{*hold}, SETTLEMENT))
+}
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+// DEFAULT_MERCHANT_ID is the merchant owning everything created before merchants existed
+const DEFAULT_MERCHANT_ID = 1
+
+var (
+	// ErrMerchantNotFound is returned when a merchant doesn't exist
+	ErrMerchantNotFound = errors.New("merchant not found")
+	// ErrInvalidAPIKey is returned for API keys which don't exist, don't match their hash, or expired
+	ErrInvalidAPIKey = errors.New("invalid API key")
+)
+
+// Merchant is a client integrating with the gateway, its transactions and gateways are isolated from other merchants'
+type Merchant struct {
+	ID        int       `json:"id" xml:"id"`
+	Name      string    `json:"name" xml:"name"`
+	CreatedAt time.Time `json:"created_at" xml:"created_at"`
+}
+
+// APIKey authenticates the requests of a merchant, only its prefix and a hash of the whole key are stored
+type APIKey struct {
+	ID         int
+	MerchantID int
+	// Prefix is the start of the key, it identifies the key without revealing it
+	Prefix string
+	// Hash is the hex encoded SHA-256 of the whole key
+	Hash      string
+	CreatedAt time.Time
+	// ExpiresAt is when a rotated key stops being accepted, nil until the key is rotated
+	ExpiresAt *time.Time
+}
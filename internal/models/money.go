@@ -0,0 +1,182 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// currencyExponents holds the ISO 4217 currencies whose minor unit isn't 1/100 of the major unit
+var currencyExponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+const defaultCurrencyExponent = 2
+
+// CurrencyExponent returns the number of decimal places of the currency, e.g. JPY 0, USD 2, KWD 3
+func CurrencyExponent(currency string) int {
+	if exponent, ok := currencyExponents[currency]; ok {
+		return exponent
+	}
+	return defaultCurrencyExponent
+}
+
+// Money is an exact amount held in integer minor units of an ISO 4217 currency,
+// e.g. USD 100.25 is held as 10025 minor units
+type Money struct {
+	MinorUnits int64
+	Currency   string
+}
+
+// NewMoney creates money from minor units of the currency
+func NewMoney(minorUnits int64, currency string) Money {
+	return Money{MinorUnits: minorUnits, Currency: strings.ToUpper(currency)}
+}
+
+// ParseMoney parses a decimal amount in major units, e.g. "100.25", of the currency.
+//
+//	Amounts with more decimal places than the currency supports are rejected instead of being rounded,
+//	trailing zeros are allowed, as postgres pads numeric columns with them
+func ParseMoney(amount, currency string) (Money, error) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if !isCurrencyCode(currency) {
+		return Money{}, fmt.Errorf("invalid currency %q", currency)
+	}
+
+	amount = strings.TrimSpace(amount)
+	negative := strings.HasPrefix(amount, "-")
+	amount = strings.TrimPrefix(strings.TrimPrefix(amount, "-"), "+")
+
+	whole, fraction, _ := strings.Cut(amount, ".")
+	if whole == "" || !isDigits(whole) || !isDigits(fraction) {
+		return Money{}, fmt.Errorf("invalid amount %q", amount)
+	}
+
+	exponent := CurrencyExponent(currency)
+	if len(fraction) > exponent {
+		if strings.Trim(fraction[exponent:], "0") != "" {
+			return Money{}, fmt.Errorf("amount %q has more than %d decimal places allowed for %s", amount, exponent, currency)
+		}
+		fraction = fraction[:exponent]
+	}
+	fraction += strings.Repeat("0", exponent-len(fraction))
+
+	minorUnits, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("amount %q is out of range: %v", amount, err)
+	}
+	if negative {
+		minorUnits = -minorUnits
+	}
+
+	return Money{MinorUnits: minorUnits, Currency: currency}, nil
+}
+
+// String returns the amount as a decimal in major units, e.g. "100.25"
+func (m Money) String() string {
+	exponent := CurrencyExponent(m.Currency)
+
+	sign := ""
+	minorUnits := m.MinorUnits
+	if minorUnits < 0 {
+		sign = "-"
+	}
+	digits := strconv.FormatUint(absInt64(minorUnits), 10)
+	if exponent == 0 {
+		return sign + digits
+	}
+
+	if len(digits) <= exponent {
+		digits = strings.Repeat("0", exponent-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-exponent] + "." + digits[len(digits)-exponent:]
+}
+
+func (m Money) IsPositive() bool {
+	return m.MinorUnits > 0
+}
+
+// Value stores money as a decimal in major units, the currency is stored separately
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// moneyWire is how money is sent over JSON, the value is a string so it never goes through a float
+type moneyWire struct {
+	Value    string `json:"value"`
+	Currency string `json:"currency"`
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(moneyWire{Value: m.String(), Currency: m.Currency})
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	wire := moneyWire{}
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return err
+	}
+
+	money, err := ParseMoney(wire.Value, wire.Currency)
+	if err != nil {
+		return err
+	}
+	*m = money
+	return nil
+}
+
+// MarshalXML encodes money as `<amount currency="USD">100.25</amount>`
+func (m Money) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "currency"}, Value: m.Currency})
+	return e.EncodeElement(m.String(), start)
+}
+
+func (m *Money) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	wire := struct {
+		Value    string `xml:",chardata"`
+		Currency string `xml:"currency,attr"`
+	}{}
+	if err := d.DecodeElement(&wire, &start); err != nil {
+		return err
+	}
+
+	money, err := ParseMoney(wire.Value, wire.Currency)
+	if err != nil {
+		return err
+	}
+	*m = money
+	return nil
+}
+
+func isCurrencyCode(currency string) bool {
+	if len(currency) != 3 {
+		return false
+	}
+	for _, r := range currency {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func absInt64(n int64) uint64 {
+	if n < 0 {
+		return uint64(-(n + 1)) + 1
+	}
+	return uint64(n)
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		amount   string
+		currency string
+		want     Money
+		wantErr  bool
+	}{
+		{amount: "100.25", currency: "USD", want: NewMoney(10025, "USD")},
+		{amount: "100", currency: "usd", want: NewMoney(10000, "USD")},
+		{amount: "100.5", currency: "USD", want: NewMoney(10050, "USD")},
+		{amount: "100.250", currency: "USD", want: NewMoney(10025, "USD")},
+		{amount: "1500", currency: "JPY", want: NewMoney(1500, "JPY")},
+		{amount: "1500.000", currency: "JPY", want: NewMoney(1500, "JPY")},
+		{amount: "1.005", currency: "KWD", want: NewMoney(1005, "KWD")},
+		{amount: "-0.01", currency: "USD", want: NewMoney(-1, "USD")},
+		{amount: "100000000.00", currency: "USD", want: NewMoney(10000000000, "USD")},
+		{amount: "0.001", currency: "USD", wantErr: true},
+		{amount: "1.5", currency: "JPY", wantErr: true},
+		{amount: "1e3", currency: "USD", wantErr: true},
+		{amount: ".5", currency: "USD", wantErr: true},
+		{amount: "", currency: "USD", wantErr: true},
+		{amount: "10", currency: "US", wantErr: true},
+		{amount: "99999999999999999999", currency: "USD", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.amount, tt.currency)
+		if tt.wantErr {
+			assert.Error(t, err, "amount: %s %s", tt.amount, tt.currency)
+			continue
+		}
+		assert.NoError(t, err, "amount: %s %s", tt.amount, tt.currency)
+		assert.Equal(t, tt.want, got)
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	assert.Equal(t, "100.25", NewMoney(10025, "USD").String())
+	assert.Equal(t, "0.05", NewMoney(5, "USD").String())
+	assert.Equal(t, "-0.05", NewMoney(-5, "USD").String())
+	assert.Equal(t, "1500", NewMoney(1500, "JPY").String())
+	assert.Equal(t, "1.005", NewMoney(1005, "KWD").String())
+}
+
+func TestMoneyCodecs(t *testing.T) {
+	money := NewMoney(1005, "KWD")
+
+	encoded, err := json.Marshal(money)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"value":"1.005","currency":"KWD"}`, string(encoded))
+
+	decoded := Money{}
+	assert.NoError(t, json.Unmarshal(encoded, &decoded))
+	assert.Equal(t, money, decoded)
+
+	encoded, err = xml.Marshal(struct {
+		XMLName xml.Name `xml:"txn"`
+		Amount  Money    `xml:"amount"`
+	}{Amount: money})
+	assert.NoError(t, err)
+	assert.Equal(t, `<txn><amount currency="KWD">1.005</amount></txn>`, string(encoded))
+}
+
+func TestTransactionRequestDecoding(t *testing.T) {
+	req := TransactionRequest{}
+	err := json.Unmarshal([]byte(`{"amount": 100.10, "user_id": 1, "currency": "USD", "country_id": 3}`), &req)
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(10010, "USD"), req.Amount)
+	assert.Equal(t, "USD", req.Currency)
+	assert.Equal(t, 1, req.UserID)
+
+	req = TransactionRequest{}
+	err = xml.Unmarshal([]byte(`<TransactionRequest><amount>1500</amount><user_id>1</user_id><currency>JPY</currency><country_id>3</country_id></TransactionRequest>`), &req)
+	assert.NoError(t, err)
+	assert.Equal(t, NewMoney(1500, "JPY"), req.Amount)
+	assert.Equal(t, 3, req.CountryID)
+
+	err = json.Unmarshal([]byte(`{"amount": 100.001, "currency": "USD"}`), &TransactionRequest{})
+	assert.Error(t, err)
+}
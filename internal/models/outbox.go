@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// OutboxEvent is a message waiting to be published to kafka.
+//
+//	It is written in the same db transaction as the change it describes,
+//	so a change is never committed without its message, or the other way around
+type OutboxEvent struct {
+	ID int64
+	// AggregateID is the transaction the event belongs to, events of a transaction are published in ID order
+	AggregateID   int
+	Key           string
+	Payload       []byte
+	CreatedAt     time.Time
+	PublishedAt   *time.Time
+	Attempts      int
+	LastError     string
+	NextAttemptAt time.Time
+	// FailedAt is set once the event used up its attempts, it isn't published anymore
+	FailedAt *time.Time
+	// EventID identifies the message in Payload, consumers skip messages whose event ID they already processed.
+	// It is only stored as part of the payload, so it isn't set on events read back from the outbox
+	EventID string
+}
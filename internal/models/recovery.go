@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+type RecoveryOutcome string
+
+// RECOVERED means the transaction left the stuck status, either through the attempt or through something else, like a late webhook
+const RECOVERED RecoveryOutcome = "RECOVERED"
+
+// RETRY means the attempt failed, and the transaction will be tried again
+const RETRY RecoveryOutcome = "RETRY"
+
+// ESCALATED means the transaction ran out of attempts and was moved to MANUAL_REVIEW
+const ESCALATED RecoveryOutcome = "ESCALATED"
+
+// StuckTransaction is a transaction the recovery worker picked up, along with how many times it was already tried
+type StuckTransaction struct {
+	Transaction Transaction
+	Attempts    int
+}
+
+// RecoveryAttempt records one try of the recovery worker on a transaction
+type RecoveryAttempt struct {
+	TransactionID int
+	// Status is the status the transaction was stuck in
+	Status      TransactionStatus
+	Outcome     RecoveryOutcome
+	Error       string
+	AttemptedAt time.Time
+}
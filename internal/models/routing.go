@@ -0,0 +1,64 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// RoutingRule decides how much of a country's traffic a gateway receives
+type RoutingRule struct {
+	// Priority of the gateway for the country, lower is preferred
+	Priority int
+	// Weight is the percentage of traffic the gateway receives among gateways of the same priority
+	Weight int
+	// MinAmount and MaxAmount bound the amounts the gateway is used for, nil means unbounded
+	MinAmount *Money
+	MaxAmount *Money
+	Enabled   bool
+}
+
+// Accepts reports if the rule allows routing the amount to its gateway
+func (r *RoutingRule) Accepts(amount Money) bool {
+	if !r.Enabled || r.Weight <= 0 {
+		return false
+	}
+	if r.MinAmount != nil && amount.MinorUnits < r.MinAmount.MinorUnits {
+		return false
+	}
+	if r.MaxAmount != nil && amount.MinorUnits > r.MaxAmount.MinorUnits {
+		return false
+	}
+	return true
+}
+
+// RoutingDecision records why a gateway was picked for a transaction, it is stored along with the transaction
+type RoutingDecision struct {
+	GatewayID int `json:"gateway_id" xml:"gateway_id"`
+	Priority  int `json:"priority" xml:"priority"`
+	// Bucket is where the transaction landed among the weights of the gateways sharing the priority
+	Bucket      int   `json:"bucket" xml:"bucket"`
+	TotalWeight int   `json:"total_weight" xml:"total_weight"`
+	Candidates  []int `json:"candidates" xml:"candidates>gateway_id"`
+	// Unavailable are eligible gateways which were skipped as their circuit breaker was open
+	Unavailable []int `json:"unavailable,omitempty" xml:"unavailable>gateway_id,omitempty"`
+	// Failed are gateways the transaction was routed to before, whose call failed
+	Failed []int  `json:"failed,omitempty" xml:"failed>gateway_id,omitempty"`
+	Reason string `json:"reason" xml:"reason"`
+}
+
+// Value stores the decision as JSON
+func (d RoutingDecision) Value() (driver.Value, error) {
+	return json.Marshal(d)
+}
+
+func (d *RoutingDecision) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, d)
+	case string:
+		return json.Unmarshal([]byte(v), d)
+	default:
+		return fmt.Errorf("unsupported type %T for routing decision", src)
+	}
+}
@@ -1,17 +1,31 @@
 package models
 
 import (
+	"encoding/json"
+	"encoding/xml"
 	"time"
 )
 
 type TransactionStatus string
 
 const INIT TransactionStatus = "INIT"
+
+// Deprecated: status changes are published through the outbox, so publishing can't fail a transaction anymore.
+// Only transactions from before the outbox may still have it.
 const KAFKA_PUBLISH_FAILED TransactionStatus = "KAFKA_PUBLISH_FAILED"
 const PENDING TransactionStatus = "PENDING"
 const SUCCESS TransactionStatus = "SUCCESS"
 const FAILED TransactionStatus = "FAILED"
 
+// MANUAL_REVIEW is set by the recovery worker on transactions it couldn't recover, so someone can settle them by hand
+const MANUAL_REVIEW TransactionStatus = "MANUAL_REVIEW"
+
+// PARTIALLY_REFUNDED is set on a deposit once refunds of part of its amount succeeded
+const PARTIALLY_REFUNDED TransactionStatus = "PARTIALLY_REFUNDED"
+
+// REFUNDED is set on a deposit once refunds of its whole amount succeeded
+const REFUNDED TransactionStatus = "REFUNDED"
+
 func (t TransactionStatus) String() string {
 	return string(t)
 }
@@ -28,9 +42,19 @@ func (t *TransactionType) String() string {
 const DEPOSIT TransactionType = "DEPOSIT"
 const WITHDRAWAL TransactionType = "WITHDRAWAL"
 
+// REFUND gives back part or all of a successful deposit, its ParentID is the deposit
+const REFUND TransactionType = "REFUND"
+
+// DebitsWallet reports whether transactions of type t take their amount out of their user's wallet,
+// their funds are checked when they are created and held once the gateway accepted them
+func (t TransactionType) DebitsWallet() bool {
+	return t == WITHDRAWAL || t == REFUND
+}
+
 type Transaction struct {
 	ID        int               `json:"id" xml:"id"`
-	Amount    float64           `json:"amount" xml:"amount"`
+	Amount    Money             `json:"amount" xml:"amount"`
+	Currency  string            `json:"currency" xml:"currency"`
 	Type      string            `json:"type" xml:"type"`
 	Status    TransactionStatus `json:"status" xml:"status"`
 	CreatedAt time.Time         `json:"created_at" xml:"created_at"`
@@ -38,16 +62,88 @@ type Transaction struct {
 	GatewayID int               `json:"gateway_id" xml:"gateway_id"`
 	CountryID int               `json:"country_id" xml:"country_id"`
 	UserID    int               `json:"user_id" xml:"user_id"`
+	// MerchantID is the merchant the transaction was made through, every read and update of it is scoped to that merchant
+	MerchantID int `json:"merchant_id" xml:"merchant_id"`
+	// Version is incremented by every update, updates only apply to the version they read
+	Version int `json:"version" xml:"version"`
+	// ParentID is the transaction a refund gives back, it is nil for other types
+	ParentID *int `json:"parent_id,omitempty" xml:"parent_id,omitempty"`
+	// RoutingDecision explains why GatewayID was picked, it is nil for transactions created before routing rules
+	RoutingDecision *RoutingDecision `json:"routing_decision,omitempty" xml:"routing_decision,omitempty"`
+	// GatewayUpdatedAt is the gateway's timestamp of the last status change applied from it,
+	// nil until one is, older status changes are stale
+	GatewayUpdatedAt *time.Time `json:"-" xml:"-"`
+	// EventID identifies the kafka message a status change was published with, it is only set on messages
+	EventID string `json:"event_id,omitempty" xml:"-" swaggerignore:"true"`
+}
+
+// TransactionPage is a page of transaction search results
+type TransactionPage struct {
+	Transactions []Transaction `json:"transactions" xml:"transactions>transaction"`
+	// NextCursor fetches the next page, it is empty on the last page
+	NextCursor string `json:"next_cursor,omitempty" xml:"next_cursor,omitempty"`
 }
 
 // a standard request structure for the transactions
 type TransactionRequest struct {
+	// UserID is the user of the request's token, it is optional in the body, and must be that user when given
 	UserID     int             `json:"user_id" xml:"user_id"`
-	Amount     float64         `json:"amount" xml:"amount"`
+	Amount     Money           `json:"amount" xml:"amount" swaggertype:"number"`
 	Currency   string          `json:"currency" xml:"currency"`
 	CountryID  int             `json:"country_id" xml:"country_id"`
 	Type       TransactionType `json:"type" xml:"type"` // "deposit" or "withdrawal"
 	DataFormat DataFormat      `json:"-" xml:"-"`
+	// MerchantID is the merchant of the request's API key
+	MerchantID int `json:"-" xml:"-"`
+}
+
+// transactionRequestWire is the wire format of TransactionRequest.
+//
+//	The amount is sent as a decimal in major units next to the currency, json.Number keeps
+//	the exact digits sent by the client, so it is parsed into Money without going through a float
+type transactionRequestWire struct {
+	UserID    int             `json:"user_id" xml:"user_id"`
+	Amount    json.Number     `json:"amount" xml:"amount"`
+	Currency  string          `json:"currency" xml:"currency"`
+	CountryID int             `json:"country_id" xml:"country_id"`
+	Type      TransactionType `json:"type" xml:"type"`
+}
+
+func (r *TransactionRequest) UnmarshalJSON(data []byte) error {
+	wire := transactionRequestWire{}
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return err
+	}
+	return r.fromWire(wire)
+}
+
+func (r *TransactionRequest) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	wire := transactionRequestWire{}
+	if err := d.DecodeElement(&wire, &start); err != nil {
+		return err
+	}
+	return r.fromWire(wire)
+}
+
+func (r *TransactionRequest) fromWire(wire transactionRequestWire) error {
+	amount, err := ParseMoney(wire.Amount.String(), wire.Currency)
+	if err != nil {
+		return err
+	}
+
+	r.UserID = wire.UserID
+	r.Amount = amount
+	r.Currency = amount.Currency
+	r.CountryID = wire.CountryID
+	r.Type = wire.Type
+	return nil
+}
+
+// RefundRequest asks to refund a transaction, in the currency of the transaction
+type RefundRequest struct {
+	// Amount is a decimal in major units, like in TransactionRequest, all that is left to refund is refunded when it is empty
+	Amount     json.Number `json:"amount,omitempty" xml:"amount,omitempty" swaggertype:"number"`
+	DataFormat DataFormat  `json:"-" xml:"-"`
 }
 
 type TransactionWebhookResponse struct {
@@ -55,4 +151,8 @@ type TransactionWebhookResponse struct {
 	Status     TransactionStatus `json:"status" xml:"status"`
 	UpdatedAt  time.Time         `json:"updated_at" xml:"updated_at"`
 	DataFormat DataFormat        `json:"-" xml:"-"`
+	// GatewayID is the gateway which sent the webhook, set from the webhook route
+	GatewayID int `json:"-" xml:"-"`
+	// MerchantID is the merchant of the gateway which sent the webhook, set from the webhook route
+	MerchantID int `json:"-" xml:"-"`
 }
@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+// TransactionEventSource is what caused a status change of a transaction
+type TransactionEventSource string
+
+// SOURCE_API is a change made while serving an API request, like creating the transaction
+const SOURCE_API TransactionEventSource = "api"
+
+// SOURCE_WEBHOOK is a change reported by a gateway's webhook
+const SOURCE_WEBHOOK TransactionEventSource = "webhook"
+
+// SOURCE_CONSUMER is a change applied from a kafka message
+const SOURCE_CONSUMER TransactionEventSource = "consumer"
+
+// SOURCE_RECOVERY is a change made by the recovery worker
+const SOURCE_RECOVERY TransactionEventSource = "recovery"
+
+// EventCause is what caused a status change, it is recorded in the status history along with the change
+type EventCause struct {
+	Source TransactionEventSource
+	// PayloadRef references the payload behind the change, the event ID of the message published or consumed for it,
+	// or the gateway's reference when no message goes with the change
+	PayloadRef string
+}
+
+// TransactionEvent is one entry of the status history of a transaction, entries are only ever appended
+type TransactionEvent struct {
+	ID            int64 `json:"id" xml:"id"`
+	TransactionID int   `json:"transaction_id" xml:"transaction_id"`
+	// FromStatus is empty for the event creating the transaction
+	FromStatus TransactionStatus      `json:"from_status,omitempty" xml:"from_status,omitempty"`
+	ToStatus   TransactionStatus      `json:"to_status" xml:"to_status"`
+	Source     TransactionEventSource `json:"source" xml:"source"`
+	PayloadRef string                 `json:"payload_ref,omitempty" xml:"payload_ref,omitempty"`
+	CreatedAt  time.Time              `json:"created_at" xml:"created_at"`
+}
@@ -0,0 +1,169 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// transactionTransitions are the statuses a transaction may move to from each status,
+// on a webhook, a consumer message or a recovery outcome.
+//
+//	A webhook can arrive before the transaction is marked PENDING, so INIT may move straight to an outcome.
+//	Nothing moves to KAFKA_PUBLISH_FAILED anymore, transactions left in it can still get their outcome.
+//	Transactions the recovery worker gives up on go to MANUAL_REVIEW, where they can still get their outcome.
+//	FAILED is terminal, a SUCCESS deposit only moves on through refundTransitions.
+var transactionTransitions = map[TransactionStatus][]TransactionStatus{
+	INIT:                 {PENDING, SUCCESS, FAILED, MANUAL_REVIEW},
+	PENDING:              {SUCCESS, FAILED},
+	KAFKA_PUBLISH_FAILED: {SUCCESS, FAILED, MANUAL_REVIEW},
+	MANUAL_REVIEW:        {SUCCESS, FAILED},
+	SUCCESS:              {},
+	FAILED:               {},
+	PARTIALLY_REFUNDED:   {},
+	REFUNDED:             {},
+}
+
+// refundTransitions are the statuses a deposit moves to as its refunds succeed, until its whole amount is REFUNDED.
+// Only the repository takes them, when it settles a refund under the deposit's row lock, so the status always
+// matches the refund rows and the ledger. No gateway may request them.
+var refundTransitions = map[TransactionStatus][]TransactionStatus{
+	SUCCESS:            {PARTIALLY_REFUNDED, REFUNDED},
+	PARTIALLY_REFUNDED: {REFUNDED},
+}
+
+// transactionStatuses are all the statuses, in the order they are reached
+var transactionStatuses = []TransactionStatus{INIT, PENDING, KAFKA_PUBLISH_FAILED, MANUAL_REVIEW, SUCCESS, FAILED, PARTIALLY_REFUNDED, REFUNDED}
+
+// ErrInvalidTransition is matched by every InvalidTransitionError with errors.Is
+var ErrInvalidTransition = errors.New("invalid transaction status transition")
+
+// InvalidTransitionError is returned when a transaction can't move from its status to the requested one
+type InvalidTransitionError struct {
+	TxnID int
+	From  TransactionStatus
+	To    TransactionStatus
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("transaction %d can't move from %s to %s", e.TxnID, e.From, e.To)
+}
+
+func (e *InvalidTransitionError) Is(target error) bool {
+	return target == ErrInvalidTransition
+}
+
+// ErrConcurrentModification is matched by every ConcurrentModificationError with errors.Is
+var ErrConcurrentModification = errors.New("transaction was modified concurrently")
+
+// ConcurrentModificationError is returned when a transaction was updated since it was read,
+// the caller may read it again and retry, or give up
+type ConcurrentModificationError struct {
+	TxnID int
+	// Version is the version the caller read
+	Version int
+	// Current is the version in db
+	Current int
+}
+
+func (e *ConcurrentModificationError) Error() string {
+	return fmt.Sprintf("transaction %d was modified concurrently, read version %d, current version %d", e.TxnID, e.Version, e.Current)
+}
+
+func (e *ConcurrentModificationError) Is(target error) bool {
+	return target == ErrConcurrentModification
+}
+
+// ErrStaleUpdate is matched by every StaleUpdateError with errors.Is
+var ErrStaleUpdate = errors.New("stale transaction status update")
+
+// StaleUpdateError is returned when a status change is older than the last one applied to a transaction,
+// gateways may deliver status changes out of order, so it is ignored rather than failed
+type StaleUpdateError struct {
+	TxnID int
+	// UpdatedAt is when the gateway made the stale status change
+	UpdatedAt time.Time
+	// GatewayUpdatedAt is when the gateway made the last status change applied to the transaction
+	GatewayUpdatedAt time.Time
+}
+
+func (e *StaleUpdateError) Error() string {
+	return fmt.Sprintf("transaction %d was updated by its gateway at %s, ignoring update from %s",
+		e.TxnID, e.GatewayUpdatedAt.Format(time.RFC3339Nano), e.UpdatedAt.Format(time.RFC3339Nano))
+}
+
+func (e *StaleUpdateError) Is(target error) bool {
+	return target == ErrStaleUpdate
+}
+
+// CanTransitionTo reports whether a transaction in status t may move to next on a gateway outcome
+func (t TransactionStatus) CanTransitionTo(next TransactionStatus) bool {
+	return containsStatus(transactionTransitions[t], next)
+}
+
+// CanRefundTo reports whether a deposit in status t may move to next when one of its refunds is settled
+func (t TransactionStatus) CanRefundTo(next TransactionStatus) bool {
+	return containsStatus(refundTransitions[t], next)
+}
+
+func containsStatus(statuses []TransactionStatus, status TransactionStatus) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValid reports whether t is a known status
+func (t TransactionStatus) IsValid() bool {
+	_, known := transactionTransitions[t]
+	return known
+}
+
+// IsRefunded reports whether refunds of a transaction in status t succeeded, which means it was SUCCESS before
+func (t TransactionStatus) IsRefunded() bool {
+	return t == PARTIALLY_REFUNDED || t == REFUNDED
+}
+
+// IsTerminal reports whether no status may follow t, not even through a refund
+func (t TransactionStatus) IsTerminal() bool {
+	next, known := transactionTransitions[t]
+	return known && len(next) == 0 && len(refundTransitions[t]) == 0
+}
+
+// SourceStatuses returns the statuses which may move to t, used to guard status updates in SQL
+func (t TransactionStatus) SourceStatuses() []TransactionStatus {
+	var sources []TransactionStatus
+	for _, from := range transactionStatuses {
+		if from.CanTransitionTo(t) {
+			sources = append(sources, from)
+		}
+	}
+	return sources
+}
+
+// RefundSourceStatuses returns the statuses a deposit may be in to move to t when a refund is settled
+func (t TransactionStatus) RefundSourceStatuses() []TransactionStatus {
+	var sources []TransactionStatus
+	for _, from := range transactionStatuses {
+		if from.CanRefundTo(t) {
+			sources = append(sources, from)
+		}
+	}
+	return sources
+}
+
+// ValidateTransition returns an InvalidTransitionError if txn can't move to next
+func (txn *Transaction) ValidateTransition(next TransactionStatus) error {
+	if !txn.Status.CanTransitionTo(next) {
+		return &InvalidTransitionError{TxnID: txn.ID, From: txn.Status, To: next}
+	}
+	return nil
+}
+
+// IsStale reports whether a status change the gateway made at updatedAt is older than the last one applied to txn,
+// a status change without a timestamp is never stale
+func (txn *Transaction) IsStale(updatedAt time.Time) bool {
+	return !updatedAt.IsZero() && txn.GatewayUpdatedAt != nil && txn.GatewayUpdatedAt.After(updatedAt)
+}
@@ -0,0 +1,96 @@
+package models
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionStatusTransitions(t *testing.T) {
+	cases := []struct {
+		from, to TransactionStatus
+		allowed  bool
+	}{
+		{INIT, PENDING, true},
+		{INIT, SUCCESS, true},
+		{PENDING, SUCCESS, true},
+		{PENDING, FAILED, true},
+		{PENDING, KAFKA_PUBLISH_FAILED, false},
+		{KAFKA_PUBLISH_FAILED, SUCCESS, true},
+		{PENDING, INIT, false},
+		{PENDING, PENDING, false},
+		{SUCCESS, PENDING, false},
+		{SUCCESS, FAILED, false},
+		{FAILED, SUCCESS, false},
+		{KAFKA_PUBLISH_FAILED, PENDING, false},
+		{INIT, MANUAL_REVIEW, true},
+		{KAFKA_PUBLISH_FAILED, MANUAL_REVIEW, true},
+		{PENDING, MANUAL_REVIEW, false},
+		{MANUAL_REVIEW, SUCCESS, true},
+		{MANUAL_REVIEW, INIT, false},
+		{SUCCESS, PARTIALLY_REFUNDED, false},
+		{SUCCESS, REFUNDED, false},
+		{PARTIALLY_REFUNDED, REFUNDED, false},
+		{PARTIALLY_REFUNDED, SUCCESS, false},
+		{REFUNDED, PARTIALLY_REFUNDED, false},
+		{FAILED, REFUNDED, false},
+		{PENDING, REFUNDED, false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.allowed, c.from.CanTransitionTo(c.to), "%s -> %s", c.from, c.to)
+	}
+
+	assert.True(t, MANUAL_REVIEW.IsValid())
+	assert.False(t, TransactionStatus("COMPLETED").IsValid())
+	assert.False(t, SUCCESS.IsTerminal())
+	assert.True(t, FAILED.IsTerminal())
+	assert.True(t, REFUNDED.IsTerminal())
+	assert.False(t, PENDING.IsTerminal())
+	assert.False(t, MANUAL_REVIEW.IsTerminal())
+	assert.ElementsMatch(t, []TransactionStatus{INIT, PENDING, KAFKA_PUBLISH_FAILED, MANUAL_REVIEW}, SUCCESS.SourceStatuses())
+	assert.ElementsMatch(t, []TransactionStatus{INIT}, PENDING.SourceStatuses())
+	assert.Empty(t, REFUNDED.SourceStatuses())
+	assert.Empty(t, PARTIALLY_REFUNDED.SourceStatuses())
+	assert.True(t, REFUNDED.IsRefunded())
+	assert.False(t, SUCCESS.IsRefunded())
+}
+
+func TestRefundTransitions(t *testing.T) {
+	cases := []struct {
+		from, to TransactionStatus
+		allowed  bool
+	}{
+		{SUCCESS, PARTIALLY_REFUNDED, true},
+		{SUCCESS, REFUNDED, true},
+		{PARTIALLY_REFUNDED, REFUNDED, true},
+		{PARTIALLY_REFUNDED, PARTIALLY_REFUNDED, false},
+		{PARTIALLY_REFUNDED, SUCCESS, false},
+		{REFUNDED, PARTIALLY_REFUNDED, false},
+		{FAILED, REFUNDED, false},
+		{PENDING, REFUNDED, false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.allowed, c.from.CanRefundTo(c.to), "%s -> %s", c.from, c.to)
+	}
+
+	assert.ElementsMatch(t, []TransactionStatus{SUCCESS, PARTIALLY_REFUNDED}, REFUNDED.RefundSourceStatuses())
+	assert.ElementsMatch(t, []TransactionStatus{SUCCESS}, PARTIALLY_REFUNDED.RefundSourceStatuses())
+	assert.Empty(t, SUCCESS.RefundSourceStatuses())
+}
+
+func TestValidateTransition(t *testing.T) {
+	txn := &Transaction{ID: 1, Status: SUCCESS}
+
+	err := txn.ValidateTransition(PENDING)
+
+	var transitionErr *InvalidTransitionError
+	assert.True(t, errors.As(err, &transitionErr))
+	assert.True(t, errors.Is(err, ErrInvalidTransition))
+	assert.Equal(t, SUCCESS, transitionErr.From)
+	assert.Equal(t, PENDING, transitionErr.To)
+
+	assert.NoError(t, (&Transaction{Status: PENDING}).ValidateTransition(SUCCESS))
+}
@@ -2,17 +2,24 @@ package repository
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"payment-gateway/internal/models"
 	"time"
 )
 
-// GatewayRepository defines methods for retrieving gateways
+// GatewayRepository defines methods for retrieving gateways.
+//
+// Gateways belong to a merchant, every gateway query is scoped to one, a gateway of another merchant is not found.
+// Countries are reference data shared by every merchant
 type GatewayRepository interface {
-	GetGatewaysByCountryAndCurrency(countryId, currency string) ([]*models.Gateway, error)
-	GetGateways() ([]models.Gateway, error)
+	GetGatewaysByCountryAndCurrency(merchantID int, countryId, currency string) ([]*models.Gateway, error)
+	GetGateways(merchantID int) ([]models.Gateway, error)
 	CreateGateway(gateway models.Gateway) error
-	GetSupportedCountriesByGateway(gatewayID int) ([]models.Country, error)
+	GetSupportedCountriesByGateway(merchantID, gatewayID int) ([]models.Country, error)
+	GetCountry(countryID int) (*models.Country, error)
+	GetGatewayByName(merchantID int, name string) (*models.Gateway, error)
+	GetGateway(merchantID, gatewayID int) (*models.Gateway, error)
 }
 
 // GatewayRepositoryImpl is the concrete implementation of GatewayRepository
@@ -25,8 +32,8 @@ func NewGatewayRepository(db *sql.DB) *GatewayRepositoryImpl {
 	return &GatewayRepositoryImpl{db: db}
 }
 
-func (g *GatewayRepositoryImpl) GetGateways() ([]models.Gateway, error) {
-	rows, err := g.db.Query(`SELECT id, name, data_format_supported, created_at, updated_at FROM gateways`)
+func (g *GatewayRepositoryImpl) GetGateways(merchantID int) ([]models.Gateway, error) {
+	rows, err := g.db.Query(`SELECT id, merchant_id, name, data_format_supported, created_at, updated_at FROM gateways WHERE merchant_id = $1`, merchantID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch gateways: %v", err)
 	}
@@ -35,7 +42,7 @@ func (g *GatewayRepositoryImpl) GetGateways() ([]models.Gateway, error) {
 	var gateways []models.Gateway
 	for rows.Next() {
 		var gateway models.Gateway
-		if err := rows.Scan(&gateway.ID, &gateway.Name, &gateway.DataFormatSupported, &gateway.CreatedAt, &gateway.UpdatedAt); err != nil {
+		if err := rows.Scan(&gateway.ID, &gateway.MerchantID, &gateway.Name, &gateway.DataFormatSupported, &gateway.CreatedAt, &gateway.UpdatedAt); err != nil {
 			return nil, fmt.Errorf("failed to scan gateway: %v", err)
 		}
 		gateways = append(gateways, gateway)
@@ -46,20 +53,21 @@ func (g *GatewayRepositoryImpl) GetGateways() ([]models.Gateway, error) {
 	return gateways, nil
 }
 
-// GetGatewayByCurrency fetches all suitable gateways based on the currency.
+// GetGatewayByCurrency fetches all suitable gateways of merchantID based on the currency, along with their routing rule for the country.
 //
-//	Note: The first gateway of the list will be the latest created gateway
-func (g *GatewayRepositoryImpl) GetGatewaysByCountryAndCurrency(countryId, currency string) ([]*models.Gateway, error) {
+//	Note: Gateways are ordered by priority, the latest created gateway comes first among the same priority
+func (g *GatewayRepositoryImpl) GetGatewaysByCountryAndCurrency(merchantID int, countryId, currency string) ([]*models.Gateway, error) {
 	query := `
-		SELECT g.id, g.name, g.data_format_supported
+		SELECT g.id, g.merchant_id, g.name, g.data_format_supported, gc.priority, gc.weight, gc.min_amount, gc.max_amount, gc.enabled
 		FROM gateways g
 		JOIN gateway_countries gc ON g.id = gc.gateway_id
 		JOIN countries c ON gc.country_id = c.id
 		WHERE c.currency = $1
 		and c.id = $2::numeric
-		order by g.created_at desc;`
+		and g.merchant_id = $3
+		order by gc.priority asc, g.created_at desc;`
 
-	rows, err := g.db.Query(query, currency, countryId)
+	rows, err := g.db.Query(query, currency, countryId, merchantID)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't find appropriate gateways: %v", err)
 	}
@@ -68,9 +76,21 @@ func (g *GatewayRepositoryImpl) GetGatewaysByCountryAndCurrency(countryId, curre
 	var gateways []*models.Gateway
 	for rows.Next() {
 		var gateway models.Gateway
-		if err := rows.Scan(&gateway.ID, &gateway.Name, &gateway.DataFormatSupported); err != nil {
+		var rule models.RoutingRule
+		var minAmount, maxAmount sql.NullString
+
+		if err := rows.Scan(&gateway.ID, &gateway.MerchantID, &gateway.Name, &gateway.DataFormatSupported, &rule.Priority, &rule.Weight, &minAmount, &maxAmount, &rule.Enabled); err != nil {
 			return nil, fmt.Errorf("failed to scan gateway: %v", err)
 		}
+
+		if rule.MinAmount, err = parseRuleAmount(minAmount, currency); err != nil {
+			return nil, fmt.Errorf("invalid min amount for gateway %d: %v", gateway.ID, err)
+		}
+		if rule.MaxAmount, err = parseRuleAmount(maxAmount, currency); err != nil {
+			return nil, fmt.Errorf("invalid max amount for gateway %d: %v", gateway.ID, err)
+		}
+
+		gateway.Routing = &rule
 		gateways = append(gateways, &gateway)
 	}
 	if err := rows.Err(); err != nil {
@@ -79,27 +99,41 @@ func (g *GatewayRepositoryImpl) GetGatewaysByCountryAndCurrency(countryId, curre
 	return gateways, nil
 }
 
+// parseRuleAmount parses a nullable routing rule bound, a NULL bound is unbounded
+func parseRuleAmount(amount sql.NullString, currency string) (*models.Money, error) {
+	if !amount.Valid {
+		return nil, nil
+	}
+
+	money, err := models.ParseMoney(amount.String, currency)
+	if err != nil {
+		return nil, err
+	}
+	return &money, nil
+}
+
 func (g *GatewayRepositoryImpl) CreateGateway(gateway models.Gateway) error {
-	query := `INSERT INTO gateways (name, data_format_supported, created_at, updated_at) 
-			  VALUES ($1, $2, $3, $4) RETURNING id`
+	query := `INSERT INTO gateways (merchant_id, name, data_format_supported, created_at, updated_at) 
+			  VALUES ($1, $2, $3, $4, $5) RETURNING id`
 
-	err := g.db.QueryRow(query, gateway.Name, gateway.DataFormatSupported, time.Now(), time.Now()).Scan(&gateway.ID)
+	err := g.db.QueryRow(query, gateway.MerchantID, gateway.Name, gateway.DataFormatSupported, time.Now(), time.Now()).Scan(&gateway.ID)
 	if err != nil {
 		return fmt.Errorf("failed to insert gateway: %v", err)
 	}
 	return nil
 }
 
-func (g *GatewayRepositoryImpl) GetSupportedCountriesByGateway(gatewayID int) ([]models.Country, error) {
+func (g *GatewayRepositoryImpl) GetSupportedCountriesByGateway(merchantID, gatewayID int) ([]models.Country, error) {
 	query := `
 		SELECT c.id AS country_id, c.name AS country_name
 		FROM countries c
 		JOIN gateway_countries gc ON c.id = gc.country_id
-		WHERE gc.gateway_id = $1
+		JOIN gateways g ON g.id = gc.gateway_id
+		WHERE gc.gateway_id = $1 AND g.merchant_id = $2
 		ORDER BY c.name
 	`
 
-	rows, err := g.db.Query(query, gatewayID)
+	rows, err := g.db.Query(query, gatewayID, merchantID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch countries for gateway %d: %v", gatewayID, err)
 	}
@@ -120,3 +154,65 @@ func (g *GatewayRepositoryImpl) GetSupportedCountriesByGateway(gatewayID int) ([
 
 	return countries, nil
 }
+
+// GetCountry fetches a country along with the currency it transacts in, countries are shared by every merchant.
+//
+//	If the country doesn't exist, `models.ErrCountryNotFound` is returned
+func (g *GatewayRepositoryImpl) GetCountry(countryID int) (*models.Country, error) {
+	country := models.Country{}
+
+	err := g.db.QueryRow(`SELECT id, name, code, currency, created_at, updated_at FROM countries WHERE id = $1`, countryID).
+		Scan(&country.ID, &country.Name, &country.Code, &country.Currency, &country.CreatedAt, &country.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, models.ErrCountryNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch country %d: %v", countryID, err)
+	}
+
+	return &country, nil
+}
+
+// GetGatewayByName fetches a gateway of merchantID by its name, which is unique per merchant.
+//
+//	If the gateway doesn't exist for merchantID, `models.ErrGatewayNotFound` is returned
+func (g *GatewayRepositoryImpl) GetGatewayByName(merchantID int, name string) (*models.Gateway, error) {
+	gateway, err := scanGateway(g.db.QueryRow(`SELECT `+gatewayColumns+` FROM gateways WHERE merchant_id = $1 AND name = $2`, merchantID, name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, models.ErrGatewayNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch gateway %s: %v", name, err)
+	}
+	return gateway, nil
+}
+
+// GetGateway fetches a gateway of merchantID by its ID.
+//
+//	If the gateway doesn't exist for merchantID, `models.ErrGatewayNotFound` is returned
+func (g *GatewayRepositoryImpl) GetGateway(merchantID, gatewayID int) (*models.Gateway, error) {
+	gateway, err := scanGateway(g.db.QueryRow(`SELECT `+gatewayColumns+` FROM gateways WHERE id = $1 AND merchant_id = $2`, gatewayID, merchantID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, models.ErrGatewayNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch gateway %d: %v", gatewayID, err)
+	}
+	return gateway, nil
+}
+
+// gatewayColumns are the columns read by scanGateway, in the order it expects them
+const gatewayColumns = `id, merchant_id, name, data_format_supported, webhook_secret, created_at, updated_at`
+
+func scanGateway(row rowScanner) (*models.Gateway, error) {
+	gateway := models.Gateway{}
+	var webhookSecret sql.NullString
+
+	err := row.Scan(&gateway.ID, &gateway.MerchantID, &gateway.Name, &gateway.DataFormatSupported, &webhookSecret, &gateway.CreatedAt, &gateway.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	gateway.WebhookSecret = webhookSecret.String
+	return &gateway, nil
+}
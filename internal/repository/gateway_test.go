@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"database/sql"
+	"payment-gateway/internal/models"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetCountry(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewGatewayRepository(db)
+
+	rows := sqlmock.NewRows([]string{"id", "name", "code", "currency", "created_at", "updated_at"}).
+		AddRow(3, "United States", "US", "USD", time.Now(), time.Now())
+
+	mock.ExpectQuery(`SELECT id, name, code, currency, created_at, updated_at FROM countries WHERE id = \$1`).
+		WithArgs(3).
+		WillReturnRows(rows)
+
+	country, err := repo.GetCountry(3)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "USD", country.Currency)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetCountry_NotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewGatewayRepository(db)
+
+	mock.ExpectQuery(`SELECT id, name, code, currency, created_at, updated_at FROM countries WHERE id = \$1`).
+		WithArgs(99).
+		WillReturnError(sql.ErrNoRows)
+
+	_, err = repo.GetCountry(99)
+
+	assert.ErrorIs(t, err, models.ErrCountryNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetGatewaysByCountryAndCurrency(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewGatewayRepository(db)
+
+	rows := sqlmock.NewRows([]string{"id", "merchant_id", "name", "data_format_supported", "priority", "weight", "min_amount", "max_amount", "enabled"}).
+		AddRow(2, 4, "stripe", "application/json", 1, 70, "10.000", nil, true).
+		AddRow(1, 4, "paypal", "application/json", 1, 30, nil, "5000.000", false)
+
+	mock.ExpectQuery(`SELECT g.id, g.merchant_id, g.name, g.data_format_supported, gc.priority, gc.weight, gc.min_amount, gc.max_amount, gc.enabled .* and g.merchant_id = \$3`).
+		WithArgs("USD", "3", 4).
+		WillReturnRows(rows)
+
+	gateways, err := repo.GetGatewaysByCountryAndCurrency(4, "3", "USD")
+
+	assert.NoError(t, err)
+	assert.Len(t, gateways, 2)
+	assert.Equal(t, 4, gateways[0].MerchantID)
+	assert.Equal(t, 70, gateways[0].Routing.Weight)
+	assert.Equal(t, models.NewMoney(1000, "USD"), *gateways[0].Routing.MinAmount)
+	assert.Nil(t, gateways[0].Routing.MaxAmount)
+	assert.Equal(t, models.NewMoney(500000, "USD"), *gateways[1].Routing.MaxAmount)
+	assert.False(t, gateways[1].Routing.Enabled)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,86 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"payment-gateway/internal/models"
+	"time"
+)
+
+// IdempotencyRepository defines methods for storing responses against idempotency keys
+type IdempotencyRepository interface {
+	// WithLock runs fn while holding a lock on key, so concurrent callers using the same key are serialized.
+	//
+	//   `existing` is nil if the key was never used or has expired.
+	//   If fn returns a record, it is stored against the key before the lock is released.
+	WithLock(ctx context.Context, key string, fn func(existing *models.IdempotencyRecord) (*models.IdempotencyRecord, error)) error
+}
+
+// IdempotencyRepositoryImpl is the concrete implementation of IdempotencyRepository
+type IdempotencyRepositoryImpl struct {
+	db *sql.DB
+}
+
+// NewIdempotencyRepository creates a new instance of IdempotencyRepository.
+func NewIdempotencyRepository(db *sql.DB) *IdempotencyRepositoryImpl {
+	return &IdempotencyRepositoryImpl{db: db}
+}
+
+// WithLock takes a transaction scoped advisory lock on the key, which is released on commit or rollback.
+//
+//	Since the lock lives in postgres, requests are serialized across every running instance.
+func (i *IdempotencyRepositoryImpl) WithLock(ctx context.Context, key string, fn func(existing *models.IdempotencyRecord) (*models.IdempotencyRecord, error)) error {
+	tx, err := i.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin idempotency transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, key); err != nil {
+		return fmt.Errorf("failed to lock idempotency key: %v", err)
+	}
+
+	var existing *models.IdempotencyRecord
+	record := models.IdempotencyRecord{}
+
+	var transactionID sql.NullInt64
+	err = tx.QueryRowContext(ctx, `SELECT key, request_hash, status_code, response, created_at, expires_at, transaction_id FROM idempotency_keys WHERE key = $1 AND expires_at > $2`, key, time.Now()).
+		Scan(&record.Key, &record.RequestHash, &record.StatusCode, &record.Response, &record.CreatedAt, &record.ExpiresAt, &transactionID)
+	switch {
+	case err == nil:
+		if transactionID.Valid {
+			id := int(transactionID.Int64)
+			record.TransactionID = &id
+		}
+		existing = &record
+	case errors.Is(err, sql.ErrNoRows):
+		// Key is new or expired, expired rows get overwritten below
+	default:
+		return fmt.Errorf("failed to fetch idempotency key: %v", err)
+	}
+
+	toSave, err := fn(existing)
+	if err != nil {
+		return err
+	}
+
+	if toSave != nil {
+		query := `INSERT INTO idempotency_keys (key, request_hash, status_code, response, created_at, expires_at, transaction_id)
+				  VALUES ($1, $2, $3, $4, $5, $6, $7)
+				  ON CONFLICT (key) DO UPDATE SET request_hash = EXCLUDED.request_hash, status_code = EXCLUDED.status_code,
+				  response = EXCLUDED.response, created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at,
+				  transaction_id = EXCLUDED.transaction_id`
+
+		_, err = tx.ExecContext(ctx, query, key, toSave.RequestHash, toSave.StatusCode, toSave.Response, toSave.CreatedAt, toSave.ExpiresAt, toSave.TransactionID)
+		if err != nil {
+			return fmt.Errorf("failed to store idempotency key: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit idempotency key: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"payment-gateway/internal/models"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyWithLock_NewKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewIdempotencyRepository(db)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock\(hashtext\(\$1\)\)`).
+		WithArgs("key-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT key, request_hash, status_code, response, created_at, expires_at, transaction_id FROM idempotency_keys WHERE key = \$1 AND expires_at > \$2`).
+		WithArgs("key-1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"key", "request_hash", "status_code", "response", "created_at", "expires_at", "transaction_id"}))
+	mock.ExpectExec(`INSERT INTO idempotency_keys`).
+		WithArgs("key-1", "hash", 200, []byte(`{}`), sqlmock.AnyArg(), sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = repo.WithLock(context.Background(), "key-1", func(existing *models.IdempotencyRecord) (*models.IdempotencyRecord, error) {
+		assert.Nil(t, existing)
+		return &models.IdempotencyRecord{RequestHash: "hash", StatusCode: 200, Response: []byte(`{}`), CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}, nil
+	})
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestIdempotencyWithLock_ExistingKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewIdempotencyRepository(db)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock`).
+		WithArgs("key-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT key, request_hash, status_code, response, created_at, expires_at, transaction_id FROM idempotency_keys`).
+		WithArgs("key-1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"key", "request_hash", "status_code", "response", "created_at", "expires_at", "transaction_id"}).
+			AddRow("key-1", "hash", 502, []byte(`{}`), time.Now(), time.Now().Add(time.Hour), 7))
+	mock.ExpectRollback()
+
+	reusedErr := errors.New("reused")
+	err = repo.WithLock(context.Background(), "key-1", func(existing *models.IdempotencyRecord) (*models.IdempotencyRecord, error) {
+		assert.NotNil(t, existing)
+		assert.Equal(t, "hash", existing.RequestHash)
+		assert.Equal(t, 7, *existing.TransactionID)
+		return nil, reusedErr
+	})
+
+	assert.ErrorIs(t, err, reusedErr)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
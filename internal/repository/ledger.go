@@ -0,0 +1,282 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"payment-gateway/internal/models"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// LedgerRepository defines methods for reading the ledger, journals are posted along with the status changes of transactions
+type LedgerRepository interface {
+	// GetJournals returns the journals posted for a transaction, oldest first
+	GetJournals(ctx context.Context, txnID int) ([]models.Journal, error)
+	// GetUserBalances returns the balances of a user at merchantID, in every currency the user has an account in there
+	GetUserBalances(ctx context.Context, merchantID, userID int) ([]models.Balance, error)
+	// UnbalancedJournals returns the journals whose entries don't sum to zero, or which have less than two entries
+	UnbalancedJournals(ctx context.Context) ([]models.JournalImbalance, error)
+}
+
+// LedgerRepositoryImpl is the concrete implementation of LedgerRepository
+type LedgerRepositoryImpl struct {
+	db *sql.DB
+}
+
+// NewLedgerRepository creates a new instance of LedgerRepository.
+func NewLedgerRepository(db *sql.DB) *LedgerRepositoryImpl {
+	return &LedgerRepositoryImpl{db: db}
+}
+
+func (l *LedgerRepositoryImpl) GetJournals(ctx context.Context, txnID int) ([]models.Journal, error) {
+	return transactionJournals(ctx, l.db, txnID)
+}
+
+func (l *LedgerRepositoryImpl) GetUserBalances(ctx context.Context, merchantID, userID int) ([]models.Balance, error) {
+	return userBalances(ctx, l.db, merchantID, userID, "")
+}
+
+// walletDebitTypes are the types of transactions taking funds out of their user's wallet
+var walletDebitTypes = []models.TransactionType{models.WITHDRAWAL, models.REFUND}
+
+// unheldDebitStatuses are the statuses of withdrawals and refunds which may still be sent to a gateway, but whose funds aren't held yet
+var unheldDebitStatuses = []models.TransactionStatus{models.INIT, models.KAFKA_PUBLISH_FAILED, models.MANUAL_REVIEW}
+
+// userBalances sums the accounts of a user at merchantID, in currency, or in every currency when it is empty.
+//
+//	The wallet and held funds are credit balances, so they are the negated sums of their entries.
+//	Withdrawals and refunds whose funds aren't held yet are taken out of the available balance, so they can't be spent twice
+func userBalances(ctx context.Context, q queryer, merchantID, userID int, currency string) ([]models.Balance, error) {
+	query := `WITH accounts AS (
+			SELECT a.currency,
+				COALESCE(-SUM(e.amount) FILTER (WHERE a.type = $2), 0) AS wallet,
+				COALESCE(-SUM(e.amount) FILTER (WHERE a.type = $3), 0) AS held
+			FROM ledger_accounts a LEFT JOIN ledger_entries e ON e.account_id = a.id
+			WHERE a.merchant_id = $7 AND a.owner_id = $1 AND a.type IN ($2, $3) AND ($4 = '' OR a.currency = $4)
+			GROUP BY a.currency
+		), unheld AS (
+			SELECT currency, SUM(amount) AS amount FROM transactions
+			WHERE merchant_id = $7 AND user_id = $1 AND type = ANY($5) AND status = ANY($6) AND ($4 = '' OR currency = $4)
+			GROUP BY currency
+		)
+		SELECT a.currency, (a.wallet - COALESCE(u.amount, 0))::text, a.held::text
+		FROM accounts a LEFT JOIN unheld u ON u.currency = a.currency
+		ORDER BY a.currency`
+
+	rows, err := q.QueryContext(ctx, query, userID, models.USER_WALLET, models.USER_HOLD, currency, pq.Array(walletDebitTypes), pq.Array(unheldDebitStatuses), merchantID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch balances of user %d: %v", userID, err)
+	}
+	defer rows.Close()
+
+	balances := []models.Balance{}
+	for rows.Next() {
+		balance := models.Balance{}
+		var available, held string
+		if err := rows.Scan(&balance.Currency, &available, &held); err != nil {
+			return nil, fmt.Errorf("failed to scan balance: %v", err)
+		}
+		if balance.Available, err = models.ParseMoney(available, balance.Currency); err != nil {
+			return nil, fmt.Errorf("invalid available balance of user %d: %v", userID, err)
+		}
+		if balance.Held, err = models.ParseMoney(held, balance.Currency); err != nil {
+			return nil, fmt.Errorf("invalid held balance of user %d: %v", userID, err)
+		}
+		balances = append(balances, balance)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to fetch balances of user %d: %v", userID, err)
+	}
+	return balances, nil
+}
+
+// checkAvailableFunds returns an error matching models.ErrInsufficientFunds unless the available balance of the user of a withdrawal
+// or a refund covers it.
+//
+//	The user's wallet is locked until the caller's db transaction ends, so the withdrawals and refunds of a user are checked one after the other,
+//	and one inserted by the caller counts against the next one's available balance
+func checkAvailableFunds(ctx context.Context, q queryer, txn *models.Transaction) error {
+	var walletID int64
+	err := q.QueryRowContext(ctx, `SELECT id FROM ledger_accounts WHERE merchant_id = $1 AND type = $2 AND owner_id = $3 AND currency = $4 FOR UPDATE`, txn.MerchantID, models.USER_WALLET, txn.UserID, txn.Currency).
+		Scan(&walletID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: user %d has no %s wallet", models.ErrInsufficientFunds, txn.UserID, txn.Currency)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock wallet of user %d: %v", txn.UserID, err)
+	}
+
+	balances, err := userBalances(ctx, q, txn.MerchantID, txn.UserID, txn.Currency)
+	if err != nil {
+		return err
+	}
+	available := models.NewMoney(0, txn.Currency)
+	if len(balances) > 0 {
+		available = balances[0].Available
+	}
+	if available.MinorUnits < txn.Amount.MinorUnits {
+		return fmt.Errorf("%w: %s of %s %s, %s available", models.ErrInsufficientFunds, strings.ToLower(txn.Type), txn.Amount, txn.Currency, available)
+	}
+	return nil
+}
+
+// UnbalancedJournals sums the entries of every journal, it is meant for offline checks as it reads the whole ledger
+func (l *LedgerRepositoryImpl) UnbalancedJournals(ctx context.Context) ([]models.JournalImbalance, error) {
+	query := `SELECT j.id, j.transaction_id, j.kind, j.currency, COALESCE(SUM(e.amount), 0)::text, COUNT(e.id)
+		FROM ledger_journals j LEFT JOIN ledger_entries e ON e.journal_id = j.id
+		GROUP BY j.id
+		HAVING COALESCE(SUM(e.amount), 0) <> 0 OR COUNT(e.id) < 2
+		ORDER BY j.id`
+
+	rows, err := l.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sum journals: %v", err)
+	}
+	defer rows.Close()
+
+	imbalances := []models.JournalImbalance{}
+	for rows.Next() {
+		imbalance := models.JournalImbalance{}
+		var sum string
+		if err := rows.Scan(&imbalance.JournalID, &imbalance.TransactionID, &imbalance.Kind, &imbalance.Currency, &sum, &imbalance.Entries); err != nil {
+			return nil, fmt.Errorf("failed to scan journal sum: %v", err)
+		}
+		imbalance.Sum, err = models.ParseMoney(sum, imbalance.Currency)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sum for journal %d: %v", imbalance.JournalID, err)
+		}
+		imbalances = append(imbalances, imbalance)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to sum journals: %v", err)
+	}
+	return imbalances, nil
+}
+
+// transactionJournals reads the journals of a transaction with their entries, oldest first
+func transactionJournals(ctx context.Context, q queryer, txnID int) ([]models.Journal, error) {
+	query := `SELECT j.id, j.kind, j.currency, j.created_at, a.type, a.owner_id, e.amount::text
+		FROM ledger_journals j
+		JOIN ledger_entries e ON e.journal_id = j.id
+		JOIN ledger_accounts a ON a.id = e.account_id
+		WHERE j.transaction_id = $1
+		ORDER BY j.id, e.id`
+
+	rows, err := q.QueryContext(ctx, query, txnID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch journals of transaction %d: %v", txnID, err)
+	}
+	defer rows.Close()
+
+	journals := []models.Journal{}
+	for rows.Next() {
+		journal := models.Journal{TransactionID: txnID}
+		entry := models.LedgerEntry{}
+		var amount string
+		if err := rows.Scan(&journal.ID, &journal.Kind, &journal.Currency, &journal.CreatedAt, &entry.AccountType, &entry.OwnerID, &amount); err != nil {
+			return nil, fmt.Errorf("failed to scan journal entry: %v", err)
+		}
+		entry.Amount, err = models.ParseMoney(amount, journal.Currency)
+		if err != nil {
+			return nil, fmt.Errorf("invalid amount in journal %d: %v", journal.ID, err)
+		}
+
+		if n := len(journals); n == 0 || journals[n-1].ID != journal.ID {
+			journals = append(journals, journal)
+		}
+		last := &journals[len(journals)-1]
+		last.Entries = append(last.Entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to fetch journals of transaction %d: %v", txnID, err)
+	}
+	return journals, nil
+}
+
+// postStatusJournal posts the journal of transaction txnID reaching status, in the caller's db transaction.
+//
+//	A withdrawal reaching PENDING has its funds held, a transaction reaching SUCCESS is settled,
+//	a transaction reaching FAILED has what was posted for it reversed, which releases held funds.
+//	No other status posts anything
+func postStatusJournal(ctx context.Context, q queryer, txnID int, status models.TransactionStatus) error {
+	var journal *models.Journal
+	switch status {
+	case models.PENDING:
+		txn, err := scanTransaction(q.QueryRowContext(ctx, `SELECT `+transactionColumns+` FROM transactions t WHERE t.id = $1`, txnID))
+		if err != nil {
+			return fmt.Errorf("failed to read transaction %d to hold: %v", txnID, err)
+		}
+		if models.TransactionType(txn.Type).DebitsWallet() {
+			journal = models.HoldJournal(txn)
+		}
+	case models.SUCCESS:
+		var feeBps int
+		row := q.QueryRowContext(ctx, `SELECT `+transactionColumns+`, g.fee_bps FROM transactions t JOIN gateways g ON g.id = t.gateway_id WHERE t.id = $1`, txnID)
+		txn, err := scanTransaction(extraColumnsScanner{row: row, extra: []interface{}{&feeBps}})
+		if err != nil {
+			return fmt.Errorf("failed to read transaction %d to settle: %v", txnID, err)
+		}
+		// A withdrawal or a refund which succeeded without going through PENDING was never held
+		held := false
+		if models.TransactionType(txn.Type).DebitsWallet() {
+			journals, err := transactionJournals(ctx, q, txnID)
+			if err != nil {
+				return err
+			}
+			held = models.HasJournal(journals, models.HOLD)
+		}
+		journal, err = models.SettlementJournal(txn, feeBps, held)
+		if err != nil {
+			return err
+		}
+	case models.FAILED:
+		txn, err := scanTransaction(q.QueryRowContext(ctx, `SELECT `+transactionColumns+` FROM transactions t WHERE t.id = $1`, txnID))
+		if err != nil {
+			return fmt.Errorf("failed to read transaction %d to reverse: %v", txnID, err)
+		}
+		journals, err := transactionJournals(ctx, q, txnID)
+		if err != nil {
+			return err
+		}
+		journal = models.ReversalJournal(txn, journals)
+	}
+
+	if journal == nil {
+		return nil
+	}
+	return insertJournal(ctx, q, journal)
+}
+
+// insertJournal posts a balanced journal, opening the accounts of its entries at the journal's merchant as needed.
+// A transaction has one journal of each kind, posting a kind again is a no-op
+func insertJournal(ctx context.Context, q queryer, journal *models.Journal) error {
+	if err := journal.Validate(); err != nil {
+		return err
+	}
+
+	err := q.QueryRowContext(ctx, `INSERT INTO ledger_journals (transaction_id, kind, currency) VALUES ($1, $2, $3)
+		ON CONFLICT (transaction_id, kind) DO NOTHING RETURNING id, created_at`, journal.TransactionID, journal.Kind, journal.Currency).
+		Scan(&journal.ID, &journal.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to insert %s journal of transaction %d: %v", journal.Kind, journal.TransactionID, err)
+	}
+
+	query := `WITH account AS (
+			INSERT INTO ledger_accounts (merchant_id, type, owner_id, currency) VALUES ($6, $2, $3, $4)
+			ON CONFLICT (merchant_id, type, owner_id, currency) DO UPDATE SET type = EXCLUDED.type
+			RETURNING id
+		)
+		INSERT INTO ledger_entries (journal_id, account_id, amount) SELECT $1, id, $5 FROM account`
+	for _, entry := range journal.Entries {
+		if _, err := q.ExecContext(ctx, query, journal.ID, entry.AccountType, entry.OwnerID, journal.Currency, entry.Amount, journal.MerchantID); err != nil {
+			return fmt.Errorf("failed to insert entry of journal %d: %v", journal.ID, err)
+		}
+	}
+	return nil
+}
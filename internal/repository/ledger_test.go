@@ -0,0 +1,184 @@
+package repository
+
+import (
+	"context"
+	"payment-gateway/internal/models"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+// expectSettlement expects the settlement of transaction txnID, a 100.00 USD deposit of user 3 through gateway 1, which charges 1%
+func expectSettlement(mock sqlmock.Sqlmock, txnID int) {
+	columns := []string{"id", "amount", "currency", "type", "status", "user_id", "gateway_id", "country_id", "created_at", "routing_decision", "gateway_updated_at", "version", "parent_id", "merchant_id", "fee_bps"}
+
+	mock.ExpectQuery(`FROM transactions t JOIN gateways g ON g.id = t.gateway_id WHERE t.id = \$1`).
+		WithArgs(txnID).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(txnID, "100.000", "USD", "DEPOSIT", "SUCCESS", 3, 1, 2, time.Now(), nil, nil, 2, nil, 1, 100))
+	mock.ExpectQuery(`INSERT INTO ledger_journals \(transaction_id, kind, currency\) VALUES \(\$1, \$2, \$3\)\s+ON CONFLICT \(transaction_id, kind\) DO NOTHING`).
+		WithArgs(txnID, models.SETTLEMENT, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(txnID*10, time.Now()))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).WithArgs(txnID*10, models.USER_WALLET, 3, "USD", "-100.00", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).WithArgs(txnID*10, models.GATEWAY_CLEARING, 1, "USD", "99.00", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).WithArgs(txnID*10, models.FEES, 0, "USD", "1.00", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func TestPostStatusJournal_Reversal(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	columns := []string{"id", "amount", "currency", "type", "status", "user_id", "gateway_id", "country_id", "created_at", "routing_decision", "gateway_updated_at", "version", "parent_id", "merchant_id"}
+	entryColumns := []string{"id", "kind", "currency", "created_at", "type", "owner_id", "amount"}
+
+	// A failed transaction had nothing posted for it, nothing is reversed
+	mock.ExpectQuery(`FROM transactions t WHERE t.id = \$1`).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "100.00", "USD", "WITHDRAWAL", "FAILED", 3, 1, 2, time.Now(), nil, nil, 3, nil, 1))
+	mock.ExpectQuery(`FROM ledger_journals j\s+JOIN ledger_entries e`).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(entryColumns))
+
+	assert.NoError(t, postStatusJournal(context.Background(), db, 1, models.FAILED))
+
+	// What was posted for it is reversed
+	mock.ExpectQuery(`FROM transactions t WHERE t.id = \$1`).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(2, "100.00", "USD", "WITHDRAWAL", "FAILED", 3, 1, 2, time.Now(), nil, nil, 3, nil, 1))
+	mock.ExpectQuery(`FROM ledger_journals j\s+JOIN ledger_entries e`).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows(entryColumns).
+			AddRow(5, "settlement", "USD", time.Now(), models.USER_WALLET, 3, "100.000").
+			AddRow(5, "settlement", "USD", time.Now(), models.SUSPENSE, 0, "-100.000"))
+	mock.ExpectQuery(`INSERT INTO ledger_journals`).
+		WithArgs(2, models.REVERSAL, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(6, time.Now()))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).WithArgs(6, models.USER_WALLET, 3, "USD", "-100.00", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).WithArgs(6, models.SUSPENSE, 0, "USD", "100.00", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	assert.NoError(t, postStatusJournal(context.Background(), db, 2, models.FAILED))
+
+	// Other statuses post nothing
+	assert.NoError(t, postStatusJournal(context.Background(), db, 3, models.MANUAL_REVIEW))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostStatusJournal_HoldsWithdrawal(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	columns := []string{"id", "amount", "currency", "type", "status", "user_id", "gateway_id", "country_id", "created_at", "routing_decision", "gateway_updated_at", "version", "parent_id", "merchant_id"}
+	entryColumns := []string{"id", "kind", "currency", "created_at", "type", "owner_id", "amount"}
+
+	// The gateway accepted the withdrawal, its funds are held
+	mock.ExpectQuery(`FROM transactions t WHERE t.id = \$1`).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "100.00", "USD", "WITHDRAWAL", "PENDING", 3, 1, 2, time.Now(), nil, nil, 2, nil, 1))
+	mock.ExpectQuery(`INSERT INTO ledger_journals`).
+		WithArgs(1, models.HOLD, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(10, time.Now()))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).WithArgs(10, models.USER_WALLET, 3, "USD", "100.00", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).WithArgs(10, models.USER_HOLD, 3, "USD", "-100.00", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	assert.NoError(t, postStatusJournal(context.Background(), db, 1, models.PENDING))
+
+	// It succeeded, the held funds are captured
+	mock.ExpectQuery(`JOIN gateways g ON g.id = t.gateway_id WHERE t.id = \$1`).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(append(columns, "fee_bps")).AddRow(1, "100.00", "USD", "WITHDRAWAL", "SUCCESS", 3, 1, 2, time.Now(), nil, nil, 3, nil, 1, 0))
+	mock.ExpectQuery(`FROM ledger_journals j\s+JOIN ledger_entries e`).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(entryColumns).
+			AddRow(10, "hold", "USD", time.Now(), models.USER_WALLET, 3, "100.000").
+			AddRow(10, "hold", "USD", time.Now(), models.USER_HOLD, 3, "-100.000"))
+	mock.ExpectQuery(`INSERT INTO ledger_journals`).
+		WithArgs(1, models.SETTLEMENT, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(11, time.Now()))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).WithArgs(11, models.USER_HOLD, 3, "USD", "100.00", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).WithArgs(11, models.GATEWAY_CLEARING, 1, "USD", "-100.00", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	assert.NoError(t, postStatusJournal(context.Background(), db, 1, models.SUCCESS))
+
+	// A refund accepted by the gateway is held too
+	mock.ExpectQuery(`FROM transactions t WHERE t.id = \$1`).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(2, "40.00", "USD", "REFUND", "PENDING", 3, 1, 2, time.Now(), nil, nil, 2, 1, 1))
+	mock.ExpectQuery(`INSERT INTO ledger_journals`).
+		WithArgs(2, models.HOLD, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(12, time.Now()))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).WithArgs(12, models.USER_WALLET, 3, "USD", "40.00", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).WithArgs(12, models.USER_HOLD, 3, "USD", "-40.00", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	assert.NoError(t, postStatusJournal(context.Background(), db, 2, models.PENDING))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetUserBalances(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewLedgerRepository(db)
+
+	mock.ExpectQuery(`WITH accounts AS`).
+		WithArgs(3, models.USER_WALLET, models.USER_HOLD, "", pq.Array(walletDebitTypes), sqlmock.AnyArg(), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"currency", "available", "held"}).
+			AddRow("EUR", "0.000", "0.000").
+			AddRow("USD", "80.500", "20.000"))
+
+	balances, err := repo.GetUserBalances(context.Background(), 2, 3)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []models.Balance{
+		{Currency: "EUR", Available: models.NewMoney(0, "EUR"), Held: models.NewMoney(0, "EUR")},
+		{Currency: "USD", Available: models.NewMoney(8050, "USD"), Held: models.NewMoney(2000, "USD")},
+	}, balances)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestInsertJournal_AlreadyPosted(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	journal := &models.Journal{TransactionID: 1, Kind: models.SETTLEMENT, Currency: "USD", Entries: []models.LedgerEntry{
+		{AccountType: models.USER_WALLET, OwnerID: 3, Amount: models.NewMoney(-100, "USD")},
+		{AccountType: models.GATEWAY_CLEARING, OwnerID: 1, Amount: models.NewMoney(100, "USD")},
+	}}
+
+	mock.ExpectQuery(`INSERT INTO ledger_journals`).
+		WithArgs(1, models.SETTLEMENT, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}))
+
+	assert.NoError(t, insertJournal(context.Background(), db, journal))
+
+	// Unbalanced journals are never inserted
+	journal.Entries[1].Amount = models.NewMoney(99, "USD")
+	assert.ErrorIs(t, insertJournal(context.Background(), db, journal), models.ErrUnbalancedJournal)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUnbalancedJournals(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewLedgerRepository(db)
+
+	mock.ExpectQuery(`HAVING COALESCE\(SUM\(e.amount\), 0\) <> 0 OR COUNT\(e.id\) < 2`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "transaction_id", "kind", "currency", "sum", "count"}).
+			AddRow(4, 1, "settlement", "KWD", "0.005", 3))
+
+	imbalances, err := repo.UnbalancedJournals(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, []models.JournalImbalance{{JournalID: 4, TransactionID: 1, Kind: models.SETTLEMENT, Currency: "KWD", Sum: models.NewMoney(5, "KWD"), Entries: 3}}, imbalances)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
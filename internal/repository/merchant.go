@@ -0,0 +1,123 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"payment-gateway/internal/models"
+	"time"
+)
+
+// MerchantRepository defines methods for storing merchants and their API keys
+type MerchantRepository interface {
+	// CreateMerchant inserts merchant along with its first API key, and sets their IDs
+	CreateMerchant(ctx context.Context, merchant *models.Merchant, key *models.APIKey) error
+	// GetActiveAPIKey returns the API key starting with prefix, if it hasn't expired at `at`.
+	//
+	//   If there is no such key, or it expired, models.ErrInvalidAPIKey is returned
+	GetActiveAPIKey(ctx context.Context, prefix string, at time.Time) (*models.APIKey, error)
+	// RotateAPIKey inserts key for `key.MerchantID`, and expires the other keys of the merchant at expiresAt,
+	// keys already expiring before keep their expiry.
+	//
+	//   If the merchant doesn't exist, models.ErrMerchantNotFound is returned
+	RotateAPIKey(ctx context.Context, key *models.APIKey, expiresAt time.Time) error
+}
+
+// MerchantRepositoryImpl is the concrete implementation of MerchantRepository
+type MerchantRepositoryImpl struct {
+	db *sql.DB
+}
+
+// NewMerchantRepository creates a new instance of MerchantRepository.
+func NewMerchantRepository(db *sql.DB) *MerchantRepositoryImpl {
+	return &MerchantRepositoryImpl{db: db}
+}
+
+func (m *MerchantRepositoryImpl) CreateMerchant(ctx context.Context, merchant *models.Merchant, key *models.APIKey) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin merchant creation: %v", err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `INSERT INTO merchants (name) VALUES ($1) RETURNING id, created_at`, merchant.Name).
+		Scan(&merchant.ID, &merchant.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert merchant %s: %v", merchant.Name, err)
+	}
+
+	key.MerchantID = merchant.ID
+	if err := insertAPIKey(ctx, tx, key); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit merchant creation: %v", err)
+	}
+	return nil
+}
+
+// GetActiveAPIKey compares the expiry in SQL, like idempotency keys, so it doesn't depend on the time zone the timestamps are read in
+func (m *MerchantRepositoryImpl) GetActiveAPIKey(ctx context.Context, prefix string, at time.Time) (*models.APIKey, error) {
+	key := models.APIKey{}
+	var expiresAt sql.NullTime
+
+	err := m.db.QueryRowContext(ctx, `SELECT id, merchant_id, prefix, key_hash, created_at, expires_at FROM merchant_api_keys
+		WHERE prefix = $1 AND (expires_at IS NULL OR expires_at > $2)`, prefix, at).
+		Scan(&key.ID, &key.MerchantID, &key.Prefix, &key.Hash, &key.CreatedAt, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: no active key %s", models.ErrInvalidAPIKey, prefix)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch API key %s: %v", prefix, err)
+	}
+
+	if expiresAt.Valid {
+		key.ExpiresAt = &expiresAt.Time
+	}
+	return &key, nil
+}
+
+// RotateAPIKey locks the merchant, so concurrent rotations of a merchant happen one after the other
+func (m *MerchantRepositoryImpl) RotateAPIKey(ctx context.Context, key *models.APIKey, expiresAt time.Time) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin API key rotation: %v", err)
+	}
+	defer tx.Rollback()
+
+	var merchantID int
+	err = tx.QueryRowContext(ctx, `SELECT id FROM merchants WHERE id = $1 FOR UPDATE`, key.MerchantID).Scan(&merchantID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.ErrMerchantNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock merchant %d: %v", key.MerchantID, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE merchant_api_keys SET expires_at = $2 WHERE merchant_id = $1 AND (expires_at IS NULL OR expires_at > $2)`,
+		key.MerchantID, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to expire API keys of merchant %d: %v", key.MerchantID, err)
+	}
+	if err := insertAPIKey(ctx, tx, key); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit API key rotation: %v", err)
+	}
+	return nil
+}
+
+// insertAPIKey inserts key, and sets its ID and creation time
+func insertAPIKey(ctx context.Context, q queryer, key *models.APIKey) error {
+	err := q.QueryRowContext(ctx, `INSERT INTO merchant_api_keys (merchant_id, prefix, key_hash) VALUES ($1, $2, $3) RETURNING id, created_at`,
+		key.MerchantID, key.Prefix, key.Hash).
+		Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert API key of merchant %d: %v", key.MerchantID, err)
+	}
+	return nil
+}
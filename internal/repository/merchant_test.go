@@ -0,0 +1,101 @@
+package repository
+
+import (
+	"context"
+	"payment-gateway/internal/models"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateMerchant(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewMerchantRepository(db)
+	merchant := &models.Merchant{Name: "acme"}
+	key := &models.APIKey{Prefix: "mk_0123456789abcdef", Hash: "hash"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO merchants \(name\) VALUES \(\$1\) RETURNING id, created_at`).
+		WithArgs("acme").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(2, time.Now()))
+	mock.ExpectQuery(`INSERT INTO merchant_api_keys \(merchant_id, prefix, key_hash\) VALUES \(\$1, \$2, \$3\) RETURNING id, created_at`).
+		WithArgs(2, "mk_0123456789abcdef", "hash").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(5, time.Now()))
+	mock.ExpectCommit()
+
+	assert.NoError(t, repo.CreateMerchant(context.Background(), merchant, key))
+	assert.Equal(t, 2, merchant.ID)
+	assert.Equal(t, 2, key.MerchantID)
+	assert.Equal(t, 5, key.ID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetActiveAPIKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewMerchantRepository(db)
+	now := time.Now()
+	expiresAt := now.Add(time.Hour)
+	columns := []string{"id", "merchant_id", "prefix", "key_hash", "created_at", "expires_at"}
+
+	// A key being rotated out still works until it expires
+	mock.ExpectQuery(`FROM merchant_api_keys\s+WHERE prefix = \$1 AND \(expires_at IS NULL OR expires_at > \$2\)`).
+		WithArgs("mk_0123456789abcdef", now).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(5, 2, "mk_0123456789abcdef", "hash", now, expiresAt))
+	mock.ExpectQuery(`FROM merchant_api_keys`).
+		WithArgs("mk_fedcba9876543210", now).
+		WillReturnRows(sqlmock.NewRows(columns))
+
+	key, err := repo.GetActiveAPIKey(context.Background(), "mk_0123456789abcdef", now)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, key.MerchantID)
+	assert.Equal(t, expiresAt, *key.ExpiresAt)
+
+	_, err = repo.GetActiveAPIKey(context.Background(), "mk_fedcba9876543210", now)
+	assert.ErrorIs(t, err, models.ErrInvalidAPIKey)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRotateAPIKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewMerchantRepository(db)
+	expiresAt := time.Now().Add(24 * time.Hour)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id FROM merchants WHERE id = \$1 FOR UPDATE`).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectExec(`UPDATE merchant_api_keys SET expires_at = \$2 WHERE merchant_id = \$1 AND \(expires_at IS NULL OR expires_at > \$2\)`).
+		WithArgs(2, expiresAt).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`INSERT INTO merchant_api_keys`).
+		WithArgs(2, "mk_0123456789abcdef", "hash").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(6, time.Now()))
+	mock.ExpectCommit()
+
+	err = repo.RotateAPIKey(context.Background(), &models.APIKey{MerchantID: 2, Prefix: "mk_0123456789abcdef", Hash: "hash"}, expiresAt)
+	assert.NoError(t, err)
+
+	// Keys of merchants which don't exist are never inserted
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id FROM merchants WHERE id = \$1 FOR UPDATE`).
+		WithArgs(9).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectRollback()
+
+	err = repo.RotateAPIKey(context.Background(), &models.APIKey{MerchantID: 9}, expiresAt)
+	assert.Equal(t, models.ErrMerchantNotFound, err)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
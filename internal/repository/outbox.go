@@ -0,0 +1,130 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"payment-gateway/internal/models"
+	"time"
+)
+
+// outboxRelayLock is the advisory lock held by the instance relaying the outbox, only one instance relays at a time
+// so events of a transaction can't be published out of order by two instances
+const outboxRelayLock = 7_246_118
+
+// OutboxRepository defines methods for reading the outbox
+type OutboxRepository interface {
+	// ProcessPending runs fn on the oldest unpublished events which are due, while holding the relay lock.
+	//
+	//   Events of a transaction whose oldest unpublished event is waiting for a retry, or failed, aren't due, so they don't use up the batch.
+	//   Returns false without calling fn if another instance holds the lock.
+	//   fn updates the events in place, `PublishedAt` for the ones published,
+	//   `Attempts`, `LastError`, `NextAttemptAt` and `FailedAt` for the ones which failed, and they are saved before the lock is released.
+	ProcessPending(ctx context.Context, limit int, fn func(events []*models.OutboxEvent) error) (bool, error)
+	// DeletePublishedBefore removes events published before the given time
+	DeletePublishedBefore(ctx context.Context, before time.Time) (int64, error)
+}
+
+// OutboxRepositoryImpl is the concrete implementation of OutboxRepository
+type OutboxRepositoryImpl struct {
+	db *sql.DB
+}
+
+// NewOutboxRepository creates a new instance of OutboxRepository.
+func NewOutboxRepository(db *sql.DB) *OutboxRepositoryImpl {
+	return &OutboxRepositoryImpl{db: db}
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx, so writes can join a caller's transaction
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// insertOutboxEvent adds event to the outbox, event.ID and event.CreatedAt are populated
+func insertOutboxEvent(ctx context.Context, q queryer, event *models.OutboxEvent) error {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	if event.NextAttemptAt.IsZero() {
+		event.NextAttemptAt = event.CreatedAt
+	}
+
+	query := `INSERT INTO outbox (aggregate_id, key, payload, created_at, next_attempt_at) VALUES ($1, $2, $3, $4, $5) RETURNING id`
+	err := q.QueryRowContext(ctx, query, event.AggregateID, event.Key, event.Payload, event.CreatedAt, event.NextAttemptAt).Scan(&event.ID)
+	if err != nil {
+		return fmt.Errorf("failed to insert outbox event: %v", err)
+	}
+	return nil
+}
+
+func (o *OutboxRepositoryImpl) ProcessPending(ctx context.Context, limit int, fn func(events []*models.OutboxEvent) error) (bool, error) {
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin outbox transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, outboxRelayLock).Scan(&locked); err != nil {
+		return false, fmt.Errorf("failed to lock outbox: %v", err)
+	}
+	if !locked {
+		return false, nil
+	}
+
+	// An event is skipped along with the later events of its transaction while it waits for a retry or failed,
+	// so the events of other transactions keep flowing, and a transaction's events are never published out of order
+	rows, err := tx.QueryContext(ctx, `SELECT o.id, o.aggregate_id, o.key, o.payload, o.created_at, o.attempts, COALESCE(o.last_error, ''), o.next_attempt_at
+		FROM outbox o WHERE o.published_at IS NULL AND NOT EXISTS (
+			SELECT 1 FROM outbox w WHERE w.aggregate_id = o.aggregate_id AND w.published_at IS NULL AND w.id <= o.id
+			AND (w.next_attempt_at > $2 OR w.failed_at IS NOT NULL)
+		) ORDER BY o.id LIMIT $1`, limit, time.Now())
+	if err != nil {
+		return true, fmt.Errorf("failed to fetch outbox events: %v", err)
+	}
+
+	var events []*models.OutboxEvent
+	for rows.Next() {
+		event := models.OutboxEvent{}
+		if err := rows.Scan(&event.ID, &event.AggregateID, &event.Key, &event.Payload, &event.CreatedAt, &event.Attempts, &event.LastError, &event.NextAttemptAt); err != nil {
+			rows.Close()
+			return true, fmt.Errorf("failed to scan outbox event: %v", err)
+		}
+		events = append(events, &event)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return true, fmt.Errorf("failed to fetch outbox events: %v", err)
+	}
+
+	if len(events) == 0 {
+		return true, nil
+	}
+
+	if err := fn(events); err != nil {
+		return true, err
+	}
+
+	for _, event := range events {
+		_, err := tx.ExecContext(ctx, `UPDATE outbox SET published_at = $1, attempts = $2, last_error = NULLIF($3, ''), next_attempt_at = $4, failed_at = $5 WHERE id = $6`,
+			event.PublishedAt, event.Attempts, event.LastError, event.NextAttemptAt, event.FailedAt, event.ID)
+		if err != nil {
+			return true, fmt.Errorf("failed to update outbox event %d: %v", event.ID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return true, fmt.Errorf("failed to commit outbox events: %v", err)
+	}
+	return true, nil
+}
+
+func (o *OutboxRepositoryImpl) DeletePublishedBefore(ctx context.Context, before time.Time) (int64, error) {
+	result, err := o.db.ExecContext(ctx, `DELETE FROM outbox WHERE published_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete published outbox events: %v", err)
+	}
+	return result.RowsAffected()
+}
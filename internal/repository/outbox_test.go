@@ -0,0 +1,132 @@
+package repository
+
+import (
+	"context"
+	"payment-gateway/internal/models"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+var outboxColumns = []string{"id", "aggregate_id", "key", "payload", "created_at", "attempts", "last_error", "next_attempt_at"}
+
+func TestOutboxProcessPending(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOutboxRepository(db)
+	now := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT pg_try_advisory_xact_lock\(\$1\)`).
+		WithArgs(outboxRelayLock).
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	// Transactions whose oldest unpublished event waits for a retry, or failed, are skipped
+	mock.ExpectQuery(`SELECT o.id, o.aggregate_id, o.key, o.payload, o.created_at, o.attempts, COALESCE\(o.last_error, ''\), o.next_attempt_at\s+FROM outbox o WHERE o.published_at IS NULL AND NOT EXISTS \(\s+`+
+		`SELECT 1 FROM outbox w WHERE w.aggregate_id = o.aggregate_id AND w.published_at IS NULL AND w.id <= o.id\s+AND \(w.next_attempt_at > \$2 OR w.failed_at IS NOT NULL\)\s+\) ORDER BY o.id LIMIT \$1`).
+		WithArgs(10, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(outboxColumns).
+			AddRow(1, 7, "7", []byte(`{}`), now, 0, "", now).
+			AddRow(2, 8, "8", []byte(`{}`), now, 0, "", now))
+	mock.ExpectExec(`UPDATE outbox SET published_at = \$1, attempts = \$2, last_error = NULLIF\(\$3, ''\), next_attempt_at = \$4, failed_at = \$5 WHERE id = \$6`).
+		WithArgs(sqlmock.AnyArg(), 1, "", now, nil, int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE outbox SET`).
+		WithArgs(nil, 1, "kafka down", sqlmock.AnyArg(), sqlmock.AnyArg(), int64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	locked, err := repo.ProcessPending(context.Background(), 10, func(events []*models.OutboxEvent) error {
+		assert.Len(t, events, 2)
+		publishedAt := time.Now()
+		events[0].PublishedAt = &publishedAt
+		events[0].Attempts = 1
+		events[1].Attempts = 1
+		events[1].LastError = "kafka down"
+		events[1].NextAttemptAt = now.Add(time.Second)
+		events[1].FailedAt = &now
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.True(t, locked)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOutboxProcessPending_Locked(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOutboxRepository(db)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT pg_try_advisory_xact_lock`).
+		WithArgs(outboxRelayLock).
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(false))
+	mock.ExpectRollback()
+
+	locked, err := repo.ProcessPending(context.Background(), 10, func(events []*models.OutboxEvent) error {
+		t.Fatal("fn must not be called without the lock")
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.False(t, locked)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateTransactionStatusWithEvent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewTransactionRepository(db)
+	txn := &models.Transaction{ID: 1, MerchantID: 1, Status: models.PENDING, Version: 1}
+	event := &models.OutboxEvent{AggregateID: 1, Key: "1", Payload: []byte(`{"id":1}`)}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE transactions SET status = \$1, gateway_updated_at = COALESCE\(\$4, gateway_updated_at\)`).
+		WithArgs(models.SUCCESS, 1, pq.Array(models.SUCCESS.SourceStatuses()), nil, 1, models.PENDING, models.SOURCE_WEBHOOK, "e1", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "gateway_updated_at", "version"}).AddRow(models.SUCCESS, nil, 2))
+	expectSettlement(mock, 1)
+	mock.ExpectQuery(`INSERT INTO outbox \(aggregate_id, key, payload, created_at, next_attempt_at\) VALUES \(\$1, \$2, \$3, \$4, \$5\) RETURNING id`).
+		WithArgs(1, "1", []byte(`{"id":1}`), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(42))
+	mock.ExpectCommit()
+
+	err = repo.UpdateTransactionStatusWithEvent(context.Background(), txn, models.SUCCESS, time.Time{}, models.EventCause{Source: models.SOURCE_WEBHOOK, PayloadRef: "e1"}, event)
+
+	assert.NoError(t, err)
+	assert.Equal(t, models.SUCCESS, txn.Status)
+	assert.Equal(t, int64(42), event.ID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateTransactionStatusWithEvent_InvalidTransition(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewTransactionRepository(db)
+	txn := &models.Transaction{ID: 1, MerchantID: 1, Status: models.PENDING, Version: 1}
+
+	// No outbox event is written when the status can't change
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE transactions SET status`).
+		WithArgs(models.SUCCESS, 1, pq.Array(models.SUCCESS.SourceStatuses()), nil, 1, models.PENDING, models.SOURCE_WEBHOOK, "e1", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "gateway_updated_at", "version"}))
+	mock.ExpectQuery(`SELECT status, gateway_updated_at, version FROM transactions WHERE id = \$1`).
+		WithArgs(1, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "gateway_updated_at", "version"}).AddRow(models.FAILED, nil, 1))
+	mock.ExpectRollback()
+
+	err = repo.UpdateTransactionStatusWithEvent(context.Background(), txn, models.SUCCESS, time.Time{}, models.EventCause{Source: models.SOURCE_WEBHOOK, PayloadRef: "e1"}, &models.OutboxEvent{AggregateID: 1})
+
+	assert.ErrorIs(t, err, models.ErrInvalidTransition)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,161 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"payment-gateway/internal/models"
+	"time"
+)
+
+// recoveryLock is the advisory lock held by the instance running recovery, so a transaction isn't re-driven twice at once
+const recoveryLock = 7_246_119
+
+// StuckTransactionFilter selects the transactions the recovery worker picks up
+type StuckTransactionFilter struct {
+	// InitBefore picks INIT transactions created before it
+	InitBefore time.Time
+	// PublishFailedBefore picks KAFKA_PUBLISH_FAILED transactions created before it
+	PublishFailedBefore time.Time
+	// LastAttemptBefore skips transactions attempted after it
+	LastAttemptBefore time.Time
+	Limit             int
+}
+
+// RecoveryRepository defines methods for finding stuck transactions and recording recovery attempts
+type RecoveryRepository interface {
+	// ProcessStuck runs fn on the transactions matching filter, while holding the recovery lock.
+	//
+	//   Returns false without calling fn if another instance holds the lock.
+	//   fn runs outside any db transaction, the attempts it returns are recorded before the lock is released.
+	ProcessStuck(ctx context.Context, filter StuckTransactionFilter, fn func(stuck []*models.StuckTransaction) ([]models.RecoveryAttempt, error)) (bool, error)
+}
+
+// RecoveryRepositoryImpl is the concrete implementation of RecoveryRepository
+type RecoveryRepositoryImpl struct {
+	db *sql.DB
+}
+
+// NewRecoveryRepository creates a new instance of RecoveryRepository.
+func NewRecoveryRepository(db *sql.DB) *RecoveryRepositoryImpl {
+	return &RecoveryRepositoryImpl{db: db}
+}
+
+// extraColumnsScanner scans the columns selected after transactionColumns into extra
+type extraColumnsScanner struct {
+	row   rowScanner
+	extra []interface{}
+}
+
+func (e extraColumnsScanner) Scan(dest ...interface{}) error {
+	return e.row.Scan(append(dest, e.extra...)...)
+}
+
+// ProcessStuck locks with a session advisory lock rather than row locks, as fn updates the transactions through other connections.
+//
+// The lock is held by a dedicated connection, outside any db transaction, so the gateway calls fn makes
+// don't keep a db transaction open. The attempts are recorded in a short db transaction once fn returns
+func (r *RecoveryRepositoryImpl) ProcessStuck(ctx context.Context, filter StuckTransactionFilter, fn func(stuck []*models.StuckTransaction) ([]models.RecoveryAttempt, error)) (bool, error) {
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to get recovery connection: %v", err)
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, recoveryLock).Scan(&locked); err != nil {
+		return false, fmt.Errorf("failed to lock recovery: %v", err)
+	}
+	if !locked {
+		return false, nil
+	}
+	defer unlockRecovery(conn)
+
+	stuck, err := fetchStuck(ctx, conn, filter)
+	if err != nil {
+		return true, err
+	}
+	if len(stuck) == 0 {
+		return true, nil
+	}
+
+	attempts, err := fn(stuck)
+	if err != nil {
+		return true, err
+	}
+	return true, recordAttempts(ctx, conn, attempts)
+}
+
+// unlockRecovery releases the recovery lock of conn, even if the context of the run is done.
+// A lock which couldn't be released would stay with the connection in the pool, so the connection is discarded instead
+func unlockRecovery(conn *sql.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, recoveryLock); err != nil {
+		log.Printf("Failed to unlock recovery, discarding its connection, err: %v", err)
+		conn.Raw(func(driverConn interface{}) error {
+			return driver.ErrBadConn
+		})
+	}
+}
+
+// fetchStuck returns the transactions matching filter, along with their number of attempts
+func fetchStuck(ctx context.Context, q queryer, filter StuckTransactionFilter) ([]*models.StuckTransaction, error) {
+	query := `SELECT ` + transactionColumns + `, COALESCE(a.attempts, 0)
+		FROM transactions t
+		LEFT JOIN (
+			SELECT transaction_id, COUNT(*) AS attempts, MAX(attempted_at) AS last_attempted_at FROM recovery_attempts GROUP BY transaction_id
+		) a ON a.transaction_id = t.id
+		WHERE ((t.status = $1 AND t.created_at < $2) OR (t.status = $3 AND t.created_at < $4))
+		AND (a.last_attempted_at IS NULL OR a.last_attempted_at < $5)
+		ORDER BY t.id LIMIT $6`
+
+	rows, err := q.QueryContext(ctx, query, models.INIT, filter.InitBefore, models.KAFKA_PUBLISH_FAILED, filter.PublishFailedBefore, filter.LastAttemptBefore, filter.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch stuck transactions: %v", err)
+	}
+	defer rows.Close()
+
+	var stuck []*models.StuckTransaction
+	for rows.Next() {
+		var attempts int
+		transaction, err := scanTransaction(extraColumnsScanner{row: rows, extra: []interface{}{&attempts}})
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan stuck transaction: %v", err)
+		}
+		stuck = append(stuck, &models.StuckTransaction{Transaction: *transaction, Attempts: attempts})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to fetch stuck transactions: %v", err)
+	}
+	return stuck, nil
+}
+
+// recordAttempts inserts attempts in one db transaction of conn
+func recordAttempts(ctx context.Context, conn *sql.Conn, attempts []models.RecoveryAttempt) error {
+	if len(attempts) == 0 {
+		return nil
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin recording recovery attempts: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, attempt := range attempts {
+		_, err := tx.ExecContext(ctx, `INSERT INTO recovery_attempts (transaction_id, status, outcome, error, attempted_at) VALUES ($1, $2, $3, NULLIF($4, ''), $5)`,
+			attempt.TransactionID, attempt.Status, attempt.Outcome, attempt.Error, attempt.AttemptedAt)
+		if err != nil {
+			return fmt.Errorf("failed to record recovery attempt of transaction %d: %v", attempt.TransactionID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit recovery attempts: %v", err)
+	}
+	return nil
+}
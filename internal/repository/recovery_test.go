@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"context"
+	"payment-gateway/internal/models"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoveryProcessStuck(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewRecoveryRepository(db)
+	now := time.Now()
+	filter := StuckTransactionFilter{
+		InitBefore:          now.Add(-5 * time.Minute),
+		PublishFailedBefore: now.Add(-5 * time.Minute),
+		LastAttemptBefore:   now.Add(-time.Minute),
+		Limit:               100,
+	}
+
+	// No db transaction is open while fn calls the gateways, the attempts are recorded in one once it returns
+	mock.ExpectQuery(`SELECT pg_try_advisory_lock\(\$1\)`).
+		WithArgs(recoveryLock).
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery(`SELECT t.id, (.+), COALESCE\(a.attempts, 0\)\s+FROM transactions t\s+LEFT JOIN \((.+)FROM recovery_attempts GROUP BY transaction_id\s+\) a`).
+		WithArgs(models.INIT, filter.InitBefore, models.KAFKA_PUBLISH_FAILED, filter.PublishFailedBefore, filter.LastAttemptBefore, 100).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "amount", "currency", "type", "status", "user_id", "gateway_id", "country_id", "created_at", "routing_decision", "gateway_updated_at", "version", "parent_id", "merchant_id", "attempts"}).
+			AddRow(1, "100.00", "USD", "DEPOSIT", "INIT", 3, 1, 2, now, nil, nil, 1, nil, 1, 0).
+			AddRow(2, "5.00", "USD", "WITHDRAWAL", "KAFKA_PUBLISH_FAILED", 3, 1, 2, now, nil, nil, 1, nil, 2, 4))
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO recovery_attempts \(transaction_id, status, outcome, error, attempted_at\) VALUES \(\$1, \$2, \$3, NULLIF\(\$4, ''\), \$5\)`).
+		WithArgs(1, models.INIT, models.RECOVERED, "", now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO recovery_attempts`).
+		WithArgs(2, models.KAFKA_PUBLISH_FAILED, models.RETRY, "gateway down", now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(`SELECT pg_advisory_unlock\(\$1\)`).
+		WithArgs(recoveryLock).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	locked, err := repo.ProcessStuck(context.Background(), filter, func(stuck []*models.StuckTransaction) ([]models.RecoveryAttempt, error) {
+		assert.Len(t, stuck, 2)
+		assert.Equal(t, models.NewMoney(10000, "USD"), stuck[0].Transaction.Amount)
+		assert.Equal(t, 0, stuck[0].Attempts)
+		assert.Equal(t, models.KAFKA_PUBLISH_FAILED, stuck[1].Transaction.Status)
+		assert.Equal(t, 4, stuck[1].Attempts)
+
+		return []models.RecoveryAttempt{
+			{TransactionID: 1, Status: models.INIT, Outcome: models.RECOVERED, AttemptedAt: now},
+			{TransactionID: 2, Status: models.KAFKA_PUBLISH_FAILED, Outcome: models.RETRY, Error: "gateway down", AttemptedAt: now},
+		}, nil
+	})
+
+	assert.NoError(t, err)
+	assert.True(t, locked)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRecoveryProcessStuck_LockedElsewhere(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewRecoveryRepository(db)
+
+	mock.ExpectQuery(`SELECT pg_try_advisory_lock\(\$1\)`).
+		WithArgs(recoveryLock).
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(false))
+
+	locked, err := repo.ProcessStuck(context.Background(), StuckTransactionFilter{Limit: 100}, func(stuck []*models.StuckTransaction) ([]models.RecoveryAttempt, error) {
+		t.Fatal("fn called without the recovery lock")
+		return nil, nil
+	})
+
+	assert.NoError(t, err)
+	assert.False(t, locked)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
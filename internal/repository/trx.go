@@ -3,24 +3,88 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"payment-gateway/internal/models"
 	"strings"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 // TransactionRepository defines the interface for transaction-related database operations.
+//
+// Every mutation appends the status changes it makes to the status history of the transaction (transaction_events),
+// in the same db transaction as the changes.
+// Every query is scoped to a merchant, reads take the merchant and updates use the `MerchantID` of their transaction,
+// a transaction of another merchant is never read nor updated, and is reported as not found.
 type TransactionRepository interface {
-	// CreateTransaction inserts a new transaction into the database.
+	// CreateTransaction inserts a new transaction into the database, with an api event for its initial status.
 	//
 	//   If insert is successful, `txn.ID` will be populated inside tx and returned
+	//   If txn is a withdrawal larger than its user's available balance, an error matching models.ErrInsufficientFunds is returned
 	CreateTransaction(ctx context.Context, txn *models.Transaction) (int, error)
-	// UpdateTransactionStatus updates the status of txn in db.
+	// UpdateTransactionStatus updates the status of txn in db, if it is still at `txn.Version`, and records cause with the change.
+	//
+	//   If update is successful, `txn.Status` will be reflecting the provided status, and `txn.Version` the new version
+	//   If txn doesn't exist for `txn.MerchantID`, models.ErrTransactionNotFound is returned
+	//   If txn was updated since it was read, a *models.ConcurrentModificationError is returned
+	//   If the status in db can't move to the provided status, a *models.InvalidTransitionError is returned
+	UpdateTransactionStatus(ctx context.Context, txn *models.Transaction, status models.TransactionStatus, cause models.EventCause) error
+	// UpdateTransactionStatusWithEvent updates the status like UpdateTransactionStatus,
+	// and adds event to the outbox in the same db transaction.
+	//
+	//   gatewayUpdatedAt is when the gateway made the status change, if the gateway already made a later change
+	//   which was applied, a *models.StaleUpdateError is returned. A zero gatewayUpdatedAt is never stale
+	UpdateTransactionStatusWithEvent(ctx context.Context, txn *models.Transaction, status models.TransactionStatus, gatewayUpdatedAt time.Time, cause models.EventCause, event *models.OutboxEvent) error
+	// UpdateTransactionsBulk updates the status and updated_at of transactions in one db transaction.
+	//
+	//   Like UpdateTransactionStatus, a row is only updated if its status in db can move to the requested status,
+	//   and if its `Version` is set, only if it is still at that version. A row of another merchant than its `MerchantID` is not found.
+	//   Changes are recorded as consumer events, referencing the `EventID` of their transaction.
+	//   Results are in the order of transactions, an error is only returned if the update couldn't run
+	UpdateTransactionsBulk(ctx context.Context, transactions []*models.Transaction) ([]models.BulkUpdateResult, error)
+	// GetTransaction returns a transaction of merchantID, or models.ErrTransactionNotFound if merchantID has no such transaction
+	GetTransaction(merchantID, txnID int) (*models.Transaction, error)
+	// GetUserTransaction returns a transaction of userID at merchantID, or models.ErrTransactionNotFound if userID has no such transaction
+	GetUserTransaction(ctx context.Context, merchantID, userID, txnID int) (*models.Transaction, error)
+	// CreateRefund inserts an INIT refund of the transaction parentID of userID at merchantID, for amount, or all that is left to refund when amount is nil.
+	//
+	//   If userID has no such transaction at merchantID, models.ErrTransactionNotFound is returned
+	//   If it isn't a successful deposit, an error matching models.ErrNotRefundable is returned
+	//   If amount is more than is left to refund, an error matching models.ErrRefundExceedsAmount is returned
+	//   If amount is more than the available balance of userID, an error matching models.ErrInsufficientFunds is returned
+	CreateRefund(ctx context.Context, merchantID, userID, parentID int, amount *models.Money) (*models.Transaction, error)
+	// RerouteTransaction moves txn, which no gateway has taken yet, to gatewayID, and stores decision as its routing decision.
+	//
+	//   If update is successful, `txn.GatewayID`, `txn.RoutingDecision` and `txn.Version` will be reflecting the change
+	//   If txn doesn't exist for `txn.MerchantID`, models.ErrTransactionNotFound is returned
+	//   If txn was updated since it was read, or isn't INIT anymore, a *models.ConcurrentModificationError is returned
+	RerouteTransaction(ctx context.Context, txn *models.Transaction, gatewayID int, decision *models.RoutingDecision) error
+	// SearchTransactions returns the transactions of `filter.MerchantID` matching filter, newest first, at most `filter.Limit` of them
+	SearchTransactions(ctx context.Context, filter TransactionFilter) ([]models.Transaction, error)
+	// GetTransactionEvents returns the status history of a transaction, oldest first.
 	//
-	//   If update is successful, `txn.Status` will be reflecting the provided status
-	UpdateTransactionStatus(txn *models.Transaction, status string) error
-	UpdateTransactionsBulk(transactions []*models.Transaction) error
-	GetTransaction(txnID int) (*models.Transaction, error)
+	//   If merchantID has no such transaction, models.ErrTransactionNotFound is returned
+	GetTransactionEvents(ctx context.Context, merchantID, txnID int) ([]models.TransactionEvent, error)
+}
+
+// TransactionFilter selects the transactions SearchTransactions returns, zero fields don't filter, except for the merchant
+type TransactionFilter struct {
+	// MerchantID is the merchant whose transactions are searched, it is always filtered on
+	MerchantID int
+	UserID     int
+	GatewayID  int
+	CountryID  int
+	Type       models.TransactionType
+	// Statuses matches transactions in any of them
+	Statuses []models.TransactionStatus
+	// CreatedFrom and CreatedTo select transactions created in [CreatedFrom, CreatedTo)
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	// BeforeID continues a search from the last transaction of the previous page, results are sorted by descending ID
+	BeforeID int
+	Limit    int
 }
 
 // TransactionRepositoryImpl is the concrete implementation of TransactionRepository.
@@ -28,6 +92,40 @@ type TransactionRepositoryImpl struct {
 	db *sql.DB
 }
 
+// transactionColumns are the columns read by every transaction query, in the order scanTransaction expects them
+const transactionColumns = `t.id, t.amount, t.currency, t.type, t.status, t.user_id, t.gateway_id, t.country_id, t.created_at, t.routing_decision, t.gateway_updated_at, t.version, t.parent_id, t.merchant_id`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanTransaction scans a row selected with transactionColumns
+func scanTransaction(row rowScanner) (*models.Transaction, error) {
+	transaction := models.Transaction{}
+	var amount string
+	var gatewayUpdatedAt sql.NullTime
+	var parentID sql.NullInt64
+
+	err := row.Scan(&transaction.ID, &amount, &transaction.Currency, &transaction.Type, &transaction.Status, &transaction.UserID, &transaction.GatewayID, &transaction.CountryID, &transaction.CreatedAt, &transaction.RoutingDecision, &gatewayUpdatedAt, &transaction.Version, &parentID, &transaction.MerchantID)
+	if err != nil {
+		return nil, err
+	}
+	if gatewayUpdatedAt.Valid {
+		transaction.GatewayUpdatedAt = &gatewayUpdatedAt.Time
+	}
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		transaction.ParentID = &id
+	}
+
+	transaction.Amount, err = models.ParseMoney(amount, transaction.Currency)
+	if err != nil {
+		return nil, fmt.Errorf("invalid amount for transaction %d: %v", transaction.ID, err)
+	}
+	return &transaction, nil
+}
+
 // NewTransactionRepository creates a new instance of transactionRepository.
 func NewTransactionRepository(db *sql.DB) *TransactionRepositoryImpl {
 	return &TransactionRepositoryImpl{db: db}
@@ -35,32 +133,230 @@ func NewTransactionRepository(db *sql.DB) *TransactionRepositoryImpl {
 
 // CreateTransaction inserts a new transaction into the database.
 //
-// Once insert is successful, `txn.ID` will be populated as well as and returned
+// Once insert is successful, `txn.ID` and `txn.Version` will be populated as well as and returned
+// If `txn.CreatedAt` is not set, it will be set to the current time
+// A withdrawal larger than the available balance of its user isn't inserted, an error matching models.ErrInsufficientFunds is returned
+// The first event of the transaction's status history is inserted by the same statement
 func (t *TransactionRepositoryImpl) CreateTransaction(context context.Context, txn *models.Transaction) (int, error) {
-	query := `INSERT INTO transactions (amount, type, status, gateway_id, country_id, user_id, created_at) 
-			  VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
+	if models.TransactionType(txn.Type) == models.WITHDRAWAL {
+		return t.createWithdrawal(context, txn)
+	}
+	if err := insertTransaction(context, t.db, txn); err != nil {
+		return 0, err
+	}
+	return txn.ID, nil
+}
 
-	err := t.db.QueryRow(query, txn.Amount, txn.Type, txn.Status, txn.GatewayID, txn.CountryID, txn.UserID, time.Now()).Scan(&txn.ID)
+// createWithdrawal inserts a withdrawal if the available balance of its user covers it, under a lock of the user's wallet
+func (t *TransactionRepositoryImpl) createWithdrawal(ctx context.Context, txn *models.Transaction) (int, error) {
+	tx, err := t.db.BeginTx(ctx, nil)
 	if err != nil {
-		return 0, fmt.Errorf("failed to insert transaction: %v", err)
+		return 0, fmt.Errorf("failed to begin withdrawal: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkAvailableFunds(ctx, tx, txn); err != nil {
+		return 0, err
+	}
+	if err := insertTransaction(ctx, tx, txn); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit withdrawal: %v", err)
 	}
 	return txn.ID, nil
 }
 
-func (t *TransactionRepositoryImpl) GetTransactions() ([]models.Transaction, error) {
-	rows, err := t.db.Query(`SELECT id, amount, type, status, user_id, gateway_id, country_id, created_at FROM transactions`)
+// insertTransaction inserts txn along with the api event of its initial status, and sets its ID and version
+func insertTransaction(ctx context.Context, q queryer, txn *models.Transaction) error {
+	query := `WITH created AS (
+			INSERT INTO transactions (amount, currency, type, status, gateway_id, country_id, user_id, created_at, routing_decision, parent_id, merchant_id) 
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id, status, version
+		), logged AS (
+			INSERT INTO transaction_events (transaction_id, to_status, source)
+			SELECT id, status, $12::varchar FROM created
+		)
+		SELECT id, version FROM created`
+
+	if txn.CreatedAt.IsZero() {
+		txn.CreatedAt = time.Now()
+	}
+
+	err := q.QueryRowContext(ctx, query, txn.Amount, txn.Currency, txn.Type, txn.Status, txn.GatewayID, txn.CountryID, txn.UserID, txn.CreatedAt, txn.RoutingDecision, txn.ParentID, txn.MerchantID, models.SOURCE_API).
+		Scan(&txn.ID, &txn.Version)
+	if err != nil {
+		return fmt.Errorf("failed to insert transaction: %v", err)
+	}
+	return nil
+}
+
+// CreateRefund inserts a REFUND of the transaction parentID of userID at merchantID, for amount, or for all that is left to refund when amount is nil.
+//
+// The parent is locked for update while the refunds already made are summed and the refund is inserted,
+// so concurrent refunds are serialized, and can't refund more than the parent's amount together.
+// Refunds which didn't fail count towards the amount refunded, as they may still succeed
+func (t *TransactionRepositoryImpl) CreateRefund(ctx context.Context, merchantID, userID, parentID int, amount *models.Money) (*models.Transaction, error) {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin refund: %v", err)
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, `SELECT `+transactionColumns+` FROM transactions t WHERE t.id = $1 AND t.merchant_id = $2 AND t.user_id = $3 FOR UPDATE`, parentID, merchantID, userID)
+	parent, err := scanTransaction(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, models.ErrTransactionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock transaction %d for refund: %v", parentID, err)
+	}
+	if models.TransactionType(parent.Type) != models.DEPOSIT || (parent.Status != models.SUCCESS && parent.Status != models.PARTIALLY_REFUNDED) {
+		return nil, fmt.Errorf("%w: transaction %d is a %s in %s", models.ErrNotRefundable, parent.ID, parent.Type, parent.Status)
+	}
+
+	refunded, err := refundedAmount(ctx, tx, parent, false)
+	if err != nil {
+		return nil, err
+	}
+	left := models.NewMoney(parent.Amount.MinorUnits-refunded.MinorUnits, parent.Currency)
+	if amount == nil {
+		amount = &left
+	}
+	if !amount.IsPositive() || amount.MinorUnits > left.MinorUnits {
+		return nil, fmt.Errorf("%w: refund of %s %s, %s left to refund of transaction %d", models.ErrRefundExceedsAmount, amount, parent.Currency, left, parent.ID)
+	}
+
+	refund := &models.Transaction{
+		Amount:     *amount,
+		Currency:   parent.Currency,
+		Type:       string(models.REFUND),
+		Status:     models.INIT,
+		GatewayID:  parent.GatewayID,
+		CountryID:  parent.CountryID,
+		UserID:     parent.UserID,
+		MerchantID: parent.MerchantID,
+		ParentID:   &parent.ID,
+	}
+	// The deposit may have been withdrawn since, like a withdrawal, a refund must be covered by the user's wallet
+	if err := checkAvailableFunds(ctx, tx, refund); err != nil {
+		return nil, err
+	}
+	if err := insertTransaction(ctx, tx, refund); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit refund: %v", err)
+	}
+	return refund, nil
+}
+
+// refundedAmount sums the refunds of parent which succeeded, or when settled is false, which didn't fail
+func refundedAmount(ctx context.Context, q queryer, parent *models.Transaction, settled bool) (models.Money, error) {
+	query := `SELECT COALESCE(SUM(amount), 0)::text FROM transactions WHERE parent_id = $1 AND type = $2 AND status <> $3`
+	status := models.FAILED
+	if settled {
+		query = `SELECT COALESCE(SUM(amount), 0)::text FROM transactions WHERE parent_id = $1 AND type = $2 AND status = $3`
+		status = models.SUCCESS
+	}
+
+	var sum string
+	if err := q.QueryRowContext(ctx, query, parent.ID, models.REFUND, status).Scan(&sum); err != nil {
+		return models.Money{}, fmt.Errorf("failed to sum refunds of transaction %d: %v", parent.ID, err)
+	}
+	refunded, err := models.ParseMoney(sum, parent.Currency)
+	if err != nil {
+		return models.Money{}, fmt.Errorf("invalid refunded amount for transaction %d: %v", parent.ID, err)
+	}
+	return refunded, nil
+}
+
+// settleRefund moves the parent of a refund which succeeded to PARTIALLY_REFUNDED, or to REFUNDED once refunds of its whole
+// amount succeeded. The parent is locked for update, so refunds settling concurrently are counted one after the other
+func settleRefund(ctx context.Context, q queryer, refund *models.Transaction, cause models.EventCause) error {
+	row := q.QueryRowContext(ctx, `SELECT `+transactionColumns+` FROM transactions t
+		WHERE t.id = (SELECT parent_id FROM transactions WHERE id = $1) AND t.merchant_id = $2 FOR UPDATE`, refund.ID, refund.MerchantID)
+	parent, err := scanTransaction(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("refund %d has no parent transaction", refund.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock parent of refund %d: %v", refund.ID, err)
+	}
+
+	refunded, err := refundedAmount(ctx, q, parent, true)
+	if err != nil {
+		return err
+	}
+	status := models.PARTIALLY_REFUNDED
+	if refunded.MinorUnits >= parent.Amount.MinorUnits {
+		status = models.REFUNDED
+	}
+	if parent.Status == status {
+		return nil
+	}
+	return updateTransactionStatusFrom(ctx, q, parent, status, status.RefundSourceStatuses(), time.Time{}, cause)
+}
+
+// SearchTransactions returns a page of the transactions matching filter, sorted by descending ID.
+//
+// The sort is stable, as IDs are unique, and pages are read with keyset pagination: a page continues after
+// the last ID of the previous one (`t.id < BeforeID`), so reading a page never scans the pages before it,
+// and rows inserted in the meantime don't shift the pages.
+// Searches are always filtered by merchant, filters are backed by the (merchant_id, id), (merchant_id, user_id, id),
+// (merchant_id, gateway_id, id) and (created_at) indexes
+func (t *TransactionRepositoryImpl) SearchTransactions(ctx context.Context, filter TransactionFilter) ([]models.Transaction, error) {
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	where("t.merchant_id = $%d", filter.MerchantID)
+	if filter.UserID != 0 {
+		where("t.user_id = $%d", filter.UserID)
+	}
+	if filter.GatewayID != 0 {
+		where("t.gateway_id = $%d", filter.GatewayID)
+	}
+	if filter.CountryID != 0 {
+		where("t.country_id = $%d", filter.CountryID)
+	}
+	if filter.Type != "" {
+		where("t.type = $%d", filter.Type)
+	}
+	if len(filter.Statuses) > 0 {
+		where("t.status = ANY($%d)", pq.Array(filter.Statuses))
+	}
+	if !filter.CreatedFrom.IsZero() {
+		where("t.created_at >= $%d", filter.CreatedFrom)
+	}
+	if !filter.CreatedTo.IsZero() {
+		where("t.created_at < $%d", filter.CreatedTo)
+	}
+	if filter.BeforeID != 0 {
+		where("t.id < $%d", filter.BeforeID)
+	}
+
+	query := `SELECT ` + transactionColumns + ` FROM transactions t WHERE ` + strings.Join(conditions, " AND ")
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(` ORDER BY t.id DESC LIMIT $%d`, len(args))
+
+	rows, err := t.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch transactions: %v", err)
 	}
 	defer rows.Close()
 
-	var transactions []models.Transaction
+	transactions := []models.Transaction{}
 	for rows.Next() {
-		var transaction models.Transaction
-		if err := rows.Scan(&transaction.ID, &transaction.Amount, &transaction.Type, &transaction.Status, &transaction.UserID, &transaction.GatewayID, &transaction.CountryID, &transaction.CreatedAt); err != nil {
+		transaction, err := scanTransaction(rows)
+		if err != nil {
 			return nil, fmt.Errorf("failed to scan transaction: %v", err)
 		}
-		transactions = append(transactions, transaction)
+		transactions = append(transactions, *transaction)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
@@ -68,59 +364,432 @@ func (t *TransactionRepositoryImpl) GetTransactions() ([]models.Transaction, err
 	return transactions, nil
 }
 
-func (t *TransactionRepositoryImpl) GetTransaction(txnID int) (*models.Transaction, error) {
-	transaction := models.Transaction{}
-
-	err := t.db.QueryRow(`SELECT id, amount, type, status, user_id, gateway_id, country_id, created_at FROM transactions WHERE id = $1`, txnID).Scan(&transaction.ID, &transaction.Amount, &transaction.Type, &transaction.Status, &transaction.UserID, &transaction.GatewayID, &transaction.CountryID, &transaction.CreatedAt)
+// GetTransaction returns a transaction only if it belongs to merchantID,
+// a transaction of another merchant is reported as not found, so its existence isn't disclosed
+func (t *TransactionRepositoryImpl) GetTransaction(merchantID, txnID int) (*models.Transaction, error) {
+	row := t.db.QueryRow(`SELECT `+transactionColumns+` FROM transactions t WHERE t.id = $1 AND t.merchant_id = $2`, txnID, merchantID)
 
+	transaction, err := scanTransaction(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, models.ErrTransactionNotFound
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch transactions: %v", err)
 	}
 
-	return &transaction, nil
+	return transaction, nil
+}
+
+// GetUserTransaction returns a transaction only if it belongs to userID at merchantID,
+// a transaction of another user or merchant is reported as not found, so its existence isn't disclosed
+func (t *TransactionRepositoryImpl) GetUserTransaction(ctx context.Context, merchantID, userID, txnID int) (*models.Transaction, error) {
+	row := t.db.QueryRowContext(ctx, `SELECT `+transactionColumns+` FROM transactions t WHERE t.id = $1 AND t.merchant_id = $2 AND t.user_id = $3`, txnID, merchantID, userID)
+
+	transaction, err := scanTransaction(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, models.ErrTransactionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch transaction: %v", err)
+	}
+
+	return transaction, nil
+}
+
+// GetTransactionEvents returns the status history of a transaction, ordered by when the changes were recorded.
+//
+// Transactions created before the history was recorded have no events, they return an empty history
+func (t *TransactionRepositoryImpl) GetTransactionEvents(ctx context.Context, merchantID, txnID int) ([]models.TransactionEvent, error) {
+	query := `SELECT e.id, e.transaction_id, COALESCE(e.from_status, ''), e.to_status, e.source, COALESCE(e.payload_ref, ''), e.created_at
+		FROM transaction_events e JOIN transactions t ON t.id = e.transaction_id
+		WHERE e.transaction_id = $1 AND t.merchant_id = $2 ORDER BY e.id`
+
+	rows, err := t.db.QueryContext(ctx, query, txnID, merchantID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch transaction events: %v", err)
+	}
+	defer rows.Close()
+
+	events := []models.TransactionEvent{}
+	for rows.Next() {
+		event := models.TransactionEvent{}
+		if err := rows.Scan(&event.ID, &event.TransactionID, &event.FromStatus, &event.ToStatus, &event.Source, &event.PayloadRef, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan transaction event: %v", err)
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to fetch transaction events: %v", err)
+	}
+
+	if len(events) == 0 {
+		var exists bool
+		if err := t.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM transactions WHERE id = $1 AND merchant_id = $2)", txnID, merchantID).Scan(&exists); err != nil {
+			return nil, fmt.Errorf("failed to fetch transaction events: %v", err)
+		}
+		if !exists {
+			return nil, models.ErrTransactionNotFound
+		}
+	}
+	return events, nil
 }
 
 // UpdateTransactionStatus updates the status of an existing transaction.
-func (t *TransactionRepositoryImpl) UpdateTransactionStatus(txn *models.Transaction, status string) error {
-	query := "UPDATE transactions SET status = $1 WHERE id = $2 returning status"
-	err := t.db.QueryRow(query, status, txn.ID).Scan(&txn.Status)
+//
+// The update is a compare-and-swap on `txn.Version`, so it never overwrites an update the caller didn't read.
+// It also only matches rows whose current status may move to status, so no update can take a transaction
+// through an illegal transition, whatever status the caller read.
+// The ledger journal of the new status is posted in the same db transaction
+func (t *TransactionRepositoryImpl) UpdateTransactionStatus(ctx context.Context, txn *models.Transaction, status models.TransactionStatus, cause models.EventCause) error {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction status update: %v", err)
+	}
+	defer tx.Rollback()
+
+	previous := *txn
+	if err := updateTransactionStatus(ctx, tx, txn, status, time.Time{}, cause); err != nil {
+		return err
+	}
+	if err := postStatusJournal(ctx, tx, txn.ID, status); err != nil {
+		*txn = previous
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		*txn = previous
+		return fmt.Errorf("failed to commit transaction status update: %v", err)
+	}
+	return nil
+}
+
+// UpdateTransactionStatusWithEvent updates the status and adds event to the outbox atomically,
+// if the status can't be updated, no event is added.
+// When a refund succeeds, its parent is marked refunded in the same db transaction, like the ledger journal of the new status is posted.
+//
+// Like the status, the gateway timestamp is guarded in SQL, so a concurrent older update can't overwrite a newer one
+func (t *TransactionRepositoryImpl) UpdateTransactionStatusWithEvent(ctx context.Context, txn *models.Transaction, status models.TransactionStatus, gatewayUpdatedAt time.Time, cause models.EventCause, event *models.OutboxEvent) error {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction status update: %v", err)
+	}
+	defer tx.Rollback()
+
+	previous := *txn
+	if err := updateTransactionStatus(ctx, tx, txn, status, gatewayUpdatedAt, cause); err != nil {
+		return err
+	}
+	if models.TransactionType(txn.Type) == models.REFUND && status == models.SUCCESS {
+		if err := settleRefund(ctx, tx, txn, cause); err != nil {
+			*txn = previous
+			return err
+		}
+	}
+	if err := postStatusJournal(ctx, tx, txn.ID, status); err != nil {
+		*txn = previous
+		return err
+	}
+	if err := insertOutboxEvent(ctx, tx, event); err != nil {
+		*txn = previous
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		*txn = previous
+		return fmt.Errorf("failed to commit transaction status update: %v", err)
+	}
+	return nil
+}
+
+// RerouteTransaction only updates INIT transactions, once a gateway took a transaction it stays with that gateway
+func (t *TransactionRepositoryImpl) RerouteTransaction(ctx context.Context, txn *models.Transaction, gatewayID int, decision *models.RoutingDecision) error {
+	query := `UPDATE transactions SET gateway_id = $1, routing_decision = $2, version = version + 1
+			  WHERE id = $3 AND merchant_id = $4 AND version = $5 AND status = $6
+			  RETURNING version`
+
+	var version int
+	err := t.db.QueryRowContext(ctx, query, gatewayID, decision, txn.ID, txn.MerchantID, txn.Version, models.INIT).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		var current int
+		err := t.db.QueryRowContext(ctx, "SELECT version FROM transactions WHERE id = $1 AND merchant_id = $2", txn.ID, txn.MerchantID).Scan(&current)
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.ErrTransactionNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to reroute transaction %d: %v", txn.ID, err)
+		}
+		return &models.ConcurrentModificationError{TxnID: txn.ID, Version: txn.Version, Current: current}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reroute transaction %d: %v", txn.ID, err)
+	}
+
+	txn.GatewayID = gatewayID
+	txn.RoutingDecision = decision
+	txn.Version = version
+	return nil
+}
+
+// updateTransactionStatus moves txn to status, unless it isn't at `txn.Version` anymore, its status can't move to status,
+// or the gateway already made a later status change than gatewayUpdatedAt (when it isn't zero).
+//
+// The change is recorded in the status history by the same statement, as the update matched `txn.Version`,
+// the status it changed from is `txn.Status`
+func updateTransactionStatus(ctx context.Context, q queryer, txn *models.Transaction, status models.TransactionStatus, gatewayUpdatedAt time.Time, cause models.EventCause) error {
+	return updateTransactionStatusFrom(ctx, q, txn, status, status.SourceStatuses(), gatewayUpdatedAt, cause)
+}
+
+// updateTransactionStatusFrom is updateTransactionStatus guarded by the given source statuses, settleRefund guards
+// with the refund transitions, which no other update may take
+func updateTransactionStatusFrom(ctx context.Context, q queryer, txn *models.Transaction, status models.TransactionStatus, sources []models.TransactionStatus, gatewayUpdatedAt time.Time, cause models.EventCause) error {
+	query := `WITH updated AS (
+			UPDATE transactions SET status = $1, gateway_updated_at = COALESCE($4, gateway_updated_at), version = version + 1
+			WHERE id = $2 AND merchant_id = $9 AND version = $5 AND status = ANY($3) AND ($4::timestamp IS NULL OR gateway_updated_at IS NULL OR gateway_updated_at <= $4)
+			returning id, status, gateway_updated_at, version
+		), logged AS (
+			INSERT INTO transaction_events (transaction_id, from_status, to_status, source, payload_ref)
+			SELECT id, $6::varchar, status, $7::varchar, NULLIF($8::varchar, '') FROM updated
+		)
+		SELECT status, gateway_updated_at, version FROM updated`
+
+	var updatedAt sql.NullTime
+	err := q.QueryRowContext(ctx, query, status, txn.ID, pq.Array(sources), nullableTimestamp(gatewayUpdatedAt), txn.Version, txn.Status, cause.Source, cause.PayloadRef, txn.MerchantID).
+		Scan(&txn.Status, &updatedAt, &txn.Version)
+	if err == sql.ErrNoRows {
+		return statusUpdateError(ctx, q, txn, status, gatewayUpdatedAt)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to update transaction status: %v", err)
 	}
+	if updatedAt.Valid {
+		txn.GatewayUpdatedAt = &updatedAt.Time
+	}
 	return nil
 }
 
-// UpdateTransactionsBulk updates the status and other columns of multiple transactions based on dynamic filters and columns.
-func (t *TransactionRepositoryImpl) UpdateTransactionsBulk(transactions []*models.Transaction) error {
-	// Initialize slices for query parts and values
-	setClauses := []string{}
-	whereClauses := []string{}
-	values := []interface{}{}
-	i := 1
+// statusUpdateError explains why a guarded status update of txn matched no row
+func statusUpdateError(ctx context.Context, q queryer, txn *models.Transaction, status models.TransactionStatus, gatewayUpdatedAt time.Time) error {
+	current := models.Transaction{ID: txn.ID}
+	var updatedAt sql.NullTime
+	err := q.QueryRowContext(ctx, "SELECT status, gateway_updated_at, version FROM transactions WHERE id = $1 AND merchant_id = $2", txn.ID, txn.MerchantID).
+		Scan(&current.Status, &updatedAt, &current.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.ErrTransactionNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update transaction status: %v", err)
+	}
 
-	// Build the SET clause for the query
-	for _, txn := range transactions {
-		// Add the ID filter
-		whereClauses = append(whereClauses, fmt.Sprintf("id = $%d", i))
-		values = append(values, txn.ID)
+	if updatedAt.Valid {
+		current.GatewayUpdatedAt = &updatedAt.Time
+	}
+	switch {
+	case current.Version != txn.Version:
+		return &models.ConcurrentModificationError{TxnID: txn.ID, Version: txn.Version, Current: current.Version}
+	case current.IsStale(gatewayUpdatedAt):
+		return &models.StaleUpdateError{TxnID: txn.ID, UpdatedAt: gatewayUpdatedAt, GatewayUpdatedAt: updatedAt.Time}
+	default:
+		return &models.InvalidTransitionError{TxnID: txn.ID, From: current.Status, To: status}
+	}
+}
 
-		// Dynamically append the set clauses for status and updated_at
-		setClauses = append(setClauses, fmt.Sprintf("status = $%d, updated_at = $%d", i+1, i+2))
-		// Add status and updated_at values to the parameters list
-		values = append(values, txn.Status, time.Now())
+// nullableTimestamp converts t for a timestamp column, the zero time is NULL
+func nullableTimestamp(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
 
-		i += 2
+// bulkUpdateQuery updates every transaction of the input arrays (which must not repeat an ID), of the merchant in input, whose status may move
+// to the requested status, which is at the requested version, and which has no later gateway timestamp
+// than the requested one. It returns, in input order, the status, gateway timestamp and version before the update,
+// whether the row was updated, and whether its event was already processed.
+//
+//	Event IDs are recorded in processed_events, a row whose event ID is already there is skipped,
+//	rows without an event ID (messages from before event IDs) are never skipped.
+//	Updated rows are recorded in the status history with the source $8, referencing their event ID.
+//	The select sees the snapshot from before the update, so current is the status the update was guarded against
+const bulkUpdateQuery = `
+	WITH input AS (
+		SELECT * FROM unnest($1::int[], $2::text[], $3::text[], $4::timestamp[], $5::text[], $6::int[], $7::int[]) WITH ORDINALITY AS i(id, status, sources, updated_at, event_id, version, merchant_id, ord)
+	), recorded AS (
+		INSERT INTO processed_events (event_id, transaction_id)
+		SELECT i.event_id, i.id FROM input i WHERE i.event_id <> ''
+		ON CONFLICT (event_id) DO NOTHING
+		RETURNING event_id
+	), updated AS (
+		UPDATE transactions t SET status = i.status, updated_at = COALESCE(i.updated_at, CURRENT_TIMESTAMP),
+			gateway_updated_at = COALESCE(i.updated_at, t.gateway_updated_at), version = t.version + 1
+		FROM input i
+		WHERE t.id = i.id AND t.merchant_id = i.merchant_id AND t.version = i.version AND t.status = ANY(string_to_array(i.sources, ','))
+		AND (i.updated_at IS NULL OR t.gateway_updated_at IS NULL OR t.gateway_updated_at <= i.updated_at)
+		AND (i.event_id = '' OR i.event_id IN (SELECT event_id FROM recorded))
+		RETURNING t.id
+	), logged AS (
+		INSERT INTO transaction_events (transaction_id, from_status, to_status, source, payload_ref)
+		SELECT i.id, t.status, i.status, $8::varchar, NULLIF(i.event_id, '')
+		FROM input i
+		JOIN updated u ON u.id = i.id
+		JOIN transactions t ON t.id = i.id
+		ORDER BY i.ord
+	)
+	SELECT i.id, t.status, t.gateway_updated_at, t.version, u.id IS NOT NULL, i.event_id <> '' AND r.event_id IS NULL
+	FROM input i
+	LEFT JOIN transactions t ON t.id = i.id AND t.merchant_id = i.merchant_id
+	LEFT JOIN updated u ON u.id = i.id
+	LEFT JOIN recorded r ON r.event_id = i.event_id
+	ORDER BY i.ord`
+
+// bulkUpdateTimestampLayout formats timestamps for the timestamp[] parameter of bulkUpdateQuery
+const bulkUpdateTimestampLayout = "2006-01-02 15:04:05.999999"
+
+// UpdateTransactionsBulk updates the status and updated_at of multiple transactions with set based updates, in one db transaction.
+//
+// A transaction's `UpdatedAt` is the gateway's timestamp of the status change, it is written as is, the current time is used if it isn't set.
+// An update older than the last one applied from the gateway is skipped as stale.
+// A transaction repeated in the batch is updated once per occurrence, in order, so the batch has the same effect
+// as updating the transactions one by one.
+// A transaction whose `EventID` was already processed is skipped, so a redelivered message is applied once.
+// Like the other updates, a transaction is only updated at its `Version`, one which already has the requested status is unchanged whatever its version.
+// Parents of refunds which succeeded are marked refunded, and the ledger journals of the new statuses are posted, in the same db transaction.
+func (t *TransactionRepositoryImpl) UpdateTransactionsBulk(ctx context.Context, transactions []*models.Transaction) ([]models.BulkUpdateResult, error) {
+	results := make([]models.BulkUpdateResult, len(transactions))
+	if len(transactions) == 0 {
+		return results, nil
 	}
 
-	// Start building the bulk update query
-	query := fmt.Sprintf("UPDATE transactions SET %s WHERE %s RETURNING id, status, updated_at",
-		strings.Join(setClauses, ", "), strings.Join(whereClauses, " AND "))
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin bulk update: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, round := range bulkUpdateRounds(transactions) {
+		if err := bulkUpdateRound(ctx, tx, transactions, round, results); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, txn := range transactions {
+		if results[i].Outcome != models.APPLIED {
+			continue
+		}
+		if models.TransactionType(txn.Type) == models.REFUND && txn.Status == models.SUCCESS {
+			if err := settleRefund(ctx, tx, txn, models.EventCause{Source: models.SOURCE_CONSUMER, PayloadRef: txn.EventID}); err != nil {
+				return nil, err
+			}
+		}
+		if err := postStatusJournal(ctx, tx, txn.ID, txn.Status); err != nil {
+			return nil, err
+		}
+	}
 
-	// Execute the query with the constructed values
-	_, err := t.db.Exec(query, values...)
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit bulk update: %v", err)
+	}
+	return results, nil
+}
+
+// bulkUpdateRounds splits transactions into rounds of indexes in which no ID repeats,
+// the nth occurrence of an ID goes to the nth round, so rounds keep the order of the batch
+func bulkUpdateRounds(transactions []*models.Transaction) [][]int {
+	var rounds [][]int
+	occurrences := make(map[int]int, len(transactions))
+
+	for i, txn := range transactions {
+		n := occurrences[txn.ID]
+		occurrences[txn.ID] = n + 1
+		if n == len(rounds) {
+			rounds = append(rounds, nil)
+		}
+		rounds[n] = append(rounds[n], i)
+	}
+	return rounds
+}
+
+// bulkUpdateRound runs bulkUpdateQuery for the transactions at indexes, and fills their results
+func bulkUpdateRound(ctx context.Context, tx *sql.Tx, transactions []*models.Transaction, indexes []int, results []models.BulkUpdateResult) error {
+	ids := make([]int, len(indexes))
+	statuses := make([]string, len(indexes))
+	sources := make([]string, len(indexes))
+	updatedAt := make([]sql.NullString, len(indexes))
+	eventIDs := make([]string, len(indexes))
+	versions := make([]int, len(indexes))
+	merchantIDs := make([]int, len(indexes))
+
+	for j, i := range indexes {
+		txn := transactions[i]
+		ids[j] = txn.ID
+		statuses[j] = string(txn.Status)
+
+		sourceStatuses := []string{}
+		for _, source := range txn.Status.SourceStatuses() {
+			sourceStatuses = append(sourceStatuses, string(source))
+		}
+		sources[j] = strings.Join(sourceStatuses, ",")
+
+		if !txn.UpdatedAt.IsZero() {
+			updatedAt[j] = sql.NullString{String: txn.UpdatedAt.UTC().Format(bulkUpdateTimestampLayout), Valid: true}
+		}
+		eventIDs[j] = txn.EventID
+		versions[j] = txn.Version
+		merchantIDs[j] = txn.MerchantID
+	}
+
+	rows, err := tx.QueryContext(ctx, bulkUpdateQuery, pq.Array(ids), pq.Array(statuses), pq.Array(sources), pq.Array(updatedAt), pq.Array(eventIDs), pq.Array(versions), pq.Array(merchantIDs), models.SOURCE_CONSUMER)
 	if err != nil {
 		return fmt.Errorf("failed to update transactions: %v", err)
 	}
+	defer rows.Close()
 
+	j := 0
+	for ; rows.Next(); j++ {
+		if j >= len(indexes) {
+			return fmt.Errorf("failed to update transactions: more rows returned than updated")
+		}
+		var id int
+		var current sql.NullString
+		var gatewayUpdatedAt sql.NullTime
+		var version sql.NullInt64
+		var updated, duplicate bool
+		if err := rows.Scan(&id, &current, &gatewayUpdatedAt, &version, &updated, &duplicate); err != nil {
+			return fmt.Errorf("failed to scan bulk update result: %v", err)
+		}
+
+		txn := transactions[indexes[j]]
+		if id != txn.ID {
+			return fmt.Errorf("failed to update transactions: result for %d returned in place of %d", id, txn.ID)
+		}
+		result := models.BulkUpdateResult{TxnID: txn.ID, Status: txn.Status, Current: models.TransactionStatus(current.String), UpdatedAt: txn.UpdatedAt, Version: txn.Version}
+		stale := !txn.UpdatedAt.IsZero() && gatewayUpdatedAt.Valid && gatewayUpdatedAt.Time.After(txn.UpdatedAt)
+		switch {
+		case duplicate:
+			result.Outcome = models.DUPLICATE
+		case updated:
+			result.Current = txn.Status
+			result.Outcome = models.APPLIED
+		case !current.Valid:
+			result.Outcome = models.NOT_FOUND
+		case result.Current == txn.Status:
+			// Messages of status changes the service made are consumed after the change, at the next version
+			result.Outcome = models.UNCHANGED
+		case int64(txn.Version) != version.Int64:
+			result.CurrentVersion = int(version.Int64)
+			result.Outcome = models.CONFLICT
+		case stale:
+			result.GatewayUpdatedAt = gatewayUpdatedAt.Time
+			result.Outcome = models.STALE
+		default:
+			result.Outcome = models.REJECTED
+		}
+		results[indexes[j]] = result
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to update transactions: %v", err)
+	}
+	if j != len(indexes) {
+		return fmt.Errorf("failed to update transactions: %d rows returned for %d transactions", j, len(indexes))
+	}
 	return nil
 }
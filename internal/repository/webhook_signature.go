@@ -0,0 +1,58 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// WebhookSignatureRepository remembers webhook signatures already accepted, so they can't be replayed
+type WebhookSignatureRepository interface {
+	// MarkUsed records the signature, returning false if it was already recorded for the gateway
+	MarkUsed(ctx context.Context, gatewayID int, signature string, receivedAt time.Time) (bool, error)
+	// Release forgets a recorded signature of the gateway, so the webhook it signs is accepted again
+	Release(ctx context.Context, gatewayID int, signature string) error
+	// DeleteBefore removes signatures received before the given time, they would fail the timestamp check anyway
+	DeleteBefore(ctx context.Context, before time.Time) (int64, error)
+}
+
+// WebhookSignatureRepositoryImpl is the concrete implementation of WebhookSignatureRepository
+type WebhookSignatureRepositoryImpl struct {
+	db *sql.DB
+}
+
+// NewWebhookSignatureRepository creates a new instance of WebhookSignatureRepository.
+func NewWebhookSignatureRepository(db *sql.DB) *WebhookSignatureRepositoryImpl {
+	return &WebhookSignatureRepositoryImpl{db: db}
+}
+
+func (w *WebhookSignatureRepositoryImpl) MarkUsed(ctx context.Context, gatewayID int, signature string, receivedAt time.Time) (bool, error) {
+	query := `INSERT INTO webhook_signatures (gateway_id, signature, received_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`
+
+	result, err := w.db.ExecContext(ctx, query, gatewayID, signature, receivedAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to record webhook signature: %v", err)
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to record webhook signature: %v", err)
+	}
+	return inserted == 1, nil
+}
+
+func (w *WebhookSignatureRepositoryImpl) Release(ctx context.Context, gatewayID int, signature string) error {
+	if _, err := w.db.ExecContext(ctx, `DELETE FROM webhook_signatures WHERE gateway_id = $1 AND signature = $2`, gatewayID, signature); err != nil {
+		return fmt.Errorf("failed to release webhook signature: %v", err)
+	}
+	return nil
+}
+
+func (w *WebhookSignatureRepositoryImpl) DeleteBefore(ctx context.Context, before time.Time) (int64, error) {
+	result, err := w.db.ExecContext(ctx, `DELETE FROM webhook_signatures WHERE received_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete webhook signatures: %v", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,70 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookSignatureMarkUsed(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewWebhookSignatureRepository(db)
+	receivedAt := time.Now()
+
+	mock.ExpectExec(`INSERT INTO webhook_signatures \(gateway_id, signature, received_at\) VALUES \(\$1, \$2, \$3\) ON CONFLICT DO NOTHING`).
+		WithArgs(1, "sig", receivedAt).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO webhook_signatures`).
+		WithArgs(1, "sig", receivedAt).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	firstUse, err := repo.MarkUsed(context.Background(), 1, "sig", receivedAt)
+	assert.NoError(t, err)
+	assert.True(t, firstUse)
+
+	// Replayed signature
+	firstUse, err = repo.MarkUsed(context.Background(), 1, "sig", receivedAt)
+	assert.NoError(t, err)
+	assert.False(t, firstUse)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWebhookSignatureRelease(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewWebhookSignatureRepository(db)
+
+	mock.ExpectExec(`DELETE FROM webhook_signatures WHERE gateway_id = \$1 AND signature = \$2`).
+		WithArgs(1, "sig").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(t, repo.Release(context.Background(), 1, "sig"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWebhookSignatureDeleteBefore(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewWebhookSignatureRepository(db)
+	before := time.Now()
+
+	mock.ExpectExec(`DELETE FROM webhook_signatures WHERE received_at < \$1`).
+		WithArgs(before).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	deleted, err := repo.DeleteBefore(context.Background(), before)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), deleted)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -22,11 +22,22 @@ func NewAPIResponse(dataFormat models.DataFormat) *APIResponseSvcImpl {
 }
 
 func (a *APIResponseSvcImpl) sendProcessedResponse(w http.ResponseWriter, statusCode int, msg string, data interface{}) {
+	a.SendResponse(w, a.BuildResponse(statusCode, msg, data))
+}
+
+// BuildResponse prepares the response without writing it, so it can be stored before being sent
+func (a *APIResponseSvcImpl) BuildResponse(statusCode int, msg string, data interface{}) *models.APIResponse {
 	a.RespModel.StatusCode = statusCode
 	a.RespModel.Message = msg
 	a.RespModel.Data = data
+	return a.RespModel
+}
 
-	if err := EncodeRequestWithHeader(w, a.RespModel); err != nil {
+// SendResponse writes an already built response in the data format of this response
+func (a *APIResponseSvcImpl) SendResponse(w http.ResponseWriter, resp *models.APIResponse) {
+	resp.DataFormat = a.RespModel.DataFormat
+
+	if err := EncodeRequestWithHeader(w, resp); err != nil {
 		// Error handling incase encoding failed
 		http.Error(w, "Failed to encode JSON response", http.StatusInternalServerError)
 		return
@@ -37,6 +48,21 @@ func (a *APIResponseSvcImpl) NewBadRequestErrorResponse(w http.ResponseWriter, m
 	a.sendProcessedResponse(w, http.StatusBadRequest, msg, nil)
 }
 
+// NewUnauthorizedErrorResponse - GRPC style method, where every status has it's own method
+func (a *APIResponseSvcImpl) NewUnauthorizedErrorResponse(w http.ResponseWriter, msg string) {
+	a.sendProcessedResponse(w, http.StatusUnauthorized, msg, nil)
+}
+
+// NewNotFoundErrorResponse - GRPC style method, where every status has it's own method
+func (a *APIResponseSvcImpl) NewNotFoundErrorResponse(w http.ResponseWriter, msg string) {
+	a.sendProcessedResponse(w, http.StatusNotFound, msg, nil)
+}
+
+// NewConflictErrorResponse - GRPC style method, where every status has it's own method
+func (a *APIResponseSvcImpl) NewConflictErrorResponse(w http.ResponseWriter, msg string) {
+	a.sendProcessedResponse(w, http.StatusConflict, msg, nil)
+}
+
 // NewStatusOKResponse - GRPC style method, where every status has it's own method
 func (a *APIResponseSvcImpl) NewStatusOKResponse(w http.ResponseWriter, msg string, data interface{}) {
 	a.sendProcessedResponse(w, http.StatusOK, msg, data)
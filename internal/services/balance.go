@@ -0,0 +1,25 @@
+package services
+
+import (
+	"context"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/repository"
+)
+
+type BalanceService interface {
+	GetUserBalances(ctx context.Context, merchantID, userID int) ([]models.Balance, error)
+}
+
+type BalanceServiceImpl struct {
+	ledgerRepository repository.LedgerRepository
+}
+
+// NewBalanceService creates the service reading user balances from the ledger
+func NewBalanceService(ledgerRepo repository.LedgerRepository) *BalanceServiceImpl {
+	return &BalanceServiceImpl{ledgerRepository: ledgerRepo}
+}
+
+// GetUserBalances returns the available and held balances of a user at merchantID, per currency
+func (b *BalanceServiceImpl) GetUserBalances(ctx context.Context, merchantID, userID int) ([]models.Balance, error) {
+	return b.ledgerRepository.GetUserBalances(ctx, merchantID, userID)
+}
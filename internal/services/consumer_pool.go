@@ -0,0 +1,100 @@
+package services
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// consumerPool processes messages in batches on a fixed number of workers,
+// messages with the same key always go to the same worker, in the order they were dispatched
+type consumerPool struct {
+	workers   []chan kafka.Message
+	batchSize int
+	maxLinger time.Duration
+	process   func(batch []kafka.Message)
+	wg        sync.WaitGroup
+}
+
+// newConsumerPool starts concurrency workers, each calling process with batches of batchSize messages,
+// or with the messages it has maxLinger after the first message of a batch
+func newConsumerPool(concurrency, batchSize int, maxLinger time.Duration, process func(batch []kafka.Message)) *consumerPool {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	p := &consumerPool{
+		workers:   make([]chan kafka.Message, concurrency),
+		batchSize: batchSize,
+		maxLinger: maxLinger,
+		process:   process,
+	}
+	for i := range p.workers {
+		// A worker's buffer holds a batch, so reading continues while the worker processes the previous one
+		p.workers[i] = make(chan kafka.Message, batchSize)
+		p.wg.Add(1)
+		go p.run(p.workers[i])
+	}
+	return p
+}
+
+// Dispatch hands msg to the worker of its key, blocking while that worker is full
+func (p *consumerPool) Dispatch(msg kafka.Message) {
+	p.workers[workerIndex(msg.Key, len(p.workers))] <- msg
+}
+
+// Close stops the workers once they processed every message dispatched to them, incomplete batches included
+func (p *consumerPool) Close() {
+	for _, worker := range p.workers {
+		close(worker)
+	}
+	p.wg.Wait()
+}
+
+func (p *consumerPool) run(in <-chan kafka.Message) {
+	defer p.wg.Done()
+
+	batch := make([]kafka.Message, 0, p.batchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			p.process(batch)
+			batch = make([]kafka.Message, 0, p.batchSize)
+		}
+	}
+
+	// The linger timer only runs while the batch has messages
+	linger := time.NewTimer(p.maxLinger)
+	linger.Stop()
+
+	for {
+		select {
+		case msg, ok := <-in:
+			if !ok {
+				linger.Stop()
+				flush()
+				return
+			}
+			if len(batch) == 0 {
+				linger.Reset(p.maxLinger)
+			}
+			batch = append(batch, msg)
+			if len(batch) >= p.batchSize {
+				linger.Stop()
+				flush()
+			}
+		case <-linger.C:
+			flush()
+		}
+	}
+}
+
+func workerIndex(key []byte, workers int) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(workers))
+}
@@ -0,0 +1,84 @@
+package services
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumerPool_KeepsKeyOrder(t *testing.T) {
+	mu := sync.Mutex{}
+	processed := map[string][]int64{}
+	batches := 0
+
+	pool := newConsumerPool(4, 5, time.Hour, func(batch []kafka.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		batches++
+		for _, msg := range batch {
+			processed[string(msg.Key)] = append(processed[string(msg.Key)], msg.Offset)
+		}
+	})
+
+	for offset := int64(0); offset < 60; offset++ {
+		pool.Dispatch(kafka.Message{Key: []byte(strconv.Itoa(int(offset % 6))), Offset: offset})
+	}
+	pool.Close()
+
+	// Every key has 10 messages, so every worker gets full batches of 5
+	assert.Equal(t, 12, batches)
+	assert.Len(t, processed, 6)
+	for key, offsets := range processed {
+		assert.Len(t, offsets, 10, key)
+		assert.IsIncreasing(t, offsets, key)
+	}
+}
+
+func TestConsumerPool_FlushesAfterMaxLinger(t *testing.T) {
+	processed := make(chan []kafka.Message, 1)
+	pool := newConsumerPool(1, 100, 10*time.Millisecond, func(batch []kafka.Message) {
+		processed <- batch
+	})
+	defer pool.Close()
+
+	pool.Dispatch(kafka.Message{Key: []byte("1"), Offset: 1})
+	pool.Dispatch(kafka.Message{Key: []byte("2"), Offset: 2})
+
+	select {
+	case batch := <-processed:
+		assert.Len(t, batch, 2)
+	case <-time.After(time.Second):
+		t.Fatal("batch wasn't processed after max linger")
+	}
+}
+
+func TestConsumerPool_CloseProcessesIncompleteBatches(t *testing.T) {
+	mu := sync.Mutex{}
+	processed := 0
+	pool := newConsumerPool(2, 100, time.Hour, func(batch []kafka.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		processed += len(batch)
+	})
+
+	for offset := int64(0); offset < 5; offset++ {
+		pool.Dispatch(kafka.Message{Key: []byte(strconv.Itoa(int(offset))), Offset: offset})
+	}
+	pool.Close()
+
+	assert.Equal(t, 5, processed)
+}
+
+func TestWorkerIndex(t *testing.T) {
+	assert.Equal(t, workerIndex([]byte("42"), 8), workerIndex([]byte("42"), 8))
+	assert.Equal(t, 0, workerIndex([]byte("42"), 1))
+
+	for i := 0; i < 100; i++ {
+		index := workerIndex([]byte(strconv.Itoa(i)), 8)
+		assert.True(t, index >= 0 && index < 8)
+	}
+}
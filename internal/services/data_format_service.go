@@ -9,8 +9,13 @@ import (
 	"reflect"
 )
 
+// GetDataFormat returns the data format of the request's body, requests without a body, like GETs,
+// may ask for a data format with the Accept header
 func GetDataFormat(r *http.Request) models.DataFormat {
 	contentTypeHeader := r.Header.Get("Content-Type")
+	if contentTypeHeader == "" {
+		contentTypeHeader = r.Header.Get("Accept")
+	}
 
 	switch contentTypeHeader {
 	case string(models.JSON):
@@ -62,7 +67,7 @@ func EncodeRequestWithHeader(w http.ResponseWriter, apiResp *models.APIResponse)
 		w.WriteHeader(apiResp.StatusCode)
 		return json.NewEncoder(w).Encode(apiResp)
 	case models.XML:
-		w.Header().Set("Content-Type", string(models.JSON))
+		w.Header().Set("Content-Type", string(models.XML))
 		w.WriteHeader(apiResp.StatusCode)
 		return xml.NewEncoder(w).Encode(apiResp)
 	default:
@@ -0,0 +1,121 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"payment-gateway/internal/models"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sony/gobreaker"
+)
+
+type GatewayHealth interface {
+	Available(gateway *models.Gateway) bool
+	Execute(gateway *models.Gateway, operation func() error) error
+	RecordOutcome(gatewayID int, success bool)
+	States() []models.GatewayBreakerState
+}
+
+// GatewayHealthImpl keeps one circuit breaker per gateway, fed by calls to the gateway and by the webhooks it sends.
+//
+//	Two step breakers are used, as webhook outcomes arrive long after the call they belong to
+type GatewayHealthImpl struct {
+	mu       sync.Mutex
+	breakers map[int]*gobreaker.TwoStepCircuitBreaker
+	names    map[int]string
+}
+
+func NewGatewayHealth() *GatewayHealthImpl {
+	return &GatewayHealthImpl{
+		breakers: map[int]*gobreaker.TwoStepCircuitBreaker{},
+		names:    map[int]string{},
+	}
+}
+
+// breaker returns the breaker of the gateway, creating it on first use.
+//
+//	Name is only used for reporting, it can be empty when only the ID is known
+func (g *GatewayHealthImpl) breaker(gatewayID int, name string) *gobreaker.TwoStepCircuitBreaker {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if name != "" {
+		g.names[gatewayID] = name
+	}
+
+	if breaker, ok := g.breakers[gatewayID]; ok {
+		return breaker
+	}
+
+	// Trips after 5 failures in a row, or when half of at least 10 outcomes in a minute failed,
+	// and lets 3 requests through to probe the gateway after 30 seconds
+	breaker := gobreaker.NewTwoStepCircuitBreaker(gobreaker.Settings{
+		Name:        fmt.Sprintf("Gateway-%d", gatewayID),
+		MaxRequests: 3,
+		Interval:    60 * time.Second,
+		Timeout:     30 * time.Second,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			if counts.ConsecutiveFailures >= 5 {
+				return true
+			}
+			return counts.Requests >= 10 && float64(counts.TotalFailures)/float64(counts.Requests) >= 0.5
+		},
+		OnStateChange: func(name string, from, to gobreaker.State) {
+			log.Printf("Circuit breaker %s changed from %s to %s", name, from.String(), to.String())
+		},
+	})
+	g.breakers[gatewayID] = breaker
+	return breaker
+}
+
+// Available reports if traffic can be routed to the gateway, i.e. its breaker isn't open
+func (g *GatewayHealthImpl) Available(gateway *models.Gateway) bool {
+	return g.breaker(gateway.ID, gateway.Name).State() != gobreaker.StateOpen
+}
+
+// Execute calls the gateway through its breaker, failing fast if the breaker is open
+func (g *GatewayHealthImpl) Execute(gateway *models.Gateway, operation func() error) error {
+	done, err := g.breaker(gateway.ID, gateway.Name).Allow()
+	if err != nil {
+		return fmt.Errorf("gateway %s is unavailable: %w", gateway.Name, err)
+	}
+
+	err = operation()
+	done(err == nil)
+	return err
+}
+
+// RecordOutcome feeds an outcome reported by the gateway asynchronously, e.g. a FAILED webhook.
+//
+//	Outcomes arriving while the breaker is open are dropped, the breaker probes the gateway with calls instead
+func (g *GatewayHealthImpl) RecordOutcome(gatewayID int, success bool) {
+	done, err := g.breaker(gatewayID, "").Allow()
+	if err != nil {
+		return
+	}
+	done(success)
+}
+
+// States returns a snapshot of every breaker, ordered by gateway ID
+func (g *GatewayHealthImpl) States() []models.GatewayBreakerState {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	states := make([]models.GatewayBreakerState, 0, len(g.breakers))
+	for gatewayID, breaker := range g.breakers {
+		counts := breaker.Counts()
+		states = append(states, models.GatewayBreakerState{
+			GatewayID:           gatewayID,
+			Name:                g.names[gatewayID],
+			State:               breaker.State().String(),
+			Requests:            counts.Requests,
+			TotalFailures:       counts.TotalFailures,
+			ConsecutiveFailures: counts.ConsecutiveFailures,
+		})
+	}
+
+	sort.Slice(states, func(i, j int) bool { return states[i].GatewayID < states[j].GatewayID })
+	return states
+}
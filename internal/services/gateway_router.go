@@ -0,0 +1,104 @@
+package services
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"payment-gateway/internal/models"
+	"sort"
+)
+
+type GatewayRouter interface {
+	Route(txn *models.Transaction, gateways []*models.Gateway) (*models.Gateway, *models.RoutingDecision, error)
+}
+
+// GatewayRouterImpl picks gateways using the routing rules of the country.
+//
+//	Gateways of the best priority whose rule accepts the amount share the traffic by weight,
+//	when none accepts it, the next priority is tried.
+//	Gateways whose circuit breaker is open are skipped, so traffic fails over to the next eligible gateway.
+type GatewayRouterImpl struct {
+	health GatewayHealth
+}
+
+func NewGatewayRouter(health GatewayHealth) *GatewayRouterImpl {
+	return &GatewayRouterImpl{health: health}
+}
+
+// Route picks a gateway for the transaction out of gateways fetched with their routing rules.
+//
+//	The pick only depends on the transaction's fields, so the same transaction is always routed
+//	to the same gateway, and the decision can be reproduced later from the stored transaction.
+func (g *GatewayRouterImpl) Route(txn *models.Transaction, gateways []*models.Gateway) (*models.Gateway, *models.RoutingDecision, error) {
+	// Group eligible gateways by priority
+	byPriority := map[int][]*models.Gateway{}
+	priorities := []int{}
+	unavailable := []int{}
+	for _, gateway := range gateways {
+		if gateway.Routing == nil || !gateway.Routing.Accepts(txn.Amount) {
+			continue
+		}
+		if !g.health.Available(gateway) {
+			unavailable = append(unavailable, gateway.ID)
+			continue
+		}
+
+		priority := gateway.Routing.Priority
+		if _, ok := byPriority[priority]; !ok {
+			priorities = append(priorities, priority)
+		}
+		byPriority[priority] = append(byPriority[priority], gateway)
+	}
+
+	if len(priorities) == 0 {
+		return nil, nil, fmt.Errorf("%w for amount %s %s among %d gateways, unavailable gateways: %v", models.ErrNoEligibleGateway, txn.Amount.String(), txn.Currency, len(gateways), unavailable)
+	}
+	sort.Ints(priorities)
+
+	candidates := byPriority[priorities[0]]
+	// Order by ID, so the weight ranges don't move when gateways are created
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].ID < candidates[j].ID })
+
+	totalWeight := 0
+	candidateIDs := make([]int, 0, len(candidates))
+	for _, gateway := range candidates {
+		totalWeight += gateway.Routing.Weight
+		candidateIDs = append(candidateIDs, gateway.ID)
+	}
+
+	bucket := int(routingHash(txn) % uint32(totalWeight))
+
+	picked := candidates[len(candidates)-1]
+	upperBound := 0
+	for _, gateway := range candidates {
+		upperBound += gateway.Routing.Weight
+		if bucket < upperBound {
+			picked = gateway
+			break
+		}
+	}
+
+	decision := &models.RoutingDecision{
+		GatewayID:   picked.ID,
+		Priority:    priorities[0],
+		Bucket:      bucket,
+		TotalWeight: totalWeight,
+		Candidates:  candidateIDs,
+		Unavailable: unavailable,
+		Reason: fmt.Sprintf("priority %d, bucket %d of %d, gateway %s has weight %d among gateways %v",
+			priorities[0], bucket, totalWeight, picked.Name, picked.Routing.Weight, candidateIDs),
+	}
+	if len(unavailable) > 0 {
+		decision.Reason += fmt.Sprintf(", skipped gateways %v with open circuit breakers", unavailable)
+	}
+
+	log.Printf("Routed %s of %s %s for user %d to gateway %d: %s", txn.Type, txn.Amount.String(), txn.Currency, txn.UserID, picked.ID, decision.Reason)
+	return picked, decision, nil
+}
+
+// routingHash hashes the fields identifying a transaction before it has an ID
+func routingHash(txn *models.Transaction) uint32 {
+	hash := fnv.New32a()
+	fmt.Fprintf(hash, "%d|%d|%s|%d|%s|%d", txn.UserID, txn.CountryID, txn.Type, txn.Amount.MinorUnits, txn.Currency, txn.CreatedAt.UnixNano())
+	return hash.Sum32()
+}
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"errors"
+	"payment-gateway/internal/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func routedGateway(id, priority, weight int, enabled bool) *models.Gateway {
+	return &models.Gateway{
+		ID:      id,
+		Name:    "gateway",
+		Routing: &models.RoutingRule{Priority: priority, Weight: weight, Enabled: enabled},
+	}
+}
+
+func routedTransaction(userID int, createdAt time.Time) *models.Transaction {
+	return &models.Transaction{
+		UserID:    userID,
+		Amount:    models.NewMoney(10000, "USD"),
+		Currency:  "USD",
+		Type:      string(models.DEPOSIT),
+		CountryID: 3,
+		CreatedAt: createdAt,
+	}
+}
+
+func TestRoute_IsDeterministic(t *testing.T) {
+	router := NewGatewayRouter(NewGatewayHealth())
+	gateways := []*models.Gateway{routedGateway(1, 1, 50, true), routedGateway(2, 1, 50, true)}
+	txn := routedTransaction(1, time.Date(2024, 12, 18, 11, 58, 52, 0, time.UTC))
+
+	first, decision, err := router.Route(txn, gateways)
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		again, againDecision, err := router.Route(txn, gateways)
+		assert.NoError(t, err)
+		assert.Equal(t, first.ID, again.ID)
+		assert.Equal(t, decision, againDecision)
+	}
+	assert.Equal(t, first.ID, decision.GatewayID)
+	assert.Equal(t, []int{1, 2}, decision.Candidates)
+}
+
+func TestRoute_PrefersPriorityAndSkipsIneligible(t *testing.T) {
+	router := NewGatewayRouter(NewGatewayHealth())
+	maxAmount := models.NewMoney(5000, "USD")
+
+	limited := routedGateway(1, 1, 100, true)
+	limited.Routing.MaxAmount = &maxAmount
+	gateways := []*models.Gateway{
+		limited,
+		routedGateway(2, 1, 100, false),
+		routedGateway(3, 2, 100, true),
+		routedGateway(4, 3, 100, true),
+	}
+
+	gateway, decision, err := router.Route(routedTransaction(1, time.Now()), gateways)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, gateway.ID)
+	assert.Equal(t, 2, decision.Priority)
+}
+
+func TestRoute_SplitsByWeight(t *testing.T) {
+	router := NewGatewayRouter(NewGatewayHealth())
+	gateways := []*models.Gateway{routedGateway(1, 1, 80, true), routedGateway(2, 1, 20, true), routedGateway(3, 1, 0, true)}
+
+	counts := map[int]int{}
+	start := time.Date(2024, 12, 18, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 2000; i++ {
+		gateway, _, err := router.Route(routedTransaction(i, start.Add(time.Duration(i)*time.Microsecond)), gateways)
+		assert.NoError(t, err)
+		counts[gateway.ID]++
+	}
+
+	assert.InDelta(t, 1600, counts[1], 150)
+	assert.InDelta(t, 400, counts[2], 150)
+	assert.Zero(t, counts[3])
+}
+
+func TestRoute_NoEligibleGateway(t *testing.T) {
+	router := NewGatewayRouter(NewGatewayHealth())
+
+	_, _, err := router.Route(routedTransaction(1, time.Now()), []*models.Gateway{routedGateway(1, 1, 100, false)})
+
+	assert.True(t, errors.Is(err, models.ErrNoEligibleGateway))
+}
+
+func TestRoute_FailsOverWhenBreakerIsOpen(t *testing.T) {
+	health := NewGatewayHealth()
+	router := NewGatewayRouter(health)
+	gateways := []*models.Gateway{routedGateway(1, 1, 100, true), routedGateway(2, 2, 100, true)}
+
+	gateway, _, err := router.Route(routedTransaction(1, time.Now()), gateways)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, gateway.ID)
+
+	for i := 0; i < 5; i++ {
+		health.RecordOutcome(1, false)
+	}
+	assert.False(t, health.Available(gateways[0]))
+
+	gateway, decision, err := router.Route(routedTransaction(1, time.Now()), gateways)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, gateway.ID)
+	assert.Equal(t, []int{1}, decision.Unavailable)
+
+	states := health.States()
+	assert.Len(t, states, 2)
+	assert.Equal(t, "open", states[0].State)
+	assert.Equal(t, "closed", states[1].State)
+}
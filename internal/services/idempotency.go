@@ -0,0 +1,139 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/repository"
+	"time"
+)
+
+// IdempotencyKeyHeader is the header clients use to make retries of a request safe
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// ErrIdempotencyKeyReused is returned when a key is replayed with a different request
+var ErrIdempotencyKeyReused = errors.New("idempotency key was already used with a different request")
+
+// IdempotentProcess processes a request made with an idempotency key.
+//
+//	resumeID is the transaction an earlier attempt of the request created without completing it, 0 on the first attempt.
+//	It returns the response along with the transaction the request created, 0 if it created none
+type IdempotentProcess func(resumeID int) (*models.APIResponse, int)
+
+type IdempotencyService interface {
+	Execute(ctx context.Context, key, requestHash string, replayData interface{}, process IdempotentProcess) (*models.APIResponse, bool, error)
+}
+
+type IdempotencyServiceImpl struct {
+	repository repository.IdempotencyRepository
+	ttl        time.Duration
+}
+
+// NewIdempotencyService creates the service storing responses against idempotency keys
+//
+//	If ttl is not provided or not a valid duration, it will default to 24h
+func NewIdempotencyService(repo repository.IdempotencyRepository, ttl string) *IdempotencyServiceImpl {
+	ttlDuration, err := time.ParseDuration(ttl)
+	if err != nil || ttlDuration <= 0 {
+		ttlDuration = 24 * time.Hour
+	}
+	return &IdempotencyServiceImpl{repository: repo, ttl: ttlDuration}
+}
+
+// HashRequest returns a hash of the method, path and body of the request.
+//
+//	The body is read fully and restored, so the request can still be decoded afterwards
+func HashRequest(r *http.Request) (string, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read request body: %v", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	hash := sha256.New()
+	hash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Execute runs process once per key and returns its response.
+//
+//	Replays with the same key and hash will return the stored response, decoding `data` into replayData,
+//	the second return value reports whether the response was replayed.
+//	Replays with a different hash will return ErrIdempotencyKeyReused.
+//	Server errors aren't replayed, so the client can retry them with the same key. Once the request created a transaction,
+//	a server error is stored along with it, and retries resume that transaction rather than creating another one.
+func (i *IdempotencyServiceImpl) Execute(ctx context.Context, key, requestHash string, replayData interface{}, process IdempotentProcess) (*models.APIResponse, bool, error) {
+	var response *models.APIResponse
+	replayed, processed := false, false
+
+	err := i.repository.WithLock(ctx, key, func(existing *models.IdempotencyRecord) (*models.IdempotencyRecord, error) {
+		resumeID := 0
+		if existing != nil {
+			if existing.RequestHash != requestHash {
+				return nil, ErrIdempotencyKeyReused
+			}
+
+			if existing.StatusCode >= http.StatusInternalServerError && existing.TransactionID != nil {
+				// The request failed after creating its transaction, e.g. at the gateway, that transaction is resumed
+				resumeID = *existing.TransactionID
+			} else {
+				response = &models.APIResponse{Data: replayData}
+				if err := json.Unmarshal(existing.Response, response); err != nil {
+					return nil, fmt.Errorf("failed to decode stored response for idempotency key %s: %v", key, err)
+				}
+				replayed = true
+				return nil, nil
+			}
+		}
+
+		var txnID int
+		response, txnID = process(resumeID)
+		processed = true
+		if txnID == 0 {
+			txnID = resumeID
+		}
+		if response.StatusCode >= http.StatusInternalServerError && txnID == 0 {
+			return nil, nil
+		}
+
+		stored, err := json.Marshal(response)
+		if err != nil {
+			// The response is still valid, only a replay of it won't be possible
+			log.Printf("Failed to encode response for idempotency key %s, err: %+v", key, err)
+			return nil, nil
+		}
+
+		now := time.Now()
+		record := &models.IdempotencyRecord{
+			Key:         key,
+			RequestHash: requestHash,
+			StatusCode:  response.StatusCode,
+			Response:    stored,
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(i.ttl),
+		}
+		if txnID != 0 {
+			record.TransactionID = &txnID
+		}
+		return record, nil
+	})
+	if err != nil && processed {
+		// The request already went through, failing it now would make the client retry it
+		log.Printf("Failed to store response for idempotency key %s, err: %+v", key, err)
+		return response, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return response, replayed, nil
+}
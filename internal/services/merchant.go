@@ -0,0 +1,123 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/repository"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix starts every merchant API key, keys are `mk_<16 hex prefix>_<43 base64url secret>`
+const apiKeyPrefix = "mk_"
+
+// apiKeyPrefixLength is the length of the stored prefix of a key, mk_ included
+const apiKeyPrefixLength = len(apiKeyPrefix) + 16
+
+// DefaultAPIKeyOverlap is how long the keys of a merchant keep working after a rotation, when no overlap is given
+const DefaultAPIKeyOverlap = 24 * time.Hour
+
+type MerchantService interface {
+	Authenticate(ctx context.Context, apiKey string) (int, error)
+	CreateMerchant(ctx context.Context, name string) (*models.Merchant, string, error)
+	RotateAPIKey(ctx context.Context, merchantID int, overlap time.Duration) (string, error)
+}
+
+type MerchantServiceImpl struct {
+	merchantRepository repository.MerchantRepository
+	now                func() time.Time
+}
+
+// NewMerchantService creates the service managing merchants and authenticating their API keys
+func NewMerchantService(merchantRepo repository.MerchantRepository) *MerchantServiceImpl {
+	return &MerchantServiceImpl{merchantRepository: merchantRepo, now: time.Now}
+}
+
+// Authenticate returns the merchant of apiKey.
+//
+//	The key is looked up by its prefix, and its SHA-256 compared in constant time with the stored one.
+//	Keys which are malformed, unknown, expired or don't match return an error matching models.ErrInvalidAPIKey
+func (m *MerchantServiceImpl) Authenticate(ctx context.Context, apiKey string) (int, error) {
+	prefix, ok := parseAPIKey(apiKey)
+	if !ok {
+		return 0, fmt.Errorf("%w: malformed key", models.ErrInvalidAPIKey)
+	}
+
+	key, err := m.merchantRepository.GetActiveAPIKey(ctx, prefix, m.now())
+	if err != nil {
+		return 0, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(apiKey)), []byte(key.Hash)) != 1 {
+		return 0, fmt.Errorf("%w: hash mismatch for key %s", models.ErrInvalidAPIKey, prefix)
+	}
+	return key.MerchantID, nil
+}
+
+// CreateMerchant creates a merchant named name with its first API key, the key is returned in plain text,
+// only its hash is stored, so it can't be shown again
+func (m *MerchantServiceImpl) CreateMerchant(ctx context.Context, name string) (*models.Merchant, string, error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, "", fmt.Errorf("merchant name is required")
+	}
+
+	apiKey, key, err := newAPIKey()
+	if err != nil {
+		return nil, "", err
+	}
+	merchant := &models.Merchant{Name: name}
+	if err := m.merchantRepository.CreateMerchant(ctx, merchant, key); err != nil {
+		return nil, "", err
+	}
+	return merchant, apiKey, nil
+}
+
+// RotateAPIKey creates a new API key for merchantID, returned in plain text, the merchant's other keys expire after overlap,
+// so clients can move to the new key without downtime. An overlap of zero expires them right away
+func (m *MerchantServiceImpl) RotateAPIKey(ctx context.Context, merchantID int, overlap time.Duration) (string, error) {
+	if overlap < 0 {
+		return "", fmt.Errorf("overlap must not be negative, got: %s", overlap)
+	}
+
+	apiKey, key, err := newAPIKey()
+	if err != nil {
+		return "", err
+	}
+	key.MerchantID = merchantID
+	if err := m.merchantRepository.RotateAPIKey(ctx, key, m.now().Add(overlap)); err != nil {
+		return "", err
+	}
+	return apiKey, nil
+}
+
+// newAPIKey generates a random API key, returned in plain text, along with the key to store
+func newAPIKey() (string, *models.APIKey, error) {
+	random := make([]byte, 8+32)
+	if _, err := io.ReadFull(rand.Reader, random); err != nil {
+		return "", nil, fmt.Errorf("failed to generate API key: %v", err)
+	}
+
+	prefix := apiKeyPrefix + hex.EncodeToString(random[:8])
+	apiKey := prefix + "_" + base64.RawURLEncoding.EncodeToString(random[8:])
+	return apiKey, &models.APIKey{Prefix: prefix, Hash: hashAPIKey(apiKey)}, nil
+}
+
+// parseAPIKey returns the prefix of apiKey, ok is false if it isn't shaped like a key made by newAPIKey
+func parseAPIKey(apiKey string) (string, bool) {
+	if len(apiKey) <= apiKeyPrefixLength+1 || !strings.HasPrefix(apiKey, apiKeyPrefix) || apiKey[apiKeyPrefixLength] != '_' {
+		return "", false
+	}
+	return apiKey[:apiKeyPrefixLength], true
+}
+
+// hashAPIKey returns the hex encoded SHA-256 of apiKey, keys are random enough not to need a slow hash
+func hashAPIKey(apiKey string) string {
+	hash := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"context"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/repository"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMerchantRepository keeps API keys by prefix, like the repository it honors their expiry
+type fakeMerchantRepository struct {
+	repository.MerchantRepository
+	keys map[string]*models.APIKey
+}
+
+func (f *fakeMerchantRepository) CreateMerchant(ctx context.Context, merchant *models.Merchant, key *models.APIKey) error {
+	merchant.ID = len(f.keys) + 1
+	key.MerchantID = merchant.ID
+	f.keys[key.Prefix] = key
+	return nil
+}
+
+func (f *fakeMerchantRepository) GetActiveAPIKey(ctx context.Context, prefix string, at time.Time) (*models.APIKey, error) {
+	key, ok := f.keys[prefix]
+	if !ok || (key.ExpiresAt != nil && !key.ExpiresAt.After(at)) {
+		return nil, models.ErrInvalidAPIKey
+	}
+	return key, nil
+}
+
+func (f *fakeMerchantRepository) RotateAPIKey(ctx context.Context, key *models.APIKey, expiresAt time.Time) error {
+	for _, other := range f.keys {
+		if other.MerchantID == key.MerchantID && (other.ExpiresAt == nil || other.ExpiresAt.After(expiresAt)) {
+			other.ExpiresAt = &expiresAt
+		}
+	}
+	f.keys[key.Prefix] = key
+	return nil
+}
+
+func TestMerchantService_Authenticate(t *testing.T) {
+	service := NewMerchantService(&fakeMerchantRepository{keys: map[string]*models.APIKey{}})
+	ctx := context.Background()
+
+	merchant, apiKey, err := service.CreateMerchant(ctx, "acme")
+	assert.NoError(t, err)
+
+	merchantID, err := service.Authenticate(ctx, apiKey)
+	assert.NoError(t, err)
+	assert.Equal(t, merchant.ID, merchantID)
+
+	// A key with a known prefix but another secret doesn't match the stored hash
+	forged := apiKey + "x"
+	for name, key := range map[string]string{"forged": forged, "malformed": "mk_nope", "empty": "", "unknown": "mk_0123456789abcdef_secret"} {
+		_, err := service.Authenticate(ctx, key)
+		assert.ErrorIs(t, err, models.ErrInvalidAPIKey, name)
+	}
+
+	_, _, err = service.CreateMerchant(ctx, " ")
+	assert.Error(t, err)
+}
+
+func TestMerchantService_RotateAPIKey(t *testing.T) {
+	service := NewMerchantService(&fakeMerchantRepository{keys: map[string]*models.APIKey{}})
+	ctx := context.Background()
+	now := time.Now()
+	service.now = func() time.Time { return now }
+
+	merchant, oldKey, err := service.CreateMerchant(ctx, "acme")
+	assert.NoError(t, err)
+
+	newKey, err := service.RotateAPIKey(ctx, merchant.ID, time.Hour)
+	assert.NoError(t, err)
+
+	// Both keys work during the overlap
+	for _, key := range []string{oldKey, newKey} {
+		merchantID, err := service.Authenticate(ctx, key)
+		assert.NoError(t, err)
+		assert.Equal(t, merchant.ID, merchantID)
+	}
+
+	// Only the new key works after it
+	now = now.Add(time.Hour)
+	_, err = service.Authenticate(ctx, oldKey)
+	assert.ErrorIs(t, err, models.ErrInvalidAPIKey)
+	_, err = service.Authenticate(ctx, newKey)
+	assert.NoError(t, err)
+
+	_, err = service.RotateAPIKey(ctx, merchant.ID, -time.Second)
+	assert.Error(t, err)
+}
@@ -0,0 +1,17 @@
+package services
+
+import "expvar"
+
+// staleStatusUpdates counts status changes ignored because the gateway already made a later one, by where they came from.
+//
+//	Exposed with the other expvar metrics on GET /api/v1/admin/metrics
+var staleStatusUpdates = expvar.NewMap("stale_status_updates")
+
+const (
+	staleSourceWebhook  = "webhook"
+	staleSourceConsumer = "consumer"
+)
+
+// failedOutboxEvents counts outbox events which used up their attempts, they and the later events of their transaction
+// aren't published until they are requeued
+var failedOutboxEvents = expvar.NewInt("failed_outbox_events")
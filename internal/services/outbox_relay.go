@@ -0,0 +1,162 @@
+package services
+
+import (
+	"context"
+	"log"
+	kafkaProducer "payment-gateway/internal/kafka/producer"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/repository"
+	"strconv"
+	"time"
+)
+
+const (
+	outboxMaxBackoff = 5 * time.Minute
+	outboxRetention  = 7 * 24 * time.Hour
+)
+
+// OutboxRelay publishes outbox events to kafka
+type OutboxRelay interface {
+	// Run relays events until ctx is cancelled
+	Run(ctx context.Context)
+	// RelayOnce publishes a batch of pending events, returning how many were published
+	RelayOnce(ctx context.Context) (int, error)
+}
+
+type OutboxRelayImpl struct {
+	outboxRepository repository.OutboxRepository
+	publisher        kafkaProducer.KafkaProducer
+	pollInterval     time.Duration
+	batchSize        int
+	maxAttempts      int
+
+	lastCleanup time.Time
+}
+
+// NewOutboxRelay creates the relay of the outbox.
+//
+//	pollInterval is how often the outbox is checked for new events, defaults to 1s
+//	batchSize is the maximum number of events published at once, defaults to 100
+//	maxAttempts is how many times an event is tried before it is marked failed, defaults to 20
+func NewOutboxRelay(outboxRepo repository.OutboxRepository, publisher kafkaProducer.KafkaProducer, pollInterval, batchSize, maxAttempts string) *OutboxRelayImpl {
+	interval, err := time.ParseDuration(pollInterval)
+	if err != nil || interval <= 0 {
+		interval = time.Second
+	}
+	size, err := strconv.Atoi(batchSize)
+	if err != nil || size <= 0 {
+		size = 100
+	}
+	attempts, err := strconv.Atoi(maxAttempts)
+	if err != nil || attempts <= 0 {
+		attempts = 20
+	}
+	return &OutboxRelayImpl{
+		outboxRepository: outboxRepo,
+		publisher:        publisher,
+		pollInterval:     interval,
+		batchSize:        size,
+		maxAttempts:      attempts,
+	}
+}
+
+func (o *OutboxRelayImpl) Run(ctx context.Context) {
+	ticker := time.NewTicker(o.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Server stop signal received, outbox relay stopped")
+			return
+		case <-ticker.C:
+		}
+
+		// Keep going while full batches are published, so a backlog drains without waiting for the ticker
+		for {
+			published, err := o.RelayOnce(ctx)
+			if err != nil {
+				log.Printf("Failed to relay outbox events: %v", err)
+			}
+			if err != nil || published < o.batchSize || ctx.Err() != nil {
+				break
+			}
+		}
+
+		o.cleanup(ctx)
+	}
+}
+
+// RelayOnce publishes pending events in order of their ID.
+//
+//	Once an event of a transaction fails or waits for a retry, the later events of the transaction are held back,
+//	so a consumer never sees a transaction's events out of order. An event may be published more than once,
+//	if the process stops between the publish and marking it published.
+//	An event failing maxAttempts times is marked failed, which holds back the later events of its transaction until it is requeued.
+func (o *OutboxRelayImpl) RelayOnce(ctx context.Context) (int, error) {
+	published := 0
+
+	_, err := o.outboxRepository.ProcessPending(ctx, o.batchSize, func(events []*models.OutboxEvent) error {
+		blocked := map[int]bool{}
+		now := time.Now()
+
+		for _, event := range events {
+			if blocked[event.AggregateID] || event.NextAttemptAt.After(now) {
+				blocked[event.AggregateID] = true
+				continue
+			}
+
+			err := PublishWithCircuitBreaker(func() error {
+				return o.publisher.Publish(ctx, event.Key, event.Payload)
+			})
+			if err != nil {
+				event.Attempts++
+				event.LastError = err.Error()
+				event.NextAttemptAt = now.Add(outboxBackoff(event.Attempts))
+				blocked[event.AggregateID] = true
+				log.Printf("Failed to publish outbox event %d of transaction %d, attempt: %d, err: %v", event.ID, event.AggregateID, event.Attempts, err)
+
+				if event.Attempts >= o.maxAttempts {
+					failedAt := time.Now()
+					event.FailedAt = &failedAt
+					failedOutboxEvents.Add(1)
+					log.Printf("Giving up on outbox event %d of transaction %d after %d attempts, its transaction's events are held back until it is requeued", event.ID, event.AggregateID, event.Attempts)
+				}
+				continue
+			}
+
+			publishedAt := time.Now()
+			event.PublishedAt = &publishedAt
+			event.Attempts++
+			event.LastError = ""
+			published++
+		}
+		return nil
+	})
+
+	return published, err
+}
+
+// cleanup deletes events published before the retention, at most once per hour
+func (o *OutboxRelayImpl) cleanup(ctx context.Context) {
+	if time.Since(o.lastCleanup) < time.Hour {
+		return
+	}
+	o.lastCleanup = time.Now()
+
+	if _, err := o.outboxRepository.DeletePublishedBefore(ctx, time.Now().Add(-outboxRetention)); err != nil {
+		log.Printf("Failed to delete published outbox events, err: %+v", err)
+	}
+}
+
+// outboxBackoff doubles the wait after every failed attempt, up to outboxMaxBackoff
+func outboxBackoff(attempts int) time.Duration {
+	if attempts > 9 {
+		return outboxMaxBackoff
+	}
+	backoff := time.Second << attempts
+	if backoff > outboxMaxBackoff {
+		return outboxMaxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,96 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"payment-gateway/internal/models"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeOutboxRepository struct {
+	events []*models.OutboxEvent
+}
+
+func (f *fakeOutboxRepository) ProcessPending(ctx context.Context, limit int, fn func(events []*models.OutboxEvent) error) (bool, error) {
+	return true, fn(f.events)
+}
+
+func (f *fakeOutboxRepository) DeletePublishedBefore(ctx context.Context, before time.Time) (int64, error) {
+	return 0, nil
+}
+
+type fakePublisher struct {
+	failKeys  map[string]bool
+	published []string
+	messages  []kafka.Message
+}
+
+func (f *fakePublisher) Publish(ctx context.Context, key string, message []byte) error {
+	if f.failKeys[string(message)] {
+		return errors.New("kafka down")
+	}
+	f.published = append(f.published, string(message))
+	return nil
+}
+
+func (f *fakePublisher) PublishMessages(ctx context.Context, msgs ...kafka.Message) error {
+	f.messages = append(f.messages, msgs...)
+	return nil
+}
+
+func (f *fakePublisher) Close() error { return nil }
+
+func TestOutboxRelayOnce_HoldsBackLaterEventsOfATransaction(t *testing.T) {
+	now := time.Now()
+	repo := &fakeOutboxRepository{events: []*models.OutboxEvent{
+		{ID: 1, AggregateID: 1, Key: "1", Payload: []byte("1-a"), NextAttemptAt: now},
+		{ID: 2, AggregateID: 2, Key: "2", Payload: []byte("2-a"), NextAttemptAt: now.Add(time.Minute)},
+		{ID: 3, AggregateID: 1, Key: "1", Payload: []byte("1-b"), NextAttemptAt: now},
+		{ID: 4, AggregateID: 2, Key: "2", Payload: []byte("2-b"), NextAttemptAt: now},
+		{ID: 5, AggregateID: 3, Key: "3", Payload: []byte("3-a"), NextAttemptAt: now},
+		{ID: 6, AggregateID: 3, Key: "3", Payload: []byte("3-b"), NextAttemptAt: now},
+	}}
+	publisher := &fakePublisher{failKeys: map[string]bool{"1-b": true}}
+
+	relay := NewOutboxRelay(repo, publisher, "", "", "")
+	published, err := relay.RelayOnce(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, published)
+	// 2-a waits for its retry so 2-b is held back, 1-b failed so nothing after it of transaction 1 would go out
+	assert.Equal(t, []string{"1-a", "3-a", "3-b"}, publisher.published)
+
+	assert.NotNil(t, repo.events[0].PublishedAt)
+	assert.Nil(t, repo.events[1].PublishedAt)
+	assert.Nil(t, repo.events[3].PublishedAt)
+
+	failed := repo.events[2]
+	assert.Nil(t, failed.PublishedAt)
+	assert.Equal(t, 1, failed.Attempts)
+	assert.Equal(t, "kafka down", failed.LastError)
+	assert.True(t, failed.NextAttemptAt.After(now))
+}
+
+func TestOutboxRelayOnce_GivesUpAfterMaxAttempts(t *testing.T) {
+	now := time.Now()
+	repo := &fakeOutboxRepository{events: []*models.OutboxEvent{
+		{ID: 1, AggregateID: 1, Key: "1", Payload: []byte("1-a"), Attempts: 2, NextAttemptAt: now},
+		{ID: 2, AggregateID: 2, Key: "2", Payload: []byte("2-a"), Attempts: 1, NextAttemptAt: now},
+	}}
+	publisher := &fakePublisher{failKeys: map[string]bool{"1-a": true, "2-a": true}}
+	before := failedOutboxEvents.Value()
+
+	relay := NewOutboxRelay(repo, publisher, "", "", "3")
+	_, err := relay.RelayOnce(context.Background())
+	assert.NoError(t, err)
+
+	// The third attempt of 1-a failed, it is marked failed and counted, 2-a is retried later
+	assert.NotNil(t, repo.events[0].FailedAt)
+	assert.Equal(t, 3, repo.events[0].Attempts)
+	assert.Nil(t, repo.events[1].FailedAt)
+	assert.Equal(t, before+1, failedOutboxEvents.Value())
+}
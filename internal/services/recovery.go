@@ -0,0 +1,207 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"payment-gateway/internal/connectors"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/repository"
+	"strconv"
+	"time"
+)
+
+const recoveryBatchSize = 100
+
+// RecoveryWorker re-drives transactions stuck in INIT or KAFKA_PUBLISH_FAILED
+type RecoveryWorker interface {
+	// Run recovers transactions until ctx is cancelled
+	Run(ctx context.Context)
+	// RecoverOnce tries a batch of stuck transactions, returning how many were tried
+	RecoverOnce(ctx context.Context) (int, error)
+}
+
+type RecoveryWorkerImpl struct {
+	recoveryRepository repository.RecoveryRepository
+	txnRepository      repository.TransactionRepository
+	gatewayRepository  repository.GatewayRepository
+	connectors         *connectors.Registry
+	gatewayHealth      GatewayHealth
+
+	interval    time.Duration
+	stuckAfter  time.Duration
+	maxAttempts int
+}
+
+// NewRecoveryWorker creates the recovery worker.
+//
+//	interval is how often stuck transactions are looked for, and how long a transaction waits between attempts, defaults to 1m
+//	stuckAfter is how old a transaction has to be to be considered stuck, defaults to 5m
+//	maxAttempts is how many attempts a transaction gets before it is moved to MANUAL_REVIEW, defaults to 5
+func NewRecoveryWorker(recoveryRepo repository.RecoveryRepository, txnRepo repository.TransactionRepository, gatewayRepo repository.GatewayRepository, connectorRegistry *connectors.Registry, gatewayHealth GatewayHealth, interval, stuckAfter, maxAttempts string) *RecoveryWorkerImpl {
+	intervalDuration, err := time.ParseDuration(interval)
+	if err != nil || intervalDuration <= 0 {
+		intervalDuration = time.Minute
+	}
+	stuckAfterDuration, err := time.ParseDuration(stuckAfter)
+	if err != nil || stuckAfterDuration <= 0 {
+		stuckAfterDuration = 5 * time.Minute
+	}
+	attempts, err := strconv.Atoi(maxAttempts)
+	if err != nil || attempts <= 0 {
+		attempts = 5
+	}
+
+	return &RecoveryWorkerImpl{
+		recoveryRepository: recoveryRepo,
+		txnRepository:      txnRepo,
+		gatewayRepository:  gatewayRepo,
+		connectors:         connectorRegistry,
+		gatewayHealth:      gatewayHealth,
+		interval:           intervalDuration,
+		stuckAfter:         stuckAfterDuration,
+		maxAttempts:        attempts,
+	}
+}
+
+func (r *RecoveryWorkerImpl) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Server stop signal received, recovery worker stopped")
+			return
+		case <-ticker.C:
+		}
+
+		tried, err := r.RecoverOnce(ctx)
+		if err != nil {
+			log.Printf("Failed to recover stuck transactions: %v", err)
+		} else if tried > 0 {
+			log.Printf("Tried to recover %d stuck transactions", tried)
+		}
+	}
+}
+
+func (r *RecoveryWorkerImpl) RecoverOnce(ctx context.Context) (int, error) {
+	now := time.Now()
+	filter := repository.StuckTransactionFilter{
+		InitBefore:          now.Add(-r.stuckAfter),
+		PublishFailedBefore: now.Add(-r.stuckAfter),
+		LastAttemptBefore:   now.Add(-r.interval),
+		Limit:               recoveryBatchSize,
+	}
+
+	tried := 0
+	_, err := r.recoveryRepository.ProcessStuck(ctx, filter, func(stuck []*models.StuckTransaction) ([]models.RecoveryAttempt, error) {
+		attempts := make([]models.RecoveryAttempt, 0, len(stuck))
+		for _, s := range stuck {
+			if ctx.Err() != nil {
+				break
+			}
+			attempts = append(attempts, r.recover(ctx, s))
+		}
+		tried = len(attempts)
+		return attempts, nil
+	})
+
+	return tried, err
+}
+
+// recover makes one attempt on a stuck transaction.
+//
+//	INIT transactions are initiated with the gateway again, KAFKA_PUBLISH_FAILED ones lost the outcome of their webhook,
+//	so it is fetched from the gateway. Once the attempts run out, the transaction is moved to MANUAL_REVIEW.
+func (r *RecoveryWorkerImpl) recover(ctx context.Context, stuck *models.StuckTransaction) models.RecoveryAttempt {
+	txn := &stuck.Transaction
+	attempt := models.RecoveryAttempt{TransactionID: txn.ID, Status: txn.Status, AttemptedAt: time.Now()}
+
+	var err error
+	if stuck.Attempts >= r.maxAttempts {
+		attempt.Outcome = models.ESCALATED
+		// The gateway didn't make this change, so it carries no gateway timestamp, which would make its later outcome look stale
+		err = r.updateStatus(ctx, txn, models.MANUAL_REVIEW, time.Time{}, "")
+		log.Printf("Transaction %d is still %s after %d recovery attempts, moving it to %s", txn.ID, attempt.Status, stuck.Attempts, models.MANUAL_REVIEW)
+	} else {
+		attempt.Outcome = models.RECOVERED
+		err = r.redrive(ctx, txn)
+	}
+
+	var transitionErr *models.InvalidTransitionError
+	switch {
+	case errors.As(err, &transitionErr):
+		// Something else, like a late webhook, moved the transaction in the meantime
+		attempt.Outcome = models.RECOVERED
+		attempt.Error = err.Error()
+	case err != nil:
+		attempt.Outcome = models.RETRY
+		attempt.Error = err.Error()
+		log.Printf("Failed to recover transaction %d, attempt: %d, err: %v", txn.ID, stuck.Attempts+1, err)
+	}
+	return attempt
+}
+
+func (r *RecoveryWorkerImpl) redrive(ctx context.Context, txn *models.Transaction) error {
+	gateway, err := r.gatewayRepository.GetGateway(txn.MerchantID, txn.GatewayID)
+	if err != nil {
+		return err
+	}
+
+	switch txn.Status {
+	case models.INIT:
+		response, err := initiateWithGateway(ctx, r.connectors, r.gatewayHealth, gateway, txn)
+		if err != nil {
+			return err
+		}
+		// The gateway may already know the outcome, if it got the transaction the first time
+		if response.Status == models.SUCCESS || response.Status == models.FAILED {
+			return r.updateStatus(ctx, txn, response.Status, response.UpdatedAt, response.Reference)
+		}
+		return r.updateStatus(ctx, txn, models.PENDING, response.UpdatedAt, response.Reference)
+
+	case models.KAFKA_PUBLISH_FAILED:
+		connector, err := r.connectors.Get(gateway.Name)
+		if err != nil {
+			return err
+		}
+
+		var response *models.GatewayResponse
+		err = r.gatewayHealth.Execute(gateway, func() error {
+			var err error
+			response, err = connector.QueryStatus(ctx, txn)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if response.Status != models.SUCCESS && response.Status != models.FAILED {
+			return fmt.Errorf("gateway %s has no outcome for transaction %d yet, status: %s", gateway.Name, txn.ID, response.Status)
+		}
+		return r.updateStatus(ctx, txn, response.Status, response.UpdatedAt, response.Reference)
+
+	default:
+		return fmt.Errorf("transaction %d in status %s can't be recovered", txn.ID, txn.Status)
+	}
+}
+
+// updateStatus moves txn to status, outcomes are published through the outbox like the ones from webhooks.
+// updatedAt is the gateway's timestamp of the change, zero for changes the worker makes on its own.
+//
+// The change is recorded with the gateway's reference, or for outcomes, with the event ID of their message
+func (r *RecoveryWorkerImpl) updateStatus(ctx context.Context, txn *models.Transaction, status models.TransactionStatus, updatedAt time.Time, reference string) error {
+	if status == models.PENDING {
+		return r.txnRepository.UpdateTransactionStatus(ctx, txn, status, models.EventCause{Source: models.SOURCE_RECOVERY, PayloadRef: reference})
+	}
+
+	next := *txn
+	next.Status = status
+	next.UpdatedAt = updatedAt
+	event, err := newStatusEvent(next)
+	if err != nil {
+		return err
+	}
+	return r.txnRepository.UpdateTransactionStatusWithEvent(ctx, txn, status, updatedAt, models.EventCause{Source: models.SOURCE_RECOVERY, PayloadRef: event.EventID}, event)
+}
@@ -0,0 +1,199 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"payment-gateway/internal/connectors"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/repository"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRecoveryRepository struct {
+	stuck    []*models.StuckTransaction
+	attempts []models.RecoveryAttempt
+}
+
+func (f *fakeRecoveryRepository) ProcessStuck(ctx context.Context, filter repository.StuckTransactionFilter, fn func(stuck []*models.StuckTransaction) ([]models.RecoveryAttempt, error)) (bool, error) {
+	attempts, err := fn(f.stuck)
+	f.attempts = attempts
+	return true, err
+}
+
+// fakeTransactionRepository records status updates, the embedded interface panics on anything else
+type fakeTransactionRepository struct {
+	repository.TransactionRepository
+	statuses     map[int]models.TransactionStatus
+	causes       map[int]models.EventCause
+	events       []*models.OutboxEvent
+	transactions map[int]*models.Transaction
+	// gatewayUpdatedAt are the gateway timestamps status changes were made with
+	gatewayUpdatedAt map[int]time.Time
+}
+
+func (f *fakeTransactionRepository) GetTransaction(merchantID, txnID int) (*models.Transaction, error) {
+	txn, ok := f.transactions[txnID]
+	if !ok || txn.MerchantID != merchantID {
+		return nil, models.ErrTransactionNotFound
+	}
+	return txn, nil
+}
+
+func (f *fakeTransactionRepository) GetUserTransaction(ctx context.Context, merchantID, userID, txnID int) (*models.Transaction, error) {
+	txn, ok := f.transactions[txnID]
+	if !ok || txn.MerchantID != merchantID || txn.UserID != userID {
+		return nil, models.ErrTransactionNotFound
+	}
+	return txn, nil
+}
+
+func (f *fakeTransactionRepository) UpdateTransactionStatus(ctx context.Context, txn *models.Transaction, status models.TransactionStatus, cause models.EventCause) error {
+	if err := txn.ValidateTransition(status); err != nil {
+		return err
+	}
+	txn.Status = status
+	txn.Version++
+	f.statuses[txn.ID] = status
+	if f.causes != nil {
+		f.causes[txn.ID] = cause
+	}
+	return nil
+}
+
+func (f *fakeTransactionRepository) UpdateTransactionStatusWithEvent(ctx context.Context, txn *models.Transaction, status models.TransactionStatus, gatewayUpdatedAt time.Time, cause models.EventCause, event *models.OutboxEvent) error {
+	if err := f.UpdateTransactionStatus(ctx, txn, status, cause); err != nil {
+		return err
+	}
+	if f.gatewayUpdatedAt != nil {
+		f.gatewayUpdatedAt[txn.ID] = gatewayUpdatedAt
+	}
+	f.events = append(f.events, event)
+	return nil
+}
+
+func (f *fakeTransactionRepository) UpdateTransactionsBulk(ctx context.Context, transactions []*models.Transaction) ([]models.BulkUpdateResult, error) {
+	results := make([]models.BulkUpdateResult, len(transactions))
+	for i, txn := range transactions {
+		f.statuses[txn.ID] = txn.Status
+		results[i] = models.BulkUpdateResult{TxnID: txn.ID, Status: txn.Status, Current: txn.Status, Outcome: models.APPLIED}
+	}
+	return results, nil
+}
+
+type fakeGatewayRepository struct {
+	repository.GatewayRepository
+}
+
+func (f *fakeGatewayRepository) GetGateway(merchantID, gatewayID int) (*models.Gateway, error) {
+	return &models.Gateway{ID: gatewayID, MerchantID: merchantID, Name: "stub"}, nil
+}
+
+// stubConnector answers every call with the status of the transaction in statuses
+type stubConnector struct {
+	statuses map[int]models.TransactionStatus
+	err      error
+}
+
+func (s *stubConnector) respond(txn *models.Transaction) (*models.GatewayResponse, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &models.GatewayResponse{Reference: "ref", Status: s.statuses[txn.ID], UpdatedAt: time.Now()}, nil
+}
+
+func (s *stubConnector) InitiatePayment(ctx context.Context, txn *models.Transaction) (*models.GatewayResponse, error) {
+	return s.respond(txn)
+}
+
+func (s *stubConnector) InitiatePayout(ctx context.Context, txn *models.Transaction) (*models.GatewayResponse, error) {
+	return s.respond(txn)
+}
+
+func (s *stubConnector) InitiateRefund(ctx context.Context, txn *models.Transaction) (*models.GatewayResponse, error) {
+	return s.respond(txn)
+}
+
+func (s *stubConnector) QueryStatus(ctx context.Context, txn *models.Transaction) (*models.GatewayResponse, error) {
+	return s.respond(txn)
+}
+
+func (s *stubConnector) ParseWebhook(body []byte, contentType string) (*models.TransactionWebhookResponse, error) {
+	return nil, errors.New("not implemented")
+}
+
+func stuckTransaction(id int, status models.TransactionStatus, attempts int) *models.StuckTransaction {
+	return &models.StuckTransaction{
+		Transaction: models.Transaction{ID: id, Status: status, Type: string(models.DEPOSIT), GatewayID: 1, Amount: models.NewMoney(100, "USD"), Currency: "USD"},
+		Attempts:    attempts,
+	}
+}
+
+func TestRecoverOnce(t *testing.T) {
+	recoveryRepo := &fakeRecoveryRepository{stuck: []*models.StuckTransaction{
+		stuckTransaction(1, models.INIT, 0),
+		stuckTransaction(2, models.KAFKA_PUBLISH_FAILED, 1),
+		stuckTransaction(3, models.KAFKA_PUBLISH_FAILED, 1),
+		stuckTransaction(4, models.INIT, 5),
+	}}
+	txnRepo := &fakeTransactionRepository{statuses: map[int]models.TransactionStatus{}, causes: map[int]models.EventCause{}}
+	connector := &stubConnector{statuses: map[int]models.TransactionStatus{
+		1: models.PENDING,
+		2: models.SUCCESS,
+		3: models.PENDING,
+	}}
+	registry := connectors.NewRegistry()
+	registry.Register("stub", connector)
+
+	worker := NewRecoveryWorker(recoveryRepo, txnRepo, &fakeGatewayRepository{}, registry, NewGatewayHealth(), "", "", "5")
+	tried, err := worker.RecoverOnce(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 4, tried)
+
+	// Re-initiated, and the gateway accepted it
+	assert.Equal(t, models.PENDING, txnRepo.statuses[1])
+	assert.Equal(t, models.RECOVERED, recoveryRepo.attempts[0].Outcome)
+	assert.Equal(t, models.EventCause{Source: models.SOURCE_RECOVERY, PayloadRef: "ref"}, txnRepo.causes[1])
+
+	// The lost outcome was fetched and published
+	assert.Equal(t, models.SUCCESS, txnRepo.statuses[2])
+	assert.Equal(t, models.RECOVERED, recoveryRepo.attempts[1].Outcome)
+	assert.Len(t, txnRepo.events, 2)
+	assert.Equal(t, models.EventCause{Source: models.SOURCE_RECOVERY, PayloadRef: txnRepo.events[0].EventID}, txnRepo.causes[2])
+
+	// The gateway has no outcome yet, tried again later
+	assert.NotContains(t, txnRepo.statuses, 3)
+	assert.Equal(t, models.RETRY, recoveryRepo.attempts[2].Outcome)
+	assert.NotEmpty(t, recoveryRepo.attempts[2].Error)
+
+	// Out of attempts
+	assert.Equal(t, models.MANUAL_REVIEW, txnRepo.statuses[4])
+	assert.Equal(t, models.ESCALATED, recoveryRepo.attempts[3].Outcome)
+	assert.Equal(t, models.INIT, recoveryRepo.attempts[3].Status)
+}
+
+func TestRecoverOnce_EscalationHasNoGatewayTimestamp(t *testing.T) {
+	recoveryRepo := &fakeRecoveryRepository{stuck: []*models.StuckTransaction{
+		stuckTransaction(1, models.KAFKA_PUBLISH_FAILED, 5),
+		stuckTransaction(2, models.KAFKA_PUBLISH_FAILED, 0),
+	}}
+	txnRepo := &fakeTransactionRepository{statuses: map[int]models.TransactionStatus{}, gatewayUpdatedAt: map[int]time.Time{}}
+	registry := connectors.NewRegistry()
+	registry.Register("stub", &stubConnector{statuses: map[int]models.TransactionStatus{2: models.SUCCESS}})
+
+	worker := NewRecoveryWorker(recoveryRepo, txnRepo, &fakeGatewayRepository{}, registry, NewGatewayHealth(), "", "", "5")
+	_, err := worker.RecoverOnce(context.Background())
+	assert.NoError(t, err)
+
+	// The escalation isn't the gateway's, its outcome made earlier than the escalation still applies afterwards
+	assert.Equal(t, models.MANUAL_REVIEW, txnRepo.statuses[1])
+	assert.Contains(t, txnRepo.gatewayUpdatedAt, 1)
+	assert.True(t, txnRepo.gatewayUpdatedAt[1].IsZero())
+
+	// Outcomes fetched from the gateway carry its timestamp
+	assert.Equal(t, models.SUCCESS, txnRepo.statuses[2])
+	assert.False(t, txnRepo.gatewayUpdatedAt[2].IsZero())
+}
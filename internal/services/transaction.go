@@ -2,24 +2,45 @@ package services
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"payment-gateway/internal/connectors"
 	kafkaConsumer "payment-gateway/internal/kafka/consumer"
+	"payment-gateway/internal/kafka/dlq"
 	kafkaProducer "payment-gateway/internal/kafka/producer"
 	"payment-gateway/internal/models"
 	"payment-gateway/internal/repository"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/segmentio/kafka-go"
 )
 
 type TransactionService interface {
+	// StartTransactionProcessing creates the transaction and sends it to its gateway.
+	//
+	//   If the transaction was created but couldn't be sent, it is returned along with the error, and can be resumed
 	StartTransactionProcessing(ctx context.Context, request *models.TransactionRequest) (*models.Transaction, error)
+	// ResumeTransaction sends a transaction of userID at merchantID to its gateway again if it is still INIT,
+	// and returns it as is otherwise. Like StartTransactionProcessing, it is returned along with the error if it couldn't be sent
+	ResumeTransaction(ctx context.Context, merchantID, userID, txnID int) (*models.Transaction, error)
 	StartWebhookProcessing(ctx context.Context, request *models.TransactionWebhookResponse) (*models.Transaction, error)
+	ParseWebhook(ctx context.Context, gateway *models.Gateway, body []byte, contentType string) (*models.TransactionWebhookResponse, error)
+	GetTransaction(ctx context.Context, merchantID, userID, txnID int) (*models.Transaction, error)
+	SearchTransactions(ctx context.Context, filter repository.TransactionFilter, cursor string) (*models.TransactionPage, error)
+	GetTransactionEvents(ctx context.Context, merchantID, userID, txnID int) ([]models.TransactionEvent, error)
+	// RefundTransaction creates a refund of a deposit and sends it to the deposit's gateway.
+	//
+	//   Like StartTransactionProcessing, if the refund was created but couldn't be sent, it is returned along with the error, and can be resumed
+	RefundTransaction(ctx context.Context, merchantID, userID, txnID int, request *models.RefundRequest) (*models.Transaction, error)
 	Consume(ctx context.Context)
 }
 
@@ -27,8 +48,11 @@ type TransactionServiceImpl struct {
 	cipherSecret      string
 	txnRepository     repository.TransactionRepository
 	gatewayRepository repository.GatewayRepository
-	publisher         kafkaProducer.KafkaProducer
+	router            GatewayRouter
+	gatewayHealth     GatewayHealth
+	connectors        *connectors.Registry
 	consumer          kafkaConsumer.KafkaConsumer
+	deadLetters       kafkaProducer.KafkaProducer
 }
 
 // ParseTransactionType converts a string to TransactionType with validation
@@ -45,36 +69,88 @@ func ParseTransactionType(operation string) (models.TransactionType, error) {
 	}
 }
 
-// createTransactionMessage creates transaction as json string
+// createTransactionMessage creates transaction as json string.
+//
+//	The version is the one the status change was made from, the consumer only applies the message to that version
 func createTransactionMessage(transaction *models.Transaction) []byte {
 	message := map[string]interface{}{
-		"id":         transaction.ID,
-		"amount":     transaction.Amount,
-		"type":       transaction.Type,
-		"status":     transaction.Status,
-		"createdAt":  transaction.CreatedAt,
-		"gateway_id": transaction.GatewayID,
-		"country_id": transaction.CountryID,
-		"user_id":    transaction.UserID,
+		"id":          transaction.ID,
+		"amount":      transaction.Amount,
+		"currency":    transaction.Currency,
+		"type":        transaction.Type,
+		"status":      transaction.Status,
+		"createdAt":   transaction.CreatedAt,
+		"updated_at":  transaction.UpdatedAt,
+		"gateway_id":  transaction.GatewayID,
+		"country_id":  transaction.CountryID,
+		"user_id":     transaction.UserID,
+		"merchant_id": transaction.MerchantID,
+		"event_id":    transaction.EventID,
+		"parent_id":   transaction.ParentID,
+		"version":     transaction.Version,
 	}
 	messageBytes, _ := json.Marshal(message)
 	return messageBytes
 }
 
-func NewTransactionService(txnRepo repository.TransactionRepository, gatewayRepo repository.GatewayRepository, pub kafkaProducer.KafkaProducer, consumer kafkaConsumer.KafkaConsumer) *TransactionServiceImpl {
+// newStatusEvent creates the outbox event publishing next, the status a transaction moves to, under a new event ID
+func newStatusEvent(next models.Transaction) (*models.OutboxEvent, error) {
+	eventID, err := newEventID()
+	if err != nil {
+		return nil, err
+	}
+	next.EventID = eventID
+
+	return &models.OutboxEvent{
+		AggregateID: next.ID,
+		Key:         fmt.Sprint(next.ID),
+		Payload:     createTransactionMessage(&next),
+		EventID:     eventID,
+	}, nil
+}
+
+// newEventID generates a random (version 4) UUID
+func newEventID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", fmt.Errorf("failed to generate event id: %v", err)
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16]), nil
+}
+
+func NewTransactionService(txnRepo repository.TransactionRepository, gatewayRepo repository.GatewayRepository, router GatewayRouter, gatewayHealth GatewayHealth, connectorRegistry *connectors.Registry, consumer kafkaConsumer.KafkaConsumer, deadLetters kafkaProducer.KafkaProducer) *TransactionServiceImpl {
 	return &TransactionServiceImpl{
 		txnRepository:     txnRepo,
 		gatewayRepository: gatewayRepo,
-		publisher:         pub,
+		router:            router,
+		gatewayHealth:     gatewayHealth,
+		connectors:        connectorRegistry,
 		consumer:          consumer,
+		deadLetters:       deadLetters,
 		// Ideally in prod, this should be injected from config service.
 		cipherSecret: os.Getenv("CIPHER_SECRET"),
 	}
 }
 
 func (t *TransactionServiceImpl) StartTransactionProcessing(ctx context.Context, request *models.TransactionRequest) (*models.Transaction, error) {
+	if !request.Amount.IsPositive() {
+		return nil, fmt.Errorf("%w: amount must be positive, got: %s %s", models.ErrInvalidAmount, request.Amount.String(), request.Amount.Currency)
+	}
 
+	// A country transacts in a single currency, anything else would make reporting and refunds ambiguous
+	country, err := t.gatewayRepository.GetCountry(request.CountryID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch country %d, err: %w", request.CountryID, err)
+	}
+	if country.Currency != request.Currency {
+		return nil, fmt.Errorf("%w: currency %s, countryID: %d expects %s", models.ErrCurrencyMismatch, request.Currency, request.CountryID, country.Currency)
+	}
+
+	// Only the gateways of the request's merchant are considered
 	gateways, err := t.gatewayRepository.GetGatewaysByCountryAndCurrency(
+		request.MerchantID,
 		fmt.Sprint(request.CountryID),
 		request.Currency,
 	)
@@ -83,14 +159,29 @@ func (t *TransactionServiceImpl) StartTransactionProcessing(ctx context.Context,
 	}
 
 	if len(gateways) < 1 {
-		return nil, fmt.Errorf("no Gateway exists for currency: %s, countryID:%d ", request.Currency, request.CountryID)
+		return nil, fmt.Errorf("%w: no Gateway exists for currency: %s, countryID:%d ", models.ErrNoEligibleGateway, request.Currency, request.CountryID)
 	}
 
-	// In case we had any priority field,
-	// here we could implement that check to find gateway
-	// Here, we're picking the latest created gateway
-	// we can have our own priority check here
-	gateway := gateways[0]
+	// Create transaction
+	// CreatedAt is truncated to the precision postgres stores, so routing can be reproduced from the stored row
+	transaction := &models.Transaction{
+		UserID:     request.UserID,
+		MerchantID: request.MerchantID,
+		Amount:     request.Amount,
+		Currency:   request.Currency,
+		Type:       request.Type.String(),
+		Status:     models.INIT,
+		CreatedAt:  time.Now().Truncate(time.Microsecond),
+		CountryID:  request.CountryID,
+	}
+
+	// Pick the gateway using the routing rules of the country
+	gateway, decision, err := t.router.Route(transaction, gateways)
+	if err != nil {
+		return nil, err
+	}
+	transaction.GatewayID = gateway.ID
+	transaction.RoutingDecision = decision
 
 	// c := NewCipherText(s.cipherSecret)
 	// maskedUser, err := c.MaskData([]byte(fmt.Sprint(request.UserID)))
@@ -103,119 +194,490 @@ func (t *TransactionServiceImpl) StartTransactionProcessing(ctx context.Context,
 	// 	log.Print("Error masking user, message sending to kafka will fail, err: %+v", err)
 	// }
 
-	// Create transaction
-	transaction := &models.Transaction{
-		UserID:    request.UserID,
-		Amount:    request.Amount,
-		Type:      request.Type.String(),
-		Status:    models.INIT,
-		GatewayID: gateway.ID,
-		CreatedAt: time.Now(),
-		CountryID: request.CountryID,
-	}
-
 	// Save to database with retry
+	var fundsErr error
 	err = RetryOperation(func() error {
 		_, err := t.txnRepository.CreateTransaction(ctx, transaction)
+		if errors.Is(err, models.ErrInsufficientFunds) {
+			// Not retryable, checked after the retries
+			fundsErr = err
+			return nil
+		}
 		if err != nil {
 			return err
 		}
 		return nil
 	}, 5)
 
+	if fundsErr != nil {
+		return nil, fundsErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transaction, err: %+v, transaction: %+v", err, *transaction)
+	}
+
+	if err := t.sendWithFailover(ctx, gateway, gateways, transaction); err != nil {
+		return transaction, err
+	}
+	return transaction, nil
+}
+
+// ResumeTransaction picks up a transaction whose request failed after creating it, e.g. when the gateway was unavailable.
+//
+//	Gateways dedupe transactions by ID, so it is safe even if the recovery worker sent it in the meantime
+func (t *TransactionServiceImpl) ResumeTransaction(ctx context.Context, merchantID, userID, txnID int) (*models.Transaction, error) {
+	transaction, err := t.txnRepository.GetUserTransaction(ctx, merchantID, userID, txnID)
 	if err != nil {
-		log.Printf("Error while creating trx, err: %+v, transaction: %+v", err, *transaction)
+		return nil, err
+	}
+	if transaction.Status != models.INIT {
+		// The gateway already knows about it
+		return transaction, nil
 	}
 
-	// Publish transaction to the actual gateway
-	// Since there is no actual gateway for this
-	// task, just leaving this comment here.
-	// We might be using `RetryOperation(someFunc, 2)` to publish
-	// to the real gateway server
+	gateway, err := t.gatewayRepository.GetGateway(transaction.MerchantID, transaction.GatewayID)
+	if err != nil {
+		return transaction, fmt.Errorf("failed to fetch gateway %d of transaction %d, err: %v", transaction.GatewayID, transaction.ID, err)
+	}
+
+	// A refund goes through the gateway of its deposit, other transactions may fail over like new ones
+	var gateways []*models.Gateway
+	if transaction.ParentID == nil {
+		gateways, err = t.gatewayRepository.GetGatewaysByCountryAndCurrency(transaction.MerchantID, fmt.Sprint(transaction.CountryID), transaction.Currency)
+		if err != nil {
+			log.Printf("Failed to fetch the gateways transaction %d may fail over to, err: %+v", transaction.ID, err)
+		}
+	}
+	if err := t.sendWithFailover(ctx, gateway, gateways, transaction); err != nil {
+		return transaction, err
+	}
+	return transaction, nil
+}
+
+// sendWithFailover sends a transaction to gateway, if the call fails, the transaction is routed again among the
+// gateways which weren't tried yet, and sent to the next one, until a gateway takes it or none is left.
+//
+//	A transaction which no gateway took stays with the last one tried, for the recovery worker to send again
+func (t *TransactionServiceImpl) sendWithFailover(ctx context.Context, gateway *models.Gateway, gateways []*models.Gateway, transaction *models.Transaction) error {
+	failed := []int{}
+	for {
+		err := t.sendToGateway(ctx, gateway, transaction)
+		if !errors.Is(err, models.ErrGatewayDispatch) || transaction.Status != models.INIT {
+			return err
+		}
+		failed = append(failed, gateway.ID)
+
+		remaining := make([]*models.Gateway, 0, len(gateways))
+		for _, candidate := range gateways {
+			if !containsGateway(failed, candidate.ID) {
+				remaining = append(remaining, candidate)
+			}
+		}
+		next, decision, routeErr := t.router.Route(transaction, remaining)
+		if routeErr != nil {
+			return err
+		}
+		decision.Failed = append([]int{}, failed...)
+		decision.Reason += fmt.Sprintf(", after gateways %v failed to take the transaction", failed)
+
+		if rerouteErr := t.txnRepository.RerouteTransaction(ctx, transaction, next.ID, decision); rerouteErr != nil {
+			// Something else, like the recovery worker, picked the transaction up in the meantime
+			log.Printf("Transaction %d was not failed over to gateway %d, err: %+v", transaction.ID, next.ID, rerouteErr)
+			return err
+		}
+		log.Printf("Failing transaction %d over from gateway %d to gateway %d, err: %+v", transaction.ID, gateway.ID, next.ID, err)
+		gateway = next
+	}
+}
+
+func containsGateway(ids []int, id int) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
+
+// sendToGateway sends a created transaction to its gateway and marks it dispatched.
+//
+//	A transaction which couldn't be sent stays in INIT, so it can be told apart from transactions the gateway knows about
+func (t *TransactionServiceImpl) sendToGateway(ctx context.Context, gateway *models.Gateway, transaction *models.Transaction) error {
+	gatewayResponse, err := t.dispatchToGateway(ctx, gateway, transaction)
+	if err != nil {
+		return fmt.Errorf("%w: failed to send %s %d to gateway %s, err: %w", models.ErrGatewayDispatch, strings.ToLower(transaction.Type), transaction.ID, gateway.Name, err)
+	}
+	return t.markDispatched(ctx, transaction, gatewayResponse)
+}
+
+// RefundTransaction refunds part of a deposit of userID at merchantID, or what is left to refund of it when the request has no amount.
+// The refund is a REFUND transaction linked to the deposit, sent through the deposit's gateway
+func (t *TransactionServiceImpl) RefundTransaction(ctx context.Context, merchantID, userID, txnID int, request *models.RefundRequest) (*models.Transaction, error) {
+	parent, err := t.txnRepository.GetUserTransaction(ctx, merchantID, userID, txnID)
+	if err != nil {
+		return nil, err
+	}
+
+	var amount *models.Money
+	if request.Amount != "" {
+		money, err := models.ParseMoney(request.Amount.String(), parent.Currency)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", models.ErrInvalidAmount, err)
+		}
+		if !money.IsPositive() {
+			return nil, fmt.Errorf("%w: refund amount must be positive, got: %s %s", models.ErrInvalidAmount, money.String(), money.Currency)
+		}
+		amount = &money
+	}
+
+	refund, err := t.txnRepository.CreateRefund(ctx, merchantID, userID, txnID, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	gateway, err := t.gatewayRepository.GetGateway(refund.MerchantID, refund.GatewayID)
+	if err != nil {
+		return refund, fmt.Errorf("failed to fetch gateway %d of refund %d, err: %v", refund.GatewayID, refund.ID, err)
+	}
+
+	// Like other transactions, a refund which couldn't be sent stays in INIT, and is picked up by the recovery worker
+	if err := t.sendToGateway(ctx, gateway, refund); err != nil {
+		return refund, err
+	}
+	return refund, nil
+}
+
+// markDispatched marks a transaction the gateway accepted PENDING, or FAILED if the gateway rejected it outright
+func (t *TransactionServiceImpl) markDispatched(ctx context.Context, transaction *models.Transaction, gatewayResponse *models.GatewayResponse) error {
+	status := models.PENDING
+	if gatewayResponse.Status == models.FAILED {
+		// Gateway rejected the transaction outright, there won't be any webhook for it
+		status = models.FAILED
+	}
 
 	// If the message is processed successfully by the gateway,
 	// mark the status PENDING, as that will help us
 	// determine, messages that were not sent to Gateway
 	// to run clean up jobs, query dlq etc
-	err = RetryOperation(func() error {
-		err = t.txnRepository.UpdateTransactionStatus(transaction, models.PENDING.String())
-		if err != nil {
-			return err
+	var transitionErr *models.InvalidTransitionError
+	err := RetryOperation(func() error {
+		err := t.txnRepository.UpdateTransactionStatus(ctx, transaction, status, models.EventCause{Source: models.SOURCE_API, PayloadRef: gatewayResponse.Reference})
+		if errors.As(err, &transitionErr) {
+			// Not retryable, checked after the retries
+			return nil
 		}
-		return nil
+		if errors.Is(err, models.ErrConcurrentModification) {
+			// Something else, like the webhook, updated the transaction first, it is retried from the latest version
+			if latest, getErr := t.txnRepository.GetTransaction(transaction.MerchantID, transaction.ID); getErr == nil {
+				*transaction = *latest
+			}
+		}
+		return err
 	}, 5)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to update transaction status even though gateway already acked the message, err: %+v", err)
+		return fmt.Errorf("failed to update transaction status even though gateway already acked the message, err: %+v", err)
 	}
 
-	return transaction, nil
+	if transitionErr != nil {
+		// The gateway's webhook was faster and already moved the transaction past PENDING
+		log.Printf("Transaction %d was not marked %s, err: %+v", transaction.ID, status, transitionErr)
+		transaction.Status = transitionErr.From
+	}
+	return nil
 }
 
-func (t *TransactionServiceImpl) StartWebhookProcessing(ctx context.Context, request *models.TransactionWebhookResponse) (*models.Transaction, error) {
-	// Find the transaction
-	txn, err := t.txnRepository.GetTransaction(request.TxnID)
+// dispatchToGateway initiates the transaction on the gateway through the gateway's circuit breaker
+func (t *TransactionServiceImpl) dispatchToGateway(ctx context.Context, gateway *models.Gateway, txn *models.Transaction) (*models.GatewayResponse, error) {
+	return initiateWithGateway(ctx, t.connectors, t.gatewayHealth, gateway, txn)
+}
+
+// initiateWithGateway sends txn to the gateway as a payment, payout or refund, depending on its type.
+//
+//	Gateways dedupe transactions by ID, so initiating the same transaction again is safe
+func initiateWithGateway(ctx context.Context, registry *connectors.Registry, gatewayHealth GatewayHealth, gateway *models.Gateway, txn *models.Transaction) (*models.GatewayResponse, error) {
+	connector, err := registry.Get(gateway.Name)
 	if err != nil {
 		return nil, err
 	}
 
-	txn.Status = request.Status
-	txn.UpdatedAt = request.UpdatedAt
+	var response *models.GatewayResponse
+	err = gatewayHealth.Execute(gateway, func() error {
+		var err error
+		switch models.TransactionType(txn.Type) {
+		case models.WITHDRAWAL:
+			response, err = connector.InitiatePayout(ctx, txn)
+		case models.REFUND:
+			response, err = connector.InitiateRefund(ctx, txn)
+		default:
+			response, err = connector.InitiatePayment(ctx, txn)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	// Publish transaction to Kafka using circuit breaker
-	message := createTransactionMessage(txn)
+	log.Printf("Gateway %s accepted transaction %d, reference: %s, status: %s", gateway.Name, txn.ID, response.Reference, response.Status)
+	return response, nil
+}
 
-	err = PublishWithCircuitBreaker(func() error {
-		return t.publisher.Publish(ctx, fmt.Sprint(txn.ID), message)
-	})
+// ParseWebhook decodes a webhook body using the connector of the gateway which sent it,
+// the webhook can only update the transactions of the gateway's merchant
+func (t *TransactionServiceImpl) ParseWebhook(ctx context.Context, gateway *models.Gateway, body []byte, contentType string) (*models.TransactionWebhookResponse, error) {
+	connector, err := t.connectors.Get(gateway.Name)
+	if err != nil {
+		return nil, err
+	}
 
+	webhook, err := connector.ParseWebhook(body, contentType)
 	if err != nil {
-		log.Printf("Error while publishing to Kafka using circuit breaker, err: %+v, msg: %+v", err, message)
-		// If publish to kafka fails, change the status so some cron job can pick these and process for refund if eligible
-		err = t.txnRepository.UpdateTransactionStatus(txn, models.KAFKA_PUBLISH_FAILED.String())
+		return nil, err
+	}
+
+	webhook.GatewayID = gateway.ID
+	webhook.MerchantID = gateway.MerchantID
+	return webhook, nil
+}
+
+// GetTransaction returns a transaction of userID at merchantID, models.ErrTransactionNotFound is returned for transactions
+// of other users or merchants
+func (t *TransactionServiceImpl) GetTransaction(ctx context.Context, merchantID, userID, txnID int) (*models.Transaction, error) {
+	return t.txnRepository.GetUserTransaction(ctx, merchantID, userID, txnID)
+}
+
+// DefaultSearchLimit is the page size of transaction searches which don't set one, MaxSearchLimit the largest one allowed
+const (
+	DefaultSearchLimit = 50
+	MaxSearchLimit     = 200
+)
+
+// SearchTransactions returns a page of the transactions matching filter, newest first.
+//
+//	cursor is the `NextCursor` of the previous page, or empty for the first page,
+//	a cursor which wasn't returned by a page returns models.ErrInvalidCursor.
+//	`filter.Limit` defaults to DefaultSearchLimit, and is capped at MaxSearchLimit
+func (t *TransactionServiceImpl) SearchTransactions(ctx context.Context, filter repository.TransactionFilter, cursor string) (*models.TransactionPage, error) {
+	if cursor != "" {
+		beforeID, err := decodeCursor(cursor)
 		if err != nil {
-			// If status setting also fails, log it, and have PD alert active.
-			return nil, fmt.Errorf("couldn't update status to %s even though kafka publish failed, msg: %+v, err: %+v", models.KAFKA_PUBLISH_FAILED.String(), message, err)
+			return nil, err
+		}
+		filter.BeforeID = beforeID
+	}
+
+	if filter.Limit <= 0 {
+		filter.Limit = DefaultSearchLimit
+	}
+	if filter.Limit > MaxSearchLimit {
+		filter.Limit = MaxSearchLimit
+	}
+	limit := filter.Limit
+
+	// One more transaction than the page is read, to know if there is a next page
+	filter.Limit++
+	transactions, err := t.txnRepository.SearchTransactions(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &models.TransactionPage{Transactions: transactions}
+	if len(transactions) > limit {
+		page.Transactions = transactions[:limit]
+		page.NextCursor = encodeCursor(page.Transactions[limit-1].ID)
+	}
+	return page, nil
+}
+
+// encodeCursor returns an opaque cursor continuing a search after the transaction txnID
+func encodeCursor(txnID int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(txnID)))
+}
+
+// decodeCursor returns the transaction ID of a cursor created by encodeCursor
+func decodeCursor(cursor string) (int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, models.ErrInvalidCursor
+	}
+	txnID, err := strconv.Atoi(string(decoded))
+	if err != nil || txnID <= 0 {
+		return 0, models.ErrInvalidCursor
+	}
+	return txnID, nil
+}
+
+// GetTransactionEvents returns the status history of a transaction of userID at merchantID, oldest change first
+func (t *TransactionServiceImpl) GetTransactionEvents(ctx context.Context, merchantID, userID, txnID int) ([]models.TransactionEvent, error) {
+	if _, err := t.txnRepository.GetUserTransaction(ctx, merchantID, userID, txnID); err != nil {
+		return nil, err
+	}
+	return t.txnRepository.GetTransactionEvents(ctx, merchantID, txnID)
+}
+
+// webhookAttempts is how many times a webhook is applied, when the transaction keeps being modified concurrently
+const webhookAttempts = 3
+
+// StartWebhookProcessing applies a webhook's status change to its transaction.
+//
+//	If the transaction is modified between reading and updating it, the webhook is applied again to the latest version,
+//	a *models.ConcurrentModificationError is returned once webhookAttempts are used up
+func (t *TransactionServiceImpl) StartWebhookProcessing(ctx context.Context, request *models.TransactionWebhookResponse) (*models.Transaction, error) {
+	var err error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		var txn *models.Transaction
+		txn, err = t.applyWebhook(ctx, request)
+		if !errors.Is(err, models.ErrConcurrentModification) {
+			return txn, err
 		}
-		return nil, fmt.Errorf("failed to publish transaction to Kafka, err: %+v", err)
+		log.Printf("Transaction %d was modified while applying webhook, attempt: %d, err: %v", request.TxnID, attempt, err)
 	}
+	return nil, err
+}
+
+func (t *TransactionServiceImpl) applyWebhook(ctx context.Context, request *models.TransactionWebhookResponse) (*models.Transaction, error) {
+	// Find the transaction, among the transactions of the merchant of the gateway which sent the webhook
+	txn, err := t.txnRepository.GetTransaction(request.MerchantID, request.TxnID)
+	if err != nil {
+		return nil, err
+	}
+
+	// A gateway may only update its own transactions
+	if request.GatewayID != 0 && request.GatewayID != txn.GatewayID {
+		return nil, fmt.Errorf("%w: webhook from gateway %d for transaction %d which belongs to gateway %d", models.ErrGatewayMismatch, request.GatewayID, txn.ID, txn.GatewayID)
+	}
+
+	// Gateways may deliver webhooks out of order, a status change older than the last applied one is acknowledged and ignored
+	if txn.IsStale(request.UpdatedAt) {
+		staleStatusUpdates.Add(staleSourceWebhook, 1)
+		log.Printf("Transaction %d was updated by its gateway at %s, ignoring %s webhook from %s", txn.ID, *txn.GatewayUpdatedAt, request.Status, request.UpdatedAt)
+		return txn, nil
+	}
+
+	// Gateways redeliver webhooks until they are acknowledged, a status the transaction already has is a no-op
+	if txn.Status == request.Status {
+		log.Printf("Transaction %d is already %s, ignoring webhook", txn.ID, txn.Status)
+		return txn, nil
+	}
+	// A deposit refunded since it succeeded is past SUCCESS, a redelivered SUCCESS webhook is a no-op too
+	if txn.Status.IsRefunded() && request.Status == models.SUCCESS {
+		log.Printf("Transaction %d is already %s, ignoring %s webhook", txn.ID, txn.Status, request.Status)
+		return txn, nil
+	}
+	if err := txn.ValidateTransition(request.Status); err != nil {
+		return nil, err
+	}
+
+	// Webhook outcomes feed the circuit breaker of the gateway, so failing gateways stop receiving traffic
+	switch request.Status {
+	case models.SUCCESS:
+		t.gatewayHealth.RecordOutcome(txn.GatewayID, true)
+	case models.FAILED:
+		t.gatewayHealth.RecordOutcome(txn.GatewayID, false)
+	}
+
+	// The kafka message is written to the outbox along with the status, the outbox relay publishes it,
+	// so a status change can't be committed without its message, even if kafka is down
+	next := *txn
+	next.Status = request.Status
+	next.UpdatedAt = request.UpdatedAt
+	event, err := newStatusEvent(next)
+	if err != nil {
+		return nil, err
+	}
+
+	cause := models.EventCause{Source: models.SOURCE_WEBHOOK, PayloadRef: event.EventID}
+	err = t.txnRepository.UpdateTransactionStatusWithEvent(ctx, txn, request.Status, request.UpdatedAt, cause, event)
+	if errors.Is(err, models.ErrStaleUpdate) {
+		// A later webhook was applied concurrently
+		staleStatusUpdates.Add(staleSourceWebhook, 1)
+		log.Printf("Ignoring webhook, err: %v", err)
+		return txn, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	txn.UpdatedAt = request.UpdatedAt
 
 	return txn, nil
 }
 
+// consumerDrainTimeout is how long Consume keeps processing and committing in-flight batches once ctx is done
+const consumerDrainTimeout = 30 * time.Second
+
+// Consume reads messages and processes them in batches on GetConcurrency workers, until ctx is done.
+//
+//	Messages are routed to workers by key, so the messages of a transaction are processed in order, by one worker.
+//	A batch is processed once it has GetBatchSize messages, or GetMaxLinger after its first message.
+//	Offsets are committed per partition, once every message read before them on the partition was processed.
+//	Once ctx is done, messages already read are processed and committed before Consume returns, for up to consumerDrainTimeout.
 func (t *TransactionServiceImpl) Consume(ctx context.Context) {
-	var batch []kafka.Message
+	tracker := kafkaConsumer.NewOffsetTracker()
+	commitMu := sync.Mutex{}
 
-	for {
-		select {
-		case <-ctx.Done():
-			log.Printf("Server stop signal received, new messages won't be processed")
+	// Processing outlives ctx, so the in-flight batches can still be drained once ctx is done
+	workCtx, cancelWork := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelWork()
+
+	pool := newConsumerPool(t.consumer.GetConcurrency(), t.consumer.GetBatchSize(), t.consumer.GetMaxLinger(), func(batch []kafka.Message) {
+		if !t.processBatchUntilDone(workCtx, batch) {
 			return
-		default:
 		}
-		m, err := t.consumer.ReadMessage(context.Background())
+		tracker.Done(batch...)
 
+		// Workers finish out of order, committing one at a time keeps a partition's offset from going backwards
+		commitMu.Lock()
+		defer commitMu.Unlock()
+		committable := tracker.Committable()
+		if len(committable) == 0 {
+			return
+		}
+		if err := t.consumer.CommitMessages(workCtx, committable...); err != nil {
+			// Commits are cumulative, the next commit of these partitions covers them
+			log.Printf("Failed to commit offsets of %d partitions: %v", len(committable), err)
+		} else {
+			log.Printf("Successfully committed batch of %d messages", len(batch))
+		}
+	})
+
+	for {
+		m, err := t.consumer.ReadMessage(ctx)
+		if ctx.Err() != nil {
+			break
+		}
 		if err != nil {
 			log.Printf("Error reading message: %v, message: %+v", err, m)
 			continue
 		}
 
-		batch = append(batch, m)
+		tracker.Track(m)
+		pool.Dispatch(m)
+	}
 
-		// Commit the batch periodically after every n messages
-		if len(batch) >= t.consumer.GetBatchSize() {
-			err := t.BulkProcessMessages(batch)
-			if err != nil {
-				log.Printf("Failed to update webhook messages in db: %v", err)
-				return
-			}
+	log.Printf("Server stop signal received, new messages won't be read, draining %d in-flight messages", tracker.Pending())
+	drainDeadline := time.AfterFunc(consumerDrainTimeout, cancelWork)
+	defer drainDeadline.Stop()
 
-			if err := t.consumer.CommitMessages(ctx, batch...); err != nil {
-				log.Printf("Failed to commit batch: %v", err)
-			} else {
-				log.Printf("Successfully committed batch of %d messages", len(batch))
-			}
-			batch = nil // reset batch
+	pool.Close()
+	log.Printf("Consumer drained, %d messages left uncommitted", tracker.Pending())
+}
+
+// processBatchUntilDone retries a batch until it is processed, blocking the worker so the batch's transactions stay in order.
+//
+//	Poison messages are dead-lettered, so failures are the db or kafka being unavailable.
+//	Returns false if ctx was cancelled before the batch could be processed.
+func (t *TransactionServiceImpl) processBatchUntilDone(ctx context.Context, batch []kafka.Message) bool {
+	for attempt := 1; ; attempt++ {
+		err := t.BulkProcessMessages(batch)
+		if err == nil {
+			return true
+		}
+		log.Printf("Failed to update webhook messages in db, batch of %d will be retried, attempt: %d, err: %v", len(batch), attempt, err)
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(time.Second):
 		}
 	}
 }
@@ -224,27 +686,80 @@ func (t *TransactionServiceImpl) Consume(ctx context.Context) {
 //
 //		SInce, webhook will onyl send ID, status and updatedAt, using id,
 //	 other two fields will be updated, everything else will remain same
+//
+// Messages which can't be unmarshalled are sent to the dead-letter topic, so they don't hold back the rest of the batch,
+// an error is only returned if they couldn't be dead-lettered or the update failed, and the batch must not be committed
 func (t *TransactionServiceImpl) BulkProcessMessages(msgs []kafka.Message) error {
 	var transactions []*models.Transaction
+	var deadLetters []kafka.Message
 
 	for _, m := range msgs {
-		var transaction *models.Transaction
-
-		// Unmarshal Kafka message value into the Transaction struct
-		err := json.Unmarshal(m.Value, &transaction)
+		transaction, err := parseTransactionMessage(m)
 		if err != nil {
-			log.Printf("Failed to unmarshal Kafka message to Transaction: %v", err)
-			return err
+			log.Printf("Failed to unmarshal Kafka message to Transaction, sending it to %s, partition: %d, offset: %d, err: %v", dlq.Topic, m.Partition, m.Offset, err)
+			deadLetters = append(deadLetters, dlq.NewMessage(m, err, time.Now()))
+			continue
 		}
 
 		log.Printf("Successfully converted Kafka message to Transaction: %+v", transaction)
 		transactions = append(transactions, transaction)
 	}
 
-	err := t.txnRepository.UpdateTransactionsBulk(transactions)
+	if len(deadLetters) > 0 {
+		if err := t.deadLetters.PublishMessages(context.Background(), deadLetters...); err != nil {
+			return fmt.Errorf("failed to send %d messages to %s: %v", len(deadLetters), dlq.Topic, err)
+		}
+	}
+
+	if len(transactions) == 0 {
+		return nil
+	}
+
+	results, err := t.txnRepository.UpdateTransactionsBulk(context.Background(), transactions)
 	if err != nil {
 		return err
 	}
 
+	// Rows which weren't applied won't be applied by a retry either, they are only logged
+	duplicates := 0
+	for _, result := range results {
+		switch result.Outcome {
+		case models.DUPLICATE:
+			duplicates++
+		case models.STALE:
+			staleStatusUpdates.Add(staleSourceConsumer, 1)
+		}
+		if err := result.Err(); err != nil {
+			log.Printf("Transaction message not applied, txnID: %d, outcome: %s, err: %v", result.TxnID, result.Outcome, err)
+		}
+	}
+	if duplicates > 0 {
+		log.Printf("Skipped %d already processed messages", duplicates)
+	}
+
 	return nil
 }
+
+// parseTransactionMessage unmarshals a message of the transactions topic, rejecting ones which can't be applied
+func parseTransactionMessage(m kafka.Message) (*models.Transaction, error) {
+	var transaction *models.Transaction
+
+	if err := json.Unmarshal(m.Value, &transaction); err != nil {
+		return nil, err
+	}
+	if transaction == nil || transaction.ID <= 0 {
+		return nil, errors.New("message has no transaction id")
+	}
+	if !transaction.Status.IsValid() {
+		return nil, fmt.Errorf("message has unknown status %q", transaction.Status)
+	}
+	// Updates compare-and-swap on the version, a message published before versions can't be applied safely
+	if transaction.Version <= 0 {
+		return nil, errors.New("message has no version")
+	}
+	// Messages published before merchants existed are of transactions of the default merchant
+	if transaction.MerchantID == 0 {
+		transaction.MerchantID = models.DEFAULT_MERCHANT_ID
+	}
+	return transaction, nil
+}
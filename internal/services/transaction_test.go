@@ -0,0 +1,452 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"payment-gateway/internal/connectors"
+	kafkaConsumer "payment-gateway/internal/kafka/consumer"
+	"payment-gateway/internal/kafka/dlq"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/repository"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestBulkProcessMessages_DeadLettersPoisonMessages(t *testing.T) {
+	txnRepo := &fakeTransactionRepository{statuses: map[int]models.TransactionStatus{}}
+	deadLetters := &fakePublisher{}
+	service := NewTransactionService(txnRepo, nil, nil, nil, nil, nil, deadLetters)
+
+	msgs := []kafka.Message{
+		{Topic: "transactions", Offset: 1, Key: []byte("1"), Value: []byte(`{"id":1,"status":"SUCCESS","version":1}`)},
+		{Topic: "transactions", Offset: 2, Key: []byte("2"), Value: []byte(`not json`)},
+		{Topic: "transactions", Offset: 3, Key: []byte("3"), Value: []byte(`{"id":3,"status":"COMPLETED","version":1}`)},
+		{Topic: "transactions", Offset: 4, Key: []byte("4"), Value: []byte(`{"id":4,"status":"FAILED","version":2}`)},
+		{Topic: "transactions", Offset: 5, Key: []byte("5"), Value: []byte(`{"id":5,"status":"FAILED"}`)},
+	}
+
+	err := service.BulkProcessMessages(msgs)
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]models.TransactionStatus{1: models.SUCCESS, 4: models.FAILED}, txnRepo.statuses)
+
+	assert.Len(t, deadLetters.messages, 3)
+	for i, offset := range []int64{2, 3, 5} {
+		assert.Equal(t, dlq.Topic, deadLetters.messages[i].Topic)
+		info := dlq.ParseInfo(deadLetters.messages[i])
+		assert.Equal(t, offset, info.OriginalOffset)
+		assert.NotEmpty(t, info.Error)
+	}
+}
+
+func TestConsume_DrainsInFlightBatchOnShutdown(t *testing.T) {
+	txnRepo := &fakeTransactionRepository{statuses: map[int]models.TransactionStatus{}}
+	consumer := kafkaConsumer.NewMockKafkaConsumer(10)
+	consumer.SetMaxLinger(time.Hour)
+	service := NewTransactionService(txnRepo, nil, nil, nil, nil, consumer, &fakePublisher{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	msgs := []kafka.Message{
+		{Topic: "transactions", Partition: 0, Offset: 7, Key: []byte("1"), Value: []byte(`{"id":1,"status":"SUCCESS","version":1}`)},
+		{Topic: "transactions", Partition: 0, Offset: 8, Key: []byte("2"), Value: []byte(`{"id":2,"status":"FAILED","version":1}`)},
+	}
+	consumer.On("ReadMessage", mock.Anything).Return(msgs[0], nil).Once()
+	consumer.On("ReadMessage", mock.Anything).Return(msgs[1], nil).Once()
+	// The next read is interrupted by the shutdown, the batch of 2 is neither full nor past its linger
+	consumer.On("ReadMessage", mock.Anything).Run(func(args mock.Arguments) {
+		cancel()
+	}).Return(kafka.Message{}, context.Canceled).Once()
+	consumer.On("CommitMessages", mock.Anything, []kafka.Message{msgs[1]}).Return(nil).Once()
+
+	done := make(chan struct{})
+	go func() {
+		service.Consume(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Consume didn't return after shutdown")
+	}
+
+	assert.Equal(t, map[int]models.TransactionStatus{1: models.SUCCESS, 2: models.FAILED}, txnRepo.statuses)
+	consumer.AssertExpectations(t)
+}
+
+func TestNewStatusEvent_CarriesEventID(t *testing.T) {
+	txn := models.Transaction{ID: 7, Status: models.SUCCESS, Amount: models.NewMoney(100, "USD"), Currency: "USD", Version: 3}
+
+	first, err := newStatusEvent(txn)
+	assert.NoError(t, err)
+	second, err := newStatusEvent(txn)
+	assert.NoError(t, err)
+	assert.Equal(t, "7", first.Key)
+
+	parsed, err := parseTransactionMessage(kafka.Message{Value: first.Payload})
+	assert.NoError(t, err)
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, parsed.EventID)
+	assert.Equal(t, parsed.EventID, first.EventID)
+	assert.Equal(t, 3, parsed.Version)
+
+	again, err := parseTransactionMessage(kafka.Message{Value: second.Payload})
+	assert.NoError(t, err)
+	assert.NotEqual(t, parsed.EventID, again.EventID)
+	assert.Empty(t, txn.EventID)
+}
+
+func TestStartWebhookProcessing_IgnoresStaleWebhook(t *testing.T) {
+	succeededAt := time.Date(2024, 12, 18, 11, 58, 52, 0, time.UTC)
+	txn := &models.Transaction{ID: 7, Status: models.SUCCESS, GatewayID: 1, GatewayUpdatedAt: &succeededAt}
+	txnRepo := &fakeTransactionRepository{statuses: map[int]models.TransactionStatus{}, transactions: map[int]*models.Transaction{7: txn}}
+	service := NewTransactionService(txnRepo, nil, nil, nil, nil, nil, nil)
+
+	staleWebhooks := func() int64 {
+		if count, ok := staleStatusUpdates.Get(staleSourceWebhook).(*expvar.Int); ok {
+			return count.Value()
+		}
+		return 0
+	}
+	before := staleWebhooks()
+
+	// The PENDING webhook was sent before the SUCCESS one, but arrived after it
+	result, err := service.StartWebhookProcessing(context.Background(), &models.TransactionWebhookResponse{
+		TxnID:     7,
+		GatewayID: 1,
+		Status:    models.PENDING,
+		UpdatedAt: succeededAt.Add(-time.Second),
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, models.SUCCESS, result.Status)
+	assert.Empty(t, txnRepo.statuses)
+	assert.Empty(t, txnRepo.events)
+	assert.Equal(t, before+1, staleWebhooks())
+}
+
+// conflictingTransactionRepository fails the first conflicts status updates, as if they raced with another update
+type conflictingTransactionRepository struct {
+	*fakeTransactionRepository
+	conflicts int
+}
+
+func (c *conflictingTransactionRepository) UpdateTransactionStatusWithEvent(ctx context.Context, txn *models.Transaction, status models.TransactionStatus, gatewayUpdatedAt time.Time, cause models.EventCause, event *models.OutboxEvent) error {
+	if c.conflicts > 0 {
+		c.conflicts--
+		return &models.ConcurrentModificationError{TxnID: txn.ID, Version: txn.Version, Current: txn.Version + 1}
+	}
+	return c.fakeTransactionRepository.UpdateTransactionStatusWithEvent(ctx, txn, status, gatewayUpdatedAt, cause, event)
+}
+
+func TestStartWebhookProcessing_RetriesConcurrentModification(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		conflicts int
+		wantErr   error
+	}{
+		{name: "applied after a conflict", conflicts: 1},
+		{name: "gives up after webhookAttempts", conflicts: webhookAttempts, wantErr: models.ErrConcurrentModification},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			txnRepo := &conflictingTransactionRepository{
+				fakeTransactionRepository: &fakeTransactionRepository{
+					statuses:     map[int]models.TransactionStatus{},
+					causes:       map[int]models.EventCause{},
+					transactions: map[int]*models.Transaction{7: {ID: 7, Status: models.PENDING, GatewayID: 1, Version: 2}},
+				},
+				conflicts: tc.conflicts,
+			}
+			service := NewTransactionService(txnRepo, nil, nil, NewGatewayHealth(), nil, nil, nil)
+
+			_, err := service.StartWebhookProcessing(context.Background(), &models.TransactionWebhookResponse{TxnID: 7, GatewayID: 1, Status: models.SUCCESS})
+
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, err, tc.wantErr)
+				assert.Empty(t, txnRepo.events)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, models.SUCCESS, txnRepo.statuses[7])
+			assert.Len(t, txnRepo.events, 1)
+			assert.Equal(t, models.EventCause{Source: models.SOURCE_WEBHOOK, PayloadRef: txnRepo.events[0].EventID}, txnRepo.causes[7])
+		})
+	}
+}
+
+func TestGetTransactionEvents_ScopedToUser(t *testing.T) {
+	// The embedded repository panics if the events of another user's transaction are read
+	txnRepo := &fakeTransactionRepository{transactions: map[int]*models.Transaction{7: {ID: 7, MerchantID: 1, UserID: 3}}}
+	service := NewTransactionService(txnRepo, nil, nil, NewGatewayHealth(), nil, nil, nil)
+
+	_, err := service.GetTransactionEvents(context.Background(), 1, 4, 7)
+	assert.Equal(t, models.ErrTransactionNotFound, err)
+
+	_, err = service.GetTransaction(context.Background(), 1, 4, 7)
+	assert.Equal(t, models.ErrTransactionNotFound, err)
+
+	// Users are only known to their merchant
+	_, err = service.GetTransaction(context.Background(), 2, 3, 7)
+	assert.Equal(t, models.ErrTransactionNotFound, err)
+
+	txn, err := service.GetTransaction(context.Background(), 1, 3, 7)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, txn.ID)
+}
+
+// searchTransactionRepository returns the transactions with an ID below `filter.BeforeID`, newest first
+type searchTransactionRepository struct {
+	repository.TransactionRepository
+	ids     []int
+	filters []repository.TransactionFilter
+}
+
+func (s *searchTransactionRepository) SearchTransactions(ctx context.Context, filter repository.TransactionFilter) ([]models.Transaction, error) {
+	s.filters = append(s.filters, filter)
+	transactions := []models.Transaction{}
+	for _, id := range s.ids {
+		if (filter.BeforeID == 0 || id < filter.BeforeID) && len(transactions) < filter.Limit {
+			transactions = append(transactions, models.Transaction{ID: id})
+		}
+	}
+	return transactions, nil
+}
+
+func TestSearchTransactions_Paginates(t *testing.T) {
+	txnRepo := &searchTransactionRepository{ids: []int{5, 4, 3, 2, 1}}
+	service := NewTransactionService(txnRepo, nil, nil, NewGatewayHealth(), nil, nil, nil)
+
+	var ids []int
+	cursor := ""
+	for pages := 1; ; pages++ {
+		page, err := service.SearchTransactions(context.Background(), repository.TransactionFilter{UserID: 3, Limit: 2}, cursor)
+		assert.NoError(t, err)
+		for _, txn := range page.Transactions {
+			ids = append(ids, txn.ID)
+		}
+		if page.NextCursor == "" {
+			assert.Equal(t, 3, pages)
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	assert.Equal(t, []int{5, 4, 3, 2, 1}, ids)
+	// One more row than the page is read, filters are kept across pages
+	assert.Equal(t, repository.TransactionFilter{UserID: 3, Limit: 3, BeforeID: 4}, txnRepo.filters[1])
+
+	_, err := service.SearchTransactions(context.Background(), repository.TransactionFilter{}, "not a cursor")
+	assert.ErrorIs(t, err, models.ErrInvalidCursor)
+
+	_, err = service.SearchTransactions(context.Background(), repository.TransactionFilter{Limit: 10_000}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, MaxSearchLimit+1, txnRepo.filters[len(txnRepo.filters)-1].Limit)
+}
+
+// refundTransactionRepository creates refunds of the deposits in transactions, like the repository would
+type refundTransactionRepository struct {
+	*fakeTransactionRepository
+	amounts []*models.Money
+}
+
+func (r *refundTransactionRepository) CreateRefund(ctx context.Context, merchantID, userID, parentID int, amount *models.Money) (*models.Transaction, error) {
+	parent, err := r.GetUserTransaction(ctx, merchantID, userID, parentID)
+	if err != nil {
+		return nil, err
+	}
+	r.amounts = append(r.amounts, amount)
+	if amount == nil {
+		amount = &parent.Amount
+	}
+	refund := &models.Transaction{ID: 100 + parentID, Type: string(models.REFUND), Status: models.INIT, Amount: *amount, Currency: parent.Currency, GatewayID: parent.GatewayID, MerchantID: merchantID, UserID: userID, ParentID: &parent.ID}
+	r.transactions[refund.ID] = refund
+	return refund, nil
+}
+
+func TestRefundTransaction(t *testing.T) {
+	txnRepo := &refundTransactionRepository{fakeTransactionRepository: &fakeTransactionRepository{
+		statuses:     map[int]models.TransactionStatus{},
+		transactions: map[int]*models.Transaction{7: {ID: 7, MerchantID: 2, UserID: 3, Type: string(models.DEPOSIT), Status: models.SUCCESS, Amount: models.NewMoney(1005, "KWD"), Currency: "KWD", GatewayID: 1}},
+	}}
+	registry := connectors.NewRegistry()
+	registry.Register("stub", &stubConnector{statuses: map[int]models.TransactionStatus{107: models.PENDING}})
+	service := NewTransactionService(txnRepo, &fakeGatewayRepository{}, nil, NewGatewayHealth(), registry, nil, nil)
+
+	// The amount is parsed in the currency of the deposit
+	refund, err := service.RefundTransaction(context.Background(), 2, 3, 7, &models.RefundRequest{Amount: "0.5"})
+	assert.NoError(t, err)
+	assert.Equal(t, models.PENDING, refund.Status)
+	assert.Equal(t, models.NewMoney(500, "KWD"), *txnRepo.amounts[0])
+
+	// Without an amount, the repository refunds all that is left
+	_, err = service.RefundTransaction(context.Background(), 2, 3, 7, &models.RefundRequest{})
+	assert.NoError(t, err)
+	assert.Nil(t, txnRepo.amounts[1])
+
+	_, err = service.RefundTransaction(context.Background(), 2, 3, 7, &models.RefundRequest{Amount: "0"})
+	assert.ErrorIs(t, err, models.ErrInvalidAmount)
+	_, err = service.RefundTransaction(context.Background(), 2, 3, 7, &models.RefundRequest{Amount: "0.0001"})
+	assert.ErrorIs(t, err, models.ErrInvalidAmount)
+	_, err = service.RefundTransaction(context.Background(), 2, 4, 7, &models.RefundRequest{Amount: "0.5"})
+	assert.Equal(t, models.ErrTransactionNotFound, err)
+	_, err = service.RefundTransaction(context.Background(), 1, 3, 7, &models.RefundRequest{Amount: "0.5"})
+	assert.Equal(t, models.ErrTransactionNotFound, err)
+	assert.Len(t, txnRepo.amounts, 2)
+}
+
+func TestStartWebhookProcessing_AcksSuccessOfRefundedDeposit(t *testing.T) {
+	txnRepo := &fakeTransactionRepository{transactions: map[int]*models.Transaction{7: {ID: 7, Status: models.PARTIALLY_REFUNDED, GatewayID: 1}}}
+	service := NewTransactionService(txnRepo, nil, nil, NewGatewayHealth(), nil, nil, nil)
+
+	txn, err := service.StartWebhookProcessing(context.Background(), &models.TransactionWebhookResponse{TxnID: 7, GatewayID: 1, Status: models.SUCCESS})
+
+	assert.NoError(t, err)
+	assert.Equal(t, models.PARTIALLY_REFUNDED, txn.Status)
+}
+
+func TestStartWebhookProcessing_RejectsRefundStatus(t *testing.T) {
+	txnRepo := &fakeTransactionRepository{transactions: map[int]*models.Transaction{7: {ID: 7, Status: models.SUCCESS, GatewayID: 1}}}
+	service := NewTransactionService(txnRepo, nil, nil, NewGatewayHealth(), nil, nil, nil)
+
+	// Only settling a refund moves a deposit to a refund status, never the gateway
+	for _, status := range []models.TransactionStatus{models.REFUNDED, models.PARTIALLY_REFUNDED} {
+		_, err := service.StartWebhookProcessing(context.Background(), &models.TransactionWebhookResponse{TxnID: 7, GatewayID: 1, Status: status})
+		assert.ErrorIs(t, err, models.ErrInvalidTransition, status)
+	}
+	assert.Equal(t, models.SUCCESS, txnRepo.transactions[7].Status)
+}
+
+// insufficientFundsRepository rejects every withdrawal for lack of funds
+type insufficientFundsRepository struct {
+	*fakeTransactionRepository
+	creates int
+}
+
+func (i *insufficientFundsRepository) CreateTransaction(ctx context.Context, txn *models.Transaction) (int, error) {
+	i.creates++
+	return 0, fmt.Errorf("%w: withdrawal of %s %s", models.ErrInsufficientFunds, txn.Amount, txn.Currency)
+}
+
+type routedGatewayRepository struct {
+	*fakeGatewayRepository
+}
+
+func (r *routedGatewayRepository) GetCountry(countryID int) (*models.Country, error) {
+	return &models.Country{ID: countryID, Currency: "USD"}, nil
+}
+
+func (r *routedGatewayRepository) GetGatewaysByCountryAndCurrency(merchantID int, countryID, currency string) ([]*models.Gateway, error) {
+	return []*models.Gateway{routedGateway(1, 1, 100, true)}, nil
+}
+
+func TestStartTransactionProcessing_InsufficientFundsIsNotRetried(t *testing.T) {
+	txnRepo := &insufficientFundsRepository{fakeTransactionRepository: &fakeTransactionRepository{statuses: map[int]models.TransactionStatus{}}}
+	service := NewTransactionService(txnRepo, &routedGatewayRepository{&fakeGatewayRepository{}}, NewGatewayRouter(NewGatewayHealth()), NewGatewayHealth(), connectors.NewRegistry(), nil, nil)
+
+	_, err := service.StartTransactionProcessing(context.Background(), &models.TransactionRequest{
+		UserID: 3, Amount: models.NewMoney(10000, "USD"), Currency: "USD", CountryID: 2, Type: models.WITHDRAWAL,
+	})
+
+	assert.ErrorIs(t, err, models.ErrInsufficientFunds)
+	assert.Equal(t, 1, txnRepo.creates)
+	assert.Empty(t, txnRepo.statuses)
+}
+
+func TestResumeTransaction(t *testing.T) {
+	txnRepo := &fakeTransactionRepository{statuses: map[int]models.TransactionStatus{}, transactions: map[int]*models.Transaction{
+		7: {ID: 7, MerchantID: 2, UserID: 3, Type: string(models.DEPOSIT), Status: models.INIT, GatewayID: 1},
+		8: {ID: 8, MerchantID: 2, UserID: 3, Type: string(models.DEPOSIT), Status: models.SUCCESS, GatewayID: 1},
+	}}
+	connector := &stubConnector{statuses: map[int]models.TransactionStatus{7: models.PENDING}, err: errors.New("connection refused")}
+	registry := connectors.NewRegistry()
+	registry.Register("stub", connector)
+	service := NewTransactionService(txnRepo, &routedGatewayRepository{&fakeGatewayRepository{}}, NewGatewayRouter(NewGatewayHealth()), NewGatewayHealth(), registry, nil, nil)
+
+	// The gateway is still failing, and has no other gateway to fail over to, the transaction is returned along with the error
+	txn, err := service.ResumeTransaction(context.Background(), 2, 3, 7)
+	assert.ErrorIs(t, err, models.ErrGatewayDispatch)
+	assert.Equal(t, models.INIT, txn.Status)
+
+	connector.err = nil
+	txn, err = service.ResumeTransaction(context.Background(), 2, 3, 7)
+	assert.NoError(t, err)
+	assert.Equal(t, models.PENDING, txn.Status)
+
+	// Transactions the gateway already knows about aren't sent again
+	txn, err = service.ResumeTransaction(context.Background(), 2, 3, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, models.SUCCESS, txn.Status)
+	assert.Equal(t, map[int]models.TransactionStatus{7: models.PENDING}, txnRepo.statuses)
+
+	_, err = service.ResumeTransaction(context.Background(), 2, 4, 7)
+	assert.Equal(t, models.ErrTransactionNotFound, err)
+}
+
+// failoverTransactionRepository creates transactions as ID 7, and records their reroutes
+type failoverTransactionRepository struct {
+	*fakeTransactionRepository
+	reroutes []int
+}
+
+func (f *failoverTransactionRepository) CreateTransaction(ctx context.Context, txn *models.Transaction) (int, error) {
+	txn.ID = 7
+	txn.Version = 1
+	f.transactions[txn.ID] = txn
+	return txn.ID, nil
+}
+
+func (f *failoverTransactionRepository) RerouteTransaction(ctx context.Context, txn *models.Transaction, gatewayID int, decision *models.RoutingDecision) error {
+	f.reroutes = append(f.reroutes, gatewayID)
+	txn.GatewayID = gatewayID
+	txn.RoutingDecision = decision
+	txn.Version++
+	return nil
+}
+
+// failoverGatewayRepository has the gateway "primary", and the gateway "secondary" of the next priority
+type failoverGatewayRepository struct {
+	*routedGatewayRepository
+}
+
+func (f *failoverGatewayRepository) GetGatewaysByCountryAndCurrency(merchantID int, countryID, currency string) ([]*models.Gateway, error) {
+	primary, secondary := routedGateway(1, 1, 100, true), routedGateway(2, 2, 100, true)
+	primary.Name, secondary.Name = "primary", "secondary"
+	return []*models.Gateway{primary, secondary}, nil
+}
+
+func TestStartTransactionProcessing_FailsOverWhenGatewayCallFails(t *testing.T) {
+	request := &models.TransactionRequest{UserID: 3, MerchantID: 2, Amount: models.NewMoney(10000, "USD"), Currency: "USD", CountryID: 2, Type: models.DEPOSIT}
+
+	for name, c := range map[string]struct {
+		secondaryErr error
+		status       models.TransactionStatus
+	}{
+		"secondary takes it": {nil, models.PENDING},
+		"both fail":          {errors.New("connection refused"), models.INIT},
+	} {
+		txnRepo := &failoverTransactionRepository{fakeTransactionRepository: &fakeTransactionRepository{statuses: map[int]models.TransactionStatus{}, transactions: map[int]*models.Transaction{}}}
+		registry := connectors.NewRegistry()
+		registry.Register("primary", &stubConnector{err: errors.New("connection refused")})
+		registry.Register("secondary", &stubConnector{statuses: map[int]models.TransactionStatus{7: models.PENDING}, err: c.secondaryErr})
+		health := NewGatewayHealth()
+		service := NewTransactionService(txnRepo, &failoverGatewayRepository{&routedGatewayRepository{&fakeGatewayRepository{}}}, NewGatewayRouter(health), health, registry, nil, nil)
+
+		txn, err := service.StartTransactionProcessing(context.Background(), request)
+
+		// The call to the primary gateway failed, so the transaction was routed again, and sent to the secondary one
+		assert.Equal(t, []int{2}, txnRepo.reroutes, name)
+		assert.Equal(t, 2, txn.GatewayID, name)
+		assert.Equal(t, []int{1}, txn.RoutingDecision.Failed, name)
+		assert.Equal(t, c.status, txn.Status, name)
+		if c.secondaryErr != nil {
+			assert.ErrorIs(t, err, models.ErrGatewayDispatch, name)
+		} else {
+			assert.NoError(t, err, name)
+		}
+	}
+}
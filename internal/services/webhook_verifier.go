@@ -0,0 +1,124 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"payment-gateway/internal/connectors"
+	"payment-gateway/internal/models"
+	"payment-gateway/internal/repository"
+	"sync"
+	"time"
+)
+
+// ErrInvalidWebhookSignature is returned for webhooks which can't be proven to come from the gateway
+var ErrInvalidWebhookSignature = errors.New("invalid webhook signature")
+
+type WebhookVerifier interface {
+	Verify(ctx context.Context, merchantID int, gatewayName, signatureHeader string, body []byte) (*models.Gateway, error)
+	Release(ctx context.Context, gateway *models.Gateway, signatureHeader string, body []byte) error
+}
+
+// WebhookVerifierImpl checks webhooks against the webhook secret of the gateway which sent them
+type WebhookVerifierImpl struct {
+	gatewayRepository   repository.GatewayRepository
+	signatureRepository repository.WebhookSignatureRepository
+	tolerance           time.Duration
+
+	cleanupMu   sync.Mutex
+	lastCleanup time.Time
+}
+
+// NewWebhookVerifier creates the verifier of webhook signatures.
+//
+//	tolerance is how far the signature timestamp may be from now,
+//	if it is not provided or not a valid duration, it will default to 5m
+func NewWebhookVerifier(gatewayRepo repository.GatewayRepository, signatureRepo repository.WebhookSignatureRepository, tolerance string) *WebhookVerifierImpl {
+	toleranceDuration, err := time.ParseDuration(tolerance)
+	if err != nil || toleranceDuration <= 0 {
+		toleranceDuration = 5 * time.Minute
+	}
+	return &WebhookVerifierImpl{
+		gatewayRepository:   gatewayRepo,
+		signatureRepository: signatureRepo,
+		tolerance:           toleranceDuration,
+	}
+}
+
+// Verify returns the gateway of merchantID which sent the webhook, if the signature header is valid for the raw body.
+//
+//	The signature must be made with the gateway's secret, within the tolerance window, and not seen before.
+//	Gateways are looked up by name within merchantID, so a webhook can only update the transactions of that merchant.
+//	Every rejection wraps ErrInvalidWebhookSignature.
+func (v *WebhookVerifierImpl) Verify(ctx context.Context, merchantID int, gatewayName, signatureHeader string, body []byte) (*models.Gateway, error) {
+	gateway, err := v.gatewayRepository.GetGatewayByName(merchantID, gatewayName)
+	if errors.Is(err, models.ErrGatewayNotFound) {
+		return nil, fmt.Errorf("%w: unknown gateway %s of merchant %d", ErrInvalidWebhookSignature, gatewayName, merchantID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if gateway.WebhookSecret == "" {
+		return nil, fmt.Errorf("%w: gateway %s has no webhook secret", ErrInvalidWebhookSignature, gatewayName)
+	}
+
+	timestamp, signatures, err := connectors.ParseWebhookSignature(signatureHeader)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidWebhookSignature, err)
+	}
+
+	now := time.Now()
+	if timestamp.Before(now.Add(-v.tolerance)) || timestamp.After(now.Add(v.tolerance)) {
+		return nil, fmt.Errorf("%w: timestamp %s is outside the tolerance of %s", ErrInvalidWebhookSignature, timestamp, v.tolerance)
+	}
+
+	signature, ok := connectors.VerifyWebhookSignature(gateway.WebhookSecret, timestamp, signatures, body)
+	if !ok {
+		return nil, fmt.Errorf("%w: signature mismatch for gateway %s", ErrInvalidWebhookSignature, gatewayName)
+	}
+
+	// Signatures only have to be remembered for the tolerance window, older ones fail the timestamp check
+	v.cleanup(ctx, now)
+
+	firstUse, err := v.signatureRepository.MarkUsed(ctx, gateway.ID, signature, now)
+	if err != nil {
+		return nil, err
+	}
+	if !firstUse {
+		return nil, fmt.Errorf("%w: signature of gateway %s was already used", ErrInvalidWebhookSignature, gatewayName)
+	}
+
+	return gateway, nil
+}
+
+// Release forgets the signature of a webhook verified for gateway, when it couldn't be processed.
+//
+//	Signatures are recorded when they are verified, before the webhook is processed, a webhook which failed
+//	changed nothing, so its signature is released for the gateway's redelivery of it to be accepted.
+func (v *WebhookVerifierImpl) Release(ctx context.Context, gateway *models.Gateway, signatureHeader string, body []byte) error {
+	timestamp, signatures, err := connectors.ParseWebhookSignature(signatureHeader)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidWebhookSignature, err)
+	}
+	signature, ok := connectors.VerifyWebhookSignature(gateway.WebhookSecret, timestamp, signatures, body)
+	if !ok {
+		return fmt.Errorf("%w: signature mismatch for gateway %s", ErrInvalidWebhookSignature, gateway.Name)
+	}
+	return v.signatureRepository.Release(ctx, gateway.ID, signature)
+}
+
+// cleanup deletes remembered signatures older than the tolerance window, at most once per minute
+func (v *WebhookVerifierImpl) cleanup(ctx context.Context, now time.Time) {
+	v.cleanupMu.Lock()
+	if now.Sub(v.lastCleanup) < time.Minute {
+		v.cleanupMu.Unlock()
+		return
+	}
+	v.lastCleanup = now
+	v.cleanupMu.Unlock()
+
+	if _, err := v.signatureRepository.DeleteBefore(ctx, now.Add(-2*v.tolerance)); err != nil {
+		log.Printf("Failed to delete old webhook signatures, err: %+v", err)
+	}
+}